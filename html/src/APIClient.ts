@@ -85,9 +85,14 @@ export class APIClient {
         })
     }
 
-    upload(path: string, file: File, onUploadProgress?: (progressEvent: AxiosProgressEvent) => void, signal?: GenericAbortSignal): Promise<AxiosResponse|APIServerError> {
+    upload(path: string, file: File, onUploadProgress?: (progressEvent: AxiosProgressEvent) => void, signal?: GenericAbortSignal, fields?: Record<string,string>): Promise<AxiosResponse|APIServerError> {
         return new Promise<AxiosResponse|APIServerError>((resolve, reject) => {
             const formData = new FormData();
+            // Fields are sent before the file so the server can validate them
+            // before receiving it
+            Object.entries(fields || {}).forEach(([name, value]) => {
+                formData.append("fields[" + name + "]", value);
+            })
             formData.append("file", file);
             
             this.request({
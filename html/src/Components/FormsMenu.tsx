@@ -0,0 +1,59 @@
+import { H } from "@/APIClient";
+import { FormTemplate, ItemField } from "@/hupload";
+import { Button, Input, Menu } from "@mantine/core";
+import { IconForms } from "@tabler/icons-react";
+import { useEffect, useState } from "react";
+import { useTranslation } from "react-i18next";
+
+interface FormsMenuProps {
+    fields?: ItemField[];
+    onChange: (fields: ItemField[]) => void;
+}
+
+export function FormsMenu(props:FormsMenuProps) {
+    const { t } = useTranslation()
+
+    // Initialize state
+    const [forms, setForms] = useState<string[]>([])
+
+    // effects
+    useEffect(() => {
+        H.get('/forms').then((res) => {
+            setForms(res as string[])
+        })
+    },[])
+
+    const selectForm = (index: number) => {
+        H.get('/forms/'+index).then((res) => {
+            const f = res as FormTemplate
+            props.onChange(f.fields)
+        })
+    }
+
+    if (forms.length === 0) {
+        return
+    }
+
+    return (
+        <Input.Wrapper label={t("intake_form")} description={t("fields_count", {count: props.fields?.length || 0})}>
+            <Menu withArrow withinPortal={false}>
+            <Menu.Target>
+                <Button id="forms" variant="light" size="xs" mt="xs" leftSection={<IconForms size={16} stroke={1.5}/>}>
+                    {t("choose_form")}
+                </Button>
+            </Menu.Target>
+            <Menu.Dropdown>
+                {forms.map((f, i) => (
+                    <Menu.Item key={i+1} onClick={() => {selectForm(i+1)}}>
+                        {f}
+                    </Menu.Item>
+                ))}
+                <Menu.Divider />
+                <Menu.Item onClick={() => {props.onChange([])}}>
+                    {t("no_form")}
+                </Menu.Item>
+            </Menu.Dropdown>
+            </Menu>
+        </Input.Wrapper>
+    );
+}
@@ -0,0 +1,62 @@
+import { ItemField } from "@/hupload";
+import { Checkbox, Paper, Select, Stack, TextInput } from "@mantine/core";
+
+interface IntakeFormProps {
+    fields: ItemField[];
+    values: Record<string,string>;
+    onChange: (values: Record<string,string>) => void;
+}
+
+// missingFields returns the names of required fields without an answer in
+// values, checkboxes must be checked.
+export function missingFields(fields: ItemField[], values: Record<string,string>) {
+    return fields.filter((f) => {
+        const v = values[f.name] || ""
+        return f.required && (v === "" || (f.type === "checkbox" && v !== "true"))
+    }).map((f) => f.name)
+}
+
+export function IntakeForm(props: IntakeFormProps) {
+    // Initialize props
+    const { fields, values, onChange } = props;
+
+    // Functions
+    const setValue = (name: string, value: string) => {
+        onChange({...values, [name]: value})
+    }
+
+    return (
+        <Paper withBorder p="sm" mb="sm">
+            <Stack gap="xs">
+                {fields.map((f) => {
+                    const label = f.label || f.name
+                    switch (f.type) {
+                        case "select":
+                            return (
+                                <Select key={f.name} id={"field-"+f.name} label={label} required={f.required}
+                                    data={f.choices || []}
+                                    value={values[f.name] || null}
+                                    onChange={(v) => { setValue(f.name, v || ""); }}
+                                />
+                            )
+                        case "checkbox":
+                            return (
+                                <Checkbox key={f.name} id={"field-"+f.name} label={label} required={f.required}
+                                    checked={values[f.name] === "true"}
+                                    onChange={(e) => { setValue(f.name, e.currentTarget.checked?"true":""); }}
+                                />
+                            )
+                        default:
+                            return (
+                                <TextInput key={f.name} id={"field-"+f.name} label={label} required={f.required}
+                                    type={f.type === "email"?"email":"text"}
+                                    value={values[f.name] || ""}
+                                    onChange={(e) => { setValue(f.name, e.currentTarget.value); }}
+                                />
+                            )
+                    }
+                })}
+            </Stack>
+        </Paper>
+    )
+}
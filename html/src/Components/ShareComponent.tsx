@@ -2,7 +2,7 @@ import { ActionIcon, ActionIconGroup, Anchor, Box, Button, CopyButton, Flex, Gro
 import { humanFileSize, prettyfiedCount, Share, ShareDefaults } from "../hupload";
 import { Link } from "react-router-dom";
 import classes from './ShareComponent.module.css';
-import { IconClock, IconDots, IconLink, IconTrash } from "@tabler/icons-react";
+import { IconClock, IconDots, IconLink, IconRefresh, IconTrash } from "@tabler/icons-react";
 import { useState } from "react";
 import { H } from "@/APIClient";
 import { ResponsivePopover } from "./ResponsivePopover";
@@ -13,7 +13,7 @@ import { QueueItem, UploadQueue } from "@/UploadQueue";
 
 import { useTranslation } from "react-i18next";
 
-export function ShareComponent(props: {share: Share, onDelete?: (name: string) => void}) {
+export function ShareComponent(props: {share: Share, onDelete?: (name: string) => void, onRename?: (name: string) => void}) {
     const { t } = useTranslation();
     
     // Initialize States
@@ -32,7 +32,7 @@ export function ShareComponent(props: {share: Share, onDelete?: (name: string) =
     const count = share.count
     const size = share.size
     const countString = prettyfiedCount(count,t("item"), t("items"),t("empty"))
-    const remaining = (share.options.validity===0||share.options.validity===undefined)?null:(new Date(share.created).getTime() + share.options.validity*1000*60*60*24 - Date.now()) / 1000 / 60 / 60 / 24
+    const remaining = share.options.expires_at?(new Date(share.options.expires_at).getTime() - Date.now()) / 1000 / 60 / 60 / 24:(share.options.validity===0||share.options.validity===undefined)?null:(new Date(share.created).getTime() + share.options.validity*1000*60*60*24 - Date.now()) / 1000 / 60 / 60 / 24
 
     // Functions
 
@@ -111,7 +111,7 @@ export function ShareComponent(props: {share: Share, onDelete?: (name: string) =
                                 (remaining<0)?
                                 t("expired")
                                 :
-                                prettyfiedCount(remaining,t("day_left"),t("days_left"),null)} | {share.options.exposure==="download"?t("guests_can_download"):(share.options.exposure==="both"?t("guests_can_upload_and_download"):t("guests_can_upload"))}
+                                prettyfiedCount(remaining,t("day_left"),t("days_left"),null)} | {share.options.exposure==="download"?t("guests_can_download"):(share.options.exposure==="both"?t("guests_can_upload_and_download"):(share.options.exposure==="dropbox"?t("guests_can_drop"):t("guests_can_upload")))}
                             </Text>
                         </Group>
                         {(uploading || uploadPercent > 0) &&
@@ -151,6 +151,21 @@ export function ShareComponent(props: {share: Share, onDelete?: (name: string) =
                                         )}
                                         </CopyButton>
 
+                                        {/* Regenerate link button with confirmation Popover */}
+                                        <Popover width={200} position="bottom" withArrow shadow="md">
+                                            <Popover.Target>
+                                                <Tooltip withArrow arrowOffset={10} arrowSize={4} label={t("regenerate_link")}>
+                                                    <ActionIcon id="regenerate" variant="light" color="blue" >
+                                                        <IconRefresh style={{ width: '70%', height: '70%' }} stroke={1.5}/>
+                                                    </ActionIcon>
+                                                </Tooltip>
+                                            </Popover.Target>
+                                            <Popover.Dropdown className={classes.popover}>
+                                                <Text ta="center" size="xs" mb="xs">{t("regenerate_this_link")}</Text>
+                                                <Button aria-description="regenerate" w="100%" variant='default' size="xs" onClick={() => props.onRename&&props.onRename(share.name)}>{t("regenerate_link")}</Button>
+                                            </Popover.Dropdown>
+                                        </Popover>
+
                                         {/* Delete button with confirmation Popover */}
                                         <Popover width={200} position="bottom" withArrow shadow="md">
                                             <Popover.Target>
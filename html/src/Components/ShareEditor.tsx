@@ -1,10 +1,11 @@
 import { Share } from "@/hupload";
-import { ActionIcon, Box, BoxComponentProps, Button, Flex, Group, Input, NumberInput, rem, SegmentedControl, Stack, TextInput, Tooltip, useMantineTheme } from "@mantine/core";
+import { ActionIcon, Box, BoxComponentProps, Button, Flex, Group, Input, NumberInput, rem, SegmentedControl, Select, Stack, TextInput, Tooltip, useMantineTheme } from "@mantine/core";
 import { IconChevronLeft, IconChevronRight, IconClockPlus } from "@tabler/icons-react";
 import { useDisclosure, useMediaQuery, useUncontrolled } from "@mantine/hooks";
 import classes from './ShareEditor.module.css';
 import { MarkDownEditor } from "./MarkdownEditor";
 import { TemplatesMenu } from "./TemplatesMenu";
+import { FormsMenu } from "./FormsMenu";
 import { useTranslation } from "react-i18next";
 
 interface ShareEditorProps {
@@ -71,6 +72,7 @@ export function ShareEditor(props: ShareEditorProps&BoxComponentProps) {
                                 data={[ { label: t("receive"), value: 'upload' }, 
                                         { label: t("send"), value: 'download' }, 
                                         { label: t("both"), value: 'both' },
+                                        { label: t("drop_box"), value: 'dropbox' },
                                     ]}
                                 onChange={(v) => { notifyChange({...options, exposure:v}); }} transitionDuration={0} 
                             />
@@ -100,6 +102,21 @@ export function ShareEditor(props: ShareEditorProps&BoxComponentProps) {
                         <TextInput label={t("description")} value={options.description}
                             onChange={(v) => { notifyChange({...options, description:v.target.value}); }}
                         />
+                        {/* Share conflict policy */}
+                        <Select label={t("existing_files")} description={t("existing_files_description")}
+                            value={options.conflict || "overwrite"}
+                            data={[ { label: t("conflict_overwrite"), value: 'overwrite' },
+                                    { label: t("conflict_reject"), value: 'reject' },
+                                    { label: t("conflict_rename"), value: 'rename' },
+                                    { label: t("conflict_version"), value: 'version' },
+                                ]}
+                            allowDeselect={false}
+                            onChange={(v) => { notifyChange({...options, conflict: (v || undefined) as Share["options"]["conflict"]}); }}
+                        />
+                        {/* Share intake form */}
+                        <FormsMenu fields={options.fields}
+                            onChange={(v) => { notifyChange({...options, fields:v}); }}
+                        />
                     </Stack>
 
                 {/* Right section */}
@@ -5,3 +5,4 @@ export * from './ShareComponent'
 export * from './ResponsivePopover'
 export * from './VersionComponent'
 export * from './SearchField'
+export * from './IntakeForm'
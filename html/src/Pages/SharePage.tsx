@@ -4,8 +4,8 @@ import { IconClock, IconDownload, IconFileZip, IconHelpHexagon, IconLink, IconMo
 import { useCallback, useEffect, useMemo, useState } from "react";
 import { H } from "../APIClient";
 import { UploadQueue, QueueItem } from "../UploadQueue";
-import {ItemComponent} from "@/Components";
-import { UploadableItem } from "../hupload";
+import {IntakeForm, ItemComponent, missingFields} from "@/Components";
+import { Item, UploadableItem } from "../hupload";
 import { useAuthContext } from "@/AuthContext";
 import { Message } from "@/Components/Message";
 import { useShare } from "@/hooks";
@@ -23,6 +23,7 @@ export function SharePage() {
     const [error, setError] = useState<undefined|AxiosError>(undefined)
     const [sortField, setSortField] = useState<SortField>("name")
     const [sortDirection, setSortDirection] = useState<SortDirection>("asc")
+    const [fieldValues, setFieldValues] = useState<Record<string,string>>({})
 
     // Initialize hooks
     const { authInfo } = useAuthContext()
@@ -163,7 +164,7 @@ export function SharePage() {
             return false
         }
 
-        return share.options.exposure === "" || share.options.exposure === "upload" || share.options.exposure === "both"
+        return share.options.exposure === "" || share.options.exposure === "upload" || share.options.exposure === "both" || share.options.exposure === "dropbox"
     }
 
     // canDownload returns if the user can download files from the share.
@@ -183,10 +184,11 @@ export function SharePage() {
         return (share.options.exposure === "download" || share.options.exposure === "both")
     }
 
-    // canDelete returns if the user can delete files from the share.
+    // canDelete returns if the user can delete an item from the share.
     // the user can delete if they are logged in or if the share is of type
-    // "upload" (i.e. they uploaded the files).
-    const canDelete = () => {
+    // "upload" or "both" and they uploaded the item, guests only get the
+    // metadata of the items they uploaded.
+    const canDelete = (item: Item) => {
         if (authInfo?.user) {
             return true
         }
@@ -197,9 +199,13 @@ export function SharePage() {
             return false
         }
 
-        return (share.options.exposure === "upload")
+        return (share.options.exposure === "upload" || share.options.exposure === "both") && item.Metadata !== undefined
     }
 
+    // Uploads are disabled until required custom fields are answered
+    const fields = share.options.fields || []
+    const missing = missingFields(fields, fieldValues)
+
     // deleteItem deletes an item from the share.
     const deleteItem = (item: string) => {
         H.delete('/shares/' + share.name + '/items/' + item).then(() => {
@@ -241,7 +247,11 @@ export function SharePage() {
             {/* Files drop zone */}
             {showDropZone() &&
             <>
+                {fields.length > 0 &&
+                    <IntakeForm fields={fields} values={fieldValues} onChange={setFieldValues} />
+                }
                 <Dropzone
+                disabled={missing.length > 0}
                 onDrop={(files) => {
                     const uploadableItems = files.map((f) => {
                         return {
@@ -266,7 +276,7 @@ export function SharePage() {
 
                     // setItems(newItems)
 
-                    queue.addFiles(files)
+                    queue.addFiles(files, fieldValues)
                     .catch((e) => {
                         console.log(e)
                     })
@@ -295,7 +305,7 @@ export function SharePage() {
                     </Dropzone.Idle>
                     <div>
                     <Text ta="center" size="xl" inline>
-                        {t("drag_area")}
+                        {missing.length > 0?t("fill_required_fields"):t("drag_area")}
                     </Text>
                     </div>
                 </Group>
@@ -337,7 +347,7 @@ export function SharePage() {
             {
                 // Display share items
                 sortedItems.map((item) => (
-                <ItemComponent download={canDownload()} canDelete={canDelete()} onDelete={deleteItem} key={item.Path} item={item} />
+                <ItemComponent download={canDownload()} canDelete={canDelete(item)} onDelete={deleteItem} key={item.Path} item={item} />
                 ))
             }
         </>
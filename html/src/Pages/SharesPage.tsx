@@ -69,6 +69,12 @@ export function SharesPage(props: {owner: string|null}) {
         })
     }
 
+    const renameShare = (name: string) => {
+        H.post('/shares/'+name+'/rename').then(() => {
+            updateShares()
+        })
+    }
+
     const matchFilter = (share: Share) => {
         if (filter === "") {
             return true
@@ -148,7 +154,7 @@ export function SharesPage(props: {owner: string|null}) {
                     {shares.some((s) => s.owner !== owner)&&<Text size="xl" fw="700">{t("your_shares")}</Text>}
                     {shares.map((s) => (
                     (s.owner === owner) && matchFilter(s) &&
-                    <ShareComponent key={s.name} share={s} onDelete={deleteShare} />
+                    <ShareComponent key={s.name} share={s} onDelete={deleteShare} onRename={renameShare} />
                     ))}
                     </>
                 }
@@ -159,7 +165,7 @@ export function SharesPage(props: {owner: string|null}) {
                     <Text mt="md" size="xl" fw="700">{t("other_shares")}</Text>
                     {shares.map((s) => (
                     ((s.owner !== owner) && matchFilter(s)) &&
-                    <ShareComponent key={s.name} share={s} onDelete={deleteShare}/>
+                    <ShareComponent key={s.name} share={s} onDelete={deleteShare} onRename={renameShare}/>
                     ))}
                     </>
                 }
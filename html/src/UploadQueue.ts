@@ -15,6 +15,9 @@ export class UploadQueue {
     path: string
     API: APIClient
     progressCallback?: (progress: QueueItem[]) => void
+    // fields are the answers to the custom fields of the share, sent with
+    // every upload
+    fields?: Record<string,string>
 
     constructor(api: APIClient, path: string, progress?: (progress: QueueItem[]) => void) {
         this.files = {}
@@ -23,7 +26,9 @@ export class UploadQueue {
         this.progressCallback = progress
     }
 
-    addFiles(files: File[]) {
+    addFiles(files: File[], fields?: Record<string,string>) {
+        this.fields = fields
+
         files.map((f) => {
             const qi = {
                 file: f,
@@ -49,7 +54,9 @@ export class UploadQueue {
                             f.total = e.total
                         }
                         this.updateProgress()
-                    }
+                    },
+                    undefined,
+                    this.fields
                 )
                 .then((r) => {
                     f.finished = true; 
@@ -5,6 +5,16 @@ import { QueueItem } from "./UploadQueue";
 export interface ShareOptions {
   exposure?: string;
   validity?: number;
+  expires_at?: string;
+  upload_opens_at?: string;
+  upload_closes_at?: string;
+  download_opens_at?: string;
+  download_closes_at?: string;
+  max_downloads?: number;
+  max_item_downloads?: number;
+  delete_after_download?: boolean;
+  fields?: ItemField[];
+  conflict?: "overwrite" | "reject" | "rename" | "version";
   description?: string;
   message?: string;
 }
@@ -23,6 +33,24 @@ export interface Item {
   Path: string;
   ItemInfo: ItemInfo;
   Downloads: number;
+  Metadata?: ItemMetadata;
+}
+
+export interface ItemMetadata {
+  owner?: string;
+  guest?: string;
+  uploader_name?: string;
+  uploader_email?: string;
+  note?: string;
+  fields?: Record<string, string>;
+}
+
+export interface ItemField {
+  name: string;
+  label?: string;
+  type?: "text" | "email" | "select" | "checkbox";
+  choices?: string[];
+  required?: boolean;
 }
 
 export interface UploadableItem extends Item {
@@ -41,6 +69,11 @@ export interface Message {
   message: string;
 }
 
+export interface FormTemplate {
+  title: string;
+  fields: ItemField[];
+}
+
 export interface ShareDefaults {
   validity: number;
   exposure: string;
@@ -47,6 +47,7 @@ i18n
 
           // Share page
           drag_area: "Drag files here or click to select files",
+          fill_required_fields: "Fill in the required fields to upload files",
           sort_by: "Sort by",
           sort_file_name: "File name",
           sort_file_size: "File size",
@@ -68,11 +69,13 @@ i18n
           other_shares: "Other Shares",
           create: "Create",
           delete_this_share: "Delete this share?",
+          regenerate_this_link: "Regenerate the link of this share? The current link will stop working.",
 
           // Share component
           guests_can_upload: "Guests can upload",
           guests_can_download: "Guests can download",
           guests_can_upload_and_download: "Guests can upload & download",
+          guests_can_drop: "Guests can only upload, without seeing other files",
           item: "file",
           items: "files",
           empty: "empty",
@@ -82,6 +85,7 @@ i18n
           expired: "Expired",
           created: "Created",
           delete_share: "Delete Share",
+          regenerate_link: "Regenerate link",
           edit_share: "Edit",
           update: "Update",
 
@@ -95,11 +99,23 @@ i18n
           send: "Send",
           receive: "Receive",
           both: "Both",
+          drop_box: "Drop box",
           renew_share: "Renew validity",
 
           validity: "Validity",
           number_of_days_the_share_is_valid: "Number of days the share is valid. 0 is unlimited.",
           description: "Description",
+          intake_form: "Intake form",
+          fields_count_one: "{{count}} field to fill in when uploading",
+          fields_count_other: "{{count}} fields to fill in when uploading",
+          choose_form: "Choose a form",
+          no_form: "No form",
+          existing_files: "Existing files",
+          existing_files_description: "When a file with the same name is uploaded",
+          conflict_overwrite: "Replace",
+          conflict_reject: "Reject",
+          conflict_rename: "Rename",
+          conflict_version: "Keep versions",
 
           // Markdown Editor
           message: "Message",
@@ -120,6 +136,7 @@ i18n
 
             // Share page
             drag_area: "Glissez des fichiers ou cliquez pour sélectionner",
+            fill_required_fields: "Remplissez les champs obligatoires pour envoyer des fichiers",
             sort_by: "Trier par",
             sort_file_name: "Nom du fichier",
             sort_file_size: "Taille du fichier",
@@ -141,11 +158,13 @@ i18n
             other_shares: "Autres Partages",
             create: "Créer",
             delete_this_share: "Supprimer ce partage ?",
+            regenerate_this_link: "Régénérer le lien de ce partage ? Le lien actuel ne fonctionnera plus.",
           
             // Share component
             guests_can_upload: "Les invités peuvent envoyer",
             guests_can_download: "Les invités peuvent télécharger",
             guests_can_upload_and_download: "Les invités peuvent envoyer & télécharger",
+            guests_can_drop: "Les invités peuvent seulement envoyer, sans voir les autres fichiers",
             item: "fichier",
             items: "fichiers",
             empty: "vide",
@@ -155,6 +174,7 @@ i18n
             expired: "Expiré",
             created: "Créé le",
             delete_share: "Supprimer",
+            regenerate_link: "Régénérer le lien",
             edit_share: "Modifier",
             update: "Mettre à jour",
 
@@ -168,11 +188,23 @@ i18n
             send: "Envoyer",
             receive: "Reçevoir",
             both: "Les deux",
+            drop_box: "Boîte de dépôt",
             renew_share: "Étendre la validité",
 
             validity: "Expiration",
             number_of_days_the_share_is_valid: "Nombre de jours pendant lesquels le partage est valide. 0 signifie illimité.",
             description: "Description",
+            intake_form: "Formulaire",
+            fields_count_one: "{{count}} champ à remplir lors de l'envoi",
+            fields_count_other: "{{count}} champs à remplir lors de l'envoi",
+            choose_form: "Choisir un formulaire",
+            no_form: "Aucun formulaire",
+            existing_files: "Fichiers existants",
+            existing_files_description: "Lorsqu'un fichier du même nom est envoyé",
+            conflict_overwrite: "Remplacer",
+            conflict_reject: "Refuser",
+            conflict_rename: "Renommer",
+            conflict_version: "Garder les versions",
 
             // Markdown Editor
             message: "Message",
@@ -195,6 +227,7 @@ i18n
 
           // Share page
           drag_area: "Dateien hierhin ziehen oder auswählen",
+          fill_required_fields: "Füllen Sie die Pflichtfelder aus, um Dateien hochzuladen",
           sort_by: "Sortieren nach",
           sort_file_name: "Dateiname",
           sort_file_size: "Dateigröße",
@@ -216,11 +249,13 @@ i18n
           other_shares: "Andere Freigaben",
           create: "Erstellen",
           delete_this_share: "Diese Freigabe löschen?",
+          regenerate_this_link: "Link dieser Freigabe neu erzeugen? Der aktuelle Link funktioniert dann nicht mehr.",
 
           // Share component
           guests_can_upload: "Empfänger darf uploaden",
           guests_can_download: "Empfänger darf downloaden",
           guests_can_upload_and_download: "Empfänger darf uploaden & downloaden",
+          guests_can_drop: "Empfänger darf nur uploaden, ohne andere Dateien zu sehen",
           item: "Datei",
           items: "Dateien",
           empty: "leer",
@@ -230,6 +265,7 @@ i18n
           expired: "Abgelaufen",
           created: "Erstellt",
           delete_share: "Freigabe löschen",
+          regenerate_link: "Link neu erzeugen",
           edit_share: "Bearbeiten",
           update: "Aktualisieren",
 
@@ -243,11 +279,23 @@ i18n
           send: "Versenden",
           receive: "Empfangen",
           both: "Beides",
+          drop_box: "Briefkasten",
           renew_share: "Freigabe verlängern",
 
           validity: "Dauer der Gültigkeit",
           number_of_days_the_share_is_valid: "Anzahl der Tage bis die Freigabe abläuft. 0 bedeutet unbegrenzt.",
           description: "Beschreibung",
+          intake_form: "Formular",
+          fields_count_one: "{{count}} Feld beim Hochladen auszufüllen",
+          fields_count_other: "{{count}} Felder beim Hochladen auszufüllen",
+          choose_form: "Formular wählen",
+          no_form: "Kein Formular",
+          existing_files: "Vorhandene Dateien",
+          existing_files_description: "Wenn eine Datei mit demselben Namen hochgeladen wird",
+          conflict_overwrite: "Ersetzen",
+          conflict_reject: "Ablehnen",
+          conflict_rename: "Umbenennen",
+          conflict_version: "Versionen behalten",
 
           // Markdown Editor
           message: "Nachricht",
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ybizeul/hupload/client"
+	"github.com/ybizeul/hupload/internal/config"
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// administration is the set of operations used by command line subcommands.
+// It is implemented by localAdministration, working directly on the configured
+// storage backend, and remoteAdministration, calling the REST API of a running
+// instance.
+type administration interface {
+	// Defaults returns the options used for new shares
+	Defaults(ctx context.Context) (storage.Options, error)
+
+	ListShares(ctx context.Context) ([]storage.Share, error)
+	GetShare(ctx context.Context, name string) (*storage.Share, error)
+	CreateShare(ctx context.Context, name string, options storage.Options) (*storage.Share, error)
+	UpdateShare(ctx context.Context, name string, options storage.Options) (*storage.Options, error)
+	DeleteShare(ctx context.Context, name string) error
+	// RenameShare renames share name to newName, or to a new code if it is
+	// empty. The previous name keeps working during grace, a duration or
+	// a date parsed by storage.ParseExpiration.
+	RenameShare(ctx context.Context, name, newName, grace string) (*storage.Share, error)
+
+	ListShare(ctx context.Context, share string) ([]storage.Item, error)
+	CreateItem(ctx context.Context, share, item string, size int64, r io.Reader) (*storage.Item, error)
+	GetItemData(ctx context.Context, share, item string) (io.ReadCloser, error)
+	DeleteItem(ctx context.Context, share, item string) error
+	// CopyItem copies item of share to toItem of toShare, or moves it if move
+	// is true
+	CopyItem(ctx context.Context, share, item, toShare, toItem string, move bool) (*storage.Item, error)
+
+	// Check checks the consistency of the storage, and repairs problems
+	// found if repair is true
+	Check(ctx context.Context, repair bool) (*storage.CheckReport, error)
+}
+
+// localAdministration works on the storage backend of the configuration file.
+type localAdministration struct {
+	Storage storage.Storage
+	Values  config.ConfigValues
+
+	// Owner is used for shares created from the command line
+	Owner string
+}
+
+func (l *localAdministration) Defaults(ctx context.Context) (storage.Options, error) {
+	return storage.Options{
+		Validity: l.Values.DefaultValidityDays,
+		Exposure: l.Values.DefaultExposure,
+	}, nil
+}
+
+func (l *localAdministration) ListShares(ctx context.Context) ([]storage.Share, error) {
+	return l.Storage.ListShares(ctx)
+}
+
+func (l *localAdministration) GetShare(ctx context.Context, name string) (*storage.Share, error) {
+	return l.Storage.GetShare(ctx, name)
+}
+
+func (l *localAdministration) CreateShare(ctx context.Context, name string, options storage.Options) (*storage.Share, error) {
+	if name == "" {
+		name = generateCode(4, 3)
+	}
+	return l.Storage.CreateShare(ctx, name, l.Owner, options)
+}
+
+func (l *localAdministration) UpdateShare(ctx context.Context, name string, options storage.Options) (*storage.Options, error) {
+	return l.Storage.UpdateShare(ctx, name, &options, nil)
+}
+
+func (l *localAdministration) DeleteShare(ctx context.Context, name string) error {
+	return l.Storage.DeleteShare(ctx, name)
+}
+
+func (l *localAdministration) RenameShare(ctx context.Context, name, newName, grace string) (*storage.Share, error) {
+	if newName == "" {
+		newName = generateCode(4, 3)
+	}
+
+	var until time.Time
+	if grace != "" {
+		var err error
+		until, err = storage.ParseExpiration(grace, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return l.Storage.RenameShare(ctx, name, newName, until)
+}
+
+func (l *localAdministration) ListShare(ctx context.Context, share string) ([]storage.Item, error) {
+	return l.Storage.ListShare(ctx, share)
+}
+
+func (l *localAdministration) CreateItem(ctx context.Context, share, item string, size int64, r io.Reader) (*storage.Item, error) {
+	return l.Storage.CreateItem(ctx, share, item, size, r, nil)
+}
+
+func (l *localAdministration) GetItemData(ctx context.Context, share, item string) (io.ReadCloser, error) {
+	return l.Storage.GetItemData(ctx, share, item)
+}
+
+func (l *localAdministration) DeleteItem(ctx context.Context, share, item string) error {
+	return l.Storage.DeleteItem(ctx, share, item)
+}
+
+func (l *localAdministration) CopyItem(ctx context.Context, share, item, toShare, toItem string, move bool) (*storage.Item, error) {
+	if move {
+		return l.Storage.MoveItem(ctx, share, item, toShare, toItem)
+	}
+	return l.Storage.CopyItem(ctx, share, item, toShare, toItem)
+}
+
+func (l *localAdministration) Check(ctx context.Context, repair bool) (*storage.CheckReport, error) {
+	return l.Storage.Check(ctx, repair)
+}
+
+// remoteAdministration calls the REST API of a running Hupload instance
+// through the client package. Client types have the same JSON representation
+// as storage types and are converted with convert.
+type remoteAdministration struct {
+	Client *client.Client
+}
+
+func newRemoteAdministration(u, apiKey string) *remoteAdministration {
+	return &remoteAdministration{
+		Client: client.New(u).WithAPIKey(apiKey),
+	}
+}
+
+// convert converts v to type T through their JSON representation
+func convert[T any](v any, err error) (T, error) {
+	var result T
+	if err != nil {
+		return result, remoteError(err)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return result, err
+	}
+
+	err = json.Unmarshal(b, &result)
+	return result, err
+}
+
+// remoteError adds the storage error matching an API error so commands can
+// handle local and remote errors the same way.
+func remoteError(err error) error {
+	switch {
+	case errors.Is(err, client.ErrNotFound):
+		if strings.Contains(err.Error(), "item") {
+			return errors.Join(storage.ErrItemNotFound, err)
+		}
+		return errors.Join(storage.ErrShareNotFound, err)
+	case errors.Is(err, client.ErrConflict):
+		return errors.Join(storage.ErrShareAlreadyExists, err)
+	}
+	return err
+}
+
+func (r *remoteAdministration) Defaults(ctx context.Context) (storage.Options, error) {
+	d, err := r.Client.Defaults(ctx)
+	if err != nil {
+		return storage.Options{}, remoteError(err)
+	}
+	return storage.Options{Validity: d.Validity, Exposure: d.Exposure}, nil
+}
+
+func (r *remoteAdministration) ListShares(ctx context.Context) ([]storage.Share, error) {
+	return convert[[]storage.Share](r.Client.ListShares(ctx))
+}
+
+func (r *remoteAdministration) GetShare(ctx context.Context, name string) (*storage.Share, error) {
+	return convert[*storage.Share](r.Client.GetShare(ctx, name))
+}
+
+func (r *remoteAdministration) CreateShare(ctx context.Context, name string, options storage.Options) (*storage.Share, error) {
+	o, err := convert[client.Options](options, nil)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return convert[*storage.Share](r.Client.CreateShare(ctx, o))
+	}
+	return convert[*storage.Share](r.Client.CreateNamedShare(ctx, name, o))
+}
+
+func (r *remoteAdministration) UpdateShare(ctx context.Context, name string, options storage.Options) (*storage.Options, error) {
+	o, err := convert[client.Options](options, nil)
+	if err != nil {
+		return nil, err
+	}
+	return convert[*storage.Options](r.Client.UpdateShare(ctx, name, o))
+}
+
+func (r *remoteAdministration) DeleteShare(ctx context.Context, name string) error {
+	return remoteError(r.Client.DeleteShare(ctx, name))
+}
+
+func (r *remoteAdministration) RenameShare(ctx context.Context, name, newName, grace string) (*storage.Share, error) {
+	return convert[*storage.Share](r.Client.RenameShare(ctx, name, newName, grace))
+}
+
+func (r *remoteAdministration) ListShare(ctx context.Context, share string) ([]storage.Item, error) {
+	return convert[[]storage.Item](r.Client.ListItems(ctx, share))
+}
+
+func (r *remoteAdministration) CreateItem(ctx context.Context, share, item string, size int64, reader io.Reader) (*storage.Item, error) {
+	return convert[*storage.Item](r.Client.UploadItem(ctx, share, item, size, reader, nil))
+}
+
+func (r *remoteAdministration) GetItemData(ctx context.Context, share, item string) (io.ReadCloser, error) {
+	rc, err := r.Client.DownloadItem(ctx, share, item)
+	return rc, remoteError(err)
+}
+
+func (r *remoteAdministration) DeleteItem(ctx context.Context, share, item string) error {
+	return remoteError(r.Client.DeleteItem(ctx, share, item))
+}
+
+func (r *remoteAdministration) CopyItem(ctx context.Context, share, item, toShare, toItem string, move bool) (*storage.Item, error) {
+	if move {
+		return convert[*storage.Item](r.Client.MoveItem(ctx, share, item, toShare, toItem))
+	}
+	return convert[*storage.Item](r.Client.CopyItem(ctx, share, item, toShare, toItem))
+}
+
+func (r *remoteAdministration) Check(ctx context.Context, repair bool) (*storage.CheckReport, error) {
+	return convert[*storage.CheckReport](r.Client.Check(ctx, repair))
+}
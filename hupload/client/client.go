@@ -0,0 +1,582 @@
+// Package client is a Go client for the Hupload REST API.
+//
+// A Client is created for the base URL of an instance, and authenticates with
+// an API key defined in the server configuration :
+//
+//	c := client.New("https://hupload.company.com").WithAPIKey(key)
+//	share, err := c.CreateShare(ctx, client.Options{Validity: 7, Exposure: "upload"})
+//
+// Guests don't need credentials to access a share, use a Client without API
+// key and the share name as the secret.
+//
+// Errors returned by the API are of type *Error and can be matched with
+// errors.Is against ErrNotFound, ErrGone, etc.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client is a client for the Hupload instance at URL
+type Client struct {
+	URL string
+
+	apiKey   string
+	username string
+	password string
+
+	httpClient *http.Client
+}
+
+// ProgressFunc is called during uploads with the number of bytes sent so far
+type ProgressFunc func(written int64)
+
+// New returns a new Client for the instance at base URL u, i.e.
+// https://hupload.company.com
+func New(u string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(u, "/"),
+		httpClient: http.DefaultClient,
+	}
+}
+
+// WithAPIKey sets the API key sent as a bearer token with every request
+func (c *Client) WithAPIKey(key string) *Client {
+	c.apiKey = key
+	return c
+}
+
+// WithBasicAuth sets the credentials sent with every request, for servers
+// using file authentication.
+func (c *Client) WithBasicAuth(username, password string) *Client {
+	c.username = username
+	c.password = password
+	return c
+}
+
+// WithHTTPClient sets the http.Client used to send requests
+func (c *Client) WithHTTPClient(h *http.Client) *Client {
+	c.httpClient = h
+	return c
+}
+
+// Health checks the instance is up
+func (c *Client) Health(ctx context.Context) error {
+	return c.do(ctx, http.MethodGet, "/health", nil, nil, nil)
+}
+
+// Version returns the version of the server
+func (c *Client) Version(ctx context.Context) (string, error) {
+	var v struct {
+		Version string `json:"version"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/v1/version", nil, nil, &v)
+	return v.Version, err
+}
+
+// Defaults returns the options used by the server for new shares
+func (c *Client) Defaults(ctx context.Context) (*Defaults, error) {
+	result := &Defaults{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/defaults", nil, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Messages returns the titles of message templates defined on the server
+func (c *Client) Messages(ctx context.Context) ([]string, error) {
+	result := []string{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/messages", nil, nil, &result)
+	return result, err
+}
+
+// Message returns message template at index, starting at 1
+func (c *Client) Message(ctx context.Context, index int) (*MessageTemplate, error) {
+	result := &MessageTemplate{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/messages/"+strconv.Itoa(index), nil, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Forms returns the titles of form templates defined on the server
+func (c *Client) Forms(ctx context.Context) ([]string, error) {
+	result := []string{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/forms", nil, nil, &result)
+	return result, err
+}
+
+// Form returns form template at index, starting at 1
+func (c *Client) Form(ctx context.Context, index int) (*FormTemplate, error) {
+	result := &FormTemplate{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/forms/"+strconv.Itoa(index), nil, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListShares returns the shares visible to the authenticated user
+func (c *Client) ListShares(ctx context.Context) ([]Share, error) {
+	result := []Share{}
+	err := c.do(ctx, http.MethodGet, "/api/v1/shares", nil, nil, &result)
+	return result, err
+}
+
+// QueryShares returns a page of shares matching q
+func (c *Client) QueryShares(ctx context.Context, q ShareQuery) (*SharePage, error) {
+	v := url.Values{}
+	setQuery(v, "owner", q.Owner)
+	setQuery(v, "status", q.Status)
+	setQuery(v, "exposure", q.Exposure)
+	setQuery(v, "prefix", q.Prefix)
+	setQueryTime(v, "created_after", q.CreatedAfter)
+	setQueryTime(v, "created_before", q.CreatedBefore)
+	setQuery(v, "sort", q.Sort)
+	setQueryInt(v, "limit", q.Limit)
+	setQuery(v, "cursor", q.Cursor)
+
+	result := &SharePage{Shares: []Share{}}
+	total, next, err := c.page(ctx, "/api/v1/shares?"+v.Encode(), &result.Shares)
+	if err != nil {
+		return nil, err
+	}
+	result.Total, result.Next = total, next
+
+	return result, nil
+}
+
+// CreateShare creates a share with a random name generated by the server
+func (c *Client) CreateShare(ctx context.Context, options Options) (*Share, error) {
+	return c.createShare(ctx, "/api/v1/shares", options)
+}
+
+// CreateNamedShare creates a share with the provided name
+func (c *Client) CreateNamedShare(ctx context.Context, name string, options Options) (*Share, error) {
+	return c.createShare(ctx, sharePath(name), options)
+}
+
+func (c *Client) createShare(ctx context.Context, p string, options Options) (*Share, error) {
+	result := &Share{}
+	err := c.doJSON(ctx, http.MethodPost, p, options, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetShare returns the share name, as seen by an authenticated user
+func (c *Client) GetShare(ctx context.Context, name string) (*Share, error) {
+	result := &Share{}
+	err := c.do(ctx, http.MethodGet, sharePath(name), nil, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// GetPublicShare returns the share name, as seen by a guest
+func (c *Client) GetPublicShare(ctx context.Context, name string) (*PublicShare, error) {
+	result := &PublicShare{}
+	err := c.do(ctx, http.MethodGet, sharePath(name), nil, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UpdateShare replaces the options of share name. Options are replaced as a
+// whole, get the share first to only change some of them.
+func (c *Client) UpdateShare(ctx context.Context, name string, options Options) (*Options, error) {
+	result := &Options{}
+	err := c.doJSON(ctx, http.MethodPatch, sharePath(name), options, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RenameShare renames share name to newName with its content, or to a new
+// code generated by the server if newName is empty. The previous name keeps
+// working for guests during grace, a duration like 4h or 3d or a date, and
+// stops working immediately if grace is empty.
+func (c *Client) RenameShare(ctx context.Context, name, newName, grace string) (*Share, error) {
+	body := struct {
+		Name  string `json:"name,omitempty"`
+		Grace string `json:"grace,omitempty"`
+	}{Name: newName, Grace: grace}
+
+	result := &Share{}
+	err := c.doJSON(ctx, http.MethodPost, sharePath(name)+"/rename", body, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteShare deletes share name and its content
+func (c *Client) DeleteShare(ctx context.Context, name string) error {
+	return c.do(ctx, http.MethodDelete, sharePath(name), nil, nil, nil)
+}
+
+// ListItems returns the items in share
+func (c *Client) ListItems(ctx context.Context, share string) ([]Item, error) {
+	result := []Item{}
+	err := c.do(ctx, http.MethodGet, sharePath(share)+"/items", nil, nil, &result)
+	return result, err
+}
+
+// QueryItems returns a page of items in share matching q
+func (c *Client) QueryItems(ctx context.Context, share string, q ItemQuery) (*ItemPage, error) {
+	v := url.Values{}
+	setQuery(v, "prefix", q.Prefix)
+	setQueryTime(v, "modified_after", q.ModifiedAfter)
+	setQueryTime(v, "modified_before", q.ModifiedBefore)
+	setQuery(v, "sort", q.Sort)
+	setQueryInt(v, "limit", q.Limit)
+	setQuery(v, "cursor", q.Cursor)
+
+	result := &ItemPage{Items: []Item{}}
+	total, next, err := c.page(ctx, sharePath(share)+"/items?"+v.Encode(), &result.Items)
+	if err != nil {
+		return nil, err
+	}
+	result.Total, result.Next = total, next
+
+	return result, nil
+}
+
+// Search returns a page of shares and items matching q, best matches first.
+// limit is the maximum number of results, 0 for all of them, and cursor is
+// the Next value of the previous page.
+func (c *Client) Search(ctx context.Context, q string, limit int, cursor string) (*SearchPage, error) {
+	v := url.Values{}
+	setQuery(v, "q", q)
+	setQueryInt(v, "limit", limit)
+	setQuery(v, "cursor", cursor)
+
+	result := &SearchPage{Results: []SearchResult{}}
+	total, next, err := c.page(ctx, "/api/v1/search?"+v.Encode(), &result.Results)
+	if err != nil {
+		return nil, err
+	}
+	result.Total, result.Next = total, next
+
+	return result, nil
+}
+
+// Check checks the consistency of the storage of the server, and repairs
+// problems found if repair is true
+func (c *Client) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	method := http.MethodGet
+	if repair {
+		method = http.MethodPost
+	}
+
+	result := &CheckReport{}
+	err := c.do(ctx, method, "/api/v1/admin/check", nil, nil, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// UploadItem streams size bytes from r as item in share. progress is called
+// as data is sent if not nil. The upload is aborted when ctx is cancelled.
+func (c *Client) UploadItem(ctx context.Context, share, item string, size int64, r io.Reader, progress ProgressFunc) (*Item, error) {
+	return c.UploadItemWithMetadata(ctx, share, item, size, r, ItemMetadata{}, progress)
+}
+
+// UploadItemWithMetadata is like UploadItem, and sends the uploader
+// information, note and fields of metadata with the item. Owner and Guest
+// are ignored.
+func (c *Client) UploadItemWithMetadata(ctx context.Context, share, item string, size int64, r io.Reader, metadata ItemMetadata, progress ProgressFunc) (*Item, error) {
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+
+	src := r
+	if progress != nil {
+		src = &progressReader{r: r, f: progress}
+	}
+
+	values := map[string]string{
+		"uploader_name":  metadata.UploaderName,
+		"uploader_email": metadata.UploaderEmail,
+		"note":           metadata.Note,
+	}
+	for k, v := range metadata.Fields {
+		values["fields["+k+"]"] = v
+	}
+
+	go func() {
+		// Metadata must be sent before the file
+		for k, v := range values {
+			if v == "" {
+				continue
+			}
+			err := mw.WriteField(k, v)
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+
+		part, err := mw.CreateFormFile("file", item)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		_, err = io.Copy(part, src)
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		pw.CloseWithError(mw.Close())
+	}()
+
+	header := http.Header{
+		"Content-Type": {mw.FormDataContentType()},
+		"Filesize":     {strconv.FormatInt(size, 10)},
+	}
+
+	result := &Item{}
+	err := c.do(ctx, http.MethodPost, itemPath(share, item), pr, header, result)
+
+	// Unblock the writer goroutine if the request failed before reading the
+	// whole body
+	pr.Close()
+
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DownloadItem returns the content of item in share. The caller must close
+// the returned reader.
+func (c *Client) DownloadItem(ctx context.Context, share, item string) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, http.MethodGet, itemPath(share, item), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DownloadShare returns a zip archive of every item in share. The caller
+// must close the returned reader.
+func (c *Client) DownloadShare(ctx context.Context, share string) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, http.MethodGet, "/d/"+url.PathEscape(share), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// UpdateItem updates the metadata of item in share. Empty values of metadata
+// are kept, except fields set to an empty string which are removed.
+func (c *Client) UpdateItem(ctx context.Context, share, item string, metadata ItemMetadata) (*Item, error) {
+	result := &Item{}
+	err := c.doJSON(ctx, http.MethodPatch, itemPath(share, item), metadata, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CopyItem copies item in share to toItem in toShare, or to an item with the
+// same name if toItem is empty. The returned item can have another name if
+// toShare renames conflicting items.
+func (c *Client) CopyItem(ctx context.Context, share, item, toShare, toItem string) (*Item, error) {
+	return c.copyItem(ctx, itemPath(share, item)+"/copy", toShare, toItem)
+}
+
+// MoveItem moves item in share to toItem in toShare, like CopyItem
+func (c *Client) MoveItem(ctx context.Context, share, item, toShare, toItem string) (*Item, error) {
+	return c.copyItem(ctx, itemPath(share, item)+"/move", toShare, toItem)
+}
+
+func (c *Client) copyItem(ctx context.Context, p, toShare, toItem string) (*Item, error) {
+	body := struct {
+		Share string `json:"share"`
+		Name  string `json:"name,omitempty"`
+	}{Share: toShare, Name: toItem}
+
+	result := &Item{}
+	err := c.doJSON(ctx, http.MethodPost, p, body, result)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DeleteItem deletes item in share
+func (c *Client) DeleteItem(ctx context.Context, share, item string) error {
+	return c.do(ctx, http.MethodDelete, itemPath(share, item), nil, nil, nil)
+}
+
+// ItemVersions returns the previous versions of item in share, oldest first
+func (c *Client) ItemVersions(ctx context.Context, share, item string) ([]ItemVersion, error) {
+	result := []ItemVersion{}
+	err := c.do(ctx, http.MethodGet, itemPath(share, item)+"/versions", nil, nil, &result)
+	return result, err
+}
+
+// GetItemVersion returns the content of version of item in share. The caller
+// must close the returned reader.
+func (c *Client) GetItemVersion(ctx context.Context, share, item string, version int) (io.ReadCloser, error) {
+	resp, err := c.send(ctx, http.MethodGet, itemPath(share, item)+"/versions/"+strconv.Itoa(version), nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// DeleteItemVersion deletes version of item in share
+func (c *Client) DeleteItemVersion(ctx context.Context, share, item string, version int) error {
+	return c.do(ctx, http.MethodDelete, itemPath(share, item)+"/versions/"+strconv.Itoa(version), nil, nil, nil)
+}
+
+func sharePath(share string) string {
+	return "/api/v1/shares/" + url.PathEscape(share)
+}
+
+func itemPath(share, item string) string {
+	return sharePath(share) + "/items/" + url.PathEscape(item)
+}
+
+// page gets a listing at p, decodes it in result and returns the total
+// number of results, -1 when it is unknown, and the cursor of the next page
+// from response headers
+func (c *Client) page(ctx context.Context, p string, result any) (int, string, error) {
+	resp, err := c.send(ctx, http.MethodGet, p, nil, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return 0, "", err
+	}
+
+	total := -1
+	if t := resp.Header.Get("X-Total-Count"); t != "" {
+		total, _ = strconv.Atoi(t)
+	}
+
+	return total, resp.Header.Get("X-Next-Cursor"), nil
+}
+
+func setQuery(v url.Values, k, value string) {
+	if value != "" {
+		v.Set(k, value)
+	}
+}
+
+func setQueryInt(v url.Values, k string, value int) {
+	if value != 0 {
+		v.Set(k, strconv.Itoa(value))
+	}
+}
+
+func setQueryTime(v url.Values, k string, value time.Time) {
+	if !value.IsZero() {
+		v.Set(k, value.Format(time.RFC3339Nano))
+	}
+}
+
+// doJSON sends body encoded as JSON and decodes the response in result
+func (c *Client) doJSON(ctx context.Context, method, p string, body, result any) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, p, bytes.NewReader(b), http.Header{"Content-Type": {"application/json"}}, result)
+}
+
+// do sends a request and decodes the JSON response in result if not nil
+func (c *Client) do(ctx context.Context, method, p string, body io.Reader, header http.Header, result any) error {
+	resp, err := c.send(ctx, method, p, body, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// send sends a request and returns the response if the status is successful,
+// or an *Error built from the APIResult in the body. The caller must close
+// the response body.
+func (c *Client) send(ctx context.Context, method, p string, body io.Reader, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.URL+p, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	switch {
+	case c.apiKey != "":
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	case c.username != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+
+	result := &Error{StatusCode: resp.StatusCode}
+
+	b, _ := io.ReadAll(resp.Body)
+	var r APIResult
+	if json.Unmarshal(b, &r) == nil && r.Message != "" {
+		result.Message = r.Message
+	} else {
+		result.Message = strings.TrimSpace(string(b))
+	}
+
+	return nil, result
+}
+
+// progressReader calls f with the total number of bytes read after each read
+type progressReader struct {
+	r       io.Reader
+	f       ProgressFunc
+	written int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.written += int64(n)
+		p.f(p.written)
+	}
+	return n, err
+}
@@ -0,0 +1,243 @@
+package client
+
+import "time"
+
+// Options are the settings of a share. ExpiresAt takes precedence over
+// Validity, which the server sets to the number of days from creation to
+// ExpiresAt. Upload and download windows restrict when guests can upload and
+// download, and download limits how many times they can download items.
+// Fields are custom fields uploaders fill in the metadata of items. Conflict
+// is overwrite, reject, rename or version, overwrite if empty.
+type Options struct {
+	Validity    int       `json:"validity,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitzero"`
+	Exposure    string    `json:"exposure"`
+	Description string    `json:"description,omitempty"`
+	Message     string    `json:"message"`
+
+	UploadOpensAt    time.Time `json:"upload_opens_at,omitzero"`
+	UploadClosesAt   time.Time `json:"upload_closes_at,omitzero"`
+	DownloadOpensAt  time.Time `json:"download_opens_at,omitzero"`
+	DownloadClosesAt time.Time `json:"download_closes_at,omitzero"`
+
+	MaxDownloads        int64 `json:"max_downloads,omitempty"`
+	MaxItemDownloads    int64 `json:"max_item_downloads,omitempty"`
+	DeleteAfterDownload bool  `json:"delete_after_download,omitempty"`
+
+	Fields []ItemField `json:"fields,omitempty"`
+
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// Share is a share as returned to authenticated users
+type Share struct {
+	Version     int       `json:"version,omitempty"`
+	Name        string    `json:"name"`
+	DateCreated time.Time `json:"created,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Options     Options   `json:"options,omitempty"`
+
+	Size  int64 `json:"size,omitempty"`
+	Count int64 `json:"count,omitempty"`
+
+	Downloads map[string]int64 `json:"downloads,omitempty"`
+
+	// GuestDownloads is the number of downloads by guests by item name,
+	// including downloads in progress, download limits apply to it
+	GuestDownloads map[string]int64 `json:"guest_downloads,omitempty"`
+
+	// Items is the metadata of items by name
+	Items map[string]ItemMetadata `json:"items,omitempty"`
+}
+
+// PublicShare is a share as returned to guests
+type PublicShare struct {
+	Name    string        `json:"name"`
+	Options PublicOptions `json:"options,omitempty"`
+
+	// RemainingDownloads is the number of item downloads left, nil if the
+	// share has no download limit
+	RemainingDownloads *int64 `json:"remaining_downloads,omitempty"`
+}
+
+// PublicOptions are the settings of a share visible to guests
+type PublicOptions struct {
+	Exposure  string    `json:"exposure"`
+	Message   string    `json:"message"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+
+	UploadOpensAt    time.Time `json:"upload_opens_at,omitzero"`
+	UploadClosesAt   time.Time `json:"upload_closes_at,omitzero"`
+	DownloadOpensAt  time.Time `json:"download_opens_at,omitzero"`
+	DownloadClosesAt time.Time `json:"download_closes_at,omitzero"`
+
+	MaxDownloads        int64 `json:"max_downloads,omitempty"`
+	MaxItemDownloads    int64 `json:"max_item_downloads,omitempty"`
+	DeleteAfterDownload bool  `json:"delete_after_download,omitempty"`
+
+	Fields []ItemField `json:"fields,omitempty"`
+
+	Conflict string `json:"conflict,omitempty"`
+}
+
+// Item is a file in a share, Path is the share name and item name joined
+// with a slash.
+type Item struct {
+	Path      string
+	Downloads int64         `json:"Downloads,omitempty"`
+	Metadata  *ItemMetadata `json:"Metadata,omitempty"`
+	ItemInfo  ItemInfo
+}
+
+// ItemField is a custom field of the metadata of items of a share. Type is
+// text, email, select or checkbox, text if empty. Choices are the values of
+// select fields, and checkboxes are "true" when checked.
+type ItemField struct {
+	Name     string   `json:"name"`
+	Label    string   `json:"label,omitempty"`
+	Type     string   `json:"type,omitempty"`
+	Choices  []string `json:"choices,omitempty"`
+	Required bool     `json:"required,omitempty"`
+}
+
+// ItemMetadata is information about an item recorded when it is uploaded.
+// Owner and Guest are set by the server.
+type ItemMetadata struct {
+	Owner string `json:"owner,omitempty"`
+	Guest string `json:"guest,omitempty"`
+
+	UploaderName  string `json:"uploader_name,omitempty"`
+	UploaderEmail string `json:"uploader_email,omitempty"`
+	Note          string `json:"note,omitempty"`
+
+	// Fields are values of the fields of the share by name
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// ItemInfo holds the size and modification date of an item
+type ItemInfo struct {
+	Size         int64
+	DateModified time.Time
+}
+
+// ItemVersion is a previous content of an item, kept when the item was
+// replaced in a share with the version conflict policy
+type ItemVersion struct {
+	Version  int
+	ItemInfo ItemInfo
+}
+
+// MessageTemplate is a canned message defined in the server configuration
+type MessageTemplate struct {
+	Title   string `json:"title"`
+	Message string `json:"message"`
+}
+
+// FormTemplate is a form defined in the server configuration, its fields can
+// be used as the fields of a share
+type FormTemplate struct {
+	Title  string      `json:"title"`
+	Fields []ItemField `json:"fields"`
+}
+
+// Defaults are the options used by the server for new shares
+type Defaults struct {
+	Validity int    `json:"validity"`
+	Exposure string `json:"exposure"`
+}
+
+// APIResult is the body returned by the API for errors and operations that
+// don't return an object.
+type APIResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message,omitempty"`
+}
+
+// ShareQuery selects, sorts and paginates shares returned by QueryShares.
+// Zero values are ignored.
+type ShareQuery struct {
+	Owner    string
+	Status   string // valid or expired
+	Exposure string
+	Prefix   string
+
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Sort is one of created, size, count, name or owner, prefixed with "-"
+	// for descending order
+	Sort string
+
+	Limit  int
+	Cursor string
+}
+
+// ItemQuery selects, sorts and paginates items returned by QueryItems.
+// Zero values are ignored.
+type ItemQuery struct {
+	Prefix string
+
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+
+	// Sort is one of modified, size or name, prefixed with "-" for
+	// descending order
+	Sort string
+
+	Limit  int
+	Cursor string
+}
+
+// SharePage is a page of shares, Next is the cursor of the next page and is
+// empty on the last page. Total is -1 when the server doesn't know it.
+type SharePage struct {
+	Shares []Share
+	Total  int
+	Next   string
+}
+
+// ItemPage is a page of items, Next is the cursor of the next page and is
+// empty on the last page. Total is -1 when the server doesn't know it.
+type ItemPage struct {
+	Items []Item
+	Total int
+	Next  string
+}
+
+// SearchResult is a share or an item matching a search, Item is empty for
+// shares. Results with a higher Score are better matches.
+type SearchResult struct {
+	Share string `json:"share"`
+	Item  string `json:"item,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	Score int    `json:"score"`
+}
+
+// SearchPage is a page of search results, Next is the cursor of the next
+// page and is empty on the last page.
+type SearchPage struct {
+	Results []SearchResult
+	Total   int
+	Next    string
+}
+
+// Problem is an inconsistency found when checking storage. Kind is one of
+// orphan, missing_metadata, corrupt_metadata, stale_size or stale_downloads.
+// Error is set when repairing it failed.
+type Problem struct {
+	Kind     string `json:"kind"`
+	Share    string `json:"share,omitempty"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CheckReport is the result of a storage check, Shares and Items are the
+// number of shares and items checked
+type CheckReport struct {
+	Repair   bool      `json:"repair"`
+	Shares   int       `json:"shares"`
+	Items    int       `json:"items"`
+	Problems []Problem `json:"problems"`
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ybizeul/hupload/client"
+	"github.com/ybizeul/hupload/internal/config"
+	"github.com/ybizeul/hupload/internal/search"
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// getClientServer returns a test server for a new Hupload instance and an
+// authenticated client for it.
+func getClientServer(t *testing.T) (*Hupload, *httptest.Server, *client.Client) {
+	t.Cleanup(func() {
+		os.RemoveAll("tmptest")
+	})
+
+	h := getHupload(t, &config.Config{Path: "handlers_testdata/config-cli.yml"})
+	server := httptest.NewServer(h.API)
+	t.Cleanup(server.Close)
+
+	return h, server, client.New(server.URL + "/").WithAPIKey("cli-test-key")
+}
+
+func TestClientShares(t *testing.T) {
+	h, server, c := getClientServer(t)
+	ctx := context.Background()
+
+	err := c.Health(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	v, err := c.Version(ctx)
+	if err != nil || v != version {
+		t.Errorf("Expected version %s, got %s (%v)", version, v, err)
+	}
+
+	d, err := c.Defaults(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if d.Validity != 12 || d.Exposure != "download" {
+		t.Errorf("Unexpected defaults %+v", d)
+	}
+
+	share, err := c.CreateShare(ctx, client.Options{Validity: 3, Exposure: "upload", Message: "hello"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if share.Owner != "api-key" || share.Options.Validity != 3 || share.Options.Message != "hello" {
+		t.Errorf("Unexpected share %+v", share)
+	}
+
+	_, err = c.CreateNamedShare(ctx, "named", client.Options{Exposure: "both"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, err = c.CreateNamedShare(ctx, "named", client.Options{})
+	if !errors.Is(err, client.ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) || apiErr.Message == "" {
+		t.Errorf("Expected *client.Error with a message, got %v", err)
+	}
+
+	options, err := c.UpdateShare(ctx, "named", client.Options{Exposure: "download", Description: "updated"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if options.Description != "updated" {
+		t.Errorf("Unexpected options %+v", options)
+	}
+
+	got, err := c.GetShare(ctx, "named")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got.Options.Exposure != "download" || got.Owner != "api-key" {
+		t.Errorf("Unexpected share %+v", got)
+	}
+
+	shares, err := c.ListShares(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(shares) != 2 {
+		t.Errorf("Expected 2 shares, got %d", len(shares))
+	}
+
+	page, err := c.QueryShares(ctx, client.ShareQuery{Prefix: "nam", Exposure: "download", CreatedAfter: time.Now().Add(-time.Hour)})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(page.Shares) != 1 || page.Shares[0].Name != "named" || page.Total != 1 || page.Next != "" {
+		t.Errorf("Unexpected page %+v", page)
+	}
+
+	_, err = c.QueryShares(ctx, client.ShareQuery{Sort: "unknown"})
+	if !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest, got %v", err)
+	}
+
+	// Guests only see public share information
+	guest := client.New(server.URL)
+	public, err := guest.GetPublicShare(ctx, "named")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if public.Name != "named" || public.Options.Exposure != "download" {
+		t.Errorf("Unexpected public share %+v", public)
+	}
+
+	_, err = guest.ListShares(ctx)
+	if !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("Expected ErrUnauthorized, got %v", err)
+	}
+
+	// Expired shares are gone for guests
+	expired, err := h.Config.Storage.GetShare(ctx, share.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired.DateCreated = time.Now().AddDate(0, 0, -4)
+	expired.Options.ExpiresAt = expired.DateCreated.AddDate(0, 0, expired.Options.Validity)
+	err = storage.SaveShareAtPath(expired, "tmptest/cli/"+share.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = guest.GetPublicShare(ctx, share.Name)
+	if !errors.Is(err, client.ErrGone) {
+		t.Errorf("Expected ErrGone, got %v", err)
+	}
+
+	err = c.DeleteShare(ctx, "named")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, err = c.GetShare(ctx, "named")
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestClientItems(t *testing.T) {
+	_, server, c := getClientServer(t)
+	ctx := context.Background()
+
+	_, err := c.CreateNamedShare(ctx, "items", client.Options{Exposure: "both"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := bytes.Repeat([]byte("hupload"), 100000)
+
+	t.Run("Upload with progress", func(t *testing.T) {
+		var progress []int64
+		item, err := c.UploadItem(ctx, "items", "file.bin", int64(len(content)), bytes.NewReader(content), func(written int64) {
+			progress = append(progress, written)
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if item.Path != "items/file.bin" || item.ItemInfo.Size != int64(len(content)) {
+			t.Errorf("Unexpected item %+v", item)
+		}
+		if len(progress) == 0 || progress[len(progress)-1] != int64(len(content)) {
+			t.Errorf("Expected progress to reach %d, got %v", len(content), progress)
+		}
+	})
+
+	t.Run("Guest upload", func(t *testing.T) {
+		_, err := client.New(server.URL).UploadItem(ctx, "items", "guest.txt", 5, bytes.NewReader([]byte("guest")), nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	})
+
+	t.Run("Upload too big", func(t *testing.T) {
+		big := int64(4 * 1024 * 1024)
+		_, err := c.UploadItem(ctx, "items", "big.bin", big, io.LimitReader(zeroReader{}, big), nil)
+		if !errors.Is(err, client.ErrInsufficientStorage) {
+			t.Errorf("Expected ErrInsufficientStorage, got %v", err)
+		}
+	})
+
+	t.Run("Cancelled upload", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := c.UploadItem(cctx, "items", "cancelled.txt", 5, bytes.NewReader([]byte("hello")), nil)
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected context.Canceled, got %v", err)
+		}
+	})
+
+	items, err := c.ListItems(ctx, "items")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(items) != 2 {
+		t.Fatalf("Expected 2 items, got %+v", items)
+	}
+
+	page, err := c.QueryItems(ctx, "items", client.ItemQuery{Sort: "name", Limit: 1})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Path != "items/file.bin" || page.Total != 2 || page.Next == "" {
+		t.Errorf("Unexpected page %+v", page)
+	}
+
+	page, err = c.QueryItems(ctx, "items", client.ItemQuery{Sort: "name", Limit: 1, Cursor: page.Next})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(page.Items) != 1 || page.Items[0].Path != "items/guest.txt" || page.Next != "" {
+		t.Errorf("Unexpected page %+v", page)
+	}
+
+	results, err := c.Search(ctx, "guest", 0, "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(results.Results) != 1 || results.Results[0].Item != "guest.txt" || results.Total != 1 {
+		t.Errorf("Unexpected search results %+v", results)
+	}
+
+	r, err := c.DownloadItem(ctx, "items", "file.bin")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	b, err := io.ReadAll(r)
+	r.Close()
+	if err != nil || !bytes.Equal(b, content) {
+		t.Errorf("Expected downloaded content to match, got %d bytes (%v)", len(b), err)
+	}
+
+	r, err = c.DownloadShare(ctx, "items")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	b, err = io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		t.Fatalf("Expected a zip archive, got %v", err)
+	}
+	if len(z.File) != 2 {
+		t.Errorf("Expected 2 files in archive, got %d", len(z.File))
+	}
+
+	err = c.DeleteItem(ctx, "items", "guest.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	err = c.DeleteItem(ctx, "items", "guest.txt")
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestClientCopyItems(t *testing.T) {
+	_, _, c := getClientServer(t)
+	ctx := context.Background()
+
+	for _, name := range []string{"customer", "vendor"} {
+		_, err := c.CreateNamedShare(ctx, name, client.Options{Exposure: "both"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"support.tgz", "logs.txt"} {
+		_, err := c.UploadItem(ctx, "customer", name, 5, bytes.NewReader([]byte("hello")), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	item, err := c.CopyItem(ctx, "customer", "support.tgz", "vendor", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if item.Path != "vendor/support.tgz" || item.ItemInfo.Size != 5 {
+		t.Errorf("Unexpected copy %+v", item)
+	}
+
+	item, err = c.MoveItem(ctx, "customer", "logs.txt", "vendor", "customer-logs.txt")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if item.Path != "vendor/customer-logs.txt" {
+		t.Errorf("Unexpected moved item %+v", item)
+	}
+
+	items, err := c.ListItems(ctx, "customer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Path != "customer/support.tgz" {
+		t.Errorf("Expected only the copied item to be left, got %+v", items)
+	}
+
+	_, err = c.MoveItem(ctx, "customer", "logs.txt", "vendor", "")
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+}
+
+func TestClientRenameShare(t *testing.T) {
+	_, _, c := getClientServer(t)
+	ctx := context.Background()
+
+	for _, name := range []string{"leaked", "taken"} {
+		_, err := c.CreateNamedShare(ctx, name, client.Options{Exposure: "both"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := c.UploadItem(ctx, "leaked", "support.tgz", 5, bytes.NewReader([]byte("hello")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	share, err := c.RenameShare(ctx, "leaked", "rotated", "1h")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if share.Name != "rotated" || share.Count != 1 {
+		t.Errorf("Unexpected share %+v", share)
+	}
+
+	// The previous name works during the grace period
+	public, err := c.GetPublicShare(ctx, "leaked")
+	if err != nil || public.Name != "rotated" {
+		t.Errorf("Expected renamed share, got %+v, %v", public, err)
+	}
+
+	share, err = c.RenameShare(ctx, "rotated", "", "")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if share.Name == "" || share.Name == "rotated" {
+		t.Errorf("Expected a new code, got %+v", share)
+	}
+
+	_, err = c.GetShare(ctx, "rotated")
+	if !errors.Is(err, client.ErrGone) {
+		t.Errorf("Expected ErrGone, got %v", err)
+	}
+
+	_, err = c.RenameShare(ctx, share.Name, "taken", "")
+	if !errors.Is(err, client.ErrConflict) {
+		t.Errorf("Expected ErrConflict, got %v", err)
+	}
+}
+
+func TestClientMessages(t *testing.T) {
+	h := getHupload(t, cfgs["file"].Config)
+	t.Cleanup(func() { cfgs["file"].Cleanup(h) })
+
+	server := httptest.NewServer(h.API)
+	t.Cleanup(server.Close)
+
+	c := client.New(server.URL).WithBasicAuth("admin", "hupload")
+
+	titles, err := c.Messages(context.Background())
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(titles, []string{"Message title"}) {
+		t.Errorf("Unexpected titles %v", titles)
+	}
+
+	m, err := c.Message(context.Background(), 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if m.Title != "Message title" {
+		t.Errorf("Unexpected message %+v", m)
+	}
+
+	_, err = c.Message(context.Background(), 2)
+	if !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest, got %v", err)
+	}
+}
+
+func TestClientForms(t *testing.T) {
+	h := getHupload(t, cfgs["memory"].Config)
+
+	server := httptest.NewServer(h.API)
+	t.Cleanup(server.Close)
+
+	c := client.New(server.URL).WithBasicAuth("admin", "hupload")
+	ctx := context.Background()
+
+	titles, err := c.Forms(ctx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(titles, []string{"Support case"}) {
+		t.Errorf("Unexpected titles %v", titles)
+	}
+
+	f, err := c.Form(ctx, 1)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if f.Title != "Support case" || len(f.Fields) != 2 || f.Fields[1].Type != "checkbox" {
+		t.Errorf("Unexpected form %+v", f)
+	}
+
+	_, err = c.Form(ctx, 2)
+	if !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest, got %v", err)
+	}
+
+	// Answers are sent with uploads and can be edited
+	_, err = c.CreateNamedShare(ctx, "form", client.Options{Exposure: "upload", Fields: f.Fields})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = c.UploadItem(ctx, "form", "missing.txt", 5, bytes.NewReader([]byte("hello")), nil)
+	if !errors.Is(err, client.ErrBadRequest) {
+		t.Errorf("Expected ErrBadRequest, got %v", err)
+	}
+
+	metadata := client.ItemMetadata{UploaderName: "Jane", Fields: map[string]string{"case": "1", "terms": "true"}}
+	item, err := c.UploadItemWithMetadata(ctx, "form", "answered.txt", 5, bytes.NewReader([]byte("hello")), metadata, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if item.Metadata == nil || item.Metadata.UploaderName != "Jane" || item.Metadata.Fields["case"] != "1" {
+		t.Errorf("Unexpected metadata %+v", item.Metadata)
+	}
+
+	item, err = c.UpdateItem(ctx, "form", "answered.txt", client.ItemMetadata{Note: "checked", Fields: map[string]string{"case": "2"}})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if item.Metadata == nil || item.Metadata.UploaderName != "Jane" || item.Metadata.Note != "checked" || item.Metadata.Fields["case"] != "2" {
+		t.Errorf("Unexpected metadata %+v", item.Metadata)
+	}
+}
+
+// TestClientTypes makes sure client types stay in sync with the JSON
+// representation of storage types.
+func TestClientTypes(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	options := storage.Options{
+		Validity:         1,
+		ExpiresAt:        now.AddDate(0, 0, 1),
+		Exposure:         "both",
+		Description:      "d",
+		Message:          "m",
+		UploadOpensAt:    now,
+		UploadClosesAt:   now.Add(time.Hour),
+		DownloadOpensAt:  now,
+		DownloadClosesAt: now.Add(time.Hour),
+
+		MaxDownloads:        2,
+		MaxItemDownloads:    1,
+		DeleteAfterDownload: true,
+
+		Fields: []storage.ItemField{{Name: "case", Label: "Case", Type: storage.FieldSelect, Choices: []string{"1"}, Required: true}},
+
+		Conflict: storage.ConflictVersion,
+	}
+
+	tests := []struct {
+		from any
+		to   any
+	}{
+		{
+			from: storage.Share{
+				Version:     1,
+				Name:        "share",
+				DateCreated: now,
+				Owner:       "admin",
+				Options:     options,
+				Size:        1,
+				Count:       1,
+				Downloads:   map[string]int64{"item": 1},
+				Items:       map[string]storage.ItemMetadata{"item": {Owner: "admin", Guest: "g", UploaderName: "n", UploaderEmail: "e@example.com", Note: "n", Fields: map[string]string{"case": "1"}}},
+			},
+			to: &client.Share{},
+		},
+		{
+			from: storage.NewShare().WithName("share").WithOptions(storage.Options{ExpiresAt: now, Exposure: "upload", Message: "m", UploadClosesAt: now, DownloadOpensAt: now, MaxDownloads: 2, Conflict: storage.ConflictRename}).PublicShare(),
+			to:   &client.PublicShare{},
+		},
+		{
+			from: storage.Item{Path: "share/item", Downloads: 1, Metadata: &storage.ItemMetadata{Owner: "admin", Guest: "g", UploaderName: "n", UploaderEmail: "e@example.com", Note: "n", Fields: map[string]string{"case": "1"}}, ItemInfo: storage.ItemInfo{Size: 1, DateModified: now}},
+			to:   &client.Item{},
+		},
+		{
+			from: storage.ItemVersion{Version: 1, ItemInfo: storage.ItemInfo{Size: 1, DateModified: now}},
+			to:   &client.ItemVersion{},
+		},
+		{
+			from: config.MessageTemplate{Title: "t", Message: "m"},
+			to:   &client.MessageTemplate{},
+		},
+		{
+			from: config.FormTemplate{Title: "t", Fields: options.Fields},
+			to:   &client.FormTemplate{},
+		},
+		{
+			from: search.Result{Share: "share", Item: "item", Owner: "admin", Score: 1},
+			to:   &client.SearchResult{},
+		},
+		{
+			from: storage.CheckReport{
+				Repair: true,
+				Shares: 1,
+				Items:  1,
+				Problems: []storage.Problem{
+					{Kind: storage.ProblemStaleSize, Share: "share", Path: "share/.metadata", Message: "m", Repaired: false, Error: "e"},
+				},
+			},
+			to: &client.CheckReport{},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(reflect.TypeOf(test.from).String(), func(t *testing.T) {
+			want, err := json.Marshal(test.from)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := json.NewDecoder(bytes.NewReader(want))
+			d.DisallowUnknownFields()
+			err = d.Decode(test.to)
+			if err != nil {
+				t.Fatalf("Expected client type to decode %s, got %v", want, err)
+			}
+
+			got, err := json.Marshal(test.to)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(want, got) {
+				t.Errorf("Expected %s, got %s", want, got)
+			}
+		})
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	clear(b)
+	return len(b), nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/ybizeul/hupload/internal/config"
+)
+
+// ErrUsage is returned by commands when arguments are invalid, usage has
+// already been written to stderr.
+var ErrUsage = errors.New("invalid usage")
+
+const usage = `usage: hupload <command> [arguments]
+
+Commands:
+  serve                                  start the web server (default)
+  config check [path]                    validate a configuration file
+  share list                             list shares
+  share create [name]                    create a share
+  share update <share>                   update share options
+  share rename <share> [name]            rename a share or regenerate its code
+  share delete <share>...                delete shares
+  item list <share>                      list items in a share
+  item upload <share> <file>...          upload files to a share
+  item download <share> <item>           download an item
+  item cp <share> <item> <to-share>      copy an item to a share
+  item mv <share> <item> <to-share>      move an item to a share
+  item rm <share> <item>...              delete items
+  migrate                                migrate storage to the current version
+  transfer -to <config> [share]...       copy shares to another storage backend
+  purge-expired                          delete expired shares
+  fsck [-repair]                         check storage consistency
+  hash-password [password]               print a hash for the users file
+  users add <username> [password]        add a user to the users file
+
+Commands working on shares and items use the storage backend of the
+configuration file, or a remote instance when -url is set.
+Run hupload <command> -h for command options.
+`
+
+// runCommand runs the command line subcommand in args and returns the process
+// exit code. Output is written to stdout and errors to stderr.
+func runCommand(args []string, stdout, stderr io.Writer) int {
+	var err error
+
+	ctx := context.Background()
+
+	switch args[0] {
+	case "serve":
+		err = serveCommand(args[1:], stderr)
+	case "config":
+		return configCommand(args[1:], stdout, stderr)
+	case "share":
+		err = shareCommand(ctx, args[1:], stdout, stderr)
+	case "item":
+		err = itemCommand(ctx, args[1:], stdout, stderr)
+	case "migrate":
+		err = migrateCommand(args[1:], stdout, stderr)
+	case "transfer":
+		err = transferCommand(ctx, args[1:], stdout, stderr)
+	case "purge-expired":
+		err = purgeCommand(ctx, args[1:], stdout, stderr)
+	case "fsck":
+		err = fsckCommand(ctx, args[1:], stdout, stderr)
+	case "hash-password":
+		err = hashPasswordCommand(args[1:], os.Stdin, stdout, stderr)
+	case "users":
+		err = usersCommand(args[1:], os.Stdin, stdout, stderr)
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(stdout, usage)
+		return 0
+	default:
+		fmt.Fprintf(stderr, "unknown command: %s\n\n%s", args[0], usage)
+		return 2
+	}
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrUsage), errors.Is(err, flag.ErrHelp):
+		return 2
+	}
+
+	fmt.Fprintf(stderr, "hupload: %v\n", err)
+	return 1
+}
+
+// serveCommand starts the web server
+func serveCommand(args []string, stderr io.Writer) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	cfgPath := fs.String("config", configPath(), "path to configuration file")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	initLogging()
+	slog.Info("Start Hupload")
+
+	// Create configuration struct
+	cfg := config.Config{
+		Path: *cfgPath,
+	}
+
+	h, err := NewHupload(&cfg)
+	if err != nil {
+		return err
+	}
+
+	// Start the web server
+	h.Start()
+
+	return nil
+}
+
+// configCommand handles `hupload config check [path]`. When path is omitted,
+// the configuration file from CONFIG environment variable is checked.
+func configCommand(args []string, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] != "check" || len(args) > 2 {
+		fmt.Fprintln(stderr, "usage: hupload config check [path]")
+		return 2
+	}
+
+	cfg := config.Config{
+		Path: configPath(),
+	}
+	if len(args) == 2 {
+		cfg.Path = args[1]
+	}
+
+	found, err := cfg.Check()
+	if !found {
+		fmt.Fprintf(stderr, "%s: configuration file not found\n", cfg.Path)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "%s: invalid configuration\n%v\n", cfg.Path, err)
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s: configuration is valid\n", cfg.Path)
+	return 0
+}
+
+// configPath returns the path of the configuration file from CONFIG
+// environment variable, or the default path.
+func configPath() string {
+	p := os.Getenv("CONFIG")
+	if p == "" {
+		p = "config.yml"
+	}
+	return p
+}
+
+// commonFlags are the flags shared by commands working on shares and items
+type commonFlags struct {
+	config string
+	url    string
+	apiKey string
+	owner  string
+	json   bool
+}
+
+// newFlagSet returns a flag set for command name with the common flags
+// registered. usage describes the positional arguments.
+func newFlagSet(name, args string, stderr io.Writer) (*flag.FlagSet, *commonFlags) {
+	c := &commonFlags{}
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(stderr, "usage: hupload %s [options] %s\n\nOptions:\n", name, args)
+		fs.PrintDefaults()
+	}
+
+	fs.StringVar(&c.config, "config", configPath(), "path to configuration file for local storage")
+	fs.StringVar(&c.url, "url", os.Getenv("HUPLOAD_URL"), "URL of a remote Hupload instance (HUPLOAD_URL)")
+	fs.StringVar(&c.apiKey, "api-key", os.Getenv("HUPLOAD_API_KEY"), "API key for the remote instance (HUPLOAD_API_KEY)")
+	fs.StringVar(&c.owner, "owner", "admin", "owner of shares created with local storage")
+	fs.BoolVar(&c.json, "json", false, "write output as JSON")
+
+	return fs, c
+}
+
+// parse parses args in fs and checks the number of positional arguments is
+// within min and max, max being -1 for no limit.
+func parse(fs *flag.FlagSet, args []string, min, max int) error {
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() < min || (max >= 0 && fs.NArg() > max) {
+		fs.Usage()
+		return ErrUsage
+	}
+	return nil
+}
+
+// backend returns the administration backend selected by flags, a remote
+// instance if an URL is set, the configured storage otherwise.
+func (c *commonFlags) backend() (administration, error) {
+	if c.url != "" {
+		return newRemoteAdministration(c.url, c.apiKey), nil
+	}
+
+	cfg := &config.Config{
+		Path: c.config,
+	}
+	found, err := cfg.LoadStorage()
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		slog.Warn("No configuration file found, using default values", "path", cfg.Path)
+	}
+
+	return &localAdministration{
+		Storage: cfg.Storage,
+		Values:  cfg.Values,
+		Owner:   c.owner,
+	}, nil
+}
+
+// writeJSON writes v as indented JSON to w
+func writeJSON(w io.Writer, v any) error {
+	e := json.NewEncoder(w)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+// writeResult writes a status message to w, as an APIResult when asJSON is
+// set.
+func writeResult(w io.Writer, asJSON bool, format string, a ...any) error {
+	m := fmt.Sprintf(format, a...)
+	if asJSON {
+		return writeJSON(w, APIResult{Status: "success", Message: m})
+	}
+	_, err := fmt.Fprintln(w, m)
+	return err
+}
+
+// humanSize returns a human readable size in bytes
+func humanSize(s int64) string {
+	const unit = 1024
+	if s < unit {
+		return fmt.Sprintf("%d B", s)
+	}
+	div, exp := int64(unit), 0
+	for n := s / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(s)/float64(div), "KMGTPE"[exp])
+}
+
+// subcommand returns the first argument of args or writes usage and returns
+// ErrUsage if there is none.
+func subcommand(args []string, name string, commands []string, stderr io.Writer) (string, error) {
+	if len(args) == 0 {
+		fmt.Fprintf(stderr, "usage: hupload %s <%s> [arguments]\n", name, strings.Join(commands, "|"))
+		return "", ErrUsage
+	}
+	for _, c := range commands {
+		if c == args[0] {
+			return c, nil
+		}
+	}
+	fmt.Fprintf(stderr, "unknown %s command: %s\nusage: hupload %s <%s> [arguments]\n", name, args[0], name, strings.Join(commands, "|"))
+	return "", ErrUsage
+}
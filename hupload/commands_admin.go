@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ybizeul/hupload/internal/config"
+	"github.com/ybizeul/hupload/internal/transfer"
+)
+
+// ErrUserAlreadyExists is returned when adding a user that is already in the
+// users file
+var ErrUserAlreadyExists = errors.New("user already exists")
+
+// migrateCommand runs the storage backend migration. It only works on local
+// storage as migration is run by the server itself at startup.
+func migrateCommand(args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("migrate", "", stderr)
+	err := parse(fs, args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	if c.url != "" {
+		return errors.New("migrate only works on local storage, remote instances migrate at startup")
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	err = a.(*localAdministration).Storage.Migrate()
+	if err != nil {
+		return err
+	}
+
+	return writeResult(stdout, c.json, "storage migrated")
+}
+
+// transferCommand copies shares and items from the storage of the
+// configuration file to the storage of another configuration file, keeping
+// share metadata. It can be run again to resume an interrupted transfer.
+func transferCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("transfer", "-to <config> [share]...", stderr)
+	to := fs.String("to", "", "configuration file of the destination storage")
+	dryRun := fs.Bool("dry-run", false, "only list what would be copied")
+	verify := fs.Bool("verify", false, "compare checksums instead of sizes and check copied items")
+	err := parse(fs, args, 0, -1)
+	if err != nil {
+		return err
+	}
+
+	if *to == "" {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	if c.url != "" {
+		return errors.New("transfer only works on local storage")
+	}
+
+	src, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	dst := &config.Config{Path: *to}
+	found, err := dst.LoadStorage()
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s: configuration file not found", dst.Path)
+	}
+
+	t := transfer.New(src.(*localAdministration).Storage, dst.Storage).
+		WithShares(fs.Args()...).
+		WithDryRun(*dryRun).
+		WithVerify(*verify)
+
+	if !c.json {
+		t.WithOnEvent(func(e transfer.Event) {
+			printTransferEvent(stdout, e, *dryRun)
+		})
+	}
+
+	report, err := t.Run(ctx)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return writeJSON(stdout, report)
+	}
+
+	verb := "copied"
+	if *dryRun {
+		verb = "would be copied"
+	}
+	_, err = fmt.Fprintf(stdout, "%d shares, %d items %s (%s), %d items skipped\n", report.Shares, report.Copied, verb, humanSize(report.Bytes), report.Skipped)
+	return err
+}
+
+// printTransferEvent writes a line for transfer event e
+func printTransferEvent(w io.Writer, e transfer.Event, dryRun bool) {
+	if e.Item == "" {
+		fmt.Fprintf(w, "share %s\n", e.Share)
+		return
+	}
+
+	action := map[string]string{
+		transfer.ActionCopy:    "copied",
+		transfer.ActionReplace: "replaced",
+		transfer.ActionSkip:    "skipped",
+	}[e.Action]
+	if dryRun && e.Action != transfer.ActionSkip {
+		action = "would be " + action
+	}
+
+	fmt.Fprintf(w, "  %s %s (%s)\n", e.Item, action, humanSize(e.Size))
+}
+
+// purgeCommand deletes every expired share
+func purgeCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("purge-expired", "", stderr)
+	dryRun := fs.Bool("dry-run", false, "only list expired shares")
+	err := parse(fs, args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	shares, err := a.ListShares(ctx)
+	if err != nil {
+		return err
+	}
+
+	purged := []string{}
+	for _, s := range shares {
+		if s.IsValid() {
+			continue
+		}
+		if !*dryRun {
+			err = a.DeleteShare(ctx, s.Name)
+			if err != nil {
+				return fmt.Errorf("%s: %w", s.Name, err)
+			}
+		}
+		purged = append(purged, s.Name)
+	}
+
+	if c.json {
+		return writeJSON(stdout, purged)
+	}
+
+	verb := "deleted"
+	if *dryRun {
+		verb = "would be deleted"
+	}
+	for _, p := range purged {
+		fmt.Fprintf(stdout, "share %s %s\n", p, verb)
+	}
+	return nil
+}
+
+// fsckCommand checks the consistency of shares metadata with their content
+// and writes the report as JSON. It fails if problems are left unrepaired.
+func fsckCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("fsck", "", stderr)
+	repair := fs.Bool("repair", false, "repair problems found")
+	err := parse(fs, args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	report, err := a.Check(ctx, *repair)
+	if err != nil {
+		return err
+	}
+
+	err = writeJSON(stdout, report)
+	if err != nil {
+		return err
+	}
+
+	remaining := 0
+	for _, p := range report.Problems {
+		if !p.Repaired {
+			remaining++
+		}
+	}
+	if remaining > 0 {
+		return fmt.Errorf("%d problems found", remaining)
+	}
+
+	return nil
+}
+
+// hashPasswordCommand prints a bcrypt hash of the password given as argument or
+// read from stdin, to be used in the users file.
+func hashPasswordCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	fs, _ := newFlagSet("hash-password", "[password]", stderr)
+	cost := fs.Int("cost", bcrypt.DefaultCost, "bcrypt cost")
+	err := parse(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	hash, err := hashPassword(fs.Arg(0), stdin, *cost)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(stdout, hash)
+	return err
+}
+
+// usersCommand handles `hupload users add`
+func usersCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	_, err := subcommand(args, "users", []string{"add"}, stderr)
+	if err != nil {
+		return err
+	}
+
+	fs, c := newFlagSet("users add", "<username> [password]", stderr)
+	file := fs.String("file", "", "users file, defaults to auth path of the configuration file")
+	err = parse(fs, args[1:], 1, 2)
+	if err != nil {
+		return err
+	}
+
+	p := *file
+	if p == "" {
+		cfg := config.Config{Path: c.config}
+		_, err = cfg.Check()
+		if err != nil {
+			return err
+		}
+		a := cfg.Values.Authentication
+		if a.Type != "file" {
+			return fmt.Errorf("authentication type is %s, use -file to set the users file", a.Type)
+		}
+		p, _ = a.Options["path"].(string)
+	}
+
+	hash, err := hashPassword(fs.Arg(1), stdin, bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	err = addUser(p, fs.Arg(0), hash)
+	if err != nil {
+		return err
+	}
+
+	return writeResult(stdout, c.json, "user %s added to %s", fs.Arg(0), p)
+}
+
+// hashPassword returns the bcrypt hash of password, or of the first line read
+// from stdin if password is empty.
+func hashPassword(password string, stdin io.Reader, cost int) (string, error) {
+	if password == "" {
+		l, err := bufio.NewReader(stdin).ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return "", err
+		}
+		password = strings.TrimRight(l, "\r\n")
+	}
+
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+
+	b, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// user is an entry of the users file
+type user struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// addUser adds username with password hash to the users file at p, which is
+// created if it doesn't exist.
+func addUser(p, username, hash string) error {
+	users := []user{}
+
+	b, err := os.ReadFile(p)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	err = yaml.Unmarshal(b, &users)
+	if err != nil {
+		return err
+	}
+
+	if slices.ContainsFunc(users, func(u user) bool { return u.Username == username }) {
+		return fmt.Errorf("%w: %s", ErrUserAlreadyExists, username)
+	}
+
+	users = append(users, user{Username: username, Password: hash})
+
+	b, err = yaml.Marshal(users)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(p, b, 0600)
+}
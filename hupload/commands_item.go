@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// itemCommand handles `hupload item <list|upload|download|cp|mv|rm>`
+func itemCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	c, err := subcommand(args, "item", []string{"list", "upload", "download", "cp", "mv", "rm"}, stderr)
+	if err != nil {
+		return err
+	}
+
+	switch c {
+	case "list":
+		return itemListCommand(ctx, args[1:], stdout, stderr)
+	case "upload":
+		return itemUploadCommand(ctx, args[1:], stdout, stderr)
+	case "download":
+		return itemDownloadCommand(ctx, args[1:], stdout, stderr)
+	case "cp", "mv":
+		return itemCopyCommand(ctx, args[1:], c == "mv", stdout, stderr)
+	}
+	return itemRemoveCommand(ctx, args[1:], stdout, stderr)
+}
+
+func itemListCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("item list", "<share>", stderr)
+	err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	items, err := a.ListShare(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return writeJSON(stdout, items)
+	}
+
+	tw := tabwriter.NewWriter(stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tSIZE\tMODIFIED\tDOWNLOADS")
+	for _, i := range items {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\n",
+			path.Base(i.Path),
+			humanSize(i.ItemInfo.Size),
+			i.ItemInfo.DateModified.Local().Format(time.DateTime),
+			i.Downloads,
+		)
+	}
+	return tw.Flush()
+}
+
+func itemUploadCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("item upload", "<share> <file>...", stderr)
+	name := fs.String("name", "", "item name, defaults to the file name (single file only)")
+	err := parse(fs, args, 2, -1)
+	if err != nil {
+		return err
+	}
+
+	if *name != "" && fs.NArg() > 2 {
+		fs.Usage()
+		return ErrUsage
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	share := fs.Arg(0)
+
+	for _, p := range fs.Args()[1:] {
+		itemName := *name
+		if itemName == "" {
+			itemName = filepath.Base(p)
+		}
+
+		item, err := uploadFile(ctx, a, share, itemName, p)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p, err)
+		}
+
+		if c.json {
+			err = writeJSON(stdout, item)
+		} else {
+			_, err = fmt.Fprintf(stdout, "%s uploaded (%s)\n", item.Path, humanSize(item.ItemInfo.Size))
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// uploadFile uploads file at p in share with name item
+func uploadFile(ctx context.Context, a administration, share, item, p string) (*storage.Item, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	s, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if s.IsDir() {
+		return nil, errors.New("is a directory")
+	}
+
+	return a.CreateItem(ctx, share, item, s.Size(), f)
+}
+
+func itemDownloadCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("item download", "<share> <item>", stderr)
+	output := fs.String("o", "", "output file, - for standard output, defaults to the item name")
+	err := parse(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	r, err := a.GetItemData(ctx, fs.Arg(0), fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if *output == "-" {
+		_, err = io.Copy(stdout, r)
+		return err
+	}
+
+	p := *output
+	if p == "" {
+		p = path.Base(path.Join("/", fs.Arg(1)))
+	}
+
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		os.Remove(p)
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return writeResult(stdout, c.json, "%s written (%s)", p, humanSize(n))
+}
+
+func itemCopyCommand(ctx context.Context, args []string, move bool, stdout, stderr io.Writer) error {
+	name, action := "item cp", "copied"
+	if move {
+		name, action = "item mv", "moved"
+	}
+	fs, c := newFlagSet(name, "<share> <item> <to-share> [name]", stderr)
+	err := parse(fs, args, 3, 4)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	share, item, toShare := fs.Arg(0), fs.Arg(1), fs.Arg(2)
+	toItem := fs.Arg(3)
+	if toItem == "" {
+		toItem = item
+	}
+
+	result, err := a.CopyItem(ctx, share, item, toShare, toItem, move)
+	if err != nil {
+		return fmt.Errorf("%s: %w", item, err)
+	}
+
+	return writeResult(stdout, c.json, "item %s %s to %s", path.Join(share, item), action, result.Path)
+}
+
+func itemRemoveCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("item rm", "<share> <item>...", stderr)
+	err := parse(fs, args, 2, -1)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	share := fs.Arg(0)
+	for _, i := range fs.Args()[1:] {
+		err = a.DeleteItem(ctx, share, i)
+		if err != nil {
+			return fmt.Errorf("%s: %w", i, err)
+		}
+		err = writeResult(stdout, c.json, "item %s deleted", path.Join(share, i))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// shareCommand handles `hupload share <list|create|update|rename|delete>`
+func shareCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	c, err := subcommand(args, "share", []string{"list", "create", "update", "rename", "delete"}, stderr)
+	if err != nil {
+		return err
+	}
+
+	switch c {
+	case "list":
+		return shareListCommand(ctx, args[1:], stdout, stderr)
+	case "create":
+		return shareCreateCommand(ctx, args[1:], stdout, stderr)
+	case "update":
+		return shareUpdateCommand(ctx, args[1:], stdout, stderr)
+	case "rename":
+		return shareRenameCommand(ctx, args[1:], stdout, stderr)
+	}
+	return shareDeleteCommand(ctx, args[1:], stdout, stderr)
+}
+
+// shareOptionsFlags registers flags for share options in fs. The returned
+// function applies the flags that have been set on the command line to o.
+func shareOptionsFlags(fs *flag.FlagSet) func(o *storage.Options) error {
+	validity := fs.Int("validity", 0, "validity in days, 0 for no expiration")
+	exposure := fs.String("exposure", "", "exposure to guests: upload, download, both or dropbox")
+	description := fs.String("description", "", "description of the share")
+	message := fs.String("message", "", "message displayed to guests, in markdown")
+	maxDownloads := fs.Int64("max-downloads", 0, "maximum number of item downloads by guests, 0 for no limit")
+	maxItemDownloads := fs.Int64("max-item-downloads", 0, "maximum number of downloads of each item by guests, 0 for no limit")
+	deleteAfterDownload := fs.Bool("delete-after-download", false, "delete items after their first complete download by a guest")
+	conflict := fs.String("conflict", "", "policy for uploads of existing items: overwrite, reject, rename or version")
+
+	// Fields are given in order with repeated flags
+	fields := []storage.ItemField{}
+	addField := func(required bool) func(string) error {
+		return func(name string) error {
+			fields = append(fields, storage.ItemField{Name: name, Required: required})
+			return nil
+		}
+	}
+	fs.Func("field", "custom field of item metadata, can be repeated", addField(false))
+	fs.Func("required-field", "custom field of item metadata uploads must set, can be repeated", addField(true))
+
+	// Dates are given as RFC 3339 dates or durations from now
+	const date = ", as an RFC 3339 date or a duration like 4h or 3d"
+	dates := map[string]*string{
+		"expires":         fs.String("expires", "", "expiration, overrides validity"+date),
+		"upload-opens":    fs.String("upload-opens", "", "when guests can start uploading"+date),
+		"upload-closes":   fs.String("upload-closes", "", "when guests can't upload anymore"+date),
+		"download-opens":  fs.String("download-opens", "", "when guests can start downloading"+date),
+		"download-closes": fs.String("download-closes", "", "when guests can't download anymore"+date),
+	}
+
+	return func(o *storage.Options) error {
+		var err error
+
+		targets := map[string]*time.Time{
+			"expires":         &o.ExpiresAt,
+			"upload-opens":    &o.UploadOpensAt,
+			"upload-closes":   &o.UploadClosesAt,
+			"download-opens":  &o.DownloadOpensAt,
+			"download-closes": &o.DownloadClosesAt,
+		}
+
+		fs.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "validity":
+				if *validity < 0 {
+					err = fmt.Errorf("invalid validity: %d", *validity)
+				}
+				o.Validity = *validity
+			case "exposure":
+				if !storage.ValidExposure(*exposure) {
+					err = fmt.Errorf("invalid exposure: %s", *exposure)
+				}
+				o.Exposure = *exposure
+			case "description":
+				o.Description = *description
+			case "message":
+				o.Message = *message
+			case "max-downloads":
+				o.MaxDownloads = *maxDownloads
+			case "max-item-downloads":
+				o.MaxItemDownloads = *maxItemDownloads
+			case "delete-after-download":
+				o.DeleteAfterDownload = *deleteAfterDownload
+			case "conflict":
+				if !storage.ValidConflict(*conflict) {
+					err = fmt.Errorf("invalid conflict policy: %s", *conflict)
+				}
+				o.Conflict = *conflict
+			case "field", "required-field":
+				o.Fields = fields
+			case "expires", "upload-opens", "upload-closes", "download-opens", "download-closes":
+				t, e := storage.ParseExpiration(*dates[f.Name], time.Now())
+				if e != nil {
+					err = fmt.Errorf("-%s: %w", f.Name, e)
+				}
+				*targets[f.Name] = t
+			}
+		})
+		if err != nil {
+			return err
+		}
+
+		err = o.ValidateWindows()
+		if err != nil {
+			return err
+		}
+
+		err = o.ValidateFields()
+		if err != nil {
+			return err
+		}
+
+		return o.ValidateDownloadLimits()
+	}
+}
+
+func shareListCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("share list", "", stderr)
+	err := parse(fs, args, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	shares, err := a.ListShares(ctx)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return writeJSON(stdout, shares)
+	}
+
+	return writeShares(stdout, shares)
+}
+
+// writeShares writes shares as a table to w
+func writeShares(w io.Writer, shares []storage.Share) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tOWNER\tEXPOSURE\tITEMS\tSIZE\tCREATED\tEXPIRES\tVALID")
+	for _, s := range shares {
+		expires := "never"
+		if e := s.Expiration(); !e.IsZero() {
+			expires = e.Local().Format(time.DateTime)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%t\n",
+			s.Name,
+			s.Owner,
+			s.Options.Exposure,
+			s.Count,
+			humanSize(s.Size),
+			s.DateCreated.Local().Format(time.DateTime),
+			expires,
+			s.IsValid(),
+		)
+	}
+	return tw.Flush()
+}
+
+func shareCreateCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("share create", "[name]", stderr)
+	apply := shareOptionsFlags(fs)
+	err := parse(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	options, err := a.Defaults(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = apply(&options)
+	if err != nil {
+		return err
+	}
+
+	share, err := a.CreateShare(ctx, fs.Arg(0), options)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return writeJSON(stdout, share)
+	}
+
+	_, err = fmt.Fprintln(stdout, share.Name)
+	return err
+}
+
+func shareUpdateCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("share update", "<share>", stderr)
+	apply := shareOptionsFlags(fs)
+	err := parse(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	// Options are replaced as a whole, so start from the current ones
+	share, err := a.GetShare(ctx, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	err = apply(&share.Options)
+	if err != nil {
+		return err
+	}
+
+	options, err := a.UpdateShare(ctx, share.Name, share.Options)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return writeJSON(stdout, options)
+	}
+
+	return writeResult(stdout, false, "share %s updated", share.Name)
+}
+
+func shareRenameCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("share rename", "<share> [name]", stderr)
+	grace := fs.String("grace", "", "how long the previous name keeps working, like 4h or 3d, or a date")
+	err := parse(fs, args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	share, err := a.RenameShare(ctx, fs.Arg(0), fs.Arg(1), *grace)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return writeJSON(stdout, share)
+	}
+
+	_, err = fmt.Fprintln(stdout, share.Name)
+	return err
+}
+
+func shareDeleteCommand(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	fs, c := newFlagSet("share delete", "<share>...", stderr)
+	err := parse(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	a, err := c.backend()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range fs.Args() {
+		err = a.DeleteShare(ctx, s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", s, err)
+		}
+		err = writeResult(stdout, c.json, "share %s deleted", s)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ybizeul/hupload/internal/config"
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+func TestConfigCheckCommand(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		output string
+	}{
+		{
+			name:   "valid configuration",
+			args:   []string{"config", "check", "handlers_testdata/config.yml"},
+			code:   0,
+			output: "configuration is valid",
+		},
+		{
+			name:   "invalid configuration",
+			args:   []string{"config", "check", "internal/config/config_testdata/config_unknown_keys.yml"},
+			code:   1,
+			output: "line 13: storage.options.max_share_md: unknown option",
+		},
+		{
+			name:   "missing configuration",
+			args:   []string{"config", "check", "handlers_testdata/nonexistent.yml"},
+			code:   1,
+			output: "configuration file not found",
+		},
+		{
+			name:   "missing subcommand",
+			args:   []string{"config"},
+			code:   2,
+			output: "usage",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+
+			code := runCommand(test.args, &stdout, &stderr)
+			if code != test.code {
+				t.Errorf("Expected exit code %d, got %d (%s)", test.code, code, stderr.String())
+			}
+
+			if !strings.Contains(stdout.String()+stderr.String(), test.output) {
+				t.Errorf("Expected output to contain %q, got %q", test.output, stdout.String()+stderr.String())
+			}
+		})
+	}
+}
+
+// runTestCommand runs command args and fails the test if exit code is not code.
+// It returns standard output.
+func runTestCommand(t *testing.T, code int, args ...string) string {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	c := runCommand(args, &stdout, &stderr)
+	if c != code {
+		t.Fatalf("%v: expected exit code %d, got %d (%s)", args, code, c, stderr.String())
+	}
+	return stdout.String()
+}
+
+func TestShareAndItemCommands(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll("tmptest")
+	})
+
+	t.Setenv("HUPLOAD_URL", "")
+	t.Setenv("HUPLOAD_API_KEY", "")
+
+	h := getHupload(t, &config.Config{Path: "handlers_testdata/config-cli.yml"})
+	server := httptest.NewServer(h.API)
+	t.Cleanup(server.Close)
+
+	modes := map[string][]string{
+		"local":  {"-config", "handlers_testdata/config-cli.yml"},
+		"remote": {"-url", server.URL, "-api-key", "cli-test-key"},
+	}
+
+	for mode, flags := range modes {
+		t.Run(mode, func(t *testing.T) {
+			cmd := func(code int, command []string, args ...string) string {
+				a := append(command, flags...)
+				return runTestCommand(t, code, append(a, args...)...)
+			}
+
+			shareName := "cli-" + mode
+
+			// Create a share with default options
+			out := cmd(0, []string{"share", "create"}, "-json", "-message", "hello", shareName)
+			var share storage.Share
+			err := json.Unmarshal([]byte(out), &share)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if share.Name != shareName || share.Options.Validity != 12 || share.Options.Exposure != "download" || share.Options.Message != "hello" {
+				t.Errorf("Unexpected share %+v", share)
+			}
+
+			// Creating it again should fail
+			cmd(1, []string{"share", "create"}, shareName)
+
+			// Update exposure only
+			cmd(0, []string{"share", "update"}, "-exposure", "both", shareName)
+			got, err := h.Config.Storage.GetShare(context.Background(), shareName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Options.Exposure != "both" || got.Options.Message != "hello" || !got.Options.ExpiresAt.Equal(share.Options.ExpiresAt) {
+				t.Errorf("Unexpected options %+v", got.Options)
+			}
+
+			// Expire in a few hours
+			cmd(0, []string{"share", "update"}, "-expires", "4h", shareName)
+			got, err = h.Config.Storage.GetShare(context.Background(), shareName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Until(got.Options.ExpiresAt); d < 3*time.Hour || d > 4*time.Hour || got.Options.Validity != 1 {
+				t.Errorf("Unexpected options %+v", got.Options)
+			}
+			cmd(1, []string{"share", "update"}, "-expires", "soon", shareName)
+
+			// Limit downloads
+			cmd(0, []string{"share", "update"}, "-max-downloads", "3", "-delete-after-download", shareName)
+			got, err = h.Config.Storage.GetShare(context.Background(), shareName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Options.MaxDownloads != 3 || !got.Options.DeleteAfterDownload || got.Options.Exposure != "both" {
+				t.Errorf("Unexpected options %+v", got.Options)
+			}
+			cmd(1, []string{"share", "update"}, "-max-item-downloads", "-1", shareName)
+
+			// Define fields of item metadata
+			cmd(0, []string{"share", "update"}, "-field", "case", "-field", "version", shareName)
+			got, err = h.Config.Storage.GetShare(context.Background(), shareName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []storage.ItemField{{Name: "case"}, {Name: "version"}}; !reflect.DeepEqual(got.Options.Fields, want) {
+				t.Errorf("Expected fields %v, got %v", want, got.Options.Fields)
+			}
+			cmd(1, []string{"share", "update"}, "-required-field", "invalid name", shareName)
+
+			// Upload a file
+			p := path.Join(t.TempDir(), "upload.txt")
+			err = os.WriteFile(p, []byte("hupload"), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cmd(0, []string{"item", "upload"}, shareName, p)
+
+			out = cmd(0, []string{"item", "list"}, "-json", shareName)
+			var items []storage.Item
+			err = json.Unmarshal([]byte(out), &items)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(items) != 1 || items[0].ItemInfo.Size != 7 {
+				t.Errorf("Unexpected items %+v", items)
+			}
+
+			// Download it to stdout
+			out = cmd(0, []string{"item", "download"}, "-o", "-", shareName, "upload.txt")
+			if out != "hupload" {
+				t.Errorf("Expected hupload, got %q", out)
+			}
+
+			// Copy it, then move the copy
+			cmd(0, []string{"item", "cp"}, shareName, "upload.txt", shareName, "copy.txt")
+			cmd(1, []string{"item", "cp"}, shareName, "upload.txt", shareName)
+			cmd(0, []string{"item", "mv"}, shareName, "copy.txt", shareName, "moved.txt")
+			cmd(1, []string{"item", "mv"}, shareName, "copy.txt", shareName, "moved.txt")
+			out = cmd(0, []string{"item", "download"}, "-o", "-", shareName, "moved.txt")
+			if out != "hupload" {
+				t.Errorf("Expected hupload, got %q", out)
+			}
+			cmd(0, []string{"item", "rm"}, shareName, "moved.txt")
+
+			// Shares list
+			out = cmd(0, []string{"share", "list"})
+			if !strings.Contains(out, shareName) {
+				t.Errorf("Expected %s in share list, got %s", shareName, out)
+			}
+
+			// Remove item
+			cmd(0, []string{"item", "rm"}, shareName, "upload.txt")
+			cmd(1, []string{"item", "rm"}, shareName, "upload.txt")
+
+			// Rename the share, the previous name is recorded
+			renamed := shareName + "-renamed"
+			out = cmd(0, []string{"share", "rename"}, "-grace", "1h", shareName, renamed)
+			if strings.TrimSpace(out) != renamed {
+				t.Errorf("Expected %s, got %q", renamed, out)
+			}
+			r, err := h.Config.Storage.GetRenamedShare(context.Background(), shareName)
+			if err != nil || r.Name != renamed || time.Until(r.Until) < 59*time.Minute {
+				t.Errorf("Unexpected rename %+v, %v", r, err)
+			}
+			cmd(1, []string{"share", "rename"}, "-grace", "soon", renamed)
+
+			// Delete share
+			cmd(0, []string{"share", "delete"}, renamed)
+
+			_, err = h.Config.Storage.GetShare(context.Background(), renamed)
+			if !errors.Is(err, storage.ErrShareNotFound) {
+				t.Errorf("Expected share to be deleted, got %v", err)
+			}
+		})
+	}
+
+	t.Run("Remote without API key should fail", func(t *testing.T) {
+		runTestCommand(t, 1, "share", "list", "-url", server.URL)
+	})
+}
+
+func TestPurgeExpiredCommand(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll("tmptest")
+	})
+
+	h := getHupload(t, &config.Config{Path: "handlers_testdata/config-cli.yml"})
+
+	makeShare(t, h, "valid", "admin", storage.Options{Validity: 10})
+	expired := makeShare(t, h, "expired", "admin", storage.Options{Validity: 1})
+	expired.DateCreated = time.Now().AddDate(0, 0, -2)
+	expired.Options.ExpiresAt = expired.DateCreated.AddDate(0, 0, 1)
+	err := storage.SaveShareAtPath(expired, "tmptest/cli/expired")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := runTestCommand(t, 0, "purge-expired", "-config", "handlers_testdata/config-cli.yml", "-dry-run")
+	if out != "share expired would be deleted\n" {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	out = runTestCommand(t, 0, "purge-expired", "-config", "handlers_testdata/config-cli.yml", "-json")
+	if strings.TrimSpace(out) != `[
+  "expired"
+]` {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	shares, err := h.Config.Storage.ListShares(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 1 || shares[0].Name != "valid" {
+		t.Errorf("Expected only valid share to remain, got %+v", shares)
+	}
+}
+
+func TestFsckCommand(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll("tmptest")
+	})
+
+	t.Setenv("HUPLOAD_URL", "")
+	t.Setenv("HUPLOAD_API_KEY", "")
+
+	h := getHupload(t, &config.Config{Path: "handlers_testdata/config-cli.yml"})
+	server := httptest.NewServer(h.API)
+	t.Cleanup(server.Close)
+
+	makeShare(t, h, "checked", "admin", storage.Options{})
+	makeItem(t, h, "checked", "item.bin", 10)
+
+	// Temporary file of an upload interrupted long ago
+	tmp := "tmptest/cli/checked/item.bin.123_huploadtemp"
+	err := os.WriteFile(tmp, []byte("partial"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * time.Hour)
+	err = os.Chtimes(tmp, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	local := []string{"fsck", "-config", "handlers_testdata/config-cli.yml"}
+
+	var report storage.CheckReport
+	out := runTestCommand(t, 1, local...)
+	err = json.Unmarshal([]byte(out), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 1 || report.Problems[0].Kind != storage.ProblemOrphan || report.Problems[0].Path != "checked/item.bin.123_huploadtemp" {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	// Repair through the API of the running instance
+	out = runTestCommand(t, 0, "fsck", "-url", server.URL, "-api-key", "cli-test-key", "--repair")
+	report = storage.CheckReport{}
+	err = json.Unmarshal([]byte(out), &report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Repair || len(report.Problems) != 1 || !report.Problems[0].Repaired {
+		t.Errorf("Unexpected report %+v", report)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("Expected temporary file to be removed, got %v", err)
+	}
+
+	out = runTestCommand(t, 0, local...)
+	if !strings.Contains(out, `"problems": []`) {
+		t.Errorf("Expected no problems, got %s", out)
+	}
+}
+
+func TestTransferCommand(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll("tmptest")
+	})
+
+	h := getHupload(t, &config.Config{Path: "handlers_testdata/config-cli.yml"})
+
+	makeShare(t, h, "transfer", "user", storage.Options{Validity: 10, Description: "moved"})
+	makeItem(t, h, "transfer", "item.bin", 10)
+
+	args := []string{"transfer", "-config", "handlers_testdata/config-cli.yml", "-to", "handlers_testdata/config-transfer.yml"}
+
+	out := runTestCommand(t, 0, append(args, "-dry-run")...)
+	if !strings.Contains(out, "item.bin would be copied") {
+		t.Errorf("Unexpected output %q", out)
+	}
+	if _, err := os.Stat("tmptest/transfer/transfer"); err == nil {
+		t.Errorf("Expected dry run not to create share")
+	}
+
+	out = runTestCommand(t, 0, append(args, "-verify")...)
+	if !strings.Contains(out, "1 shares, 1 items copied") {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	got, err := storage.NewShareAtPath("tmptest/transfer/transfer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Owner != "user" || got.Options.Description != "moved" || got.Size != 10 {
+		t.Errorf("Unexpected share %+v", got)
+	}
+
+	// Running it again skips items already copied
+	out = runTestCommand(t, 0, append(args, "-json")...)
+	if !strings.Contains(out, `"skipped": 1`) {
+		t.Errorf("Unexpected output %q", out)
+	}
+
+	runTestCommand(t, 1, append(args, "missing")...)
+	runTestCommand(t, 2, "transfer", "-config", "handlers_testdata/config-cli.yml")
+}
+
+func TestUsersCommands(t *testing.T) {
+	usersFile := path.Join(t.TempDir(), "users.yml")
+
+	out := runTestCommand(t, 0, "hash-password", "secret")
+	if bcrypt.CompareHashAndPassword([]byte(strings.TrimSpace(out)), []byte("secret")) != nil {
+		t.Errorf("Expected hash of secret, got %s", out)
+	}
+
+	runTestCommand(t, 0, "users", "add", "-file", usersFile, "user1", "secret1")
+	runTestCommand(t, 0, "users", "add", "-file", usersFile, "user2", "secret2")
+	runTestCommand(t, 1, "users", "add", "-file", usersFile, "user1", "secret1")
+
+	var users []user
+	b, err := os.ReadFile(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = yaml.Unmarshal(b, &users)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(users) != 2 || users[1].Username != "user2" {
+		t.Fatalf("Unexpected users %+v", users)
+	}
+	if bcrypt.CompareHashAndPassword([]byte(users[1].Password), []byte("secret2")) != nil {
+		t.Errorf("Expected password hash of secret2")
+	}
+}
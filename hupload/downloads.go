@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+)
+
+// download is a download of items of a share being served
+type download struct {
+	h     *Hupload
+	share string
+	items []string
+
+	// guest is true for downloads by guests, they are subject to download
+	// limits and delete items of shares deleted after download
+	guest bool
+
+	// complete is set once every item has been sent
+	complete bool
+}
+
+// startDownload starts a download of items of share name. Downloads by guests
+// are counted in storage before they are served, so instances sharing the
+// storage can't exceed the download limits of the share, and
+// ErrDownloadLimitReached is returned when they would. finish must be called
+// once the download is over.
+func (h *Hupload) startDownload(ctx context.Context, name string, items []string, guest bool) (*download, error) {
+	if guest {
+		_, err := h.Config.Storage.ReserveDownloads(ctx, name, items)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &download{h: h, share: name, items: items, guest: guest}, nil
+}
+
+// finish counts a complete download. Items of shares deleted after download
+// are deleted when downloaded by a guest, and the whole share once all its
+// items have been downloaded. The download limits reserved by an aborted
+// download are released.
+func (d *download) finish() {
+	// Downloads are counted even if the client is gone after the last byte
+	ctx := context.Background()
+	s := d.h.Config.Storage
+
+	if !d.complete {
+		if d.guest {
+			_, err := s.ReleaseDownloads(ctx, d.share, d.items)
+			if err != nil {
+				slog.Error("finish", slog.String("share", d.share), slog.String("error", err.Error()))
+			}
+		}
+		return
+	}
+
+	share, err := s.AddDownloads(ctx, d.share, d.items)
+	if err != nil {
+		slog.Error("finish", slog.String("share", d.share), slog.String("error", err.Error()))
+		return
+	}
+
+	if !d.guest || !share.Options.DeleteAfterDownload {
+		return
+	}
+
+	for _, i := range d.items {
+		err = s.DeleteItem(ctx, d.share, i)
+		if err != nil {
+			slog.Error("finish", slog.String("share", d.share), slog.String("item", i), slog.String("error", err.Error()))
+			return
+		}
+	}
+
+	share, err = s.GetShare(ctx, d.share)
+	if err != nil {
+		slog.Error("finish", slog.String("share", d.share), slog.String("error", err.Error()))
+		return
+	}
+	if share.Count > 0 {
+		return
+	}
+
+	err = s.DeleteShare(ctx, d.share)
+	if err != nil {
+		slog.Error("finish", slog.String("share", d.share), slog.String("error", err.Error()))
+		return
+	}
+
+	slog.Info("share deleted after download", slog.String("share", d.share))
+}
@@ -19,6 +19,7 @@ require (
 	github.com/aws/smithy-go v1.23.0
 	github.com/minio/minio-go/v7 v7.0.95
 	github.com/ybizeul/apiws v1.0.0
+	golang.org/x/crypto v0.43.0
 )
 
 require (
@@ -52,7 +53,6 @@ require (
 	github.com/pquerna/cachecontrol v0.2.0 // indirect
 	github.com/rs/xid v1.6.0 // indirect
 	github.com/tinylib/msgp v1.4.0 // indirect
-	golang.org/x/crypto v0.43.0 // indirect
 	golang.org/x/net v0.46.0 // indirect
 	golang.org/x/oauth2 v0.32.0 // indirect
 	golang.org/x/sys v0.37.0 // indirect
@@ -3,18 +3,23 @@ package main
 import (
 	"archive/zip"
 	"bufio"
-	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"mime/multipart"
 	"net/http"
 	"path"
+	"slices"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/smithy-go"
 	"github.com/ybizeul/apiws/auth"
+	"github.com/ybizeul/hupload/internal/search"
 	"github.com/ybizeul/hupload/internal/storage"
 )
 
@@ -48,8 +53,11 @@ func (h *Hupload) postShare(w http.ResponseWriter, r *http.Request) {
 		Validity: h.Config.Values.DefaultValidityDays,
 	}
 
-	// We ignore unmarshalling of JSON body as it is optional.
-	_ = json.NewDecoder(r.Body).Decode(&options)
+	err := decodeShareOptions(r, &options)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	share, err := h.Config.Storage.CreateShare(r.Context(), code, user, options)
 	if err != nil {
@@ -66,6 +74,68 @@ func (h *Hupload) postShare(w http.ResponseWriter, r *http.Request) {
 	writeSuccessJSON(w, share)
 }
 
+// decodeShareOptions decodes options from the body of r, which is optional.
+// expires_in sets the expiration date as a duration from now, and windows
+// must not close before they open.
+func decodeShareOptions(r *http.Request, options *storage.Options) error {
+	body := struct {
+		*storage.Options
+		ExpiresIn string `json:"expires_in"`
+	}{Options: options}
+
+	// We ignore unmarshalling of JSON body as it is optional.
+	_ = json.NewDecoder(r.Body).Decode(&body)
+
+	if body.ExpiresIn != "" {
+		t, err := storage.ParseExpiration(body.ExpiresIn, time.Now())
+		if err != nil {
+			return err
+		}
+		options.ExpiresAt = t
+	}
+
+	err := options.ValidateWindows()
+	if err != nil {
+		return err
+	}
+
+	err = options.ValidateFields()
+	if err != nil {
+		return err
+	}
+
+	err = options.ValidateConflict()
+	if err != nil {
+		return err
+	}
+
+	return options.ValidateDownloadLimits()
+}
+
+// writeWindowError writes err returned when the upload or download window of
+// a share is closed to guests, 403 before it opens and 410 once it closed
+func writeWindowError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrUploadNotOpen), errors.Is(err, storage.ErrDownloadNotOpen):
+		writeError(w, http.StatusForbidden, err.Error())
+	default:
+		writeError(w, http.StatusGone, err.Error())
+	}
+}
+
+// writeDownloadError writes the error returned when reserving a download
+func writeDownloadError(w http.ResponseWriter, op string, err error) {
+	switch {
+	case errors.Is(err, storage.ErrDownloadLimitReached):
+		writeError(w, http.StatusGone, err.Error())
+	case errors.Is(err, storage.ErrShareNotFound):
+		writeError(w, http.StatusNotFound, "share not found")
+	default:
+		slog.Error(op, slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
 // patchShare updates an existing share
 func (h *Hupload) patchShare(w http.ResponseWriter, r *http.Request) {
 	user, _ := auth.UserForRequest(r)
@@ -81,8 +151,11 @@ func (h *Hupload) patchShare(w http.ResponseWriter, r *http.Request) {
 	// Parse the request body
 	options := &storage.Options{}
 
-	// We ignore unmarshalling of JSON body as it is optional.
-	_ = json.NewDecoder(r.Body).Decode(&options)
+	err := decodeShareOptions(r, options)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	share, err := h.Config.Storage.GetShare(r.Context(), r.PathValue("share"))
 	if err != nil {
@@ -112,33 +185,163 @@ func (h *Hupload) patchShare(w http.ResponseWriter, r *http.Request) {
 	writeSuccessJSON(w, result)
 }
 
+// renameShare renames a share to the name given in the body, or to a new
+// random code. The previous name keeps working until the end of the grace
+// period given in the body, then requests to it get a 410.
+func (h *Hupload) renameShare(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserForRequest(r)
+
+	// The body is optional
+	body := struct {
+		Name  string `json:"name"`
+		Grace string `json:"grace"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Name == "" {
+		body.Name = generateCode(4, 3)
+	}
+
+	var until time.Time
+	if body.Grace != "" {
+		until, err = storage.ParseExpiration(body.Grace, time.Now())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	share, err := h.Config.Storage.GetShare(r.Context(), r.PathValue("share"))
+	if err != nil {
+		slog.Error("renameShare", slog.String("error", err.Error()))
+		switch {
+		case errors.Is(err, storage.ErrShareNotFound):
+			writeError(w, http.StatusNotFound, "share not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if h.Config.Values.HideOtherShares && share.Owner != user {
+		writeError(w, http.StatusForbidden, "unauthorized")
+		return
+	}
+
+	result, err := h.Config.Storage.RenameShare(r.Context(), share.Name, body.Name, until)
+	if err != nil {
+		slog.Error("renameShare", slog.String("error", err.Error()))
+		switch {
+		case errors.Is(err, storage.ErrInvalidShareName):
+			writeError(w, http.StatusBadRequest, "invalid share name")
+			return
+		case errors.Is(err, storage.ErrShareAlreadyExists):
+			writeError(w, http.StatusConflict, err.Error())
+			return
+		case errors.Is(err, storage.ErrShareNotFound):
+			writeError(w, http.StatusNotFound, "share not found")
+			return
+		case errors.Is(err, storage.ErrRenameIncomplete):
+			// The share is renamed, objects left over are reported by check
+			writeSuccessJSON(w, result)
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeSuccessJSON(w, result)
+}
+
 // postItem copies a new item in the share and returns the json description
 func (h *Hupload) postItem(w http.ResponseWriter, r *http.Request) {
-	share, err := h.Config.Storage.GetShare(r.Context(), r.PathValue("share"))
+	share, err := h.publicShare(w, r)
 	if err != nil {
 		slog.Error("postItem", slog.String("error", err.Error()))
 		switch {
 		case errors.Is(err, storage.ErrShareNotFound):
 			writeError(w, http.StatusNotFound, "share not found")
 			return
+		case errors.Is(err, storage.ErrShareRenamed):
+			writeError(w, http.StatusGone, "share renamed")
+			return
 		}
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	user, _ := auth.UserForRequest(r)
 
-	if user == "" && (share.Options.Exposure != "both" && share.Options.Exposure != "upload") {
+	if user == "" && !share.Options.GuestCanUpload() {
 		writeError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
 
+	if user == "" && !share.IsValid() {
+		writeError(w, http.StatusGone, "Share expired")
+		return
+	}
+
+	if user == "" {
+		err = share.CanUpload(time.Now())
+		if err != nil {
+			writeWindowError(w, err)
+			return
+		}
+	}
+
+	// Guests can't replace items uploaded by others in shares overwriting or
+	// versioning items. Guests of drop-box shares don't learn the names of
+	// items of others, their uploads are renamed instead.
+	name := r.PathValue("item")
+	guest := ""
+	if user == "" {
+		guest = h.receipts.guest(r, share.Name)
+		existing, err := h.Config.Storage.GetItem(r.Context(), share.Name, name)
+		if err == nil && (existing.Metadata == nil || existing.Metadata.Guest != guest) {
+			switch {
+			case share.Options.Exposure == storage.ExposureDropBox:
+				name, err = storage.AvailableItemName(r.Context(), h.Config.Storage, share.Name, name)
+				if err != nil {
+					writeError(w, http.StatusInternalServerError, err.Error())
+					return
+				}
+			case share.Options.Conflict != storage.ConflictReject && share.Options.Conflict != storage.ConflictRename:
+				writeError(w, http.StatusConflict, "item already exists")
+				return
+			}
+		}
+	}
+
 	mp, err := r.MultipartReader()
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	np, err := mp.NextPart()
+	// Metadata is sent in form fields before the file, and validated before
+	// the file is read
+	metadata := storage.ItemMetadata{Owner: user, Guest: guest}
+	var np *multipart.Part
+	for {
+		np, err = mp.NextPart()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if np.FileName() != "" || np.FormName() == "file" {
+			break
+		}
+		err = decodeItemMetadataField(np, &metadata)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	err = share.Options.ValidateItemMetadata(metadata, false)
 	if err != nil {
 		writeError(w, http.StatusBadRequest, err.Error())
 		return
@@ -148,6 +351,7 @@ func (h *Hupload) postItem(w http.ResponseWriter, r *http.Request) {
 
 	if r.Header.Get("FileSize") == "" {
 		writeError(w, http.StatusBadRequest, "missing content length")
+		return
 	}
 
 	cl, err = strconv.Atoi(r.Header.Get("FileSize"))
@@ -157,7 +361,7 @@ func (h *Hupload) postItem(w http.ResponseWriter, r *http.Request) {
 	}
 
 	b := bufio.NewReader(np)
-	item, err := h.Config.Storage.CreateItem(r.Context(), r.PathValue("share"), r.PathValue("item"), int64(cl), b)
+	item, err := h.Config.Storage.CreateItem(r.Context(), r.PathValue("share"), name, int64(cl), b, &metadata)
 	var apiErr smithy.APIError
 	if err != nil {
 		switch {
@@ -167,6 +371,9 @@ func (h *Hupload) postItem(w http.ResponseWriter, r *http.Request) {
 		case errors.Is(err, storage.ErrMaxFileSizeReached):
 			writeError(w, http.StatusInsufficientStorage, "max item size reached")
 			return
+		case errors.Is(err, storage.ErrItemAlreadyExists):
+			writeError(w, http.StatusConflict, "item already exists")
+			return
 		}
 		if errors.As(err, &apiErr) {
 			writeError(w, http.StatusBadRequest, apiErr.ErrorMessage())
@@ -176,29 +383,178 @@ func (h *Hupload) postItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// The item is renamed when the share renames conflicting items
+	name = path.Base(item.Path)
+
+	if guest != "" {
+		h.receipts.add(w, r, share.Name, guest, name)
+		w.Header().Set(uploadTokenHeader, h.receipts.token(share.Name, name, guest))
+	}
+
 	writeSuccessJSON(w, item)
 }
 
-// postItem copies a new item in the share and returns the json description
-func (h *Hupload) deleteItem(w http.ResponseWriter, r *http.Request) {
+// maxFormFieldSize is the maximum size of a form field read from an upload,
+// larger than the maximum size of item metadata values so they can be
+// rejected
+const maxFormFieldSize = 8 << 10
+
+// decodeItemMetadataField sets the value of form field p in m. Uploader
+// information and notes are sent as uploader_name, uploader_email and note,
+// and fields of the share as fields[name].
+func decodeItemMetadataField(p *multipart.Part, m *storage.ItemMetadata) error {
+	// Values that are too long are rejected when the metadata is validated
+	b, err := io.ReadAll(io.LimitReader(p, maxFormFieldSize))
+	if err != nil {
+		return err
+	}
+	v := string(b)
+
+	switch n := p.FormName(); {
+	case n == "uploader_name":
+		m.UploaderName = v
+	case n == "uploader_email":
+		m.UploaderEmail = v
+	case n == "note":
+		m.Note = v
+	case strings.HasPrefix(n, "fields[") && strings.HasSuffix(n, "]"):
+		if m.Fields == nil {
+			m.Fields = map[string]string{}
+		}
+		m.Fields[strings.TrimSuffix(strings.TrimPrefix(n, "fields["), "]")] = v
+	default:
+		return fmt.Errorf("%w: unknown form field %s", storage.ErrInvalidItemMetadata, n)
+	}
+
+	return nil
+}
+
+// patchItem updates the metadata of an item given by its uploader. Values
+// that are not in the request body are kept, and fields set to an empty
+// string are removed.
+func (h *Hupload) patchItem(w http.ResponseWriter, r *http.Request) {
+	user, _ := auth.UserForRequest(r)
+
 	share, err := h.Config.Storage.GetShare(r.Context(), r.PathValue("share"))
+	if err != nil {
+		slog.Error("patchItem", slog.String("error", err.Error()))
+		switch {
+		case errors.Is(err, storage.ErrShareNotFound):
+			writeError(w, http.StatusNotFound, "share not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if h.Config.Values.HideOtherShares && share.Owner != user {
+		writeError(w, http.StatusForbidden, "unauthorized")
+		return
+	}
+
+	item, err := h.Config.Storage.GetItem(r.Context(), share.Name, r.PathValue("item"))
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrItemNotFound):
+			writeError(w, http.StatusNotFound, "item does not exists")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	metadata := storage.ItemMetadata{}
+	if item.Metadata != nil {
+		metadata = *item.Metadata
+	}
+	metadata.Fields = maps.Clone(metadata.Fields)
+	owner, guest := metadata.Owner, metadata.Guest
+
+	err = json.NewDecoder(r.Body).Decode(&metadata)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Uploaders are recorded by the server and can't be changed
+	metadata.Owner, metadata.Guest = owner, guest
+	maps.DeleteFunc(metadata.Fields, func(_, v string) bool { return v == "" })
+
+	err = share.Options.ValidateItemMetadata(metadata, true)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	item, err = h.Config.Storage.SetItemMetadata(r.Context(), share.Name, r.PathValue("item"), metadata)
+	if err != nil {
+		slog.Error("patchItem", slog.String("error", err.Error()))
+		switch {
+		case errors.Is(err, storage.ErrItemNotFound):
+			writeError(w, http.StatusNotFound, "item does not exists")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeSuccessJSON(w, item)
+}
+
+// deleteItem deletes an item of the share. Guests can only delete items they
+// uploaded, with the upload token of the item or their receipt.
+func (h *Hupload) deleteItem(w http.ResponseWriter, r *http.Request) {
+	share, err := h.publicShare(w, r)
 	if err != nil {
 		slog.Error("postItem", slog.String("error", err.Error()))
 		switch {
 		case errors.Is(err, storage.ErrShareNotFound):
 			writeError(w, http.StatusNotFound, "share not found")
 			return
+		case errors.Is(err, storage.ErrShareRenamed):
+			writeError(w, http.StatusGone, "share renamed")
+			return
 		}
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 	user, _ := auth.UserForRequest(r)
 
-	if user == "" && (share.Options.Exposure != "both" && share.Options.Exposure != "upload") {
+	if user == "" && !share.Options.GuestCanDelete() {
 		writeError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
 
+	if user == "" && !share.IsValid() {
+		writeError(w, http.StatusGone, "Share expired")
+		return
+	}
+
+	if user == "" {
+		err = share.CanUpload(time.Now())
+		if err != nil {
+			writeWindowError(w, err)
+			return
+		}
+
+		item, err := h.Config.Storage.GetItem(r.Context(), share.Name, r.PathValue("item"))
+		if err != nil {
+			switch {
+			case errors.Is(err, storage.ErrItemNotFound):
+				writeError(w, http.StatusNotFound, "item does not exists")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		guest := h.receipts.uploader(r, share.Name, r.PathValue("item"))
+		if guest == "" || item.Metadata == nil || item.Metadata.Guest != guest {
+			writeError(w, http.StatusForbidden, "item uploaded by someone else")
+			return
+		}
+	}
+
 	err = h.Config.Storage.DeleteItem(r.Context(), r.PathValue("share"), r.PathValue("item"))
 	if err != nil {
 		switch {
@@ -213,37 +569,308 @@ func (h *Hupload) deleteItem(w http.ResponseWriter, r *http.Request) {
 	writeSuccess(w, "item deleted")
 }
 
-// getShares returns the list of shares as json
-func (h *Hupload) getShares(w http.ResponseWriter, r *http.Request) {
-	shares, err := h.Config.Storage.ListShares(r.Context())
+// versionsShare returns the share of a request on versions of an item, or
+// writes an error and returns nil. Versions are only available to
+// authenticated users.
+func (h *Hupload) versionsShare(w http.ResponseWriter, r *http.Request, op string) *storage.Share {
+	user, _ := auth.UserForRequest(r)
+
+	share, err := h.Config.Storage.GetShare(r.Context(), r.PathValue("share"))
+	if err != nil {
+		slog.Error(op, slog.String("error", err.Error()))
+		switch {
+		case errors.Is(err, storage.ErrShareNotFound):
+			writeError(w, http.StatusNotFound, "share not found")
+			return nil
+		}
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return nil
+	}
+
+	if h.Config.Values.HideOtherShares && share.Owner != user {
+		writeError(w, http.StatusForbidden, "unauthorized")
+		return nil
+	}
+
+	return share
+}
+
+// writeVersionError writes err returned for versions of an item
+func writeVersionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, storage.ErrItemNotFound):
+		writeError(w, http.StatusNotFound, "item does not exists")
+	case errors.Is(err, storage.ErrVersionNotFound):
+		writeError(w, http.StatusNotFound, "version does not exists")
+	default:
+		writeError(w, http.StatusInternalServerError, err.Error())
+	}
+}
 
+// getItemVersions returns the previous versions of an item, oldest first
+func (h *Hupload) getItemVersions(w http.ResponseWriter, r *http.Request) {
+	share := h.versionsShare(w, r, "getItemVersions")
+	if share == nil {
+		return
+	}
+
+	versions, err := h.Config.Storage.ListItemVersions(r.Context(), share.Name, r.PathValue("item"))
 	if err != nil {
-		slog.Error("getShares", slog.String("error", err.Error()))
+		writeVersionError(w, err)
+		return
+	}
+
+	writeSuccessJSON(w, versions)
+}
+
+// getItemVersion returns the content of a version of an item
+func (h *Hupload) getItemVersion(w http.ResponseWriter, r *http.Request) {
+	share := h.versionsShare(w, r, "getItemVersion")
+	if share == nil {
+		return
+	}
+
+	v, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid version")
+		return
+	}
+
+	versions, err := h.Config.Storage.ListItemVersions(r.Context(), share.Name, r.PathValue("item"))
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+	i := slices.IndexFunc(versions, func(version storage.ItemVersion) bool { return version.Version == v })
+	if i < 0 {
+		writeVersionError(w, storage.ErrVersionNotFound)
+		return
+	}
+
+	reader, err := h.Config.Storage.GetItemVersionData(r.Context(), share.Name, r.PathValue("item"), v)
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+	defer reader.Close()
+
+	w.Header().Add("Content-Type", "application/octet-stream")
+	w.Header().Add("Content-Length", fmt.Sprintf("%d", versions[i].ItemInfo.Size))
+	w.Header().Add("Content-Disposition", "attachment")
+
+	_, err = io.Copy(w, reader)
+	if err != nil {
+		slog.Error("getItemVersion", slog.String("error", err.Error()))
+	}
+}
+
+// deleteItemVersion deletes a version of an item
+func (h *Hupload) deleteItemVersion(w http.ResponseWriter, r *http.Request) {
+	share := h.versionsShare(w, r, "deleteItemVersion")
+	if share == nil {
+		return
+	}
+
+	v, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid version")
+		return
+	}
+
+	err = h.Config.Storage.DeleteItemVersion(r.Context(), share.Name, r.PathValue("item"), v)
+	if err != nil {
+		writeVersionError(w, err)
+		return
+	}
+
+	writeSuccess(w, "version deleted")
+}
+
+// copyItem copies an item to the share given in the body, with an optional
+// new name
+func (h *Hupload) copyItem(w http.ResponseWriter, r *http.Request) {
+	h.copyOrMoveItem(w, r, false)
+}
+
+// moveItem moves an item to the share given in the body, with an optional
+// new name. The item and its metadata are moved, its versions are deleted.
+func (h *Hupload) moveItem(w http.ResponseWriter, r *http.Request) {
+	h.copyOrMoveItem(w, r, true)
+}
+
+func (h *Hupload) copyOrMoveItem(w http.ResponseWriter, r *http.Request, move bool) {
+	op := "copyItem"
+	if move {
+		op = "moveItem"
+	}
+
+	user, _ := auth.UserForRequest(r)
+
+	body := struct {
+		Share string `json:"share"`
+		Name  string `json:"name"`
+	}{}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if body.Share == "" {
+		writeError(w, http.StatusBadRequest, "destination share is required")
+		return
+	}
+	if body.Name == "" {
+		body.Name = r.PathValue("item")
+	}
+
+	// Users must be able to see both shares
+	for _, name := range []string{r.PathValue("share"), body.Share} {
+		share, err := h.Config.Storage.GetShare(r.Context(), name)
+		if err != nil {
+			slog.Error(op, slog.String("error", err.Error()))
+			switch {
+			case errors.Is(err, storage.ErrShareNotFound):
+				writeError(w, http.StatusNotFound, "share not found")
+				return
+			case errors.Is(err, storage.ErrInvalidShareName):
+				writeError(w, http.StatusBadRequest, "invalid share name")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		if h.Config.Values.HideOtherShares && share.Owner != user {
+			writeError(w, http.StatusForbidden, "unauthorized")
+			return
+		}
+	}
+
+	copyOrMove := h.Config.Storage.CopyItem
+	if move {
+		copyOrMove = h.Config.Storage.MoveItem
+	}
+
+	item, err := copyOrMove(r.Context(), r.PathValue("share"), r.PathValue("item"), body.Share, body.Name)
+	if err != nil {
+		slog.Error(op, slog.String("error", err.Error()))
+		switch {
+		case errors.Is(err, storage.ErrItemNotFound):
+			writeError(w, http.StatusNotFound, "item does not exists")
+			return
+		case errors.Is(err, storage.ErrShareNotFound):
+			writeError(w, http.StatusNotFound, "share not found")
+			return
+		case errors.Is(err, storage.ErrInvalidItemName):
+			writeError(w, http.StatusBadRequest, "invalid item name")
+			return
+		case errors.Is(err, storage.ErrItemAlreadyExists):
+			writeError(w, http.StatusConflict, "item already exists")
+			return
+		case errors.Is(err, storage.ErrMaxShareSizeReached):
+			writeError(w, http.StatusInsufficientStorage, "max share size reached")
+			return
+		case errors.Is(err, storage.ErrMaxFileSizeReached):
+			writeError(w, http.StatusInsufficientStorage, "max item size reached")
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+
+	writeSuccessJSON(w, item)
+}
+
+// getShares returns the list of shares as json, filtered, sorted and
+// paginated with query parameters
+func (h *Hupload) getShares(w http.ResponseWriter, r *http.Request) {
+	q, err := shareQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
 	user, _ := auth.UserForRequest(r)
 
 	if h.Config.Values.HideOtherShares {
-		tmpShares := make([]storage.Share, 0, len(shares))
-		for s := range shares {
-			if shares[s].Owner == user {
-				tmpShares = append(tmpShares, shares[s])
-			}
+		q.Owner = user
+	}
+
+	page, err := h.Config.Storage.QueryShares(r.Context(), *q)
+	if err != nil {
+		slog.Error("getShares", slog.String("error", err.Error()))
+		if errors.Is(err, storage.ErrInvalidQuery) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
 		}
-		shares = tmpShares
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
+	setPageHeaders(w, page.Total, page.Next)
+
 	if user == "" {
-		writeSuccessJSON(w, storage.PublicShares(shares))
+		writeSuccessJSON(w, storage.PublicShares(page.Shares))
 	} else {
-		writeSuccessJSON(w, shares)
+		writeSuccessJSON(w, page.Shares)
+	}
+}
+
+// getSearch returns shares and items matching the q parameter, best matches
+// first
+func (h *Hupload) getSearch(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+
+	limit, err := queryInt(v, "limit")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, _ := auth.UserForRequest(r)
+
+	var visible func(string) bool
+	if h.Config.Values.HideOtherShares {
+		visible = func(owner string) bool { return owner == user }
+	}
+
+	results := h.Search.Search(v.Get("q"), visible)
+
+	page, next, err := search.Page(results, limit, v.Get("cursor"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	setPageHeaders(w, len(results), next)
+
+	writeSuccessJSON(w, page)
+}
+
+// getCheck reports inconsistencies between shares metadata and their content
+func (h *Hupload) getCheck(w http.ResponseWriter, r *http.Request) {
+	h.check(w, r, false)
+}
+
+// postCheck repairs inconsistencies between shares metadata and their content
+func (h *Hupload) postCheck(w http.ResponseWriter, r *http.Request) {
+	h.check(w, r, true)
+}
+
+func (h *Hupload) check(w http.ResponseWriter, r *http.Request, repair bool) {
+	report, err := h.Config.Storage.Check(r.Context(), repair)
+	if err != nil {
+		slog.Error("check", slog.String("error", err.Error()))
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
+
+	writeSuccessJSON(w, report)
 }
 
 // getShareItems returns the share identified by the request parameter
 func (h *Hupload) getShare(w http.ResponseWriter, r *http.Request) {
-	share, err := h.Config.Storage.GetShare(r.Context(), r.PathValue("share"))
+	share, err := h.publicShare(w, r)
 
 	if err != nil {
 		slog.Error("getShare", slog.String("error", err.Error()))
@@ -251,6 +878,9 @@ func (h *Hupload) getShare(w http.ResponseWriter, r *http.Request) {
 		case errors.Is(err, storage.ErrShareNotFound):
 			writeError(w, http.StatusNotFound, "share not found")
 			return
+		case errors.Is(err, storage.ErrShareRenamed):
+			writeError(w, http.StatusGone, "share renamed")
+			return
 		}
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -263,24 +893,30 @@ func (h *Hupload) getShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	share.Downloads = map[string]int64{}
-
+	// Guests get remaining downloads but not the downloads of each item
 	if user == "" {
 		writeSuccessJSON(w, share.PublicShare())
-	} else {
-		writeSuccessJSON(w, share)
+		return
 	}
+
+	share.Downloads = map[string]int64{}
+	share.GuestDownloads = map[string]int64{}
+
+	writeSuccessJSON(w, share)
 }
 
 // getShareItems returns the share content identified by the request parameter
 func (h *Hupload) getShareItems(w http.ResponseWriter, r *http.Request) {
-	share, err := h.Config.Storage.GetShare(r.Context(), r.PathValue("share"))
+	share, err := h.publicShare(w, r)
 	if err != nil {
 		slog.Error("getShareItems", slog.String("error", err.Error()))
 		switch {
 		case errors.Is(err, storage.ErrShareNotFound):
 			writeError(w, http.StatusNotFound, "share not found")
 			return
+		case errors.Is(err, storage.ErrShareRenamed):
+			writeError(w, http.StatusGone, "share renamed")
+			return
 		}
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -292,19 +928,47 @@ func (h *Hupload) getShareItems(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	content, err := h.Config.Storage.ListShare(r.Context(), share.Name)
+	q, err := itemQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Guests of drop-box shares only see the items of their receipt
+	if user == "" && !share.Options.GuestCanList() {
+		if share.Options.Exposure != storage.ExposureDropBox {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		q.Names = h.receipts.items(r, share.Name)
+	}
+
+	page, err := h.Config.Storage.QueryItems(r.Context(), share.Name, *q)
 	if err != nil {
 		slog.Error("getShareItems", slog.String("error", err.Error()))
+		if errors.Is(err, storage.ErrInvalidQuery) {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	content := page.Items
+
+	// Guests only see the metadata of items they uploaded
 	if user == "" {
+		guest := h.receipts.receipt(r, share.Name).Guest
 		for i := range content {
 			content[i].Downloads = 0
+			if guest == "" || content[i].Metadata == nil || content[i].Metadata.Guest != guest {
+				content[i].Metadata = nil
+			}
 		}
 	}
 
+	setPageHeaders(w, page.Total, page.Next)
+
 	writeSuccessJSON(w, content)
 }
 
@@ -326,28 +990,52 @@ func (h *Hupload) deleteShare(w http.ResponseWriter, r *http.Request) {
 
 // getItem returns the item identified by the request parameter
 func (h *Hupload) getItem(w http.ResponseWriter, r *http.Request) {
-	shareName := r.PathValue("share")
 	itemName := r.PathValue("item")
 
-	share, err := h.Config.Storage.GetShare(r.Context(), shareName)
+	share, err := h.publicShare(w, r)
 	if err != nil {
 		slog.Error("getItem", slog.String("error", err.Error()))
 		switch {
 		case errors.Is(err, storage.ErrShareNotFound):
 			writeError(w, http.StatusNotFound, "share not found")
 			return
+		case errors.Is(err, storage.ErrShareRenamed):
+			writeError(w, http.StatusGone, "share renamed")
+			return
 		}
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	shareName := share.Name
+
 	user, _ := auth.UserForRequest(r)
 
-	if user == "" && (share.Options.Exposure != "both" && share.Options.Exposure != "download") {
+	if user == "" && !share.Options.GuestCanDownload() {
 		writeError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
 
+	if user == "" && !share.IsValid() {
+		writeError(w, http.StatusGone, "Share expired")
+		return
+	}
+
+	if user == "" {
+		err = share.CanDownload(time.Now())
+		if err != nil {
+			writeWindowError(w, err)
+			return
+		}
+	}
+
+	download, err := h.startDownload(r.Context(), shareName, []string{itemName}, user == "")
+	if err != nil {
+		writeDownloadError(w, "getItem", err)
+		return
+	}
+	defer download.finish()
+
 	item, err := h.Config.Storage.GetItem(r.Context(), shareName, itemName)
 	if err != nil {
 		switch {
@@ -372,45 +1060,62 @@ func (h *Hupload) getItem(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Length", fmt.Sprintf("%d", item.ItemInfo.Size))
 	w.Header().Add("Content-Disposition", "attachment")
 
-	_, err = io.Copy(w, reader)
+	n, err := io.Copy(w, reader)
 	if err != nil {
 		slog.Error("getItem", slog.String("error", err.Error()))
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Update downloads count
-	share.Downloads[itemName]++
-	_, err = h.Config.Storage.UpdateShare(context.Background(), shareName, nil, &share.Downloads)
-	if err != nil {
-		slog.Error("getItem", slog.String("error", err.Error()))
+	// Aborted downloads are not counted
+	if n != item.ItemInfo.Size {
+		slog.Error("getItem", slog.String("error", "incomplete download"), slog.Int64("size", n))
 		return
 	}
+
+	download.complete = true
 }
 
 // getVersion returns hupload version
 func (h *Hupload) downloadShare(w http.ResponseWriter, r *http.Request) {
-	shareName := r.PathValue("share")
 
-	share, err := h.Config.Storage.GetShare(r.Context(), shareName)
+	share, err := h.publicShare(w, r)
 	if err != nil {
 		slog.Error("getItem", slog.String("error", err.Error()))
 		switch {
 		case errors.Is(err, storage.ErrShareNotFound):
 			writeError(w, http.StatusNotFound, "share not found")
 			return
+		case errors.Is(err, storage.ErrShareRenamed):
+			writeError(w, http.StatusGone, "share renamed")
+			return
 		}
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	shareName := share.Name
+
 	user, _ := auth.UserForRequest(r)
 
-	if user == "" && (share.Options.Exposure != "both" && share.Options.Exposure != "download") {
+	if user == "" && !share.Options.GuestCanDownload() {
 		writeError(w, http.StatusUnauthorized, "unauthorized")
 		return
 	}
 
+	if user == "" && !share.IsValid() {
+		writeError(w, http.StatusGone, "Share expired")
+		return
+	}
+
+	if user == "" {
+		err = share.CanDownload(time.Now())
+		if err != nil {
+			writeWindowError(w, err)
+			return
+		}
+	}
+
 	items, err := h.Config.Storage.ListShare(r.Context(), shareName)
 	if err != nil {
 		slog.Error("downloadShare", slog.String("error", err.Error()))
@@ -418,31 +1123,49 @@ func (h *Hupload) downloadShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = path.Base(item.Path)
+	}
+
+	download, err := h.startDownload(r.Context(), shareName, names, user == "")
+	if err != nil {
+		writeDownloadError(w, "downloadShare", err)
+		return
+	}
+	defer download.finish()
+
 	w.Header().Add("Content-Type", "application/zip")
 	w.Header().Add("Content-Disposition", "attachment")
 
 	zipWriter := zip.NewWriter(w)
 
-	for _, item := range items {
-		f, err := zipWriter.Create(path.Base(item.Path))
+	for i, item := range items {
+		f, err := zipWriter.Create(names[i])
 		if err != nil {
 			slog.Error("downloadShare", slog.String("error", err.Error()))
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
-		d, err := h.Config.Storage.GetItemData(r.Context(), shareName, path.Base(item.Path))
+		d, err := h.Config.Storage.GetItemData(r.Context(), shareName, names[i])
 		if err != nil {
 			slog.Error("downloadShare", slog.String("error", err.Error()))
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
 		defer d.Close()
-		_, err = io.Copy(f, d)
+		n, err := io.Copy(f, d)
 		if err != nil {
 			slog.Error("downloadShare", slog.String("error", err.Error()))
 			writeError(w, http.StatusInternalServerError, err.Error())
 			return
 		}
+
+		// Aborted downloads are not counted
+		if n != item.ItemInfo.Size {
+			slog.Error("downloadShare", slog.String("error", "incomplete download"), slog.String("item", item.Path))
+			return
+		}
 	}
 	err = zipWriter.Close()
 	if err != nil {
@@ -451,16 +1174,7 @@ func (h *Hupload) downloadShare(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Update downloads count
-	for _, item := range items {
-		share.Downloads[path.Base(item.Path)]++
-	}
-
-	_, err = h.Config.Storage.UpdateShare(context.Background(), shareName, nil, &share.Downloads)
-	if err != nil {
-		slog.Error("getItem", slog.String("error", err.Error()))
-		return
-	}
+	download.complete = true
 }
 
 // // postLogin returns the user name for the current session
@@ -487,6 +1201,32 @@ func (h *Hupload) getMessages(w http.ResponseWriter, r *http.Request) {
 	writeSuccessJSON(w, titles)
 }
 
+// getForms returns the titles of form templates
+func (h *Hupload) getForms(w http.ResponseWriter, r *http.Request) {
+	titles := []string{}
+
+	for _, f := range h.Config.Values.FormTemplates {
+		titles = append(titles, f.Title)
+	}
+
+	writeSuccessJSON(w, titles)
+}
+
+// getForm returns the form template at index, starting at 1
+func (h *Hupload) getForm(w http.ResponseWriter, r *http.Request) {
+	index, err := strconv.Atoi(r.PathValue("index"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, ErrMessageInvalidIndex.Error())
+		return
+	}
+	t := h.Config.Values.FormTemplates
+	if index > len(t) || index <= 0 {
+		writeError(w, http.StatusBadRequest, ErrMessageIndexOutOfBounds.Error())
+		return
+	}
+	writeSuccessJSON(w, t[index-1])
+}
+
 func (h *Hupload) getDefaults(w http.ResponseWriter, r *http.Request) {
 	defaults := struct {
 		Validity int    `json:"validity"`
@@ -5,7 +5,9 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"mime/multipart"
@@ -15,6 +17,7 @@ import (
 	"os"
 	"path"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -31,6 +34,13 @@ var cfgs map[string]struct {
 	Enabled bool
 	Cleanup func(h *Hupload)
 }{
+	"memory": {
+		Config: &config.Config{
+			Path: "handlers_testdata/config-memory.yml",
+		},
+		Enabled: true,
+		Cleanup: func(h *Hupload) {},
+	},
 	"file": {
 		Config: &config.Config{
 			Path: "handlers_testdata/config.yml",
@@ -75,12 +85,96 @@ func makeShare(t *testing.T, h *Hupload, name string, owner string, params stora
 
 // makeItem creates a new item with the given name and size.
 func makeItem(t *testing.T, h *Hupload, shareName, fileName string, size int) {
-	_, err := h.Config.Storage.CreateItem(context.Background(), shareName, fileName, int64(size), bufio.NewReader(io.LimitReader(rand.Reader, int64(size))))
+	_, err := h.Config.Storage.CreateItem(context.Background(), shareName, fileName, int64(size), bufio.NewReader(io.LimitReader(rand.Reader, int64(size))), nil)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
+// forEachBackend runs test with a Hupload instance for each enabled backend
+func forEachBackend(t *testing.T, test func(t *testing.T, h *Hupload)) {
+	for name, cfg := range cfgs {
+		if !cfg.Enabled {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			h := getHupload(t, cfg.Config)
+			t.Cleanup(func() { cfg.Cleanup(h) })
+			test(t, h)
+		})
+	}
+}
+
+// serveRequest sends req to the API of h with cookies, authenticated as admin
+// if admin is true, and returns the response.
+func serveRequest(h *Hupload, req *http.Request, admin bool, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	if admin {
+		req.SetBasicAuth("admin", "hupload")
+	}
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	w := httptest.NewRecorder()
+	h.API.ServeHTTP(w, req)
+	return w
+}
+
+// serve sends a request with body to the API of h, see serveRequest.
+func serve(h *Hupload, method, target, body string, admin bool, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	return serveRequest(h, httptest.NewRequest(method, target, strings.NewReader(body)), admin, cookies...)
+}
+
+// uploadRequest returns a request uploading an item of 10 bytes to target.
+func uploadRequest(target string) *http.Request {
+	pr, ct := multipartWriter(10)
+	req := httptest.NewRequest("POST", target, pr)
+	req.Header.Set("Content-Type", ct)
+	req.Header.Set("FileSize", "10")
+	return req
+}
+
+// guestStatus returns the status of a request of a guest to target, POST
+// requests upload an item of 10 bytes.
+func guestStatus(h *Hupload, method, target string) int {
+	req := httptest.NewRequest(method, target, nil)
+	if method == "POST" {
+		req = uploadRequest(target)
+	}
+	return serveRequest(h, req, false).Code
+}
+
+// guestDelete deletes an item as a guest with cookies and an upload token if
+// token is not empty, and returns the response.
+func guestDelete(h *Hupload, shareName, fileName, token string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("DELETE", path.Join("/api/v1/shares", shareName, "items", url.PathEscape(fileName)), nil)
+	if token != "" {
+		req.Header.Set(uploadTokenHeader, token)
+	}
+	return serveRequest(h, req, false, cookies...)
+}
+
+// receiptCookies returns the receipt cookie set by the response w, if any.
+func receiptCookies(w *httptest.ResponseRecorder) []*http.Cookie {
+	result := []*http.Cookie{}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == receiptCookie {
+			result = append(result, c)
+		}
+	}
+	return result
+}
+
+// guestUpload uploads an item of 10 bytes as a guest with cookies and returns
+// the response.
+func guestUpload(t *testing.T, h *Hupload, shareName, fileName string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+	t.Helper()
+	w := serveRequest(h, uploadRequest(path.Join("/api/v1/shares", shareName, "items", fileName)), false, cookies...)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Upload: expected status %d, got %d", http.StatusOK, w.Code)
+	}
+	return w
+}
+
 func mustUnmarshalJSON(t *testing.T, s string) map[string]any {
 	t.Helper()
 	var m map[string]any
@@ -339,6 +433,12 @@ func TestUpdateShare(t *testing.T) {
 					_ = json.NewDecoder(w.Body).Decode(&got)
 					_ = json.NewDecoder(bytes.NewBufferString(payload)).Decode(&want)
 
+					// The expiration date is set from validity
+					if _, ok := got["expires_at"]; !ok {
+						t.Errorf("Expected expiration date in %v", got)
+					}
+					delete(got, "expires_at")
+
 					if !reflect.DeepEqual(got, want) {
 						t.Errorf("Want %v, got %v", want, got)
 					}
@@ -546,7 +646,7 @@ func TestGetShare(t *testing.T) {
 						{
 							ShareName: "test",
 							Want: `{
-								"version":1,
+								"version":2,
 								"name":"test",
 								"owner":"admin",
 								"options":{
@@ -561,7 +661,7 @@ func TestGetShare(t *testing.T) {
 						{
 							ShareName: "test3",
 							Want: `{
-								"version":1,
+								"version":2,
 								"name":"test3",
 								"owner":"admin2",
 								"options":{
@@ -592,6 +692,13 @@ func TestGetShare(t *testing.T) {
 
 						delete(share, "created")
 
+						// Expiration depends on creation date
+						options, _ := share["options"].(map[string]any)
+						if _, ok := options["expires_at"]; !ok {
+							t.Errorf("Expected expiration date in %v", options)
+						}
+						delete(options, "expires_at")
+
 						want := mustUnmarshalJSON(t, tt.Want)
 
 						if !reflect.DeepEqual(share, want) {
@@ -620,6 +727,13 @@ func TestGetShare(t *testing.T) {
 
 					_ = json.NewDecoder(w.Body).Decode(&share)
 
+					// Guests see when the share expires
+					options, _ := share["options"].(map[string]any)
+					if _, ok := options["expires_at"]; !ok {
+						t.Errorf("Expected expiration date in %v", options)
+					}
+					delete(options, "expires_at")
+
 					want := mustUnmarshalJSON(t, `
 					{
 						"name":"test",
@@ -852,177 +966,857 @@ func TestGetShare(t *testing.T) {
 	}
 }
 
-func TestDownloadShare(t *testing.T) {
-	for name, cfg := range cfgs {
-		if !cfg.Enabled {
-			continue
-		}
+func TestShareExpiration(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "expiring")
+		})
 
-		shareName := "downloadshare"
+		t.Run("Create share expiring in a few hours should succeed", func(t *testing.T) {
+			w := serve(h, "POST", "/api/v1/shares/expiring", `{"exposure":"upload","expires_in":"4h"}`, true)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
 
-		h := getHupload(t, cfg.Config)
+			share := storage.Share{}
+			_ = json.NewDecoder(w.Body).Decode(&share)
+			if d := time.Until(share.Options.ExpiresAt); d < 3*time.Hour || d > 4*time.Hour || share.Options.Validity != 1 {
+				t.Errorf("Unexpected options %+v", share.Options)
+			}
+		})
 
-		makeShare(t, h, shareName, "admin", storage.Options{Exposure: "download"})
+		t.Run("Guests should see the expiration date", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/shares/expiring", "", false)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
 
-		t.Cleanup(func() {
-			_ = h.Config.Storage.DeleteShare(context.Background(), shareName)
-			cfg.Cleanup(h)
+			share := storage.PublicShare{}
+			_ = json.NewDecoder(w.Body).Decode(&share)
+			if share.Options.ExpiresAt.IsZero() {
+				t.Errorf("Expected expiration date, got %+v", share.Options)
+			}
 		})
 
-		makeItem(t, h, shareName, "newfile1.txt", 1*1024*1024)
-		makeItem(t, h, shareName, "newfile2.txt", 1*1024*1024)
-
-		t.Run(name, func(t *testing.T) {
-			api := h.API
+		t.Run("Invalid duration should fail", func(t *testing.T) {
+			w := serve(h, "PATCH", "/api/v1/shares/expiring", `{"exposure":"upload","expires_in":"soon"}`, true)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
 
-			req := httptest.NewRequest("GET", path.Join("/d/", shareName), nil)
+		t.Run("Share past its expiration date should be gone for guests", func(t *testing.T) {
+			makeItem(t, h, "expiring", "item.txt", 10)
 
-			w := httptest.NewRecorder()
+			expires := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+			w := serve(h, "PATCH", "/api/v1/shares/expiring", `{"exposure":"both","expires_at":"`+expires+`"}`, true)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
 
-			api.ServeHTTP(w, req)
+			tests := []struct {
+				method string
+				target string
+			}{
+				{"GET", "/api/v1/shares/expiring"},
+				{"GET", "/api/v1/shares/expiring/items"},
+				{"POST", "/api/v1/shares/expiring/items/new.txt"},
+				{"DELETE", "/api/v1/shares/expiring/items/item.txt"},
+				{"GET", "/api/v1/shares/expiring/items/item.txt"},
+				{"GET", "/d/expiring"},
+				{"GET", "/d/expiring/item.txt"},
+			}
+			for _, test := range tests {
+				if got := guestStatus(h, test.method, test.target); got != http.StatusGone {
+					t.Errorf("%s %s: expected status %d, got %d", test.method, test.target, http.StatusGone, got)
+				}
+			}
 
-			if w.Code != http.StatusOK {
-				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
-				return
+			// Owners can still download items
+			if w := serve(h, "GET", "/d/expiring/item.txt", "", true); w.Code != http.StatusOK {
+				t.Errorf("Owner: expected status %d, got %d", http.StatusOK, w.Code)
 			}
 		})
+	})
+}
 
-		t.Run(name+" mass download counter updated", func(t *testing.T) {
-			storage := h.Config.Storage
-			items, err := storage.ListShare(context.Background(), shareName)
+func TestShareWindows(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		past, future := time.Now().Add(-time.Hour), time.Now().Add(time.Hour)
+
+		// Uploads have closed, downloads are not open yet
+		makeShare(t, h, "windows", "admin", storage.Options{
+			Exposure:        "both",
+			UploadClosesAt:  past,
+			DownloadOpensAt: future,
+		})
+		makeItem(t, h, "windows", "item.txt", 10)
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "windows")
+		})
+
+		update := func(t *testing.T, o storage.Options) {
+			_, err := h.Config.Storage.UpdateShare(context.Background(), "windows", &o, nil)
 			if err != nil {
 				t.Fatal(err)
 			}
-			for _, item := range items {
-				// Check if the mass download counter was updated
-				if item.Downloads != 1 {
-					t.Errorf("Expected mass download counter to be updated, got %d", item.Downloads)
+		}
+
+		tests := []struct {
+			name   string
+			method string
+			target string
+			want   int
+		}{
+			{"Upload after upload closes should be gone", "POST", "/api/v1/shares/windows/items/new.txt", http.StatusGone},
+			{"Delete after upload closes should be gone", "DELETE", "/api/v1/shares/windows/items/item.txt", http.StatusGone},
+			{"Download before download opens should be forbidden", "GET", "/api/v1/shares/windows/items/item.txt", http.StatusForbidden},
+			{"Zip download before download opens should be forbidden", "GET", "/d/windows", http.StatusForbidden},
+		}
+		for _, test := range tests {
+			t.Run(test.name, func(t *testing.T) {
+				if got := guestStatus(h, test.method, test.target); got != test.want {
+					t.Errorf("Expected status %d, got %d", test.want, got)
 				}
+			})
+		}
+
+		t.Run("Windows don't apply to authenticated users", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/shares/windows/items/item.txt", "", true)
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
 			}
 		})
-	}
-}
 
-func TestDeleteShare(t *testing.T) {
-	for name, cfg := range cfgs {
-		if !cfg.Enabled {
-			continue
-		}
-		t.Run(name, func(t *testing.T) {
-			h := getHupload(t, cfg.Config)
-			t.Cleanup(func() { cfg.Cleanup(h) })
-			api := h.API
+		t.Run("Guests should see windows", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/shares/windows", "", false)
 
-			t.Run("delete share should work", func(t *testing.T) {
-				var (
-					req *http.Request
-					w   *httptest.ResponseRecorder
-				)
+			share := storage.PublicShare{}
+			_ = json.NewDecoder(w.Body).Decode(&share)
+			if share.Options.UploadClosesAt.IsZero() || share.Options.DownloadOpensAt.IsZero() {
+				t.Errorf("Expected windows, got %+v", share.Options)
+			}
+		})
 
-				shareName := "deleteshare"
-				makeShare(t, h, shareName, "admin", storage.Options{Exposure: "download"})
-				t.Cleanup(func() {
-					_ = h.Config.Storage.DeleteShare(context.Background(), shareName)
-				})
-				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares/", shareName), nil)
-				req.SetBasicAuth("admin", "hupload")
-				w = httptest.NewRecorder()
+		t.Run("Upload before upload opens should be forbidden", func(t *testing.T) {
+			update(t, storage.Options{Exposure: "both", UploadOpensAt: future})
+			if got := guestStatus(h, "POST", "/api/v1/shares/windows/items/new.txt"); got != http.StatusForbidden {
+				t.Errorf("Expected status %d, got %d", http.StatusForbidden, got)
+			}
+		})
 
-				api.ServeHTTP(w, req)
+		t.Run("Download after download closes should be gone", func(t *testing.T) {
+			update(t, storage.Options{Exposure: "both", DownloadOpensAt: past.Add(-time.Hour), DownloadClosesAt: past})
+			if got := guestStatus(h, "GET", "/d/windows/item.txt"); got != http.StatusGone {
+				t.Errorf("Expected status %d, got %d", http.StatusGone, got)
+			}
+		})
 
-				if w.Code != http.StatusOK {
-					t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
-					return
-				}
+		t.Run("Open windows should allow guests", func(t *testing.T) {
+			update(t, storage.Options{Exposure: "both", UploadOpensAt: past, UploadClosesAt: future, DownloadClosesAt: future})
+			if got := guestStatus(h, "POST", "/api/v1/shares/windows/items/new.txt"); got != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, got)
+			}
+			if got := guestStatus(h, "GET", "/api/v1/shares/windows/items/new.txt"); got != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, got)
+			}
+		})
 
-			})
+		t.Run("Window closing before it opens should fail", func(t *testing.T) {
+			payload := fmt.Sprintf(`{"exposure":"both","upload_opens_at":%q,"upload_closes_at":%q}`, future.Format(time.RFC3339), past.Format(time.RFC3339))
+			w := serve(h, "PATCH", "/api/v1/shares/windows", payload, true)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	})
+}
 
-			t.Run("delete share unauthentication shouldn't work", func(t *testing.T) {
-				var (
-					req *http.Request
-					w   *httptest.ResponseRecorder
-				)
+// failingWriter is a ResponseWriter failing after the first write, like a
+// client that goes away during a download
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	written bool
+}
 
-				shareName := "deleteshare"
-				makeShare(t, h, shareName, "admin", storage.Options{Exposure: "download"})
+func (w *failingWriter) Write(b []byte) (int, error) {
+	if w.written {
+		return 0, io.ErrClosedPipe
+	}
+	w.written = true
+	return w.ResponseRecorder.Write(b[:len(b)/2])
+}
 
-				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares/", shareName), nil)
-				w = httptest.NewRecorder()
+func TestDownloadLimits(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		getShare := func(t *testing.T, name string) *storage.Share {
+			share, err := h.Config.Storage.GetShare(context.Background(), name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return share
+		}
 
-				api.ServeHTTP(w, req)
+		makeShare(t, h, "limits", "admin", storage.Options{Exposure: "download", MaxDownloads: 2, MaxItemDownloads: 1})
+		makeItem(t, h, "limits", "item1.txt", 1024)
+		makeItem(t, h, "limits", "item2.txt", 1024)
+		makeItem(t, h, "limits", "item3.txt", 1024)
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "limits")
+		})
 
-				if w.Code != http.StatusUnauthorized {
-					t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
-					return
-				}
-				t.Cleanup(func() {
-					_ = h.Config.Storage.DeleteShare(context.Background(), "deleteshare")
-				})
-			})
+		t.Run("Aborted downloads should not be counted", func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/api/v1/shares/limits/items/item1.txt", nil)
+			w := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+			h.API.ServeHTTP(w, req)
 
-			t.Run("delete share invalid share name shouldn't work", func(t *testing.T) {
-				var (
-					req *http.Request
-					w   *httptest.ResponseRecorder
-				)
+			share := getShare(t, "limits")
+			if d, g := share.Downloads["item1.txt"], share.GuestDownloads["item1.txt"]; d != 0 || g != 0 {
+				t.Errorf("Expected no download, got %d and %d by guests", d, g)
+			}
+		})
 
-				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares/", url.QueryEscape("../bogus")), nil)
-				req.SetBasicAuth("admin", "hupload")
+		t.Run("Item limit should be enforced", func(t *testing.T) {
+			if got := serve(h, "GET", "/api/v1/shares/limits/items/item1.txt", "", false).Code; got != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, got)
+			}
+			if got := serve(h, "GET", "/api/v1/shares/limits/items/item1.txt", "", false).Code; got != http.StatusGone {
+				t.Errorf("Expected status %d, got %d", http.StatusGone, got)
+			}
+		})
 
-				w = httptest.NewRecorder()
+		t.Run("Limits don't apply to authenticated users", func(t *testing.T) {
+			if got := serve(h, "GET", "/api/v1/shares/limits/items/item1.txt", "", true).Code; got != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, got)
+			}
+			share := getShare(t, "limits")
+			if d, g := share.Downloads["item1.txt"], share.GuestDownloads["item1.txt"]; d != 2 || g != 1 {
+				t.Errorf("Expected 2 downloads with 1 by guests, got %d and %d by guests", d, g)
+			}
+		})
 
-				api.ServeHTTP(w, req)
+		t.Run("Guests should see remaining downloads", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/shares/limits", "", false)
 
-				if w.Code != http.StatusBadRequest {
-					t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
-					return
-				}
-			})
+			share := storage.PublicShare{}
+			_ = json.NewDecoder(w.Body).Decode(&share)
+			if share.RemainingDownloads == nil || *share.RemainingDownloads != 1 {
+				t.Errorf("Expected 1 remaining download, got %v", share.RemainingDownloads)
+			}
+		})
 
-			t.Run("delete share inexistant share name shouldn't work", func(t *testing.T) {
-				var (
-					req *http.Request
-					w   *httptest.ResponseRecorder
-				)
+		t.Run("Share download should count every item", func(t *testing.T) {
+			// Item 1 has already been downloaded
+			if got := serve(h, "GET", "/d/limits", "", false).Code; got != http.StatusGone {
+				t.Errorf("Expected status %d, got %d", http.StatusGone, got)
+			}
+			if got := serve(h, "GET", "/api/v1/shares/limits/items/item2.txt", "", false).Code; got != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, got)
+			}
+			// Share limit is reached even though item 3 was never downloaded
+			if got := serve(h, "GET", "/api/v1/shares/limits/items/item3.txt", "", false).Code; got != http.StatusGone {
+				t.Errorf("Expected status %d, got %d", http.StatusGone, got)
+			}
+		})
 
-				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares/", "nonexistant"), nil)
-				req.SetBasicAuth("admin", "hupload")
+		t.Run("Negative limits should fail", func(t *testing.T) {
+			w := serve(h, "PATCH", "/api/v1/shares/limits", `{"exposure":"download","max_downloads":-1}`, true)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
 
-				w = httptest.NewRecorder()
+		makeShare(t, h, "burn", "admin", storage.Options{Exposure: "download", DeleteAfterDownload: true})
+		makeItem(t, h, "burn", "item1.txt", 1024)
+		makeItem(t, h, "burn", "item2.txt", 1024)
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "burn")
+		})
 
-				api.ServeHTTP(w, req)
+		t.Run("Items should be deleted after download", func(t *testing.T) {
+			if got := serve(h, "GET", "/api/v1/shares/burn/items/item1.txt", "", true).Code; got != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, got)
+			}
+			if getShare(t, "burn").Count != 2 {
+				t.Error("Expected authenticated download to keep item")
+			}
 
-				if w.Code != http.StatusNotFound {
-					t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
-					return
+			// Only one concurrent guest gets the item
+			const guests = 5
+			codes := make(chan int, guests)
+			for range guests {
+				go func() {
+					codes <- serve(h, "GET", "/api/v1/shares/burn/items/item1.txt", "", false).Code
+				}()
+			}
+			succeeded := 0
+			for range guests {
+				if <-codes == http.StatusOK {
+					succeeded++
 				}
-			})
+			}
+			if succeeded != 1 {
+				t.Errorf("Expected 1 download to succeed, got %d", succeeded)
+			}
+
+			_, err := h.Config.Storage.GetItem(context.Background(), "burn", "item1.txt")
+			if err != storage.ErrItemNotFound {
+				t.Errorf("Expected item to be deleted, got %v", err)
+			}
 		})
-	}
+
+		t.Run("Share should be deleted once empty", func(t *testing.T) {
+			if got := serve(h, "GET", "/d/burn", "", false).Code; got != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, got)
+			}
+			_, err := h.Config.Storage.GetShare(context.Background(), "burn")
+			if err != storage.ErrShareNotFound {
+				t.Errorf("Expected share to be deleted, got %v", err)
+			}
+		})
+	})
 }
 
-func TestGetItems(t *testing.T) {
-	for name, cfg := range cfgs {
-		if !cfg.Enabled {
-			continue
+func TestExposures(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		const ok, unauthorized, forbidden = http.StatusOK, http.StatusUnauthorized, http.StatusForbidden
+
+		// Expected status for guests listing, uploading, downloading and
+		// deleting items uploaded by others
+		tests := []struct {
+			exposure string
+			list     int
+			upload   int
+			download int
+			delete   int
+		}{
+			{"upload", ok, ok, unauthorized, forbidden},
+			{"download", ok, unauthorized, ok, unauthorized},
+			{"both", ok, ok, ok, forbidden},
+			{"dropbox", ok, ok, unauthorized, unauthorized},
+			{"unknown", unauthorized, unauthorized, unauthorized, unauthorized},
 		}
-		t.Run(name, func(t *testing.T) {
-			h := getHupload(t, cfg.Config)
-			t.Cleanup(func() { cfg.Cleanup(h) })
-			api := h.API
 
-			t.Run("Get share item should work", func(t *testing.T) {
-				var (
-					req *http.Request
-					w   *httptest.ResponseRecorder
-				)
+		for _, test := range tests {
+			t.Run(test.exposure, func(t *testing.T) {
+				shareName := "exposure-" + test.exposure
+				makeShare(t, h, shareName, "admin", storage.Options{Exposure: test.exposure})
+				makeItem(t, h, shareName, "item.txt", 10)
+				t.Cleanup(func() {
+					_ = h.Config.Storage.DeleteShare(context.Background(), shareName)
+				})
 
-				for _, exp := range []string{"download", "both"} {
-					shareName := "getitem" + exp
-					fileSize := 1 * 1024 * 1024
-					makeShare(t, h, shareName, "admin", storage.Options{Exposure: exp})
-					t.Cleanup(func() {
-						_ = h.Config.Storage.DeleteShare(context.Background(), shareName)
+				items := path.Join("/api/v1/shares", shareName, "items")
+
+				if got := guestStatus(h, "GET", items); got != test.list {
+					t.Errorf("List: expected status %d, got %d", test.list, got)
+				}
+				if got := guestStatus(h, "POST", path.Join(items, "new.txt")); got != test.upload {
+					t.Errorf("Upload: expected status %d, got %d", test.upload, got)
+				}
+				if got := guestStatus(h, "GET", path.Join(items, "item.txt")); got != test.download {
+					t.Errorf("Download: expected status %d, got %d", test.download, got)
+				}
+				if got := guestStatus(h, "GET", path.Join("/d", shareName)); got != test.download {
+					t.Errorf("Share download: expected status %d, got %d", test.download, got)
+				}
+				if got := guestStatus(h, "DELETE", path.Join(items, "item.txt")); got != test.delete {
+					t.Errorf("Delete: expected status %d, got %d", test.delete, got)
+				}
+			})
+		}
+	})
+}
+
+func TestDropBox(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		makeShare(t, h, "dropbox", "admin", storage.Options{Exposure: "dropbox"})
+		makeItem(t, h, "dropbox", "owner.txt", 10)
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "dropbox")
+		})
+
+		// list returns the items listed by a guest with cookies
+		list := func(t *testing.T, cookies []*http.Cookie) []string {
+			w := serve(h, "GET", "/api/v1/shares/dropbox/items?sort=name", "", false, cookies...)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			var items []storage.Item
+			_ = json.NewDecoder(w.Body).Decode(&items)
+			result := []string{}
+			for _, i := range items {
+				result = append(result, path.Base(i.Path))
+			}
+			return result
+		}
+
+		var receipt []*http.Cookie
+
+		t.Run("Uploads should be added to the receipt", func(t *testing.T) {
+			for _, item := range []string{"a.txt", "b.txt"} {
+				w := guestUpload(t, h, "dropbox", item, receipt)
+				receipt = receiptCookies(w)
+			}
+			if len(receipt) != 1 || receipt[0].Path != "/api/v1/shares/dropbox" || !receipt[0].HttpOnly {
+				t.Fatalf("Unexpected receipt %+v", receipt)
+			}
+			if got := list(t, receipt); !reflect.DeepEqual(got, []string{"a.txt", "b.txt"}) {
+				t.Errorf("Expected receipt items, got %v", got)
+			}
+		})
+
+		t.Run("Guests without receipt should see nothing", func(t *testing.T) {
+			if got := list(t, nil); len(got) != 0 {
+				t.Errorf("Expected no items, got %v", got)
+			}
+		})
+
+		t.Run("Tampered receipts should be ignored", func(t *testing.T) {
+			c := *receipt[0]
+			c.Value = base64.RawURLEncoding.EncodeToString([]byte(`["owner.txt"]`)) + c.Value[strings.Index(c.Value, "."):]
+			if got := list(t, []*http.Cookie{&c}); len(got) != 0 {
+				t.Errorf("Expected no items, got %v", got)
+			}
+		})
+
+		t.Run("Uploads over items of others should be renamed", func(t *testing.T) {
+			// Guests can't tell names of items of others from new ones
+			w := guestUpload(t, h, "dropbox", "a.txt", nil)
+			item := storage.Item{}
+			_ = json.NewDecoder(w.Body).Decode(&item)
+			if path.Base(item.Path) != "a (1).txt" {
+				t.Errorf("Expected renamed item, got %+v", item)
+			}
+			if got := list(t, receiptCookies(w)); !reflect.DeepEqual(got, []string{"a (1).txt"}) {
+				t.Errorf("Expected renamed item in receipt, got %v", got)
+			}
+
+			w = guestUpload(t, h, "dropbox", "owner.txt", receipt)
+			receipt = receiptCookies(w)
+			if got := list(t, receipt); !reflect.DeepEqual(got, []string{"a.txt", "b.txt", "owner (1).txt"}) {
+				t.Errorf("Expected renamed item in receipt, got %v", got)
+			}
+
+			// Guests replace their own items
+			guestUpload(t, h, "dropbox", "a.txt", receipt)
+		})
+
+		t.Run("Authenticated users should see every item", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/shares/dropbox/items", "", true)
+
+			var items []storage.Item
+			_ = json.NewDecoder(w.Body).Decode(&items)
+			if len(items) != 5 {
+				t.Errorf("Expected 5 items, got %d", len(items))
+			}
+		})
+	})
+}
+
+func TestUploadTokens(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		makeShare(t, h, "tokens", "admin", storage.Options{Exposure: "both"})
+		makeItem(t, h, "tokens", "owner.txt", 10)
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "tokens")
+		})
+
+		a := guestUpload(t, h, "tokens", "a.txt", nil)
+		b := guestUpload(t, h, "tokens", "b.txt", nil)
+		tokenA, tokenB := a.Header().Get(uploadTokenHeader), b.Header().Get(uploadTokenHeader)
+		cookieA, cookieB := receiptCookies(a), receiptCookies(b)
+
+		t.Run("Uploads should record the guest", func(t *testing.T) {
+			itemA, err := h.Config.Storage.GetItem(context.Background(), "tokens", "a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			itemB, err := h.Config.Storage.GetItem(context.Background(), "tokens", "b.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if itemA.Metadata == nil || itemB.Metadata == nil || itemA.Metadata.Guest == "" || itemA.Metadata.Guest == itemB.Metadata.Guest {
+				t.Errorf("Expected distinct guests, got %+v and %+v", itemA.Metadata, itemB.Metadata)
+			}
+			if tokenA == "" || tokenA == tokenB {
+				t.Errorf("Expected distinct tokens, got %q and %q", tokenA, tokenB)
+			}
+		})
+
+		t.Run("Authenticated uploads should record the owner", func(t *testing.T) {
+			w := serveRequest(h, uploadRequest("/api/v1/shares/tokens/items/admin.txt"), true)
+
+			var item storage.Item
+			_ = json.NewDecoder(w.Body).Decode(&item)
+			if item.Metadata == nil || item.Metadata.Owner != "admin" || item.Metadata.Guest != "" {
+				t.Errorf("Expected owner admin, got %+v", item.Metadata)
+			}
+			if w.Header().Get(uploadTokenHeader) != "" {
+				t.Errorf("Expected no upload token")
+			}
+		})
+
+		t.Run("Guests should only see their own metadata", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/shares/tokens/items", "", false, cookieA...)
+
+			var items []storage.Item
+			_ = json.NewDecoder(w.Body).Decode(&items)
+			for _, i := range items {
+				if (i.Metadata != nil) != (path.Base(i.Path) == "a.txt") {
+					t.Errorf("Unexpected metadata %+v for %s", i.Metadata, i.Path)
+				}
+			}
+		})
+
+		t.Run("Guests can't replace items of others", func(t *testing.T) {
+			w := serveRequest(h, uploadRequest("/api/v1/shares/tokens/items/a.txt"), false, cookieB...)
+			if w.Code != http.StatusConflict {
+				t.Errorf("Expected status %d, got %d", http.StatusConflict, w.Code)
+			}
+			guestUpload(t, h, "tokens", "a.txt", cookieA)
+		})
+
+		t.Run("Guests can't delete items of others", func(t *testing.T) {
+			tests := []struct {
+				name    string
+				item    string
+				token   string
+				cookies []*http.Cookie
+			}{
+				{"no token", "a.txt", "", nil},
+				{"token of another item", "a.txt", tokenB, nil},
+				{"forged token", "a.txt", strings.SplitN(tokenA, ".", 2)[0] + ".forged", nil},
+				{"receipt of another guest", "a.txt", "", cookieB},
+				{"item of the owner", "owner.txt", tokenA, cookieA},
+			}
+			for _, test := range tests {
+				if got := guestDelete(h, "tokens", test.item, test.token, test.cookies...).Code; got != http.StatusForbidden {
+					t.Errorf("%s: expected status %d, got %d", test.name, http.StatusForbidden, got)
+				}
+			}
+		})
+
+		t.Run("Guests should delete their own items", func(t *testing.T) {
+			if got := guestDelete(h, "tokens", "a.txt", tokenA).Code; got != http.StatusOK {
+				t.Errorf("Token: expected status %d, got %d", http.StatusOK, got)
+			}
+			if got := guestDelete(h, "tokens", "b.txt", "", cookieB...).Code; got != http.StatusOK {
+				t.Errorf("Receipt: expected status %d, got %d", http.StatusOK, got)
+			}
+		})
+
+		t.Run("Owners should delete every item", func(t *testing.T) {
+			w := serve(h, "DELETE", "/api/v1/shares/tokens/items/owner.txt", "", true)
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			share, err := h.Config.Storage.GetShare(context.Background(), "tokens")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := share.Items["owner.txt"]; ok || len(share.Items) != 1 {
+				t.Errorf("Expected metadata of deleted items to be removed, got %v", share.Items)
+			}
+		})
+	})
+}
+
+func TestItemMetadata(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		makeShare(t, h, "metadata", "admin", storage.Options{
+			Exposure: "both",
+			Fields:   []storage.ItemField{{Name: "case", Required: true}, {Name: "version"}},
+		})
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "metadata")
+		})
+
+		// upload uploads item as a guest with form fields sent before the
+		// file
+		upload := func(item string, fields map[string]string) *httptest.ResponseRecorder {
+			b := &bytes.Buffer{}
+			mw := multipart.NewWriter(b)
+			for k, v := range fields {
+				_ = mw.WriteField(k, v)
+			}
+			part, _ := mw.CreateFormFile("file", item)
+			_, _ = part.Write([]byte("content"))
+			_ = mw.Close()
+
+			req := httptest.NewRequest("POST", "/api/v1/shares/metadata/items/"+item, b)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			req.Header.Set("FileSize", "7")
+			return serveRequest(h, req, false)
+		}
+
+		t.Run("Invalid metadata should be rejected before upload", func(t *testing.T) {
+			tests := map[string]map[string]string{
+				"missing field": {"uploader_name": "Jane"},
+				"unknown field": {"fields[case]": "1", "fields[other]": "x"},
+				"invalid email": {"fields[case]": "1", "uploader_email": "jane"},
+				"unknown form":  {"fields[case]": "1", "comment": "x"},
+				"too long":      {"fields[case]": "1", "note": strings.Repeat("n", 5000)},
+			}
+			for name, fields := range tests {
+				if w := upload("rejected.txt", fields); w.Code != http.StatusBadRequest {
+					t.Errorf("%s: expected status %d, got %d", name, http.StatusBadRequest, w.Code)
+				}
+			}
+			_, err := h.Config.Storage.GetItem(context.Background(), "metadata", "rejected.txt")
+			if !errors.Is(err, storage.ErrItemNotFound) {
+				t.Errorf("Expected item not to be created, got %v", err)
+			}
+		})
+
+		want := storage.ItemMetadata{
+			UploaderName:  "Jane",
+			UploaderEmail: "jane@example.com",
+			Note:          "logs of the crash",
+			Fields:        map[string]string{"case": "1234"},
+		}
+
+		t.Run("Metadata should be recorded on upload", func(t *testing.T) {
+			w := upload("support.tgz", map[string]string{
+				"uploader_name":  want.UploaderName,
+				"uploader_email": want.UploaderEmail,
+				"note":           want.Note,
+				"fields[case]":   want.Fields["case"],
+			})
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			var item storage.Item
+			_ = json.NewDecoder(w.Body).Decode(&item)
+			if item.Metadata == nil || item.Metadata.Guest == "" {
+				t.Fatalf("Expected guest metadata, got %+v", item.Metadata)
+			}
+			want.Guest = item.Metadata.Guest
+			if !reflect.DeepEqual(*item.Metadata, want) {
+				t.Errorf("Expected metadata %+v, got %+v", want, *item.Metadata)
+			}
+
+			w = serve(h, "GET", "/api/v1/shares/metadata/items", "", true)
+
+			var items []storage.Item
+			_ = json.NewDecoder(w.Body).Decode(&items)
+			if len(items) != 1 || items[0].Metadata == nil || !reflect.DeepEqual(*items[0].Metadata, want) {
+				t.Errorf("Expected listed metadata %+v, got %+v", want, items)
+			}
+		})
+
+		t.Run("Owners should edit metadata", func(t *testing.T) {
+			w := serve(h, "PATCH", "/api/v1/shares/metadata/items/support.tgz", `{"note":"updated","guest":"someone","fields":{"version":"2","case":""}}`, true)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			want.Note = "updated"
+			want.Fields = map[string]string{"version": "2"}
+
+			var item storage.Item
+			_ = json.NewDecoder(w.Body).Decode(&item)
+			if item.Metadata == nil || !reflect.DeepEqual(*item.Metadata, want) {
+				t.Errorf("Expected metadata %+v, got %+v", want, item.Metadata)
+			}
+		})
+
+		t.Run("Invalid edits should fail", func(t *testing.T) {
+			tests := []struct {
+				name          string
+				item          string
+				body          string
+				authenticated bool
+				status        int
+			}{
+				{"guest", "support.tgz", `{"note":"x"}`, false, http.StatusUnauthorized},
+				{"unknown field", "support.tgz", `{"fields":{"other":"x"}}`, true, http.StatusBadRequest},
+				{"invalid body", "support.tgz", `{`, true, http.StatusBadRequest},
+				{"missing item", "missing.txt", `{"note":"x"}`, true, http.StatusNotFound},
+			}
+			for _, test := range tests {
+				if w := serve(h, "PATCH", "/api/v1/shares/metadata/items/"+test.item, test.body, test.authenticated); w.Code != test.status {
+					t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+				}
+			}
+		})
+	})
+}
+
+func TestDownloadShare(t *testing.T) {
+	for name, cfg := range cfgs {
+		if !cfg.Enabled {
+			continue
+		}
+
+		shareName := "downloadshare"
+
+		h := getHupload(t, cfg.Config)
+
+		makeShare(t, h, shareName, "admin", storage.Options{Exposure: "download"})
+
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), shareName)
+			cfg.Cleanup(h)
+		})
+
+		makeItem(t, h, shareName, "newfile1.txt", 1*1024*1024)
+		makeItem(t, h, shareName, "newfile2.txt", 1*1024*1024)
+
+		t.Run(name, func(t *testing.T) {
+			api := h.API
+
+			req := httptest.NewRequest("GET", path.Join("/d/", shareName), nil)
+
+			w := httptest.NewRecorder()
+
+			api.ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+				return
+			}
+		})
+
+		t.Run(name+" mass download counter updated", func(t *testing.T) {
+			storage := h.Config.Storage
+			items, err := storage.ListShare(context.Background(), shareName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range items {
+				// Check if the mass download counter was updated
+				if item.Downloads != 1 {
+					t.Errorf("Expected mass download counter to be updated, got %d", item.Downloads)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteShare(t *testing.T) {
+	for name, cfg := range cfgs {
+		if !cfg.Enabled {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			h := getHupload(t, cfg.Config)
+			t.Cleanup(func() { cfg.Cleanup(h) })
+			api := h.API
+
+			t.Run("delete share should work", func(t *testing.T) {
+				var (
+					req *http.Request
+					w   *httptest.ResponseRecorder
+				)
+
+				shareName := "deleteshare"
+				makeShare(t, h, shareName, "admin", storage.Options{Exposure: "download"})
+				t.Cleanup(func() {
+					_ = h.Config.Storage.DeleteShare(context.Background(), shareName)
+				})
+				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares/", shareName), nil)
+				req.SetBasicAuth("admin", "hupload")
+				w = httptest.NewRecorder()
+
+				api.ServeHTTP(w, req)
+
+				if w.Code != http.StatusOK {
+					t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+					return
+				}
+
+			})
+
+			t.Run("delete share unauthentication shouldn't work", func(t *testing.T) {
+				var (
+					req *http.Request
+					w   *httptest.ResponseRecorder
+				)
+
+				shareName := "deleteshare"
+				makeShare(t, h, shareName, "admin", storage.Options{Exposure: "download"})
+
+				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares/", shareName), nil)
+				w = httptest.NewRecorder()
+
+				api.ServeHTTP(w, req)
+
+				if w.Code != http.StatusUnauthorized {
+					t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+					return
+				}
+				t.Cleanup(func() {
+					_ = h.Config.Storage.DeleteShare(context.Background(), "deleteshare")
+				})
+			})
+
+			t.Run("delete share invalid share name shouldn't work", func(t *testing.T) {
+				var (
+					req *http.Request
+					w   *httptest.ResponseRecorder
+				)
+
+				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares/", url.QueryEscape("../bogus")), nil)
+				req.SetBasicAuth("admin", "hupload")
+
+				w = httptest.NewRecorder()
+
+				api.ServeHTTP(w, req)
+
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+					return
+				}
+			})
+
+			t.Run("delete share inexistant share name shouldn't work", func(t *testing.T) {
+				var (
+					req *http.Request
+					w   *httptest.ResponseRecorder
+				)
+
+				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares/", "nonexistant"), nil)
+				req.SetBasicAuth("admin", "hupload")
+
+				w = httptest.NewRecorder()
+
+				api.ServeHTTP(w, req)
+
+				if w.Code != http.StatusNotFound {
+					t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+					return
+				}
+			})
+		})
+	}
+}
+
+func TestGetItems(t *testing.T) {
+	for name, cfg := range cfgs {
+		if !cfg.Enabled {
+			continue
+		}
+		t.Run(name, func(t *testing.T) {
+			h := getHupload(t, cfg.Config)
+			t.Cleanup(func() { cfg.Cleanup(h) })
+			api := h.API
+
+			t.Run("Get share item should work", func(t *testing.T) {
+				var (
+					req *http.Request
+					w   *httptest.ResponseRecorder
+				)
+
+				for _, exp := range []string{"download", "both"} {
+					shareName := "getitem" + exp
+					fileSize := 1 * 1024 * 1024
+					makeShare(t, h, shareName, "admin", storage.Options{Exposure: exp})
+					t.Cleanup(func() {
+						_ = h.Config.Storage.DeleteShare(context.Background(), shareName)
 					})
 
 					makeItem(t, h, shareName, "newfile.txt", fileSize)
@@ -1211,8 +2005,6 @@ func TestUpload(t *testing.T) {
 					_ = h.Config.Storage.DeleteShare(context.Background(), "upload")
 				})
 
-				makeItem(t, h, "upload", "newfile.txt", 1*1024*1024)
-
 				fileSize := 1 * 1024 * 1024
 
 				pr, ct := multipartWriter(fileSize)
@@ -1450,6 +2242,12 @@ func TestUpload(t *testing.T) {
 					t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
 					return
 				}
+
+				// Only one error is returned
+				want := `{"status":"error","message":"missing content length"}` + "\n"
+				if w.Body.String() != want {
+					t.Errorf("Expected body %q, got %q", want, w.Body.String())
+				}
 			})
 
 			t.Run("Upload a file with invalid file name should fail", func(t *testing.T) {
@@ -1534,9 +2332,10 @@ func TestDeleteItem(t *testing.T) {
 				t.Cleanup(func() {
 					_ = h.Config.Storage.DeleteShare(context.Background(), "upload")
 				})
-				makeItem(t, h, share.Name, "newfile.txt", 1*1024*1024)
+				upload := guestUpload(t, h, share.Name, "newfile.txt", nil)
 
 				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares", share.Name, "items", "newfile.txt"), nil)
+				req.Header.Set(uploadTokenHeader, upload.Header().Get(uploadTokenHeader))
 
 				w = httptest.NewRecorder()
 
@@ -1558,9 +2357,10 @@ func TestDeleteItem(t *testing.T) {
 					_ = h.Config.Storage.DeleteShare(context.Background(), "both")
 				})
 
-				makeItem(t, h, share.Name, "newfile.txt", 1*1024*1024)
+				upload := guestUpload(t, h, share.Name, "newfile.txt", nil)
 
 				req = httptest.NewRequest("DELETE", path.Join("/api/v1/shares", share.Name, "items", "newfile.txt"), nil)
+				req.Header.Set(uploadTokenHeader, upload.Header().Get(uploadTokenHeader))
 
 				w = httptest.NewRecorder()
 
@@ -1668,128 +2468,605 @@ func TestDeleteItem(t *testing.T) {
 
 			})
 		})
-	}
+	}
+}
+
+func TestMessages(t *testing.T) {
+	c := &config.Config{
+		Path: "handlers_testdata/config.yml",
+	}
+
+	h := getHupload(t, c)
+
+	t.Run("Get messages should work", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/messages", nil)
+
+		req.SetBasicAuth("admin", "hupload")
+
+		w := httptest.NewRecorder()
+
+		h.API.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			return
+		}
+
+		got := []string{}
+		_ = json.NewDecoder(w.Body).Decode(&got)
+
+		want := []string{"Message title"}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+			return
+		}
+	})
+
+	t.Run("Get message without auth should fail", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/messages", nil)
+
+		w := httptest.NewRecorder()
+
+		h.API.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			return
+		}
+
+		type btype struct {
+			Errors []string `json:"errors"`
+		}
+
+		got := btype{}
+
+		_ = json.NewDecoder(w.Body).Decode(&got)
+
+		want := btype{
+			Errors: []string{"JWTAuthMiddleware: no Authorization header"},
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+			return
+		}
+	})
+
+	t.Run("Get message should work", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/messages/1", nil)
+
+		req.SetBasicAuth("admin", "hupload")
+
+		w := httptest.NewRecorder()
+
+		h.API.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			return
+		}
+
+		var got *config.MessageTemplate
+
+		_ = json.NewDecoder(w.Body).Decode(&got)
+
+		want := &config.MessageTemplate{
+			Title:   "Message title",
+			Message: "Message content",
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+			return
+		}
+	})
+
+	t.Run("Get message without auth should fail", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/messages/1", nil)
+
+		w := httptest.NewRecorder()
+
+		h.API.ServeHTTP(w, req)
+
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+			return
+		}
+
+		type btype struct {
+			Errors []string `json:"errors"`
+		}
+
+		got := btype{}
+
+		_ = json.NewDecoder(w.Body).Decode(&got)
+
+		want := btype{
+			Errors: []string{"JWTAuthMiddleware: no Authorization header"},
+		}
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+			return
+		}
+	})
+}
+
+func TestForms(t *testing.T) {
+	h := getHupload(t, cfgs["memory"].Config)
+
+	t.Run("Get forms should work", func(t *testing.T) {
+		w := serve(h, "GET", "/api/v1/forms", "", true)
+		got := []string{}
+		_ = json.NewDecoder(w.Body).Decode(&got)
+		if w.Code != http.StatusOK || !reflect.DeepEqual(got, []string{"Support case"}) {
+			t.Errorf("Expected form titles, got %d %v", w.Code, got)
+		}
+		if w := serve(h, "GET", "/api/v1/forms", "", false); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+	})
+
+	t.Run("Get form should work", func(t *testing.T) {
+		w := serve(h, "GET", "/api/v1/forms/1", "", true)
+		got := config.FormTemplate{}
+		_ = json.NewDecoder(w.Body).Decode(&got)
+		if w.Code != http.StatusOK || !reflect.DeepEqual(got, h.Config.Values.FormTemplates[0]) {
+			t.Errorf("Expected form template, got %d %+v", w.Code, got)
+		}
+		for _, index := range []string{"0", "2", "a"} {
+			if w := serve(h, "GET", "/api/v1/forms/"+index, "", true); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status %d, got %d", index, http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+
+	t.Run("Shares with a form should validate uploads", func(t *testing.T) {
+		share := makeShare(t, h, "intake", "admin", storage.Options{
+			Exposure: "upload",
+			Fields:   h.Config.Values.FormTemplates[0].Fields,
+		})
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "intake")
+		})
+
+		w := serve(h, "GET", "/api/v1/shares/intake", "", false)
+		var public storage.PublicShare
+		_ = json.NewDecoder(w.Body).Decode(&public)
+		if !reflect.DeepEqual(public.Options.Fields, share.Options.Fields) {
+			t.Errorf("Expected form in public share, got %+v", public.Options.Fields)
+		}
+
+		upload := func(terms string) int {
+			b := &bytes.Buffer{}
+			mw := multipart.NewWriter(b)
+			_ = mw.WriteField("fields[case]", "1234")
+			_ = mw.WriteField("fields[terms]", terms)
+			part, _ := mw.CreateFormFile("file", "support.tgz")
+			_, _ = part.Write([]byte("content"))
+			_ = mw.Close()
+
+			req := httptest.NewRequest("POST", "/api/v1/shares/intake/items/support.tgz", b)
+			req.Header.Set("Content-Type", mw.FormDataContentType())
+			req.Header.Set("FileSize", "7")
+			return serveRequest(h, req, false).Code
+		}
+
+		if got := upload("false"); got != http.StatusBadRequest {
+			t.Errorf("Terms not accepted: expected status %d, got %d", http.StatusBadRequest, got)
+		}
+		if got := upload("true"); got != http.StatusOK {
+			t.Errorf("Terms accepted: expected status %d, got %d", http.StatusOK, got)
+		}
+
+		item, err := h.Config.Storage.GetItem(context.Background(), "intake", "support.tgz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := map[string]string{"case": "1234", "terms": "true"}; !reflect.DeepEqual(item.Metadata.Fields, want) {
+			t.Errorf("Expected answers %v, got %v", want, item.Metadata.Fields)
+		}
+	})
+}
+
+func TestConflictPolicies(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		t.Run("Invalid conflict policy should fail", func(t *testing.T) {
+			w := serve(h, "POST", "/api/v1/shares", `{"exposure":"upload","conflict":"ignore"}`, true)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+
+		t.Run("Existing items should be rejected", func(t *testing.T) {
+			makeShare(t, h, "reject", "admin", storage.Options{Exposure: "upload", Conflict: storage.ConflictReject})
+			t.Cleanup(func() {
+				_ = h.Config.Storage.DeleteShare(context.Background(), "reject")
+			})
+
+			w := guestUpload(t, h, "reject", "support.tgz", nil)
+			if w := serveRequest(h, uploadRequest("/api/v1/shares/reject/items/support.tgz"), false, w.Result().Cookies()...); w.Code != http.StatusConflict {
+				t.Errorf("Expected status %d, got %d", http.StatusConflict, w.Code)
+			}
+		})
+
+		t.Run("Guests can't version items of others", func(t *testing.T) {
+			makeShare(t, h, "version", "admin", storage.Options{Exposure: "upload", Conflict: storage.ConflictVersion})
+			t.Cleanup(func() {
+				_ = h.Config.Storage.DeleteShare(context.Background(), "version")
+			})
+
+			w := guestUpload(t, h, "version", "support.tgz", nil)
+			if w := serveRequest(h, uploadRequest("/api/v1/shares/version/items/support.tgz"), false); w.Code != http.StatusConflict {
+				t.Errorf("Expected status %d, got %d", http.StatusConflict, w.Code)
+			}
+			guestUpload(t, h, "version", "support.tgz", receiptCookies(w))
+		})
+
+		t.Run("Guests should upload renamed items", func(t *testing.T) {
+			makeShare(t, h, "rename", "admin", storage.Options{Exposure: "upload", Conflict: storage.ConflictRename})
+			t.Cleanup(func() {
+				_ = h.Config.Storage.DeleteShare(context.Background(), "rename")
+			})
+
+			guestUpload(t, h, "rename", "support.tgz", nil)
+
+			// Another guest can upload an item with the same name
+			w := serveRequest(h, uploadRequest("/api/v1/shares/rename/items/support.tgz"), false)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			item := storage.Item{}
+			_ = json.NewDecoder(w.Body).Decode(&item)
+			if item.Path != "rename/support (1).tgz" || item.Metadata == nil || item.Metadata.Guest == "" {
+				t.Errorf("Expected renamed item uploaded by a guest, got %+v", item)
+			}
+
+			// The upload token is for the renamed item
+			w = guestDelete(h, "rename", "support (1).tgz", w.Header().Get(uploadTokenHeader))
+			if w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+		})
+	})
+}
+
+func TestItemVersions(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		makeShare(t, h, "versions", "admin", storage.Options{Exposure: "upload", Conflict: storage.ConflictVersion})
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "versions")
+		})
+		makeItem(t, h, "versions", "support.tgz", 10)
+		makeItem(t, h, "versions", "support.tgz", 20)
+
+		t.Run("List versions should work", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/shares/versions/items/support.tgz/versions", "", true)
+			versions := []storage.ItemVersion{}
+			_ = json.NewDecoder(w.Body).Decode(&versions)
+			if w.Code != http.StatusOK || len(versions) != 1 || versions[0].Version != 1 || versions[0].ItemInfo.Size != 10 {
+				t.Errorf("Expected one version, got %d %+v", w.Code, versions)
+			}
+
+			if w := serve(h, "GET", "/api/v1/shares/versions/items/support.tgz/versions", "", false); w.Code != http.StatusUnauthorized {
+				t.Errorf("Guest: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if w := serve(h, "GET", "/api/v1/shares/versions/items/missing/versions", "", true); w.Code != http.StatusNotFound {
+				t.Errorf("Missing item: expected status %d, got %d", http.StatusNotFound, w.Code)
+			}
+		})
+
+		t.Run("Download version should work", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/shares/versions/items/support.tgz/versions/1", "", true)
+			if w.Code != http.StatusOK || w.Body.Len() != 10 || w.Header().Get("Content-Length") != "10" {
+				t.Errorf("Expected version of 10 bytes, got %d with %d bytes", w.Code, w.Body.Len())
+			}
+
+			tests := map[string]int{"2": http.StatusNotFound, "a": http.StatusBadRequest}
+			for version, status := range tests {
+				if w := serve(h, "GET", "/api/v1/shares/versions/items/support.tgz/versions/"+version, "", true); w.Code != status {
+					t.Errorf("%s: expected status %d, got %d", version, status, w.Code)
+				}
+			}
+		})
+
+		t.Run("Delete version should work", func(t *testing.T) {
+			if w := serve(h, "DELETE", "/api/v1/shares/versions/items/support.tgz/versions/1", "", false); w.Code != http.StatusUnauthorized {
+				t.Errorf("Guest: expected status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+			if w := serve(h, "DELETE", "/api/v1/shares/versions/items/support.tgz/versions/1", "", true); w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			if w := serve(h, "DELETE", "/api/v1/shares/versions/items/support.tgz/versions/1", "", true); w.Code != http.StatusNotFound {
+				t.Errorf("Deleted version: expected status %d, got %d", http.StatusNotFound, w.Code)
+			}
+
+			share, err := h.Config.Storage.GetShare(context.Background(), "versions")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if share.Size != 20 {
+				t.Errorf("Expected size 20 after delete, got %d", share.Size)
+			}
+		})
+	})
 }
 
-func TestMessages(t *testing.T) {
-	c := &config.Config{
-		Path: "handlers_testdata/config.yml",
-	}
+func TestCopyItem(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		shares := map[string]storage.Options{
+			"customer": {},
+			"vendor":   {},
+			"rejects":  {Conflict: storage.ConflictReject},
+			"full":     {},
+		}
+		for name, options := range shares {
+			makeShare(t, h, name, "admin", options)
+		}
+		makeShare(t, h, "private", "user", storage.Options{})
+		t.Cleanup(func() {
+			for _, name := range []string{"customer", "vendor", "rejects", "full", "private"} {
+				_ = h.Config.Storage.DeleteShare(context.Background(), name)
+			}
+		})
 
-	h := getHupload(t, c)
+		for _, name := range []string{"support.tgz", "logs.txt", "core.dump"} {
+			makeItem(t, h, "customer", name, 10)
+		}
+		makeItem(t, h, "rejects", "support.tgz", 10)
+		makeItem(t, h, "full", "first", 3*1024*1024)
+		makeItem(t, h, "full", "second", 2*1024*1024)
 
-	t.Run("Get messages should work", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/api/v1/messages", nil)
+		send := func(op, item, body string, authenticated bool) *httptest.ResponseRecorder {
+			return serve(h, "POST", "/api/v1/shares/customer/items/"+item+"/"+op, body, authenticated)
+		}
 
-		req.SetBasicAuth("admin", "hupload")
+		t.Run("Copy item should work", func(t *testing.T) {
+			w := send("copy", "support.tgz", `{"share":"vendor"}`, true)
+			item := storage.Item{}
+			_ = json.NewDecoder(w.Body).Decode(&item)
+			if w.Code != http.StatusOK || item.Path != "vendor/support.tgz" || item.ItemInfo.Size != 10 {
+				t.Errorf("Expected copied item, got %d %+v", w.Code, item)
+			}
 
-		w := httptest.NewRecorder()
+			_, err := h.Config.Storage.GetItem(context.Background(), "customer", "support.tgz")
+			if err != nil {
+				t.Errorf("Expected source to be kept, got %v", err)
+			}
+		})
 
-		h.API.ServeHTTP(w, req)
+		t.Run("Move item should work", func(t *testing.T) {
+			w := send("move", "logs.txt", `{"share":"vendor","name":"customer-logs.txt"}`, true)
+			item := storage.Item{}
+			_ = json.NewDecoder(w.Body).Decode(&item)
+			if w.Code != http.StatusOK || item.Path != "vendor/customer-logs.txt" {
+				t.Errorf("Expected moved item, got %d %+v", w.Code, item)
+			}
 
-		if w.Code != http.StatusOK {
-			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
-			return
-		}
+			_, err := h.Config.Storage.GetItem(context.Background(), "customer", "logs.txt")
+			if !errors.Is(err, storage.ErrItemNotFound) {
+				t.Errorf("Expected source to be deleted, got %v", err)
+			}
+		})
 
-		got := []string{}
-		_ = json.NewDecoder(w.Body).Decode(&got)
+		t.Run("Invalid copies should fail", func(t *testing.T) {
+			tests := []struct {
+				name          string
+				item          string
+				body          string
+				authenticated bool
+				status        int
+			}{
+				{"guest", "core.dump", `{"share":"vendor"}`, false, http.StatusUnauthorized},
+				{"invalid body", "core.dump", `{`, true, http.StatusBadRequest},
+				{"no destination", "core.dump", `{}`, true, http.StatusBadRequest},
+				{"invalid name", "core.dump", `{"share":"vendor","name":".metadata"}`, true, http.StatusBadRequest},
+				{"missing share", "core.dump", `{"share":"missing"}`, true, http.StatusNotFound},
+				{"missing item", "missing", `{"share":"vendor"}`, true, http.StatusNotFound},
+				{"itself", "core.dump", `{"share":"customer"}`, true, http.StatusConflict},
+				{"rejected conflict", "support.tgz", `{"share":"rejects"}`, true, http.StatusConflict},
+				{"full share", "core.dump", `{"share":"full"}`, true, http.StatusInsufficientStorage},
+			}
+			for _, test := range tests {
+				for _, op := range []string{"copy", "move"} {
+					if w := send(op, test.item, test.body, test.authenticated); w.Code != test.status {
+						t.Errorf("%s %s: expected status %d, got %d", op, test.name, test.status, w.Code)
+					}
+				}
+			}
 
-		want := []string{"Message title"}
+			// Failed moves keep the source
+			_, err := h.Config.Storage.GetItem(context.Background(), "customer", "core.dump")
+			if err != nil {
+				t.Errorf("Expected source to be kept, got %v", err)
+			}
+		})
 
-		if !reflect.DeepEqual(got, want) {
-			t.Errorf("Expected %v, got %v", want, got)
-			return
-		}
-	})
+		t.Run("Hidden shares should not be a destination", func(t *testing.T) {
+			h.Config.Values.HideOtherShares = true
+			t.Cleanup(func() { h.Config.Values.HideOtherShares = false })
 
-	t.Run("Get message without auth should fail", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/api/v1/messages", nil)
+			if w := send("copy", "core.dump", `{"share":"private"}`, true); w.Code != http.StatusForbidden {
+				t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+			}
+		})
+	})
+}
 
-		w := httptest.NewRecorder()
+// lookupStorage counts share and rename record lookups
+type lookupStorage struct {
+	storage.Storage
 
-		h.API.ServeHTTP(w, req)
+	shares, renames int
+}
 
-		if w.Code != http.StatusUnauthorized {
-			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
-			return
-		}
+func (s *lookupStorage) GetShare(ctx context.Context, name string) (*storage.Share, error) {
+	s.shares++
+	return s.Storage.GetShare(ctx, name)
+}
 
-		type btype struct {
-			Errors []string `json:"errors"`
-		}
+func (s *lookupStorage) GetRenamedShare(ctx context.Context, name string) (*storage.RenamedShare, error) {
+	s.renames++
+	return s.Storage.GetRenamedShare(ctx, name)
+}
 
-		got := btype{}
+func TestRenameShare(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		makeShare(t, h, "leaked", "admin", storage.Options{Exposure: "both"})
+		makeShare(t, h, "taken", "admin", storage.Options{})
+		makeShare(t, h, "private", "user", storage.Options{})
+		makeItem(t, h, "leaked", "support.tgz", 10)
 
-		_ = json.NewDecoder(w.Body).Decode(&got)
+		current := "leaked"
+		t.Cleanup(func() {
+			for _, name := range []string{current, "taken", "private"} {
+				_ = h.Config.Storage.DeleteShare(context.Background(), name)
+			}
+		})
 
-		want := btype{
-			Errors: []string{"JWTAuthMiddleware: no Authorization header"},
+		send := func(share, body string, authenticated bool) *httptest.ResponseRecorder {
+			return serve(h, "POST", "/api/v1/shares/"+share+"/rename", body, authenticated)
 		}
-
-		if !reflect.DeepEqual(got, want) {
-			t.Errorf("Expected %v, got %v", want, got)
-			return
+		get := func(url string) *httptest.ResponseRecorder {
+			return serve(h, "GET", url, "", false)
 		}
-	})
-
-	t.Run("Get message should work", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/api/v1/messages/1", nil)
-
-		req.SetBasicAuth("admin", "hupload")
 
-		w := httptest.NewRecorder()
+		t.Run("Requests to shares should only look up renames if they don't exist", func(t *testing.T) {
+			lookups := &lookupStorage{Storage: h.Config.Storage}
+			h.Config.Storage = lookups
+			t.Cleanup(func() { h.Config.Storage = lookups.Storage })
 
-		h.API.ServeHTTP(w, req)
+			if w := get("/api/v1/shares/leaked"); w.Code != http.StatusOK {
+				t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			if lookups.shares != 1 || lookups.renames != 0 {
+				t.Errorf("Expected 1 share lookup and no rename lookup, got %d and %d", lookups.shares, lookups.renames)
+			}
 
-		if w.Code != http.StatusOK {
-			t.Errorf("Expected status %d, got %d", http.StatusOK, w.Code)
-			return
-		}
+			if w := get("/api/v1/shares/unknown"); w.Code != http.StatusNotFound {
+				t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+			}
+			if lookups.renames != 1 {
+				t.Errorf("Expected 1 rename lookup, got %d", lookups.renames)
+			}
+		})
 
-		var got *config.MessageTemplate
+		t.Run("Rename with grace period should keep the previous name working", func(t *testing.T) {
+			w := send("leaked", `{"name":"rotated","grace":"1h"}`, true)
+			share := storage.Share{}
+			_ = json.NewDecoder(w.Body).Decode(&share)
+			if w.Code != http.StatusOK || share.Name != "rotated" || share.Count != 1 {
+				t.Fatalf("Expected renamed share, got %d %+v", w.Code, share)
+			}
+			current = share.Name
 
-		_ = json.NewDecoder(w.Body).Decode(&got)
+			if w = get("/d/rotated/support.tgz"); w.Code != http.StatusOK {
+				t.Errorf("Expected status %d for new name, got %d", http.StatusOK, w.Code)
+			}
+			if w = get("/d/leaked/support.tgz"); w.Code != http.StatusOK || w.Body.Len() != 10 {
+				t.Errorf("Expected status %d for previous name, got %d", http.StatusOK, w.Code)
+			}
 
-		want := &config.MessageTemplate{
-			Title:   "Message title",
-			Message: "Message content",
-		}
+			w = get("/api/v1/shares/leaked")
+			public := storage.PublicShare{}
+			_ = json.NewDecoder(w.Body).Decode(&public)
+			if w.Code != http.StatusOK || public.Name != "rotated" {
+				t.Errorf("Expected renamed share for previous name, got %d %+v", w.Code, public)
+			}
+		})
 
-		if !reflect.DeepEqual(got, want) {
-			t.Errorf("Expected %v, got %v", want, got)
-			return
-		}
-	})
+		t.Run("Regenerating a code without grace period should end previous names", func(t *testing.T) {
+			w := send("rotated", "", true)
+			share := storage.Share{}
+			_ = json.NewDecoder(w.Body).Decode(&share)
+			if w.Code != http.StatusOK || share.Name == "" || share.Name == "rotated" {
+				t.Fatalf("Expected share with a new code, got %d %+v", w.Code, share)
+			}
+			current = share.Name
 
-	t.Run("Get message without auth should fail", func(t *testing.T) {
-		req := httptest.NewRequest("GET", "/api/v1/messages/1", nil)
+			for _, url := range []string{"/api/v1/shares/rotated", "/api/v1/shares/leaked/items", "/d/leaked/support.tgz"} {
+				if w = get(url); w.Code != http.StatusGone {
+					t.Errorf("%s: expected status %d, got %d", url, http.StatusGone, w.Code)
+				}
+			}
+			if w = get("/d/" + current + "/support.tgz"); w.Code != http.StatusOK {
+				t.Errorf("Expected status %d for new code, got %d", http.StatusOK, w.Code)
+			}
+			if w = get("/api/v1/shares/unknown"); w.Code != http.StatusNotFound {
+				t.Errorf("Expected status %d for unknown share, got %d", http.StatusNotFound, w.Code)
+			}
+		})
 
-		w := httptest.NewRecorder()
+		t.Run("Guests should delete their items after a rename", func(t *testing.T) {
+			makeShare(t, h, "dropped", "admin", storage.Options{Exposure: "upload"})
+			t.Cleanup(func() {
+				_ = h.Config.Storage.DeleteShare(context.Background(), "moved")
+			})
 
-		h.API.ServeHTTP(w, req)
+			w := guestUpload(t, h, "dropped", "first.txt", nil)
+			cookies := w.Result().Cookies()
+			w = guestUpload(t, h, "dropped", "second.txt", cookies)
+			cookies = w.Result().Cookies()
+			token := w.Header().Get(uploadTokenHeader)
+			guestUpload(t, h, "dropped", "third.txt", cookies)
 
-		if w.Code != http.StatusUnauthorized {
-			t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
-			return
-		}
+			if w := send("dropped", `{"name":"moved","grace":"1h"}`, true); w.Code != http.StatusOK {
+				t.Fatalf("Expected renamed share, got %d", w.Code)
+			}
 
-		type btype struct {
-			Errors []string `json:"errors"`
-		}
+			// The upload token and the receipt work with the previous name
+			if w := guestDelete(h, "dropped", "second.txt", token); w.Code != http.StatusOK {
+				t.Errorf("Token: expected status %d, got %d", http.StatusOK, w.Code)
+			}
+			w = guestDelete(h, "dropped", "first.txt", "", cookies...)
+			if w.Code != http.StatusOK {
+				t.Errorf("Receipt: expected status %d, got %d", http.StatusOK, w.Code)
+			}
 
-		got := btype{}
+			// The receipt is moved to the new name
+			rekeyed := receiptCookies(w)
+			if len(rekeyed) != 1 || rekeyed[0].Path != "/api/v1/shares/moved" {
+				t.Fatalf("Expected receipt for the new name, got %+v", rekeyed)
+			}
+			if w := guestDelete(h, "moved", "third.txt", "", cookies...); w.Code != http.StatusForbidden {
+				t.Errorf("Previous receipt: expected status %d, got %d", http.StatusForbidden, w.Code)
+			}
+			if w := guestDelete(h, "moved", "third.txt", "", rekeyed...); w.Code != http.StatusOK {
+				t.Errorf("Moved receipt: expected status %d, got %d", http.StatusOK, w.Code)
+			}
+		})
 
-		_ = json.NewDecoder(w.Body).Decode(&got)
+		t.Run("Invalid renames should fail", func(t *testing.T) {
+			tests := []struct {
+				name          string
+				share         string
+				body          string
+				authenticated bool
+				status        int
+			}{
+				{"guest", current, `{"name":"guest"}`, false, http.StatusUnauthorized},
+				{"invalid body", current, `{`, true, http.StatusBadRequest},
+				{"invalid grace", current, `{"grace":"soon"}`, true, http.StatusBadRequest},
+				{"invalid name", current, `{"name":"a b"}`, true, http.StatusBadRequest},
+				{"missing share", "missing", `{"name":"found"}`, true, http.StatusNotFound},
+				{"existing name", current, `{"name":"taken"}`, true, http.StatusConflict},
+			}
+			for _, test := range tests {
+				if w := send(test.share, test.body, test.authenticated); w.Code != test.status {
+					t.Errorf("%s: expected status %d, got %d", test.name, test.status, w.Code)
+				}
+			}
+		})
 
-		want := btype{
-			Errors: []string{"JWTAuthMiddleware: no Authorization header"},
-		}
+		t.Run("Hidden shares should not be renamed", func(t *testing.T) {
+			h.Config.Values.HideOtherShares = true
+			t.Cleanup(func() { h.Config.Values.HideOtherShares = false })
 
-		if !reflect.DeepEqual(got, want) {
-			t.Errorf("Expected %v, got %v", want, got)
-			return
-		}
+			if w := send("private", `{"name":"mine"}`, true); w.Code != http.StatusForbidden {
+				t.Errorf("Expected status %d, got %d", http.StatusForbidden, w.Code)
+			}
+		})
 	})
 }
 
@@ -1944,3 +3221,243 @@ func TestHealth(t *testing.T) {
 		}
 	})
 }
+
+func TestListQueries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		for i, owner := range []string{"admin", "admin", "user", "admin"} {
+			shareName := fmt.Sprintf("query%d", i)
+			makeShare(t, h, shareName, owner, storage.Options{Exposure: "both"})
+			t.Cleanup(func() {
+				_ = h.Config.Storage.DeleteShare(context.Background(), shareName)
+			})
+		}
+		for i := range 3 {
+			makeItem(t, h, "query0", fmt.Sprintf("item%d.txt", i), 10*(i+1))
+		}
+
+		t.Run("Shares are filtered, sorted and paginated", func(t *testing.T) {
+			names := []string{}
+			u := "/api/v1/shares?prefix=query&owner=admin&sort=-name&limit=2"
+			for {
+				w := serve(h, "GET", u, "", true)
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+				}
+				// Backends reading shares in name order don't count
+				// shares filtered by owner
+				if c := w.Header().Get("X-Total-Count"); c != "" && c != "3" {
+					t.Errorf("Expected total count 3, got %s", c)
+				}
+
+				got := []storage.Share{}
+				err := json.NewDecoder(w.Body).Decode(&got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, s := range got {
+					names = append(names, s.Name)
+				}
+
+				next := w.Header().Get("X-Next-Cursor")
+				if next == "" {
+					break
+				}
+				u = "/api/v1/shares?prefix=query&owner=admin&sort=-name&limit=2&cursor=" + url.QueryEscape(next)
+			}
+
+			want := []string{"query3", "query1", "query0"}
+			if !reflect.DeepEqual(names, want) {
+				t.Errorf("Expected %v, got %v", want, names)
+			}
+		})
+
+		t.Run("Hidden shares are not listed", func(t *testing.T) {
+			h.Config.Values.HideOtherShares = true
+			t.Cleanup(func() { h.Config.Values.HideOtherShares = false })
+
+			w := serve(h, "GET", "/api/v1/shares?owner=user&prefix=query", "", true)
+			if w.Header().Get("X-Total-Count") != "3" {
+				t.Errorf("Expected total count 3, got %s", w.Header().Get("X-Total-Count"))
+			}
+		})
+
+		t.Run("Items are filtered, sorted and paginated", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/shares/query0/items?sort=-size&limit=2&prefix=item", "", true)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			got := []storage.Item{}
+			err := json.NewDecoder(w.Body).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != 2 || got[0].Path != "query0/item2.txt" || got[1].Path != "query0/item1.txt" {
+				t.Errorf("Unexpected items %v", got)
+			}
+			if w.Header().Get("X-Total-Count") != "3" || w.Header().Get("X-Next-Cursor") == "" {
+				t.Errorf("Unexpected headers %v", w.Header())
+			}
+		})
+
+		t.Run("Invalid queries are rejected", func(t *testing.T) {
+			for _, u := range []string{
+				"/api/v1/shares?sort=date",
+				"/api/v1/shares?status=old",
+				"/api/v1/shares?limit=ten",
+				"/api/v1/shares?created_after=yesterday",
+				"/api/v1/shares?cursor=invalid",
+				"/api/v1/shares/query0/items?sort=created",
+			} {
+				w := serve(h, "GET", u, "", true)
+				if w.Code != http.StatusBadRequest {
+					t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, u, w.Code)
+				}
+			}
+		})
+	})
+}
+
+func TestSearch(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		makeShare(t, h, "searchadmin", "admin", storage.Options{Description: "Invoices from suppliers"})
+		makeShare(t, h, "searchother", "admin2", storage.Options{Message: "Please upload invoices"})
+		makeItem(t, h, "searchadmin", "invoice-2024.pdf", 10)
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "searchadmin")
+			_ = h.Config.Storage.DeleteShare(context.Background(), "searchother")
+		})
+
+		t.Run("Search without authentication should fail", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/search?q=invoices", "", false)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+		})
+
+		t.Run("Results are ranked and paginated", func(t *testing.T) {
+			got := []string{}
+			u := "/api/v1/search?q=invoice&limit=2"
+			for {
+				w := serve(h, "GET", u, "", true)
+				if w.Code != http.StatusOK {
+					t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+				}
+				if w.Header().Get("X-Total-Count") != "3" {
+					t.Errorf("Expected total count 3, got %s", w.Header().Get("X-Total-Count"))
+				}
+
+				results := []struct {
+					Share string `json:"share"`
+					Item  string `json:"item"`
+				}{}
+				err := json.NewDecoder(w.Body).Decode(&results)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, r := range results {
+					got = append(got, path.Join(r.Share, r.Item))
+				}
+
+				next := w.Header().Get("X-Next-Cursor")
+				if next == "" {
+					break
+				}
+				u = "/api/v1/search?q=invoice&limit=2&cursor=" + url.QueryEscape(next)
+			}
+
+			want := []string{"searchadmin/invoice-2024.pdf", "searchadmin", "searchother"}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Expected %v, got %v", want, got)
+			}
+		})
+
+		t.Run("Hidden shares are not found", func(t *testing.T) {
+			h.Config.Values.HideOtherShares = true
+			t.Cleanup(func() { h.Config.Values.HideOtherShares = false })
+
+			w := serve(h, "GET", "/api/v1/search?q=invoices", "", true)
+			if w.Header().Get("X-Total-Count") != "1" {
+				t.Errorf("Expected total count 1, got %s", w.Header().Get("X-Total-Count"))
+			}
+		})
+
+		t.Run("Invalid cursor should fail", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/search?q=invoices&cursor=invalid", "", true)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, w.Code)
+			}
+		})
+	})
+}
+
+func TestCheck(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, h *Hupload) {
+		makeShare(t, h, "checkshare", "admin", storage.Options{})
+		makeItem(t, h, "checkshare", "item.txt", 10)
+		t.Cleanup(func() {
+			_ = h.Config.Storage.DeleteShare(context.Background(), "checkshare")
+		})
+
+		downloads := map[string]int64{"item.txt": 1, "deleted.txt": 2}
+		_, err := h.Config.Storage.UpdateShare(context.Background(), "checkshare", nil, &downloads)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		check := func(t *testing.T, method string) []storage.Problem {
+			w := serve(h, method, "/api/v1/admin/check", "", true)
+			if w.Code != http.StatusOK {
+				t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+			}
+
+			report := storage.CheckReport{}
+			err := json.NewDecoder(w.Body).Decode(&report)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			result := []storage.Problem{}
+			for _, p := range report.Problems {
+				if p.Share == "checkshare" {
+					result = append(result, p)
+				}
+			}
+			return result
+		}
+
+		t.Run("Check without authentication should fail", func(t *testing.T) {
+			w := serve(h, "GET", "/api/v1/admin/check", "", false)
+			if w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+			}
+		})
+
+		t.Run("Check reports problems", func(t *testing.T) {
+			problems := check(t, "GET")
+			if len(problems) != 1 || problems[0].Kind != storage.ProblemStaleDownloads || problems[0].Repaired {
+				t.Errorf("Expected unrepaired stale downloads, got %+v", problems)
+			}
+		})
+
+		t.Run("Repair fixes problems", func(t *testing.T) {
+			problems := check(t, "POST")
+			if len(problems) != 1 || !problems[0].Repaired {
+				t.Errorf("Expected repaired stale downloads, got %+v", problems)
+			}
+
+			problems = check(t, "GET")
+			if len(problems) != 0 {
+				t.Errorf("Expected no problems, got %+v", problems)
+			}
+
+			share, err := h.Config.Storage.GetShare(context.Background(), "checkshare")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(share.Downloads, map[string]int64{"item.txt": 1}) {
+				t.Errorf("Expected downloads of existing items to be kept, got %v", share.Downloads)
+			}
+		})
+	})
+}
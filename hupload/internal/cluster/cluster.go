@@ -0,0 +1,344 @@
+// Package cluster coordinates Hupload instances sharing a storage backend.
+//
+// Instances elect a leader with a lease stored in the backend, in the bucket
+// for object storage or in the storage directory for the file backend.
+// Singleton tasks only run on the leader, and metadata updates of a share are
+// serialized across instances with a lease per share.
+package cluster
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// DefaultLeaseDuration is the duration of leases when none is configured
+const DefaultLeaseDuration = 15 * time.Second
+
+// leaderLease is the name of the lease held by the leader
+const leaderLease = "leader"
+
+var (
+	// ErrLockTimeout is returned when a share lock can't be acquired in
+	// time
+	ErrLockTimeout = errors.New("timeout waiting for share lock")
+
+	// ErrLockLost is the cause of the cancellation of the context of a
+	// share lock which lease couldn't be renewed
+	ErrLockLost = errors.New("share lock lost")
+)
+
+// Config is the cluster section of the configuration file
+// Enabled turns coordination on, it is required when several instances share
+// the same storage
+// ID identifies this instance, it defaults to the host name
+// LeaseSeconds is the duration of leases, the leader is replaced at most this
+// long after it stops
+// RefreshSeconds is the interval at which state kept in memory, like the
+// search index, is reloaded from storage to include changes made by other
+// instances
+type Config struct {
+	Enabled        bool   `yaml:"enabled"`
+	ID             string `yaml:"id,omitempty"`
+	LeaseSeconds   int    `yaml:"lease_seconds,omitempty"`
+	RefreshSeconds int    `yaml:"refresh_seconds,omitempty"`
+}
+
+// DefaultRefreshInterval is the interval at which state kept in memory is
+// reloaded when none is configured
+const DefaultRefreshInterval = time.Minute
+
+// Cluster coordinates this instance with other instances using the same
+// LeaseStore
+type Cluster struct {
+	ID    string
+	Store storage.LeaseStore
+
+	// LeaseDuration is the duration of the leader lease and share locks,
+	// they are renewed every third of it
+	LeaseDuration time.Duration
+
+	// local serializes share locks within this instance, as share leases
+	// are held by the instance
+	local storage.LocalLocker
+
+	mu     sync.Mutex
+	leader bool
+	tasks  []*task
+
+	// leaderCtx is passed to tasks, it is canceled when leadership is lost
+	leaderCtx    context.Context
+	leaderCancel context.CancelFunc
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// task is a singleton task run every interval on the leader
+type task struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+
+	last    time.Time
+	running bool
+}
+
+// New returns a Cluster for instance id using store, or the host name if id
+// is empty
+func New(store storage.LeaseStore, id string) *Cluster {
+	if id == "" {
+		id, _ = os.Hostname()
+	}
+
+	return &Cluster{
+		ID:            id,
+		Store:         store,
+		LeaseDuration: DefaultLeaseDuration,
+	}
+}
+
+// WithLeaseDuration sets the duration of leases
+func (c *Cluster) WithLeaseDuration(d time.Duration) *Cluster {
+	c.LeaseDuration = d
+	return c
+}
+
+// AddTask registers a task run every interval, only on the leader. The
+// context passed to run is canceled when leadership is lost.
+func (c *Cluster) AddTask(name string, interval time.Duration, run func(ctx context.Context) error) *Cluster {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tasks = append(c.tasks, &task{name: name, interval: interval, run: run})
+
+	return c
+}
+
+// IsLeader returns true if this instance is the leader
+func (c *Cluster) IsLeader() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.leader
+}
+
+// Start starts campaigning for leadership and running tasks in the
+// background until ctx is done or Stop is called
+func (c *Cluster) Start(ctx context.Context) {
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.done = make(chan struct{})
+
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(c.LeaseDuration / 3)
+		defer ticker.Stop()
+
+		for {
+			c.campaign(ctx)
+			c.runTasks()
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop stops campaigning and releases leadership so another instance takes
+// over without waiting for the lease to expire
+func (c *Cluster) Stop() {
+	if c.cancel == nil {
+		return
+	}
+	c.cancel()
+	<-c.done
+
+	c.setLeader(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.LeaseDuration)
+	defer cancel()
+
+	err := c.Store.ReleaseLease(ctx, leaderLease, c.ID)
+	if err != nil {
+		slog.Error("cannot release leader lease", slog.String("error", err.Error()))
+	}
+}
+
+// campaign acquires or renews the leader lease
+func (c *Cluster) campaign(ctx context.Context) {
+	_, err := c.Store.AcquireLease(ctx, leaderLease, c.ID, c.LeaseDuration)
+	if err != nil && !errors.Is(err, storage.ErrLeaseHeld) && ctx.Err() == nil {
+		slog.Error("cannot acquire leader lease", slog.String("error", err.Error()))
+	}
+
+	// Leadership is also given up when the lease can't be renewed, as
+	// another instance will take over when it expires
+	c.setLeader(err == nil)
+}
+
+func (c *Cluster) setLeader(leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if leader == c.leader {
+		return
+	}
+	c.leader = leader
+
+	if leader {
+		slog.Info("instance is now the leader", slog.String("id", c.ID))
+		return
+	}
+
+	slog.Info("instance is not the leader anymore", slog.String("id", c.ID))
+	if c.leaderCancel != nil {
+		c.leaderCancel()
+		c.leaderCtx, c.leaderCancel = nil, nil
+	}
+}
+
+// runTasks starts tasks that are due if this instance is the leader
+func (c *Cluster) runTasks() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.leader {
+		return
+	}
+
+	if c.leaderCtx == nil {
+		c.leaderCtx, c.leaderCancel = context.WithCancel(context.Background())
+	}
+
+	now := time.Now()
+	for _, t := range c.tasks {
+		if t.running || now.Sub(t.last) < t.interval {
+			continue
+		}
+		t.running = true
+		t.last = now
+
+		go c.runTask(c.leaderCtx, t)
+	}
+}
+
+func (c *Cluster) runTask(ctx context.Context, t *task) {
+	err := t.run(ctx)
+	if err != nil {
+		slog.Error("task failed", slog.String("task", t.name), slog.String("error", err.Error()))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t.running = false
+}
+
+// Lock locks share name across instances, it implements storage.Locker. The
+// lock is a lease of LeaseDuration, renewed every third of it while the lock
+// is held. The returned context is canceled with ErrLockLost if the lease
+// can't be renewed, so operations made while holding the lock fail instead of
+// running without it.
+func (c *Cluster) Lock(ctx context.Context, name string) (context.Context, func(), error) {
+	_, unlock, err := c.local.Lock(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lease := "share-" + name
+
+	err = c.acquireShareLease(ctx, lease)
+	if err != nil {
+		unlock()
+		return nil, nil, fmt.Errorf("%w : %s", err, name)
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		c.renewShareLease(lease, stop, cancel)
+	}()
+
+	return ctx, func() {
+		close(stop)
+		<-done
+		cancel(nil)
+
+		err := c.Store.ReleaseLease(context.Background(), lease, c.ID)
+		if err != nil {
+			slog.Error("cannot release share lock", slog.String("error", err.Error()), slog.String("share", name))
+		}
+		unlock()
+	}, nil
+}
+
+// acquireShareLease acquires lease, waiting up to twice LeaseDuration for
+// another instance to release it
+func (c *Cluster) acquireShareLease(ctx context.Context, lease string) error {
+	ctx, cancel := context.WithTimeout(ctx, 2*c.LeaseDuration)
+	defer cancel()
+
+	for {
+		_, err := c.Store.AcquireLease(ctx, lease, c.ID, c.LeaseDuration)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, storage.ErrLeaseHeld) && ctx.Err() == nil {
+			return err
+		}
+
+		// Wait for the other instance to release the lock
+		delay := 10*time.Millisecond + rand.N(20*time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return ErrLockTimeout
+		case <-time.After(delay):
+		}
+	}
+}
+
+// renewShareLease renews lease every third of LeaseDuration until stop is
+// closed. The lock is lost, and lost is called with ErrLockLost, if another
+// instance took the lease or if it couldn't be renewed before it expires.
+func (c *Cluster) renewShareLease(lease string, stop chan struct{}, lost context.CancelCauseFunc) {
+	ticker := time.NewTicker(c.LeaseDuration / 3)
+	defer ticker.Stop()
+
+	renewed := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.LeaseDuration/3)
+		_, err := c.Store.AcquireLease(ctx, lease, c.ID, c.LeaseDuration)
+		cancel()
+		if err == nil {
+			renewed = time.Now()
+			continue
+		}
+
+		slog.Error("cannot renew share lock", slog.String("error", err.Error()), slog.String("lease", lease))
+
+		// Transient errors are retried while the lease is still valid
+		if errors.Is(err, storage.ErrLeaseHeld) || time.Since(renewed) >= c.LeaseDuration*2/3 {
+			lost(ErrLockLost)
+			return
+		}
+	}
+}
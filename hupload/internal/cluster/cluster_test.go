@@ -0,0 +1,219 @@
+package cluster_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/cluster"
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+const leaseDuration = 300 * time.Millisecond
+
+// waitFor waits until cond is true or fails after d
+func waitFor(t *testing.T, d time.Duration, msg string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(d)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLeaderElection(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryStorageConfig{})
+
+	var runs [2]atomic.Int32
+	clusters := [2]*cluster.Cluster{}
+	for i := range clusters {
+		clusters[i] = cluster.New(store, []string{"a", "b"}[i]).
+			WithLeaseDuration(leaseDuration).
+			AddTask("count", 0, func(ctx context.Context) error {
+				runs[i].Add(1)
+				return nil
+			})
+	}
+
+	clusters[0].Start(context.Background())
+	waitFor(t, time.Second, "Expected a to be the leader", clusters[0].IsLeader)
+
+	clusters[1].Start(context.Background())
+	defer clusters[1].Stop()
+
+	// Only the leader runs tasks
+	time.Sleep(leaseDuration)
+	if clusters[1].IsLeader() {
+		t.Error("Expected a single leader")
+	}
+	if runs[0].Load() == 0 || runs[1].Load() != 0 {
+		t.Errorf("Expected tasks to run on a only, got %d and %d", runs[0].Load(), runs[1].Load())
+	}
+
+	// Leadership is handed over when the leader stops
+	clusters[0].Stop()
+	if clusters[0].IsLeader() {
+		t.Error("Expected a not to be the leader anymore")
+	}
+	before := runs[0].Load()
+
+	waitFor(t, leaseDuration, "Expected b to be the leader", clusters[1].IsLeader)
+	waitFor(t, leaseDuration, "Expected tasks to run on b", func() bool { return runs[1].Load() > 0 })
+
+	if runs[0].Load() != before {
+		t.Error("Expected tasks not to run on a anymore")
+	}
+}
+
+func TestLeaseExpiration(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryStorageConfig{})
+
+	// An instance that stopped without releasing its lease
+	_, err := store.AcquireLease(context.Background(), "leader", "gone", leaseDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := cluster.New(store, "a").WithLeaseDuration(leaseDuration)
+	c.Start(context.Background())
+	defer c.Stop()
+
+	time.Sleep(leaseDuration / 2)
+	if c.IsLeader() {
+		t.Error("Expected a not to be the leader before the lease expires")
+	}
+
+	waitFor(t, 2*leaseDuration, "Expected a to be the leader after the lease expired", c.IsLeader)
+}
+
+func TestTaskCanceled(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryStorageConfig{})
+
+	canceled := make(chan struct{})
+	c := cluster.New(store, "a").
+		WithLeaseDuration(leaseDuration).
+		AddTask("wait", time.Hour, func(ctx context.Context) error {
+			<-ctx.Done()
+			close(canceled)
+			return nil
+		})
+
+	c.Start(context.Background())
+	waitFor(t, time.Second, "Expected a to be the leader", c.IsLeader)
+
+	// Running tasks are canceled when leadership is lost
+	c.Stop()
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("Expected task to be canceled")
+	}
+}
+
+func TestLock(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryStorageConfig{})
+
+	a := cluster.New(store, "a").WithLeaseDuration(leaseDuration)
+	b := cluster.New(store, "b").WithLeaseDuration(leaseDuration)
+
+	// Locks are exclusive across instances and within an instance
+	counter := 0
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c := a
+			if i%2 == 1 {
+				c = b
+			}
+			_, unlock, err := c.Lock(context.Background(), "share")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+			v := counter
+			time.Sleep(time.Millisecond)
+			counter = v + 1
+		}()
+	}
+	wg.Wait()
+
+	if counter != 20 {
+		t.Errorf("Expected 20, got %d", counter)
+	}
+
+	// Waiting for a lock stops when ctx is done
+	_, unlock, err := a.Lock(context.Background(), "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), leaseDuration/2)
+	defer cancel()
+	_, _, err = b.Lock(ctx, "share")
+	if !errors.Is(err, cluster.ErrLockTimeout) {
+		t.Errorf("Expected ErrLockTimeout, got %v", err)
+	}
+
+	// Locks are renewed while they are held
+	time.Sleep(leaseDuration)
+	ctx, cancel = context.WithTimeout(context.Background(), leaseDuration/2)
+	defer cancel()
+	_, _, err = b.Lock(ctx, "share")
+	if !errors.Is(err, cluster.ErrLockTimeout) {
+		t.Errorf("Expected lock to be renewed, got %v", err)
+	}
+	unlock()
+
+	// Locks of an instance that stopped are taken over when they expire
+	_, err = store.AcquireLease(context.Background(), "share-other", "gone", leaseDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, unlockB, err := b.Lock(context.Background(), "other")
+	if err != nil {
+		t.Errorf("Expected lock to be acquired after expiration, got %v", err)
+	} else {
+		unlockB()
+	}
+}
+
+func TestLockLost(t *testing.T) {
+	store := storage.NewMemoryStorage(storage.MemoryStorageConfig{})
+	a := cluster.New(store, "a").WithLeaseDuration(leaseDuration)
+
+	ctx, unlock, err := a.Lock(context.Background(), "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	// Another instance takes the lease, as if it expired while a was
+	// unable to renew it
+	err = store.ReleaseLease(context.Background(), "share-share", "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.AcquireLease(context.Background(), "share-share", "b", leaseDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ctx.Done():
+		if !errors.Is(context.Cause(ctx), cluster.ErrLockLost) {
+			t.Errorf("Expected ErrLockLost, got %v", context.Cause(ctx))
+		}
+	case <-time.After(leaseDuration):
+		t.Error("Expected context of the lock to be canceled")
+	}
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"errors"
 	"os"
+	"reflect"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
@@ -10,6 +12,7 @@ import (
 	"github.com/ybizeul/apiws/auth"
 	"github.com/ybizeul/apiws/auth/oidc"
 
+	"github.com/ybizeul/hupload/internal/cluster"
 	"github.com/ybizeul/hupload/internal/storage"
 )
 
@@ -39,17 +42,25 @@ type ConfigValues struct {
 	Storage             TypeOptions       `yaml:"storage"`
 	Authentication      TypeOptions       `yaml:"auth"`
 	MessageTemplates    []MessageTemplate `yaml:"messages"`
+	FormTemplates       []FormTemplate    `yaml:"forms"`
+	Cluster             cluster.Config    `yaml:"cluster"`
+	PurgeExpired        bool              `yaml:"purge_expired"`
 }
 
 // Config is the internal representation of Hupload configuration file at path
 // Path. Storage and Authentication are interfaces to the actual backends used
-// to store shares data and authenticate users.
+// to store shares data and authenticate users. Cluster coordinates instances
+// sharing Storage, it is nil unless enabled.
 type Config struct {
 	Path   string
 	Values ConfigValues
 
 	Storage        storage.Storage
 	Authentication auth.Authentication
+	Cluster        *cluster.Cluster
+
+	// root is the yaml document read from Path, used to report line numbers
+	root *yaml.Node
 }
 
 // Load reads the configuration file and populates the Config struct
@@ -61,6 +72,52 @@ type Config struct {
 // missing so appropriate action can be taken by the caller.
 
 func (c *Config) Load() (fileExists bool, err error) {
+	defer func() {
+		if err != nil {
+			return
+		}
+
+		c.Storage, err = c.storage()
+		if err != nil {
+			return
+		}
+
+		c.Cluster, err = c.cluster()
+		if err != nil {
+			return
+		}
+
+		c.Authentication, err = c.authentication()
+		if err != nil {
+			return
+		}
+	}()
+
+	return c.Check()
+}
+
+// LoadStorage reads the configuration file like Load but only creates the
+// storage backend, for command line tools that don't need authentication.
+
+func (c *Config) LoadStorage() (fileExists bool, err error) {
+	fileExists, err = c.Check()
+	if err != nil {
+		return fileExists, err
+	}
+
+	c.Storage, err = c.storage()
+
+	return fileExists, err
+}
+
+// Check reads and validates the configuration file without creating the
+// storage and authentication backends. Unknown keys, type mismatches and
+// invalid backend options are all reported at once in a ValidationErrors,
+// along with their line number in the file.
+// fileExists is a boolean that is set to false if the configuration file is
+// missing, in which case default values are validated.
+
+func (c *Config) Check() (fileExists bool, err error) {
 	// Set default templating values
 	c.Values = ConfigValues{
 		Title:               "Hupload",
@@ -77,40 +134,51 @@ func (c *Config) Load() (fileExists bool, err error) {
 			Type: "default",
 		},
 	}
+	c.root = nil
 
-	fileExists = true
-
-	defer func() {
-		if err != nil {
-			return
+	// Open the configuration file
+	b, err := os.ReadFile(c.Path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return false, c.Validate()
 		}
+		return true, err
+	}
 
-		c.Storage, err = c.storage()
-		if err != nil {
-			return
-		}
+	// Keep the document tree to report line numbers of backend options
+	var root yaml.Node
+	err = yaml.Unmarshal(b, &root)
+	if err != nil {
+		return true, err
+	}
+	c.root = &root
 
-		c.Authentication, err = c.authentication()
-		if err != nil {
-			return
-		}
-	}()
+	// Resolve environment and secret files references before decoding
+	errs, secrets := interpolate(&root)
 
-	// Open the configuration file
-	f, err2 := os.Open(c.Path)
-	if err2 != nil {
-		if errors.Is(err2, os.ErrNotExist) {
-			fileExists = false
-			return
+	// Reject unknown keys, then populate yaml content to Config struct
+	errs = append(errs, knownKeys(&root, reflect.TypeOf(c.Values), "")...)
+
+	err = root.Decode(&c.Values)
+	if err != nil {
+		var te *yaml.TypeError
+		if !errors.As(err, &te) {
+			return true, err
 		}
-		return true, err
+		errs = append(errs, typeErrors(err, "")...)
 	}
-	defer f.Close()
 
-	// populate yaml content to Config struct
-	err = yaml.NewDecoder(f).Decode(&c.Values)
+	err = c.Validate()
 	if err != nil {
-		return true, err
+		var ve ValidationErrors
+		if !errors.As(err, &ve) {
+			return true, err
+		}
+		errs = append(errs, ve...)
+	}
+
+	if len(errs) > 0 {
+		return true, redact(errs, secrets)
 	}
 
 	return true, nil
@@ -122,111 +190,82 @@ func (c *Config) Load() (fileExists bool, err error) {
 // it returns a storage.Storage interface and an error if something failed
 
 func (c *Config) storage() (storage.Storage, error) {
-	s := c.Values.Storage
-	if s.Type == "" {
-		return nil, ErrMissingStorageBackendType
+	o, errs := c.storageOptions()
+	if len(errs) > 0 {
+		return nil, errs
 	}
 
-	switch c.Values.Storage.Type {
-	case "file":
-		var options storage.FileStorageConfig
-		b, err := yaml.Marshal(s.Options)
-		if err != nil {
-			return nil, err
-		}
-
-		err = yaml.Unmarshal(b, &options)
-		if err != nil {
-			return nil, err
-		}
-
+	switch options := o.(type) {
+	case storage.FileStorageConfig:
 		return storage.NewFileStorage(options), nil
 
-	case "s3":
-		var options storage.S3StorageConfig
-		b, err := yaml.Marshal(s.Options)
-		if err != nil {
-			return nil, err
-		}
-
-		err = yaml.Unmarshal(b, &options)
-		if err != nil {
-			return nil, err
-		}
-
-		if options.Region == "" {
-			if os.Getenv("AWS_DEFAULT_REGION") == "" {
-				panic("missing region parameter or AWS_DEFAULT_REGION environment for s3 config !")
-			}
-			options.Region = os.Getenv("AWS_DEFAULT_REGION")
+	case storage.S3StorageConfig:
+		s := storage.NewS3Storage(options)
+		if s == nil {
+			return nil, ErrStorageInitialization
 		}
+		return s, nil
 
-		if options.AWSKey == "" {
-			if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
-				panic("missing aws_key parameter or AWS_ACCESS_KEY_ID environment for s3 config !")
-			}
-			options.AWSKey = os.Getenv("AWS_ACCESS_KEY_ID")
+	case storage.MinioStorageConfig:
+		s := storage.NewMinioStorage(options)
+		if s == nil {
+			return nil, ErrStorageInitialization
 		}
+		return s, nil
 
-		if options.AWSSecret == "" {
-			if os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
-				panic("missing aws_secret parameter or AWS_SECRET_ACCESS_KEY environment for s3 config !")
-			}
-			options.AWSSecret = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	case storage.MemoryStorageConfig:
+		s := storage.NewMemoryStorage(options)
+		if s == nil {
+			return nil, ErrStorageInitialization
 		}
+		return s, nil
+	}
 
-		if options.Bucket == "" {
-			if os.Getenv("BUCKET") == "" {
-				panic("missing bucket parameter or BUCKET environment for s3 config !")
-			}
-			options.Bucket = os.Getenv("BUCKET")
-		}
+	return nil, ErrUnknownStorageBackend
+}
 
-		return storage.NewS3Storage(options), nil
-	case "minio":
-		var options storage.MinioStorageConfig
-		b, err := yaml.Marshal(s.Options)
-		if err != nil {
-			return nil, err
-		}
+// cluster returns the cluster coordinating this instance with other instances
+// sharing the storage backend, or nil if it is not enabled. Share metadata
+// updates of the backend are serialized across instances by the cluster.
+func (c *Config) cluster() (*cluster.Cluster, error) {
+	o := c.Values.Cluster
+	if !o.Enabled {
+		return nil, nil
+	}
 
-		err = yaml.Unmarshal(b, &options)
-		if err != nil {
-			return nil, err
-		}
+	store, ok := c.Storage.(storage.LeaseStore)
+	if !ok {
+		return nil, ErrClusterUnsupported
+	}
 
-		if options.Region == "" {
-			if os.Getenv("AWS_DEFAULT_REGION") == "" {
-				panic("missing region parameter or AWS_DEFAULT_REGION environment for s3 config !")
-			}
-			options.Region = os.Getenv("AWS_DEFAULT_REGION")
-		}
+	result := cluster.New(store, o.ID)
+	if o.LeaseSeconds > 0 {
+		result.WithLeaseDuration(time.Duration(o.LeaseSeconds) * time.Second)
+	}
 
-		if options.AWSKey == "" {
-			if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
-				panic("missing aws_key parameter or AWS_ACCESS_KEY_ID environment for s3 config !")
-			}
-			options.AWSKey = os.Getenv("AWS_ACCESS_KEY_ID")
-		}
+	if l, ok := c.Storage.(storage.Lockable); ok {
+		l.SetLocker(result)
+	}
 
-		if options.AWSSecret == "" {
-			if os.Getenv("AWS_SECRET_ACCESS_KEY") == "" {
-				panic("missing aws_secret parameter or AWS_SECRET_ACCESS_KEY environment for s3 config !")
-			}
-			options.AWSSecret = os.Getenv("AWS_SECRET_ACCESS_KEY")
-		}
+	return result, nil
+}
 
-		if options.Bucket == "" {
-			if os.Getenv("BUCKET") == "" {
-				panic("missing bucket parameter or BUCKET environment for s3 config !")
-			}
-			options.Bucket = os.Getenv("BUCKET")
+// s3Env sets S3 options that are missing from the configuration file from
+// their corresponding environment variables.
+func s3Env(region, key, secret, bucket *string) {
+	for _, o := range []struct {
+		value *string
+		env   string
+	}{
+		{region, "AWS_DEFAULT_REGION"},
+		{key, "AWS_ACCESS_KEY_ID"},
+		{secret, "AWS_SECRET_ACCESS_KEY"},
+		{bucket, "BUCKET"},
+	} {
+		if *o.value == "" {
+			*o.value = os.Getenv(o.env)
 		}
-
-		return storage.NewMinioStorage(options), nil
 	}
-
-	return nil, ErrUnknownStorageBackend
 }
 
 // authentication returns the authentication backend struct that will be used to
@@ -237,6 +276,11 @@ func (c *Config) storage() (storage.Storage, error) {
 func (c *Config) authentication() (auth.Authentication, error) {
 	a := c.Values.Authentication
 
+	o, errs := c.authenticationOptions()
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
 	withAPIKeys := func(base auth.Authentication, err error) (auth.Authentication, error) {
 		if err != nil {
 			return nil, err
@@ -255,25 +299,9 @@ func (c *Config) authentication() (auth.Authentication, error) {
 
 	switch a.Type {
 	case "file":
-		filePath, ok := a.Options["path"].(string)
-		if !ok {
-			return nil, errors.New("missing path: parameter for file authentication backend")
-		}
-
-		return withAPIKeys(apiws.NewFile(filePath))
+		return withAPIKeys(apiws.NewFile(o.(string)))
 	case "oidc":
-		var options oidc.OIDCConfig
-
-		b, err := yaml.Marshal(a.Options)
-		if err != nil {
-			return nil, err
-		}
-
-		err = yaml.Unmarshal(b, &options)
-		if err != nil {
-			return nil, err
-		}
-		return withAPIKeys(apiws.NewOIDC(options))
+		return withAPIKeys(apiws.NewOIDC(o.(oidc.OIDCConfig)))
 	case "default":
 		return withAPIKeys(apiws.NewBasic("admin", nil), nil)
 	}
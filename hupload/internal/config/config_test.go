@@ -1,16 +1,21 @@
 package config
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/ybizeul/apiws/auth"
 	"github.com/ybizeul/apiws/auth/file"
 	"github.com/ybizeul/hupload/internal/storage"
+	"gopkg.in/yaml.v3"
 )
 
 func TestLoadEmptyConfig(t *testing.T) {
@@ -95,6 +100,15 @@ func TestLoadGoodConfig(t *testing.T) {
 				Message: "Message content",
 			},
 		},
+		FormTemplates: []FormTemplate{
+			{
+				Title: "Support case",
+				Fields: []storage.ItemField{
+					{Name: "case", Label: "Case number", Required: true},
+					{Name: "product", Type: storage.FieldSelect, Choices: []string{"hupload", "other"}},
+				},
+			},
+		},
 	}
 
 	got := c.Values
@@ -247,3 +261,357 @@ func TestInvalidAPIKeyAddsAuthenticationError(t *testing.T) {
 		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
 	}
 }
+
+func TestCheckUnknownKeys(t *testing.T) {
+	c := Config{
+		Path: "config_testdata/config_unknown_keys.yml",
+	}
+	b, err := c.Check()
+	if !b {
+		t.Errorf("Expected config file to be found")
+	}
+
+	if !errors.Is(err, ErrInvalidConfiguration) {
+		t.Fatalf("Expected ErrInvalidConfiguration, got %v", err)
+	}
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ValidationErrors, got %T", err)
+	}
+
+	want := []struct {
+		line int
+		key  string
+	}{
+		{3, "hide_other_share"},
+		{2, "default_exposure"},
+		{13, "storage.options.max_share_md"},
+	}
+
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(want), len(errs), err)
+	}
+
+	for i, w := range want {
+		if errs[i].Line != w.line || errs[i].Key != w.key {
+			t.Errorf("Expected error at line %d for %q, got %v", w.line, w.key, errs[i])
+		}
+	}
+}
+
+func TestLoadMemoryConfig(t *testing.T) {
+	c := Config{
+		Path: "config_testdata/config_memory.yml",
+	}
+	_, err := c.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	m, ok := c.Storage.(*storage.MemoryBackend)
+	if !ok {
+		t.Fatalf("Expected memory backend, got %T", c.Storage)
+	}
+
+	want := storage.MemoryStorageConfig{MaxFileSize: 1, Seed: "../storage/memory_testdata/seed.yml", Demo: true}
+	if m.Options != want {
+		t.Errorf("Expected %+v, got %+v", want, m.Options)
+	}
+
+	_, err = m.GetShare(context.Background(), "report")
+	if err != nil {
+		t.Errorf("Expected seeded share, got %v", err)
+	}
+}
+
+func TestCheckFileLargerThanShare(t *testing.T) {
+	// max_file_mb greater than max_share_mb is only a warning
+	c := Config{
+		Path: "config_testdata/config_sizes.yml",
+	}
+	_, err := c.Check()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+}
+
+func TestLoadClusterConfig(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.RemoveAll("data")
+	})
+
+	c := Config{
+		Path: "config_testdata/config_cluster.yml",
+	}
+	_, err := c.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if c.Cluster == nil {
+		t.Fatalf("Expected cluster to be created")
+	}
+	if c.Cluster.ID != "pod-a" || c.Cluster.LeaseDuration != 30*time.Second {
+		t.Errorf("Unexpected cluster %s with lease duration %v", c.Cluster.ID, c.Cluster.LeaseDuration)
+	}
+
+	// Cluster is disabled by default
+	c = Config{
+		Path: "config_testdata/config_memory.yml",
+	}
+	_, err = c.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if c.Cluster != nil {
+		t.Errorf("Expected no cluster")
+	}
+}
+
+func TestCheckClusterOptions(t *testing.T) {
+	c := Config{
+		Path: "config_testdata/config_cluster_invalid.yml",
+	}
+	_, err := c.Check()
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	want := []struct {
+		line int
+		key  string
+	}{
+		{9, "cluster.lease_seconds"},
+		{10, "cluster.refresh_seconds"},
+		{8, "cluster.enabled"},
+	}
+
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(want), len(errs), err)
+	}
+
+	for i, w := range want {
+		if errs[i].Line != w.line || errs[i].Key != w.key {
+			t.Errorf("Expected error at line %d for %q, got %v", w.line, w.key, errs[i])
+		}
+	}
+}
+
+func TestCheckFormTemplates(t *testing.T) {
+	c := Config{
+		Path: "config_testdata/config_forms_invalid.yml",
+	}
+	_, err := c.Check()
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	want := []struct {
+		line int
+		key  string
+	}{
+		{8, "forms[0].title"},
+		{8, "forms[1].fields"},
+	}
+
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(want), len(errs), err)
+	}
+
+	for i, w := range want {
+		if errs[i].Line != w.line || errs[i].Key != w.key {
+			t.Errorf("Expected error at line %d for %q, got %v", w.line, w.key, errs[i])
+		}
+	}
+}
+
+func TestCheckS3MissingOptions(t *testing.T) {
+	for _, env := range []string{"AWS_DEFAULT_REGION", "AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "BUCKET"} {
+		t.Setenv(env, "")
+	}
+	t.Setenv("AWS_DEFAULT_REGION", "us-east-1")
+
+	c := Config{
+		Path: "config_testdata/config_s3_missing.yml",
+	}
+	_, err := c.Load()
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	// max_file_mb type mismatch, aws_key, aws_secret and bucket
+	if len(errs) != 4 {
+		t.Fatalf("Expected 4 errors, got %d: %v", len(errs), err)
+	}
+
+	if errs[0].Line != 4 {
+		t.Errorf("Expected type error on line 4, got %v", errs[0])
+	}
+
+	if c.Storage != nil {
+		t.Errorf("Expected storage backend not to be created")
+	}
+}
+
+func TestCheckOIDCMissingOptions(t *testing.T) {
+	c := Config{
+		Path: "config_testdata/config_oidc_missing.yml",
+	}
+	_, err := c.Check()
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	// Required options are reported in a stable order
+	got := []string{}
+	for _, e := range errs {
+		got = append(got, e.Key)
+	}
+	want := []string{"auth.options.provider_url", "auth.options.client_id", "auth.options.redirect_url"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected errors for %v, got %v", want, got)
+	}
+}
+
+func TestCheckDoesNotCreateBackends(t *testing.T) {
+	c := Config{
+		Path: "config_testdata/config_api_keys.yml",
+	}
+	_, err := c.Check()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if c.Storage != nil || c.Authentication != nil {
+		t.Errorf("Expected backends not to be created")
+	}
+
+	_, err = os.Stat("data")
+	if err == nil {
+		t.Errorf("Expected data directory not to be created")
+	}
+}
+
+func TestInterpolation(t *testing.T) {
+	t.Cleanup(func() {
+		_ = os.RemoveAll("data")
+	})
+
+	t.Setenv("HUPLOAD_TEST_TITLE", "Interpolated")
+	t.Setenv("HUPLOAD_TEST_MAX_FILE", "42")
+
+	c := Config{
+		Path: "config_testdata/config_interpolation.yml",
+	}
+	_, err := c.Load()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if c.Values.Title != "Interpolated" {
+		t.Errorf("Expected title to be Interpolated, got %s", c.Values.Title)
+	}
+
+	if c.Values.DefaultExposure != "both" {
+		t.Errorf("Expected default exposure to be both, got %s", c.Values.DefaultExposure)
+	}
+
+	// Only ${...} references are resolved, other $ and file: are literals
+	wantKeys := []string{"top-secret-key", "key-${literal}", "pa$$word-$1", "file:not-a-secret"}
+	if !reflect.DeepEqual(c.Values.Authentication.APIKeys, wantKeys) {
+		t.Errorf("Expected api keys %v, got %v", wantKeys, c.Values.Authentication.APIKeys)
+	}
+
+	s := c.Storage.(*storage.FileBackend)
+	if s.Options.Path != "data/shares" {
+		t.Errorf("Expected path to be data/shares, got %s", s.Options.Path)
+	}
+	if s.Options.MaxFileSize != 42 {
+		t.Errorf("Expected max file size to be 42, got %d", s.Options.MaxFileSize)
+	}
+}
+
+func TestInterpolationErrors(t *testing.T) {
+	t.Setenv("HUPLOAD_TEST_SIZE", "very-secret-value")
+
+	c := Config{
+		Path: "config_testdata/config_interpolation_errors.yml",
+	}
+	_, err := c.Check()
+
+	var errs ValidationErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ValidationErrors, got %v", err)
+	}
+
+	for _, want := range []string{
+		"line 6: auth.options.client_secret: environment variable HUPLOAD_TEST_UNSET_SECRET is not set",
+		"line 11: storage.options.path: unable to read secret file",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got %v", want, err)
+		}
+	}
+
+	if strings.Contains(err.Error(), "very-se") {
+		t.Errorf("Expected resolved values to be redacted, got %v", err)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	t.Setenv("HUPLOAD_TEST_FLAG", "on")
+	t.Setenv("HUPLOAD_TEST_TOKEN", "very-secret-value")
+
+	_, secrets, err := resolve("${HUPLOAD_TEST_FLAG} ${HUPLOAD_TEST_TOKEN} ${file:config_testdata/secret.txt}")
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Every resolved value is redacted, whatever its length
+	errs := redact(ValidationErrors{{Line: 1, Key: "key", Message: "must be true or false, not on, very-secret-value or top-secret-key"}}, secrets)
+
+	want := "must be true or false, not [redacted], [redacted] or [redacted]"
+	if errs[0].Message != want {
+		t.Errorf("Expected %q, got %q", want, errs[0].Message)
+	}
+}
+
+func TestInterpolationSecretFileValues(t *testing.T) {
+	p, err := filepath.Abs("config_testdata/secret.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := yaml.Node{}
+	err = yaml.Unmarshal([]byte("secret: file:"+p+"\nmissing: file:/nonexistent/secret\nliteral: file:not-a-secret\n"), &n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs, secrets := interpolate(&n)
+	if len(errs) != 1 || errs[0].Key != "missing" || !strings.Contains(errs[0].Message, "unable to read secret file") {
+		t.Errorf("Expected error reading missing file, got %v", errs)
+	}
+	if !reflect.DeepEqual(secrets, []string{"top-secret-key"}) {
+		t.Errorf("Expected secret file content to be redacted, got %v", secrets)
+	}
+
+	values := map[string]string{}
+	err = n.Decode(&values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"secret": "top-secret-key", "missing": "file:/nonexistent/secret", "literal": "file:not-a-secret"}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("Expected %v, got %v", want, values)
+	}
+}
@@ -8,4 +8,7 @@ var (
 	ErrMissingAuthenticationBackendType = errors.New("missing authentication backend type")
 	ErrUnknownStorageBackend            = errors.New("unknown storage backend")
 	ErrUnknownAuthenticationBackend     = errors.New("unknown authentication backend")
+	ErrInvalidConfiguration             = errors.New("invalid configuration")
+	ErrStorageInitialization            = errors.New("unable to initialize storage backend")
+	ErrClusterUnsupported               = errors.New("storage backend can't be shared by instances")
 )
@@ -0,0 +1,10 @@
+package config
+
+import "github.com/ybizeul/hupload/internal/storage"
+
+// FormTemplate is a form defined in the configuration that share owners can
+// use as the fields of item metadata of their shares
+type FormTemplate struct {
+	Title  string              `yaml:"title" json:"title"`
+	Fields []storage.ItemField `yaml:"fields" json:"fields"`
+}
@@ -0,0 +1,180 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// secretFilePrefix introduces a reference to a file, typically a docker or
+// kubernetes secret mounted in the container.
+const secretFilePrefix = "file:"
+
+// secretFileValuePrefix starts values which are entirely a reference to a
+// file with an absolute path, like file:/run/secrets/x.
+const secretFileValuePrefix = secretFilePrefix + "/"
+
+// interpolate resolves references in every string value of the yaml document
+// n, in place, before it is decoded :
+//
+//   - ${VAR} is replaced by the value of environment variable VAR, which must
+//     be set,
+//   - ${VAR:-default} is replaced by the value of VAR, or default if VAR is
+//     unset or empty,
+//   - ${file:/path}, or a value of file:/path alone, is replaced by the
+//     content of the file at /path, without trailing new line,
+//   - $${ is a literal ${.
+//
+// Any other $ is kept as is. It returns the errors encountered, keyed by the
+// dotted path of the value, and the list of secret values so they can be
+// redacted from messages.
+func interpolate(n *yaml.Node) (ValidationErrors, []string) {
+	errs := ValidationErrors{}
+	secrets := []string{}
+
+	var walk func(n *yaml.Node, key string)
+	walk = func(n *yaml.Node, key string) {
+		switch n.Kind {
+		case yaml.DocumentNode:
+			for _, c := range n.Content {
+				walk(c, key)
+			}
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				k := n.Content[i].Value
+				if key != "" {
+					k = key + "." + k
+				}
+				walk(n.Content[i+1], k)
+			}
+		case yaml.SequenceNode:
+			for i, c := range n.Content {
+				walk(c, fmt.Sprintf("%s[%d]", key, i))
+			}
+		case yaml.ScalarNode:
+			if n.ShortTag() != "!!str" {
+				return
+			}
+			if !strings.Contains(n.Value, "${") && !strings.HasPrefix(n.Value, secretFileValuePrefix) {
+				return
+			}
+
+			v, s, err := resolveValue(n.Value)
+			if err != nil {
+				errs = append(errs, ValidationError{Line: n.Line, Key: key, Message: err.Error()})
+				return
+			}
+			secrets = append(secrets, s...)
+			if v == n.Value {
+				return
+			}
+
+			n.Value = v
+
+			// Let yaml infer the type of unquoted values again, so
+			// max_file_mb: ${MAX_FILE_MB} decodes to an integer.
+			if n.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+				n.Tag = ""
+			}
+		}
+	}
+	walk(n, "")
+
+	return errs, secrets
+}
+
+// resolveValue returns value s with references expanded, like resolve, or
+// the content of the file s references if it starts with file:/.
+func resolveValue(s string) (string, []string, error) {
+	if p, ok := strings.CutPrefix(s, secretFilePrefix); ok && strings.HasPrefix(s, secretFileValuePrefix) {
+		v, err := readSecretFile(p)
+		if err != nil {
+			return "", nil, err
+		}
+		return v, []string{v}, nil
+	}
+
+	return resolve(s)
+}
+
+// readSecretFile returns the content of file p without trailing new line
+func readSecretFile(p string) (string, error) {
+	c, err := os.ReadFile(p)
+	if err != nil {
+		return "", fmt.Errorf("unable to read secret file: %w", err)
+	}
+	return strings.TrimRight(string(c), "\r\n"), nil
+}
+
+// resolve returns s with references expanded, and the values that must be
+// redacted from messages : content of secret files and environment values.
+func resolve(s string) (string, []string, error) {
+	var b strings.Builder
+	secrets := []string{}
+
+	for i := 0; i < len(s); i++ {
+		if strings.HasPrefix(s[i:], "$${") {
+			b.WriteString("${")
+			i += 2
+			continue
+		}
+		if !strings.HasPrefix(s[i:], "${") {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", nil, fmt.Errorf("unterminated reference %q", s[i:])
+		}
+		ref := s[i+2 : i+end]
+		i += end
+
+		if p, ok := strings.CutPrefix(ref, secretFilePrefix); ok {
+			v, err := readSecretFile(p)
+			if err != nil {
+				return "", nil, err
+			}
+			b.WriteString(v)
+			secrets = append(secrets, v)
+			continue
+		}
+
+		name, def, hasDefault := strings.Cut(ref, ":-")
+		if name == "" {
+			return "", nil, fmt.Errorf("empty environment variable name")
+		}
+		v, ok := os.LookupEnv(name)
+		switch {
+		case hasDefault && v == "":
+			v = def
+		case !ok:
+			return "", nil, fmt.Errorf("environment variable %s is not set", name)
+		}
+		b.WriteString(v)
+		secrets = append(secrets, v)
+	}
+
+	return b.String(), secrets, nil
+}
+
+// redact replaces every occurrence of secret values in the messages of errs
+// so secrets read from the environment or files never end up in logs.
+func redact(errs ValidationErrors, secrets []string) ValidationErrors {
+	for i := range errs {
+		for _, v := range secrets {
+			if v == "" {
+				continue
+			}
+			errs[i].Message = strings.ReplaceAll(errs[i].Message, v, "[redacted]")
+
+			// yaml shortens values longer than 10 characters in type errors
+			if len(v) > 10 {
+				errs[i].Message = strings.ReplaceAll(errs[i].Message, v[:7]+"...", "[redacted]")
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,505 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/ybizeul/apiws/auth/oidc"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// ValidationError is a single problem found in the configuration file. Line
+// is the line number in the file where the problem was found, or 0 if the
+// value did not come from the file (i.e. a default value or an environment
+// variable). Key is the dotted path of the offending key.
+type ValidationError struct {
+	Line    int
+	Key     string
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	var b strings.Builder
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", e.Line)
+	}
+	if e.Key != "" {
+		fmt.Fprintf(&b, "%s: ", e.Key)
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// ValidationErrors aggregates every problem found in the configuration file so
+// they can all be reported at once instead of failing on the first one.
+type ValidationErrors []ValidationError
+
+func (e ValidationErrors) Error() string {
+	s := make([]string, 0, len(e))
+	for _, err := range e {
+		s = append(s, err.Error())
+	}
+	return strings.Join(s, "\n")
+}
+
+// Is makes ValidationErrors match ErrInvalidConfiguration with errors.Is
+func (e ValidationErrors) Is(target error) bool {
+	return target == ErrInvalidConfiguration
+}
+
+// validExposures are the values accepted for default_exposure
+var validExposures = []string{"upload", "download", "both", "dropbox"}
+
+// yamlErrorLine extracts the line number yaml.v3 prepends to decoding errors
+var yamlErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// typeErrors converts a yaml.TypeError into ValidationErrors. Any other error
+// is returned as a single ValidationError.
+func typeErrors(err error, key string) ValidationErrors {
+	var te *yaml.TypeError
+	if !errors.As(err, &te) {
+		return ValidationErrors{{Key: key, Message: err.Error()}}
+	}
+
+	result := ValidationErrors{}
+	for _, msg := range te.Errors {
+		v := ValidationError{Key: key, Message: msg}
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			v.Line, _ = strconv.Atoi(m[1])
+			v.Message = m[2]
+		}
+		result = append(result, v)
+	}
+	return result
+}
+
+// knownKeys reports every key of the yaml node n that doesn't match a field of
+// struct type t, recursively. Maps are not checked as they accept any key.
+// key is the dotted path of n used in error messages.
+func knownKeys(n *yaml.Node, t reflect.Type, key string) ValidationErrors {
+	result := ValidationErrors{}
+
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	switch n.Kind {
+	case yaml.DocumentNode:
+		for _, c := range n.Content {
+			result = append(result, knownKeys(c, t, key)...)
+		}
+	case yaml.SequenceNode:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return result
+		}
+		for i, c := range n.Content {
+			result = append(result, knownKeys(c, t.Elem(), fmt.Sprintf("%s[%d]", key, i))...)
+		}
+	case yaml.MappingNode:
+		if t.Kind() != reflect.Struct {
+			return result
+		}
+		fields := fieldsByKey(t)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k := n.Content[i]
+			name := k.Value
+			if key != "" {
+				name = key + "." + k.Value
+			}
+			f, ok := fields[k.Value]
+			if !ok {
+				result = append(result, ValidationError{Line: k.Line, Key: name, Message: "unknown option"})
+				continue
+			}
+			result = append(result, knownKeys(n.Content[i+1], f.Type, name)...)
+		}
+	}
+
+	return result
+}
+
+// fieldsByKey returns the fields of struct type t indexed by their yaml key
+func fieldsByKey(t reflect.Type) map[string]reflect.StructField {
+	result := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		result[name] = f
+	}
+	return result
+}
+
+// decodeOptions decodes the options mapping node n into out. Unlike the
+// default yaml behaviour, unknown keys are reported as errors, along with
+// type mismatches. key is the dotted path of n used in error messages.
+func decodeOptions(n *yaml.Node, key string, out any) ValidationErrors {
+	result := ValidationErrors{}
+	if n == nil {
+		return result
+	}
+
+	if n.Kind != yaml.MappingNode {
+		if n.Tag == "!!null" {
+			return result
+		}
+		return append(result, ValidationError{Line: n.Line, Key: key, Message: "must be a mapping"})
+	}
+
+	result = append(result, knownKeys(n, reflect.TypeOf(out), key)...)
+
+	err := n.Decode(out)
+	if err != nil {
+		result = append(result, typeErrors(err, key)...)
+	}
+
+	return result
+}
+
+// optionsNode returns the yaml node holding the options of section (storage or
+// auth). If the configuration was not read from a file, a node is built from
+// the current values so validation can run the same way, without line
+// numbers.
+func (c *Config) optionsNode(section string, options map[string]any) *yaml.Node {
+	if n := lookupNode(c.root, section, "options"); n != nil {
+		return n
+	}
+
+	if options == nil {
+		return nil
+	}
+
+	n := &yaml.Node{}
+	err := n.Encode(options)
+	if err != nil {
+		return nil
+	}
+	// Encoded values don't come from the file, discard line numbers
+	clearLines(n)
+	return n
+}
+
+// lookupNode walks the mapping nodes starting at n following keys and returns
+// the value node found, or nil.
+func lookupNode(n *yaml.Node, keys ...string) *yaml.Node {
+	if n == nil {
+		return nil
+	}
+	if n.Kind == yaml.DocumentNode {
+		if len(n.Content) == 0 {
+			return nil
+		}
+		n = n.Content[0]
+	}
+	for _, key := range keys {
+		if n.Kind != yaml.MappingNode {
+			return nil
+		}
+		var next *yaml.Node
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if n.Content[i].Value == key {
+				next = n.Content[i+1]
+				break
+			}
+		}
+		if next == nil {
+			return nil
+		}
+		n = next
+	}
+	return n
+}
+
+// lineFor returns the line of keys in the configuration file, or 0
+func (c *Config) lineFor(keys ...string) int {
+	n := lookupNode(c.root, keys...)
+	if n == nil {
+		return 0
+	}
+	return n.Line
+}
+
+func clearLines(n *yaml.Node) {
+	n.Line = 0
+	n.Column = 0
+	for _, c := range n.Content {
+		clearLines(c)
+	}
+}
+
+// Validate checks the values read from the configuration file and returns
+// ValidationErrors listing every problem found, or nil.
+func (c *Config) Validate() error {
+	result := ValidationErrors{}
+
+	v := c.Values
+
+	if v.DefaultValidityDays < 0 {
+		result = append(result, ValidationError{
+			Line:    c.lineFor("default_validity_days"),
+			Key:     "default_validity_days",
+			Message: "must be positive or zero",
+		})
+	}
+
+	if v.DefaultExposure != "" && !slices.Contains(validExposures, v.DefaultExposure) {
+		result = append(result, ValidationError{
+			Line:    c.lineFor("default_exposure"),
+			Key:     "default_exposure",
+			Message: fmt.Sprintf("must be one of %s", strings.Join(validExposures, ", ")),
+		})
+	}
+
+	for i, m := range v.MessageTemplates {
+		if m.Title == "" {
+			result = append(result, ValidationError{
+				Line:    c.lineFor("messages"),
+				Key:     fmt.Sprintf("messages[%d].title", i),
+				Message: "is required",
+			})
+		}
+	}
+
+	for i, f := range v.FormTemplates {
+		if f.Title == "" {
+			result = append(result, ValidationError{
+				Line:    c.lineFor("forms"),
+				Key:     fmt.Sprintf("forms[%d].title", i),
+				Message: "is required",
+			})
+		}
+		err := storage.Options{Fields: f.Fields}.ValidateFields()
+		if err != nil {
+			result = append(result, ValidationError{
+				Line:    c.lineFor("forms"),
+				Key:     fmt.Sprintf("forms[%d].fields", i),
+				Message: err.Error(),
+			})
+		}
+	}
+
+	_, errs := c.storageOptions()
+	result = append(result, errs...)
+
+	result = append(result, c.validateCluster()...)
+
+	_, errs = c.authenticationOptions()
+	result = append(result, errs...)
+
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
+
+// validateCluster checks cluster options
+func (c *Config) validateCluster() ValidationErrors {
+	result := ValidationErrors{}
+
+	o := c.Values.Cluster
+
+	for _, v := range []struct {
+		key   string
+		value int
+	}{
+		{"lease_seconds", o.LeaseSeconds},
+		{"refresh_seconds", o.RefreshSeconds},
+	} {
+		if v.value < 0 {
+			result = append(result, ValidationError{
+				Line:    c.lineFor("cluster", v.key),
+				Key:     "cluster." + v.key,
+				Message: "must be positive or zero",
+			})
+		}
+	}
+
+	// Memory storage is only visible to the instance holding it
+	if o.Enabled && c.Values.Storage.Type == "memory" {
+		result = append(result, ValidationError{
+			Line:    c.lineFor("cluster", "enabled"),
+			Key:     "cluster.enabled",
+			Message: ErrClusterUnsupported.Error(),
+		})
+	}
+
+	return result
+}
+
+// storageOptions decodes and validates the storage backend options. It returns
+// the typed configuration struct for the backend.
+func (c *Config) storageOptions() (any, ValidationErrors) {
+	s := c.Values.Storage
+	line := c.lineFor("storage", "type")
+
+	if s.Type == "" {
+		return nil, ValidationErrors{{Line: c.lineFor("storage"), Key: "storage.type", Message: ErrMissingStorageBackendType.Error()}}
+	}
+
+	errs := ValidationErrors{}
+	if len(s.APIKeys) > 0 {
+		errs = append(errs, ValidationError{Line: c.lineFor("storage", "apiKeys"), Key: "storage.apiKeys", Message: "unknown option"})
+	}
+
+	n := c.optionsNode("storage", s.Options)
+	optionLine := func(key string) int {
+		if v := lookupNode(n, key); v != nil {
+			return v.Line
+		}
+		return 0
+	}
+
+	switch s.Type {
+	case "file":
+		var options storage.FileStorageConfig
+		errs = append(errs, decodeOptions(n, "storage.options", &options)...)
+		if options.Path == "" {
+			errs = append(errs, ValidationError{Line: line, Key: "storage.options.path", Message: "is required"})
+		}
+		errs = append(errs, validateSizes(options.MaxFileSize, options.MaxShareSize, optionLine)...)
+		return options, errs
+
+	case "s3":
+		var options storage.S3StorageConfig
+		errs = append(errs, decodeOptions(n, "storage.options", &options)...)
+		s3Env(&options.Region, &options.AWSKey, &options.AWSSecret, &options.Bucket)
+		errs = append(errs, validateS3(options.Region, options.AWSKey, options.AWSSecret, options.Bucket, line)...)
+		errs = append(errs, validateSizes(options.MaxFileSize, options.MaxShareSize, optionLine)...)
+		return options, errs
+
+	case "minio":
+		var options storage.MinioStorageConfig
+		errs = append(errs, decodeOptions(n, "storage.options", &options)...)
+		s3Env(&options.Region, &options.AWSKey, &options.AWSSecret, &options.Bucket)
+		errs = append(errs, validateS3(options.Region, options.AWSKey, options.AWSSecret, options.Bucket, line)...)
+		if options.Endpoint == "" {
+			errs = append(errs, ValidationError{Line: line, Key: "storage.options.endpoint", Message: "is required"})
+		}
+		errs = append(errs, validateSizes(options.MaxFileSize, options.MaxShareSize, optionLine)...)
+		return options, errs
+
+	case "memory":
+		var options storage.MemoryStorageConfig
+		errs = append(errs, decodeOptions(n, "storage.options", &options)...)
+		errs = append(errs, validateSizes(options.MaxFileSize, options.MaxShareSize, optionLine)...)
+		return options, errs
+	}
+
+	return nil, append(errs, ValidationError{Line: line, Key: "storage.type", Message: fmt.Sprintf("%s: %s", ErrUnknownStorageBackend.Error(), s.Type)})
+}
+
+// authenticationOptions decodes and validates the authentication backend
+// options. It returns the typed configuration for the backend.
+func (c *Config) authenticationOptions() (any, ValidationErrors) {
+	a := c.Values.Authentication
+	line := c.lineFor("auth", "type")
+
+	errs := ValidationErrors{}
+	for i, k := range a.APIKeys {
+		if strings.TrimSpace(k) == "" {
+			errs = append(errs, ValidationError{Line: c.lineFor("auth", "apiKeys"), Key: fmt.Sprintf("auth.apiKeys[%d]", i), Message: "must not be empty"})
+		}
+	}
+
+	if a.Type == "" {
+		return nil, append(errs, ValidationError{Line: c.lineFor("auth"), Key: "auth.type", Message: ErrMissingAuthenticationBackendType.Error()})
+	}
+
+	n := c.optionsNode("auth", a.Options)
+
+	switch a.Type {
+	case "file":
+		var options struct {
+			Path string `yaml:"path"`
+		}
+		errs = append(errs, decodeOptions(n, "auth.options", &options)...)
+		if options.Path == "" {
+			errs = append(errs, ValidationError{Line: line, Key: "auth.options.path", Message: "is required"})
+		}
+		return options.Path, errs
+
+	case "oidc":
+		var options oidc.OIDCConfig
+		errs = append(errs, decodeOptions(n, "auth.options", &options)...)
+		for _, o := range []struct {
+			key, value string
+		}{
+			{"provider_url", options.ProviderURL},
+			{"client_id", options.ClientID},
+			{"redirect_url", options.RedirectURL},
+		} {
+			if o.value == "" {
+				errs = append(errs, ValidationError{Line: line, Key: "auth.options." + o.key, Message: "is required"})
+			}
+		}
+		return options, errs
+
+	case "default":
+		if n != nil && n.Kind == yaml.MappingNode && len(n.Content) > 0 {
+			errs = append(errs, ValidationError{Line: n.Line, Key: "auth.options", Message: "default authentication takes no options"})
+		}
+		return nil, errs
+	}
+
+	return nil, append(errs, ValidationError{Line: line, Key: "auth.type", Message: fmt.Sprintf("%s: %s", ErrUnknownAuthenticationBackend.Error(), a.Type)})
+}
+
+// validateSizes checks max_file_mb and max_share_mb are consistent. A
+// max_file_mb greater than max_share_mb only logs a warning, as configurations
+// written before it was checked must keep loading.
+func validateSizes(maxFile, maxShare int64, line func(string) int) ValidationErrors {
+	result := ValidationErrors{}
+	if maxFile < 0 {
+		result = append(result, ValidationError{Line: line("max_file_mb"), Key: "storage.options.max_file_mb", Message: "must be positive or zero"})
+	}
+	if maxShare < 0 {
+		result = append(result, ValidationError{Line: line("max_share_mb"), Key: "storage.options.max_share_mb", Message: "must be positive or zero"})
+	}
+	if maxFile > 0 && maxShare > 0 && maxFile > maxShare {
+		slog.Warn("max_file_mb is greater than max_share_mb, files are limited by max_share_mb",
+			slog.Int("line", line("max_file_mb")),
+			slog.Int64("max_file_mb", maxFile),
+			slog.Int64("max_share_mb", maxShare))
+	}
+	return result
+}
+
+// validateS3 checks mandatory options for S3 compatible backends, after
+// environment variables have been applied.
+func validateS3(region, key, secret, bucket string, line int) ValidationErrors {
+	result := ValidationErrors{}
+	for _, o := range []struct {
+		value, option, env string
+	}{
+		{region, "region", "AWS_DEFAULT_REGION"},
+		{key, "aws_key", "AWS_ACCESS_KEY_ID"},
+		{secret, "aws_secret", "AWS_SECRET_ACCESS_KEY"},
+		{bucket, "bucket", "BUCKET"},
+	} {
+		if o.value == "" {
+			result = append(result, ValidationError{
+				Line:    line,
+				Key:     "storage.options." + o.option,
+				Message: fmt.Sprintf("is required (or set %s in environment)", o.env),
+			})
+		}
+	}
+	return result
+}
@@ -0,0 +1,296 @@
+// Package search maintains an in-memory full-text index of shares and items.
+//
+// The index is built from storage at startup with Rebuild, then kept up to
+// date by Storage, which wraps a storage backend and updates the index on
+// every change.
+package search
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// Weights of fields in results ranking, an exact token match scores the
+// field weight, a prefix match half of it.
+const (
+	weightName        = 10
+	weightOwner       = 4
+	weightDescription = 3
+	weightMessage     = 1
+)
+
+// Result is a share or an item matching a query
+type Result struct {
+	Share string `json:"share"`
+	Item  string `json:"item,omitempty"`
+	Owner string `json:"owner,omitempty"`
+	Score int    `json:"score"`
+}
+
+// document is an indexed share or item
+type document struct {
+	share  string
+	item   string
+	tokens map[string]int
+}
+
+// Index is an inverted index of shares and items, safe for concurrent use
+type Index struct {
+	mu sync.RWMutex
+
+	// docs are documents by id, share name for shares and share/item for
+	// items
+	docs map[string]*document
+
+	// postings are the ids of documents containing a token, with the token
+	// weight in that document
+	postings map[string]map[string]int
+
+	// owners are share owners, used for visibility of items
+	owners map[string]string
+}
+
+// NewIndex returns an empty index
+func NewIndex() *Index {
+	return &Index{
+		docs:     map[string]*document{},
+		postings: map[string]map[string]int{},
+		owners:   map[string]string{},
+	}
+}
+
+// Rebuild replaces the content of the index with shares and items read from
+// s.
+func (i *Index) Rebuild(ctx context.Context, s storage.Storage) error {
+	shares, err := s.ListShares(ctx)
+	if err != nil {
+		return err
+	}
+
+	n := NewIndex()
+	for _, share := range shares {
+		n.AddShare(&share)
+
+		items, err := s.ListShare(ctx, share.Name)
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			n.AddItem(share.Name, path.Base(item.Path))
+		}
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.docs, i.postings, i.owners = n.docs, n.postings, n.owners
+
+	return nil
+}
+
+// tokenize splits s in lowercase words of letters and digits
+func tokenize(s string) []string {
+	return strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// addTokens adds tokens of s to t with weight w, keeping the highest weight
+// of a token found in several fields.
+func addTokens(t map[string]int, s string, w int) {
+	for _, token := range tokenize(s) {
+		t[token] = max(t[token], w)
+	}
+}
+
+// AddShare indexes share s, replacing a previous version
+func (i *Index) AddShare(s *storage.Share) {
+	tokens := map[string]int{}
+	addTokens(tokens, s.Name, weightName)
+	addTokens(tokens, s.Owner, weightOwner)
+	addTokens(tokens, s.Options.Description, weightDescription)
+	addTokens(tokens, s.Options.Message, weightMessage)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.owners[s.Name] = s.Owner
+	i.set(&document{share: s.Name, tokens: tokens})
+}
+
+// AddItem indexes item in share
+func (i *Index) AddItem(share, item string) {
+	tokens := map[string]int{}
+	addTokens(tokens, item, weightName)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.set(&document{share: share, item: item, tokens: tokens})
+}
+
+// RemoveItem removes item in share from the index
+func (i *Index) RemoveItem(share, item string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.remove(path.Join(share, item))
+}
+
+// RemoveShare removes share and its items from the index
+func (i *Index) RemoveShare(share string) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	for id, d := range i.docs {
+		if d.share == share {
+			i.remove(id)
+		}
+	}
+	delete(i.owners, share)
+}
+
+func (d *document) id() string {
+	if d.item == "" {
+		return d.share
+	}
+	return path.Join(d.share, d.item)
+}
+
+// set adds d to the index, i.mu must be held
+func (i *Index) set(d *document) {
+	id := d.id()
+	i.remove(id)
+
+	i.docs[id] = d
+	for token, w := range d.tokens {
+		p, ok := i.postings[token]
+		if !ok {
+			p = map[string]int{}
+			i.postings[token] = p
+		}
+		p[id] = w
+	}
+}
+
+// remove removes document id from the index, i.mu must be held
+func (i *Index) remove(id string) {
+	d, ok := i.docs[id]
+	if !ok {
+		return
+	}
+	for token := range d.tokens {
+		delete(i.postings[token], id)
+		if len(i.postings[token]) == 0 {
+			delete(i.postings, token)
+		}
+	}
+	delete(i.docs, id)
+}
+
+// Search returns shares and items matching every word of q, best matches
+// first. Words match indexed words they are a prefix of. visible is called
+// with the owner of each share to filter results, it can be nil.
+func (i *Index) Search(q string, visible func(owner string) bool) []Result {
+	words := tokenize(q)
+	if len(words) == 0 {
+		return []Result{}
+	}
+
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	var scores map[string]int
+	for _, word := range words {
+		// Best score of word in each document
+		wordScores := map[string]int{}
+		for token, p := range i.postings {
+			if !strings.HasPrefix(token, word) {
+				continue
+			}
+			for id, w := range p {
+				if token != word {
+					w /= 2
+				}
+				wordScores[id] = max(wordScores[id], w)
+			}
+		}
+
+		// Documents must match every word
+		if scores == nil {
+			scores = wordScores
+			continue
+		}
+		for id := range scores {
+			if s, ok := wordScores[id]; ok {
+				scores[id] += s
+			} else {
+				delete(scores, id)
+			}
+		}
+	}
+
+	result := []Result{}
+	for id, score := range scores {
+		d := i.docs[id]
+		owner := i.owners[d.share]
+		if visible != nil && !visible(owner) {
+			continue
+		}
+		result = append(result, Result{
+			Share: d.share,
+			Item:  d.item,
+			Owner: owner,
+			Score: score,
+		})
+	}
+
+	slices.SortFunc(result, func(a, b Result) int {
+		return cmp.Or(
+			cmp.Compare(b.Score, a.Score),
+			strings.Compare(a.Share, b.Share),
+			strings.Compare(a.Item, b.Item),
+		)
+	})
+
+	return result
+}
+
+// Page returns at most limit results after cursor, and the cursor of the next
+// page, empty on the last page. A limit of 0 returns every result.
+func Page(results []Result, limit int, cursor string) ([]Result, string, error) {
+	if limit < 0 {
+		return nil, "", fmt.Errorf("%w: negative limit", storage.ErrInvalidQuery)
+	}
+
+	offset := 0
+	if cursor != "" {
+		b, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err == nil {
+			offset, err = strconv.Atoi(string(b))
+		}
+		if err != nil || offset < 0 {
+			return nil, "", fmt.Errorf("%w: invalid cursor", storage.ErrInvalidQuery)
+		}
+	}
+
+	results = results[min(offset, len(results)):]
+
+	if limit == 0 || len(results) <= limit {
+		return results, "", nil
+	}
+
+	next := base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(offset + limit)))
+
+	return results[:limit], next, nil
+}
@@ -0,0 +1,249 @@
+package search_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/search"
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+func names(results []search.Result) []string {
+	r := []string{}
+	for _, result := range results {
+		if result.Item == "" {
+			r = append(r, result.Share)
+		} else {
+			r = append(r, result.Share+"/"+result.Item)
+		}
+	}
+	return r
+}
+
+func TestSearch(t *testing.T) {
+	i := search.NewIndex()
+
+	i.AddShare(&storage.Share{Name: "invoices", Owner: "admin", Options: storage.Options{Description: "Customer reports"}})
+	i.AddShare(&storage.Share{Name: "reports", Owner: "user", Options: storage.Options{Message: "Upload your **invoices** here"}})
+	i.AddItem("invoices", "2024-report.pdf")
+	i.AddItem("reports", "photo.jpg")
+
+	tests := []struct {
+		Query string
+		Want  []string
+	}{
+		{"invoices", []string{"invoices", "reports"}},
+		{"report", []string{"invoices/2024-report.pdf", "reports", "invoices"}},
+		{"REPORT 2024", []string{"invoices/2024-report.pdf"}},
+		{"user", []string{"reports"}},
+		{"jpg", []string{"reports/photo.jpg"}},
+		{"missing", []string{}},
+		{"  ", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Query, func(t *testing.T) {
+			got := names(i.Search(test.Query, nil))
+			if !reflect.DeepEqual(got, test.Want) {
+				t.Errorf("Expected %v, got %v", test.Want, got)
+			}
+		})
+	}
+
+	t.Run("Results are filtered by owner", func(t *testing.T) {
+		got := names(i.Search("invoices", func(owner string) bool { return owner == "user" }))
+		want := []string{"reports"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	})
+
+	t.Run("Updated and removed documents are not found", func(t *testing.T) {
+		i.AddShare(&storage.Share{Name: "reports", Owner: "user"})
+		i.RemoveItem("invoices", "2024-report.pdf")
+
+		got := names(i.Search("invoices", nil))
+		want := []string{"invoices"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+
+		i.RemoveShare("reports")
+
+		got = names(i.Search("photo", nil))
+		if len(got) != 0 {
+			t.Errorf("Expected no results, got %v", got)
+		}
+	})
+}
+
+func TestPage(t *testing.T) {
+	results := []search.Result{{Share: "a"}, {Share: "b"}, {Share: "c"}}
+
+	got := []string{}
+	cursor := ""
+	for {
+		page, next, err := search.Page(results, 2, cursor)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, names(page)...)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	want := []string{"a", "b", "c"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	_, _, err := search.Page(results, 2, "invalid")
+	if !errors.Is(err, storage.ErrInvalidQuery) {
+		t.Errorf("Expected ErrInvalidQuery, got %v", err)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	b := storage.NewFileStorage(storage.FileStorageConfig{Path: dir})
+
+	_, err := b.CreateShare(ctx, "existing", "admin", storage.Options{Description: "Quarterly figures"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.CreateItem(ctx, "existing", "figures.xlsx", 4, bytes.NewReader([]byte("data")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := search.NewIndex()
+	err = i.Rebuild(ctx, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := names(i.Search("figures", nil))
+	want := []string{"existing/figures.xlsx", "existing"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	s := search.NewStorage(b, i)
+
+	_, err = s.CreateShare(ctx, "created", "admin", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateItem(ctx, "created", "notes.txt", 4, bytes.NewReader([]byte("data")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.UpdateShare(ctx, "created", &storage.Options{Description: "Meeting notes"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = names(i.Search("notes", nil))
+	want = []string{"created/notes.txt", "created"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	_, err = s.CopyItem(ctx, "created", "notes.txt", "existing", "minutes.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = names(i.Search("minutes", nil))
+	want = []string{"existing/minutes.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	_, err = s.MoveItem(ctx, "existing", "minutes.txt", "existing", "agenda.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = names(i.Search("minutes", nil))
+	if len(got) != 0 {
+		t.Errorf("Expected no results, got %v", got)
+	}
+	got = names(i.Search("agenda", nil))
+	want = []string{"existing/agenda.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	_, err = s.RenameShare(ctx, "created", "renamed", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = names(i.Search("notes", nil))
+	want = []string{"renamed/notes.txt", "renamed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	err = s.DeleteItem(ctx, "existing", "figures.xlsx")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeleteShare(ctx, "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got = names(i.Search("notes figures", nil))
+	if len(got) != 0 {
+		t.Errorf("Expected no results, got %v", got)
+	}
+	got = names(i.Search("quarterly", nil))
+	want = []string{"existing"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
+
+// failingList is a backend which shares can't be listed
+type failingList struct {
+	storage.Storage
+}
+
+func (f *failingList) ListShare(ctx context.Context, name string) ([]storage.Item, error) {
+	return nil, errors.New("listing failed")
+}
+
+func TestStorageRenameShareWithoutListing(t *testing.T) {
+	ctx := context.Background()
+
+	b := storage.NewFileStorage(storage.FileStorageConfig{Path: t.TempDir()})
+	_, err := b.CreateShare(ctx, "created", "admin", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	i := search.NewIndex()
+	s := search.NewStorage(&failingList{Storage: b}, i)
+
+	// The share is renamed and indexed even if its items can't be listed
+	share, err := s.RenameShare(ctx, "created", "renamed", time.Time{})
+	if err != nil || share == nil || share.Name != "renamed" {
+		t.Fatalf("Expected renamed share, got %+v %v", share, err)
+	}
+
+	got := names(i.Search("renamed", nil))
+	want := []string{"renamed"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,178 @@
+package search
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"path"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// Storage is a storage backend that updates Index when shares and items
+// change. Other methods are served by the wrapped backend.
+type Storage struct {
+	storage.Storage
+
+	Index *Index
+}
+
+// NewStorage returns a Storage wrapping s and updating index
+func NewStorage(s storage.Storage, index *Index) *Storage {
+	return &Storage{
+		Storage: s,
+		Index:   index,
+	}
+}
+
+// CreateShare creates a new share and indexes it
+func (s *Storage) CreateShare(ctx context.Context, name, owner string, options storage.Options) (*storage.Share, error) {
+	share, err := s.Storage.CreateShare(ctx, name, owner, options)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Index.AddShare(share)
+
+	return share, nil
+}
+
+// UpdateShare updates an existing share and indexes its new options
+func (s *Storage) UpdateShare(ctx context.Context, name string, options *storage.Options, downloads *map[string]int64) (*storage.Options, error) {
+	result, err := s.Storage.UpdateShare(ctx, name, options, downloads)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only options are indexed
+	if options == nil {
+		return result, nil
+	}
+
+	share, err := s.Storage.GetShare(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Index.AddShare(share)
+
+	return result, nil
+}
+
+// RestoreShare restores the metadata of a share and indexes it
+func (s *Storage) RestoreShare(ctx context.Context, share *storage.Share) (*storage.Share, error) {
+	result, err := s.Storage.RestoreShare(ctx, share)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Index.AddShare(result)
+
+	return result, nil
+}
+
+// CreateItem creates a new item in a share and indexes it
+func (s *Storage) CreateItem(ctx context.Context, share, item string, size int64, reader io.Reader, metadata *storage.ItemMetadata) (*storage.Item, error) {
+	result, err := s.Storage.CreateItem(ctx, share, item, size, reader, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	// The item can be renamed by the conflict policy of the share
+	s.Index.AddItem(share, path.Base(result.Path))
+
+	return result, nil
+}
+
+// CopyItem copies an item to a share and indexes the copy
+func (s *Storage) CopyItem(ctx context.Context, share, item, toShare, toItem string) (*storage.Item, error) {
+	result, err := s.Storage.CopyItem(ctx, share, item, toShare, toItem)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Index.AddItem(toShare, path.Base(result.Path))
+
+	return result, nil
+}
+
+// MoveItem moves an item to a share and updates the index
+func (s *Storage) MoveItem(ctx context.Context, share, item, toShare, toItem string) (*storage.Item, error) {
+	result, err := s.Storage.MoveItem(ctx, share, item, toShare, toItem)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Index.RemoveItem(share, item)
+	s.Index.AddItem(toShare, path.Base(result.Path))
+
+	return result, nil
+}
+
+// DeleteItem deletes an item and removes it from the index
+func (s *Storage) DeleteItem(ctx context.Context, share, item string) error {
+	err := s.Storage.DeleteItem(ctx, share, item)
+	if err != nil {
+		return err
+	}
+
+	s.Index.RemoveItem(share, item)
+
+	return nil
+}
+
+// DeleteShare deletes a share and removes it and its items from the index
+func (s *Storage) DeleteShare(ctx context.Context, share string) error {
+	err := s.Storage.DeleteShare(ctx, share)
+	if err != nil {
+		return err
+	}
+
+	s.Index.RemoveShare(share)
+
+	return nil
+}
+
+// RenameShare renames a share and indexes it and its items under the new name
+func (s *Storage) RenameShare(ctx context.Context, share, name string, until time.Time) (*storage.Share, error) {
+	result, err := s.Storage.RenameShare(ctx, share, name, until)
+	if err != nil && !errors.Is(err, storage.ErrRenameIncomplete) {
+		return nil, err
+	}
+
+	s.Index.RemoveShare(share)
+	s.Index.AddShare(result)
+
+	// The share is renamed even if its items can't be indexed, they are
+	// indexed when the index is rebuilt
+	items, listErr := s.Storage.ListShare(ctx, name)
+	if listErr != nil {
+		slog.Error("cannot index items of renamed share", slog.String("error", listErr.Error()), slog.String("share", name))
+		return result, err
+	}
+	for _, i := range items {
+		s.Index.AddItem(name, path.Base(i.Path))
+	}
+
+	return result, err
+}
+
+// Check checks the wrapped backend, the index is rebuilt after a repair so it
+// includes shares which metadata has been recreated
+func (s *Storage) Check(ctx context.Context, repair bool) (*storage.CheckReport, error) {
+	report, err := s.Storage.Check(ctx, repair)
+	if err != nil {
+		return nil, err
+	}
+
+	if repair && len(report.Problems) > 0 {
+		err = s.Index.Rebuild(ctx, s.Storage)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,339 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Kinds of problems found by Check
+const (
+	// ProblemOrphan is a temporary file left by an interrupted upload, an
+	// object outside any share, or an object left over by a share rename
+	ProblemOrphan = "orphan"
+
+	// ProblemMissingMetadata is a share with items but no metadata, it is not
+	// listed
+	ProblemMissingMetadata = "missing_metadata"
+
+	// ProblemCorruptMetadata is a share which metadata can't be decoded, it is
+	// not listed
+	ProblemCorruptMetadata = "corrupt_metadata"
+
+	// ProblemStaleSize is a share which size or count doesn't match its items
+	ProblemStaleSize = "stale_size"
+
+	// ProblemStaleDownloads is a download count of an item that doesn't exist
+	// anymore
+	ProblemStaleDownloads = "stale_downloads"
+)
+
+// checkGracePeriod is the age under which temporary files and shares without
+// metadata are considered in progress rather than left over
+const checkGracePeriod = time.Hour
+
+// Problem is an inconsistency found by Check. Path is the location of the
+// problem in the backend, a path relative to the storage directory or an
+// object key. Error is set when repairing it failed.
+type Problem struct {
+	Kind     string `json:"kind"`
+	Share    string `json:"share,omitempty"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CheckReport is the result of Check, Shares and Items are the number of
+// shares and items checked
+type CheckReport struct {
+	Repair   bool      `json:"repair"`
+	Shares   int       `json:"shares"`
+	Items    int       `json:"items"`
+	Problems []Problem `json:"problems"`
+}
+
+// newCheckReport returns an empty report
+func newCheckReport(repair bool) *CheckReport {
+	return &CheckReport{
+		Repair:   repair,
+		Problems: []Problem{},
+	}
+}
+
+// add adds problems p to the report, err being the result of their repair
+func (r *CheckReport) add(err error, p ...Problem) {
+	for _, p := range p {
+		if r.Repair {
+			p.Repaired = err == nil
+			if err != nil {
+				p.Error = err.Error()
+			}
+		}
+		r.Problems = append(r.Problems, p)
+	}
+}
+
+// sort sorts problems by path so reports are stable
+func (r *CheckReport) sort() {
+	sort.SliceStable(r.Problems, func(i, j int) bool {
+		return r.Problems[i].Path < r.Problems[j].Path
+	})
+}
+
+// checkShare compares the metadata of share with its items and the versions
+// of its items, and fixes share so it matches them. metadata is the location
+// of the metadata in the backend.
+func checkShare(share *Share, items, versions []Item, metadata string) []Problem {
+	result := []Problem{}
+
+	size, count := shareSize(items, versions)
+	if share.Size != size || share.Count != count {
+		result = append(result, Problem{
+			Kind:    ProblemStaleSize,
+			Share:   share.Name,
+			Path:    metadata,
+			Message: fmt.Sprintf("size %d and count %d, expected %d and %d", share.Size, share.Count, size, count),
+		})
+		share.Size, share.Count = size, count
+	}
+
+	names := make([]string, len(items))
+	for i, item := range items {
+		names[i] = path.Base(item.Path)
+	}
+
+	stale := []string{}
+	for _, downloads := range []map[string]int64{share.Downloads, share.GuestDownloads} {
+		for item := range downloads {
+			if !slices.Contains(names, item) && !slices.Contains(stale, item) {
+				stale = append(stale, item)
+			}
+		}
+	}
+	slices.Sort(stale)
+
+	for _, item := range stale {
+		result = append(result, Problem{
+			Kind:    ProblemStaleDownloads,
+			Share:   share.Name,
+			Path:    metadata,
+			Message: fmt.Sprintf("download count of missing item %s", item),
+		})
+		delete(share.Downloads, item)
+		delete(share.GuestDownloads, item)
+	}
+
+	return result
+}
+
+// recoveredShare returns the metadata of share name recreated from its items.
+// Options are empty, so it is only accessible to authenticated users until
+// updated.
+func recoveredShare(name string, items, versions []Item) *Share {
+	created := time.Now()
+	for _, i := range items {
+		if i.ItemInfo.DateModified.Before(created) {
+			created = i.ItemInfo.DateModified
+		}
+	}
+
+	result := NewShare().
+		WithName(name).
+		WithDateCreated(created).
+		WithOptions(Options{})
+	result.Size, result.Count = shareSize(items, versions)
+
+	return result
+}
+
+// isCorruptMetadata returns true if err is an error decoding metadata
+func isCorruptMetadata(err error) bool {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	return errors.As(err, &syntaxErr) ||
+		errors.As(err, &typeErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// objectBackend is implemented by object storage backends, which store the
+// metadata of a share in shares/<share>/.metadata and its items in
+// <share>/<item>
+type objectBackend interface {
+	metadataBackend
+	renameBackend
+
+	// listKeys returns objects with a key starting with prefix
+	listKeys(ctx context.Context, prefix string) ([]Item, error)
+
+	// deleteKey deletes object key
+	deleteKey(ctx context.Context, key string) error
+
+	// indexShare updates share name in the metadata index if it is enabled
+	indexShare(ctx context.Context, name string, share *Share)
+}
+
+// checkObjects implements Storage.Check for object storage backends, shares
+// are locked with locker while they are checked
+func checkObjects(ctx context.Context, b objectBackend, locker Locker, repair bool) (*CheckReport, error) {
+	report := newCheckReport(repair)
+
+	objects, err := b.listKeys(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	shares := map[string]bool{}
+	for _, o := range objects {
+		parts := strings.Split(o.Path, "/")
+		switch {
+		case strings.HasPrefix(o.Path, ".hupload/"):
+			// Metadata index and leases
+		case len(parts) == 3 && parts[0] == "shares" && parts[2] == ".metadata" && IsShareNameSafe(parts[1]):
+			shares[parts[1]] = true
+		case len(parts) == 2 && IsShareNameSafe(parts[0]) && isItemNameSafe(parts[1]):
+			shares[parts[0]] = true
+		case len(parts) == 4 && IsShareNameSafe(parts[0]) && isVersionPath(path.Join(parts[1:]...)):
+			shares[parts[0]] = true
+		default:
+			var err error
+			if repair {
+				err = b.deleteKey(ctx, o.Path)
+			}
+			report.add(err, Problem{
+				Kind:    ProblemOrphan,
+				Path:    o.Path,
+				Message: "object outside any share",
+			})
+		}
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(shares)) {
+		err = checkObjectShare(ctx, b, locker, report, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report.sort()
+
+	return report, nil
+}
+
+// checkObjectShare checks share name of b and adds problems to report
+func checkObjectShare(ctx context.Context, b objectBackend, locker Locker, report *CheckReport, name string) error {
+	ctx, unlock, err := locker.Lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	// Items are listed while the share is locked, so uploads completed in
+	// the meantime are accounted
+	objects, err := b.listKeys(ctx, name+"/")
+	if err != nil {
+		return err
+	}
+	items, versions := []Item{}, []Item{}
+	for _, o := range objects {
+		switch p := strings.TrimPrefix(o.Path, name+"/"); {
+		case isItemNameSafe(p):
+			items = append(items, o)
+		case isVersionPath(p):
+			versions = append(versions, o)
+		}
+	}
+
+	report.Shares++
+	report.Items += len(items)
+
+	key := path.Join("shares", name, ".metadata")
+
+	share, _, err := b.getMetadata(ctx, name)
+
+	var problem *Problem
+	switch {
+	case errors.Is(err, ErrShareNotFound):
+		if len(items) == 0 && len(versions) == 0 {
+			// The share has been deleted in the meantime
+			report.Shares--
+			return nil
+		}
+		_, err = b.GetRenamedShare(ctx, name)
+		if err == nil {
+			// Objects left over by an incomplete rename
+			report.Shares--
+			report.Items -= len(items)
+			for _, o := range objects {
+				if report.Repair {
+					err = b.deleteKey(ctx, o.Path)
+				}
+				report.add(err, Problem{
+					Kind:    ProblemOrphan,
+					Share:   name,
+					Path:    o.Path,
+					Message: "object of a renamed share",
+				})
+			}
+			return nil
+		}
+		if !errors.Is(err, ErrShareNotFound) {
+			return err
+		}
+		problem = &Problem{
+			Kind:    ProblemMissingMetadata,
+			Share:   name,
+			Path:    key,
+			Message: "share has items but no metadata",
+		}
+	case isCorruptMetadata(err):
+		problem = &Problem{
+			Kind:    ProblemCorruptMetadata,
+			Share:   name,
+			Path:    key,
+			Message: fmt.Sprintf("metadata can't be decoded: %v", err),
+		}
+	case err != nil:
+		return err
+	}
+
+	if problem != nil {
+		err = nil
+		if report.Repair {
+			share = recoveredShare(name, items, versions)
+			err = b.putMetadata(ctx, share, "")
+			if err == nil {
+				b.indexShare(ctx, name, share)
+			}
+		}
+		report.add(err, *problem)
+		return nil
+	}
+
+	problems := checkShare(share, items, versions, key)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	if report.Repair {
+		share, err = updateShareMetadata(ctx, b, name, func(s *Share) error {
+			checkShare(s, items, versions, key)
+			return nil
+		})
+		if err == nil {
+			b.indexShare(ctx, name, share)
+		}
+	}
+	report.add(err, problems...)
+
+	return nil
+}
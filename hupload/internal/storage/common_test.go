@@ -1,11 +1,18 @@
 package storage_test
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path"
+	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ybizeul/hupload/internal/storage"
 )
@@ -53,7 +60,7 @@ func TestFileOverflow(t *testing.T) {
 
 			reader := readerForCapacity(fileSize)
 
-			_, err = s.CreateItem(context.Background(), share.Name, "test.txt", int64(fileSize), reader)
+			_, err = s.CreateItem(context.Background(), share.Name, "test.txt", int64(fileSize), reader, nil)
 			reader.Close()
 
 			if !errors.Is(err, storage.ErrMaxFileSizeReached) {
@@ -66,7 +73,7 @@ func TestFileOverflow(t *testing.T) {
 
 			reader := readerForCapacity(fileSize)
 
-			_, err = s.CreateItem(context.Background(), share.Name, "test.txt", int64(fileSize), reader)
+			_, err = s.CreateItem(context.Background(), share.Name, "test.txt", int64(fileSize), reader, nil)
 			reader.Close()
 
 			if err != nil {
@@ -79,7 +86,7 @@ func TestFileOverflow(t *testing.T) {
 
 			reader := readerForCapacity(fileSize)
 
-			_, err = s.CreateItem(context.Background(), share.Name, "test.txt", int64(fileSize), reader)
+			_, err = s.CreateItem(context.Background(), share.Name, "test.txt", int64(fileSize), reader, nil)
 			reader.Close()
 
 			if !errors.Is(err, storage.ErrMaxShareSizeReached) {
@@ -115,7 +122,7 @@ func TestShareOverflow(t *testing.T) {
 	reader1 := readerForCapacity(3 * 1024 * 1024)
 	defer reader1.Close()
 
-	_, err = f.CreateItem(context.Background(), share.Name, "test.txt", 0, reader1)
+	_, err = f.CreateItem(context.Background(), share.Name, "test.txt", 0, reader1, nil)
 
 	if err != nil {
 		t.Errorf("Expected no error, got %v", err)
@@ -124,9 +131,169 @@ func TestShareOverflow(t *testing.T) {
 	reader2 := readerForCapacity(3 * 1024 * 1024)
 	defer reader2.Close()
 
-	_, err = f.CreateItem(context.Background(), share.Name, "test2.txt", 0, reader2)
+	_, err = f.CreateItem(context.Background(), share.Name, "test2.txt", 0, reader2, nil)
 
 	if err == nil {
 		t.Errorf("Expected error, got nil")
 	}
 }
+
+// largeListing is more than the 1000 keys returned by a single S3 listing
+const largeListing = 1050
+
+// parallel calls f for i in [0, n[ from a few goroutines
+func parallel(n int, f func(i int)) {
+	var wg sync.WaitGroup
+	c := make(chan int)
+
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range c {
+				f(i)
+			}
+		}()
+	}
+
+	for i := range n {
+		c <- i
+	}
+	close(c)
+
+	wg.Wait()
+}
+
+// testLargeListings checks listings of object storage backend s are complete
+// when they span multiple pages.
+func testLargeListings(t *testing.T, s storage.Storage) {
+	ctx := context.Background()
+
+	name := func(i int) string {
+		return fmt.Sprintf("Large-%04d", i)
+	}
+
+	t.Cleanup(func() {
+		parallel(largeListing, func(i int) {
+			_ = s.DeleteShare(ctx, name(i))
+		})
+	})
+
+	parallel(largeListing, func(i int) {
+		_, err := s.CreateShare(ctx, name(i), "admin", storage.DefaultOptions())
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+	})
+
+	countShares := func() int {
+		shares, err := s.ListShares(ctx)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		count := 0
+		for _, share := range shares {
+			if strings.HasPrefix(share.Name, "Large-") {
+				count++
+			}
+		}
+		return count
+	}
+
+	if c := countShares(); c != largeListing {
+		t.Errorf("Expected %d shares, got %d", largeListing, c)
+	}
+
+	err := s.DeleteShare(ctx, name(0))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	if c := countShares(); c != largeListing-1 {
+		t.Errorf("Expected %d shares after delete, got %d", largeListing-1, c)
+	}
+
+	for i := range largeListing {
+		_, err = s.CreateItem(ctx, name(1), fmt.Sprintf("item-%04d", i), 1, bytes.NewReader([]byte("x")), nil)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+	}
+
+	items, err := s.ListShare(ctx, name(1))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(items) != largeListing {
+		t.Errorf("Expected %d items, got %d", largeListing, len(items))
+	}
+
+	share, err := s.GetShare(ctx, name(1))
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if share.Count != largeListing || share.Size != largeListing {
+		t.Errorf("Expected share count and size to be %d, got %d and %d", largeListing, share.Count, share.Size)
+	}
+}
+
+// testObjectMigrate checks Migrate upgrades the metadata of data_old fixtures
+// uploaded to an object storage backend with put
+func testObjectMigrate(t *testing.T, s storage.Storage, put func(key string, b []byte) error) {
+	names := []string{"test", "test2", "test3"}
+
+	t.Cleanup(func() {
+		for _, n := range names {
+			_ = s.DeleteShare(context.Background(), n)
+		}
+	})
+
+	// The schema marker is reset so shares are migrated
+	err := put(".hupload/schema.json", []byte(`{"version":0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, n := range names {
+		for _, f := range []string{".metadata", "test.txt"} {
+			b, err := os.ReadFile(path.Join("file_testdata/data_old", n, f))
+			if err != nil {
+				t.Fatal(err)
+			}
+			key := path.Join(n, f)
+			if f == ".metadata" {
+				key = path.Join("shares", n, f)
+			}
+			err = put(key, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	err = s.Migrate()
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	want := map[string]storage.Options{
+		"test":  {Validity: 10},
+		"test2": {Validity: 10},
+		"test3": {Validity: 10, Exposure: "both", Description: "desc", Message: "message"},
+	}
+	for _, n := range names {
+		share, err := s.GetShare(context.Background(), n)
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+			continue
+		}
+		expires := share.DateCreated.AddDate(0, 0, 10)
+		if share.Version != storage.MetadataVersion || !share.Options.ExpiresAt.Equal(expires) {
+			t.Errorf("Expected version %d and expiration %v, got %d and %v", storage.MetadataVersion, expires, share.Version, share.Options.ExpiresAt)
+		}
+		share.Options.ExpiresAt = time.Time{}
+		if !reflect.DeepEqual(share.Options, want[n]) {
+			t.Errorf("Expected options %+v, got %+v", want[n], share.Options)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrDownloadLimitReached = errors.New("download limit reached")
+	ErrInvalidDownloadLimit = errors.New("invalid download limit")
+)
+
+// ValidateDownloadLimits returns ErrInvalidDownloadLimit if a download limit
+// of o is negative
+func (o Options) ValidateDownloadLimits() error {
+	if o.MaxDownloads < 0 || o.MaxItemDownloads < 0 {
+		return fmt.Errorf("%w: limits can't be negative", ErrInvalidDownloadLimit)
+	}
+	return nil
+}
+
+// totalGuestDownloads returns the number of downloads of all items of s by
+// guests, a share download counting once per item
+func (s *Share) totalGuestDownloads() int64 {
+	total := int64(0)
+	for _, d := range s.GuestDownloads {
+		total += d
+	}
+	return total
+}
+
+// RemainingDownloads returns the number of item downloads left to guests
+// before s reaches MaxDownloads, or -1 if it has no limit
+func (s *Share) RemainingDownloads() int64 {
+	if s.Options.MaxDownloads <= 0 {
+		return -1
+	}
+	return max(0, s.Options.MaxDownloads-s.totalGuestDownloads())
+}
+
+// CheckDownloads returns ErrDownloadLimitReached if downloading items of s
+// once more by a guest would exceed its download limits. Items of a share
+// deleted after download can only be downloaded once by guests.
+func (s *Share) CheckDownloads(items []string) error {
+	if r := s.RemainingDownloads(); r >= 0 && r < int64(len(items)) {
+		return fmt.Errorf("%w: %d downloads left", ErrDownloadLimitReached, r)
+	}
+
+	limit := s.Options.MaxItemDownloads
+	if s.Options.DeleteAfterDownload {
+		limit = 1
+	}
+	if limit <= 0 {
+		return nil
+	}
+
+	for _, i := range items {
+		if s.GuestDownloads[i] >= limit {
+			return fmt.Errorf("%w: %s", ErrDownloadLimitReached, i)
+		}
+	}
+
+	return nil
+}
+
+// reserveDownloads counts a download of items of s by a guest, or returns
+// ErrDownloadLimitReached without counting anything if it would exceed the
+// download limits of s
+func (s *Share) reserveDownloads(items []string) error {
+	err := s.CheckDownloads(items)
+	if err != nil {
+		return err
+	}
+
+	if s.GuestDownloads == nil {
+		s.GuestDownloads = map[string]int64{}
+	}
+	for _, i := range items {
+		s.GuestDownloads[i]++
+	}
+
+	return nil
+}
+
+// releaseDownloads uncounts a download of items of s by a guest
+func (s *Share) releaseDownloads(items []string) error {
+	for _, i := range items {
+		if s.GuestDownloads[i] <= 1 {
+			delete(s.GuestDownloads, i)
+			continue
+		}
+		s.GuestDownloads[i]--
+	}
+
+	return nil
+}
+
+// addDownloads counts a complete download of items of s
+func (s *Share) addDownloads(items []string) error {
+	if s.Downloads == nil {
+		s.Downloads = map[string]int64{}
+	}
+	for _, i := range items {
+		s.Downloads[i]++
+	}
+
+	return nil
+}
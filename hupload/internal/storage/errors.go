@@ -13,4 +13,8 @@ var (
 	ErrInvalidItemName = errors.New("invalid item name")
 
 	ErrEmptyFile = errors.New("empty file")
+
+	ErrInvalidQuery = errors.New("invalid query")
+
+	ErrInvalidExpiration = errors.New("invalid expiration")
 )
@@ -0,0 +1,40 @@
+package storage
+
+// Exposure values define what guests can do in a share. Guests of a drop-box
+// share can only upload, they can't list, download or delete items.
+const (
+	ExposureUpload   = "upload"
+	ExposureDownload = "download"
+	ExposureBoth     = "both"
+	ExposureDropBox  = "dropbox"
+)
+
+// ValidExposure returns true if e is a known exposure
+func ValidExposure(e string) bool {
+	switch e {
+	case ExposureUpload, ExposureDownload, ExposureBoth, ExposureDropBox:
+		return true
+	}
+	return false
+}
+
+// GuestCanUpload returns true if guests can upload items to shares with o
+func (o Options) GuestCanUpload() bool {
+	return o.Exposure == ExposureUpload || o.Exposure == ExposureBoth || o.Exposure == ExposureDropBox
+}
+
+// GuestCanDownload returns true if guests can download items of shares with o
+func (o Options) GuestCanDownload() bool {
+	return o.Exposure == ExposureDownload || o.Exposure == ExposureBoth
+}
+
+// GuestCanList returns true if guests can list every item of shares with o.
+// Guests of drop-box shares only see the items they uploaded.
+func (o Options) GuestCanList() bool {
+	return o.Exposure == ExposureUpload || o.Exposure == ExposureDownload || o.Exposure == ExposureBoth
+}
+
+// GuestCanDelete returns true if guests can delete items of shares with o
+func (o Options) GuestCanDelete() bool {
+	return o.Exposure == ExposureUpload || o.Exposure == ExposureBoth
+}
@@ -3,7 +3,10 @@ package storage
 import (
 	"bufio"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -34,12 +37,16 @@ type FileStorageConfig struct {
 type FileBackend struct {
 	Options             FileStorageConfig
 	DefaultValidityDays int
+
+	// locker serializes metadata updates of shares
+	locker Locker
 }
 
 // NewFileStorage creates a new FileBackend with the provided options o
 func NewFileStorage(o FileStorageConfig) *FileBackend {
 	r := FileBackend{
 		Options: o,
+		locker:  &LocalLocker{},
 	}
 
 	r.initialize()
@@ -47,6 +54,12 @@ func NewFileStorage(o FileStorageConfig) *FileBackend {
 	return &r
 }
 
+// SetLocker sets the Locker serializing metadata updates of shares. It must
+// be set before the backend is used.
+func (b *FileBackend) SetLocker(l Locker) {
+	b.locker = l
+}
+
 // initialize creates the root directory for the backend and panics if it can't
 // be created or if no path is provided.
 
@@ -68,69 +81,77 @@ func IsShareNameSafe(n string) bool {
 	return m
 }
 
+// isItemNameSafe checks an item name is not empty, hidden or a path
 func isItemNameSafe(n string) bool {
-	return !strings.HasPrefix(n, ".")
+	return n != "" && !strings.HasPrefix(n, ".") && !strings.Contains(n, "/")
 }
 
-// Migrate moves all previous metadata versions to new version
+// Migrate upgrades the metadata of shares to MetadataVersion
 func (b *FileBackend) Migrate() error {
-	type ShareV1 struct {
-		Version     int       `json:"version"`
-		Name        string    `json:"name"`
-		DateCreated time.Time `json:"created,omitempty"`
-		Owner       string    `json:"owner,omitempty"`
-		Validity    int       `json:"validity"`
-		Exposure    string    `json:"exposure"`
-		Options     Options   `json:"options,omitempty"`
-		Size        int64     `json:"size,omitempty"`
-		Count       int64     `json:"count,omitempty"`
-	}
+	return migrate(context.Background(), b, b.locker)
+}
 
+// listMetadata returns the names of shares with metadata
+func (b *FileBackend) listMetadata(ctx context.Context) ([]string, error) {
 	d, err := os.ReadDir(b.Options.Path)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	for _, d := range d {
-		if !d.IsDir() {
-			continue
-		}
 
-		fm, err := os.Open(path.Join(b.Options.Path, d.Name(), ".metadata"))
-		if err != nil {
+	result := []string{}
+	for _, f := range d {
+		if !f.IsDir() || !IsShareNameSafe(f.Name()) {
 			continue
 		}
-
-		var m ShareV1
-		err = json.NewDecoder(fm).Decode(&m)
-		if err != nil || m.Version > 0 {
-			continue
+		_, err = os.Stat(path.Join(b.Options.Path, f.Name(), ".metadata"))
+		if err == nil {
+			result = append(result, f.Name())
 		}
-		fm.Close()
+	}
 
-		o := Options{}
-		if m.Options != o {
-			o = m.Options
-		} else {
-			o = Options{
-				Validity: m.Validity,
-				Exposure: m.Exposure,
-			}
+	return result, nil
+}
+
+// readMetadata returns the metadata of share name as stored, files have no
+// ETag
+func (b *FileBackend) readMetadata(ctx context.Context, name string) ([]byte, string, error) {
+	j, err := os.ReadFile(path.Join(b.Options.Path, name, ".metadata"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", ErrShareNotFound
 		}
+		return nil, "", err
+	}
 
-		nm := NewShare().
-			WithName(m.Name).
-			WithDateCreated(m.DateCreated).
-			WithOwner(m.Owner).
-			WithOptions(o)
-		nm.Size = m.Size
-		nm.Count = m.Count
+	return j, "", nil
+}
 
-		err = SaveShareAtPath(nm, path.Join(b.Options.Path, d.Name()))
-		if err != nil {
-			return err
-		}
+// putMetadata writes the metadata of share. Files are not written
+// conditionally, the share lock must be held by the caller.
+func (b *FileBackend) putMetadata(ctx context.Context, share *Share, etag string) error {
+	return SaveShareAtPath(share, path.Join(b.Options.Path, share.Name))
+}
+
+// readSchema returns the schema marker, or nil if there is none
+func (b *FileBackend) readSchema(ctx context.Context) ([]byte, error) {
+	j, err := os.ReadFile(path.Join(b.Options.Path, schemaKey))
+	if os.IsNotExist(err) {
+		return nil, nil
 	}
-	return nil
+
+	return j, err
+}
+
+// writeSchema writes the schema marker
+func (b *FileBackend) writeSchema(ctx context.Context, j []byte) error {
+	p := path.Join(b.Options.Path, schemaKey)
+
+	err := os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, j)
 }
 
 // CreateShare creates a new share with the provided name, owner and validity
@@ -161,8 +182,8 @@ func (b *FileBackend) CreateShare(ctx context.Context, name, owner string, optio
 	m := NewShare().
 		WithName(name).
 		WithOwner(owner).
-		WithOptions(options).
 		WithDateCreated(time.Now())
+	m.updateOptions(options)
 
 	err = SaveShareAtPath(m, path.Join(b.Options.Path, name))
 	if err != nil {
@@ -180,43 +201,131 @@ func (b *FileBackend) UpdateShare(ctx context.Context, name string, options *Opt
 		return nil, ErrInvalidShareName
 	}
 
+	ctx, unlock, err := b.locker.Lock(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	m, err := b.GetShare(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
 	if options != nil {
-		m.Options = *options
+		m.updateOptions(*options)
 	}
 
 	if downloads != nil {
 		m.Downloads = *downloads
 	}
 
-	f, err := os.Create(path.Join(b.Options.Path, name, ".metadata"))
+	err = SaveShareAtPath(m, path.Join(b.Options.Path, name))
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
 
-	err = json.NewEncoder(f).Encode(m)
+	return &m.Options, nil
+}
+
+// ReserveDownloads counts a download of items of share by a guest before it
+// is served. It returns ErrDownloadLimitReached if the download limits of the
+// share would be exceeded.
+func (b *FileBackend) ReserveDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(ctx, name, func(s *Share) error { return s.reserveDownloads(items) })
+}
+
+// ReleaseDownloads uncounts a download of items of share by a guest that
+// didn't complete
+func (b *FileBackend) ReleaseDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(ctx, name, func(s *Share) error { return s.releaseDownloads(items) })
+}
+
+// AddDownloads counts a complete download of items of share
+func (b *FileBackend) AddDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(ctx, name, func(s *Share) error { return s.addDownloads(items) })
+}
+
+// updateDownloads applies update to the metadata of share name while it is
+// locked
+func (b *FileBackend) updateDownloads(ctx context.Context, name string, update func(*Share) error) (*Share, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	ctx, unlock, err := b.locker.Lock(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	return &m.Options, nil
+	m, err := b.GetShare(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = update(m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = SaveShareAtPath(m, path.Join(b.Options.Path, name))
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// RestoreShare writes the metadata of share as is, creating the share if it
+// doesn't exist. Size and Count are computed from the items of the share.
+
+func (b *FileBackend) RestoreShare(ctx context.Context, share *Share) (*Share, error) {
+	if !IsShareNameSafe(share.Name) {
+		return nil, ErrInvalidShareName
+	}
+
+	ctx, unlock, err := b.locker.Lock(ctx, share.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	p := path.Join(b.Options.Path, share.Name)
+	err = os.MkdirAll(p, 0755)
+	if err != nil {
+		slog.Error("cannot create share", slog.String("error", err.Error()), slog.String("path", p))
+		return nil, err
+	}
+
+	err = SaveShareAtPath(restoredShare(share), p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.refreshMetadata(share.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.GetShare(ctx, share.Name)
 }
 
 // CreateItem creates a new item in the provided share with the provided name
 // and content. It returns an error if the share does not exist, or if the item
 // doesn't fit in the share or if the share is full. The content is read from
-// the provided bufio.Reader.
+// the provided bufio.Reader. Conflicts with existing items are resolved while
+// the share is locked, once the content has been written.
 
-func (b *FileBackend) CreateItem(ctx context.Context, s string, i string, size int64, r io.Reader) (*Item, error) {
+func (b *FileBackend) CreateItem(ctx context.Context, s string, i string, size int64, r io.Reader, metadata *ItemMetadata) (*Item, error) {
 	if !IsShareNameSafe(s) {
 		return nil, ErrInvalidShareName
 	}
 
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
 	// Get Share metadata
 	share, err := b.GetShare(ctx, s)
 	if err != nil {
@@ -224,235 +333,201 @@ func (b *FileBackend) CreateItem(ctx context.Context, s string, i string, size i
 	}
 
 	// Check amount of free capacity in share according to current limits
-	maxWrite := int64(0)
-
-	maxShare := b.Options.MaxShareSize * 1024 * 1024
-	if maxShare > 0 {
-		maxWrite = maxShare - share.Size
-		if maxWrite <= 0 {
-			return nil, ErrMaxShareSizeReached
-		}
-	}
-
-	maxItem := b.Options.MaxFileSize * 1024 * 1024
-	if maxItem > 0 {
-		if size > 0 && maxItem < size {
-			return nil, ErrMaxFileSizeReached
-		}
-		if maxWrite > maxItem || maxWrite == 0 {
-			maxWrite = maxItem
-		}
+	maxWrite, err := itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, share, size)
+	if err != nil {
+		return nil, err
 	}
 
-	// maxWrite is the actual allowed size for the item, so we fix the limit
-	// to one more byte
-	if maxWrite > 0 {
-		maxWrite++
+	exists := b.itemExists(s)
 
-		if size > 0 && maxWrite < size {
-			return nil, ErrMaxShareSizeReached
-		}
+	// Rejected uploads fail before their content is read
+	_, err = share.Options.itemName(i, exists)
+	if err != nil {
+		return nil, err
 	}
 
 	// path.Join("/", i) is used to avoid path traversal
 	p := path.Join(b.Options.Path, s, path.Join("/", i))
-	f, err := os.Create(p + suffix)
+
+	// Content is written to a temporary file with a unique name so
+	// concurrent uploads of the same item don't write to the same file
+	f, err := os.CreateTemp(path.Join(b.Options.Path, s), path.Base(p)+".*"+suffix)
 	if err != nil {
 		slog.Error("cannot create item", slog.String("error", err.Error()), slog.String("path", p))
 		return nil, err
 	}
 	defer f.Close()
+	tmp := f.Name()
 
 	src := r
-	// Substitute bufio.Reader with a limited reader
+	// Substitute bufio.Reader with a limited reader, reading one more byte
+	// than allowed to detect items larger than announced
 	if maxWrite != 0 {
-		src = bufio.NewReader(io.LimitReader(r, maxWrite))
+		src = bufio.NewReader(io.LimitReader(r, maxWrite+1))
 	}
 
 	written, err := io.Copy(f, src)
 	if err != nil {
-		os.Remove(p + suffix)
+		os.Remove(tmp)
 		return nil, err
 	}
 
-	// If nothing was written or if the max write limit was reached, remove the
-	// temporary file and return an error
-	if written > 0 && written == maxWrite {
-		os.Remove(p + suffix)
+	// If the max write limit was reached, remove the temporary file and
+	// return an error
+	if exceedsQuota(maxWrite, written) {
+		os.Remove(tmp)
 		return nil, ErrMaxShareSizeReached
 	}
 
-	err = os.Rename(p+suffix, p)
+	ctx, unlock, err := b.locker.Lock(ctx, s)
 	if err != nil {
+		os.Remove(tmp)
 		return nil, err
 	}
+	defer unlock()
 
-	item, err := b.GetItem(ctx, s, i)
+	// Another upload might have filled the share in the meantime
+	share, err = b.GetShare(ctx, s)
+	if err == nil {
+		_, err = itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, share, written)
+	}
 	if err != nil {
+		os.Remove(tmp)
 		return nil, err
 	}
 
-	err = b.updateMetadata(s)
+	name, err := share.Options.itemName(i, exists)
 	if err != nil {
+		os.Remove(tmp)
 		return nil, err
 	}
 
-	return item, nil
-}
-
-func (b *FileBackend) DeleteItem(ctx context.Context, s string, i string) error {
-	if !IsShareNameSafe(s) {
-		return ErrInvalidShareName
-	}
-
-	if !isItemNameSafe(i) {
-		return ErrInvalidItemName
+	if share.Options.Conflict == ConflictVersion {
+		err = b.keepVersion(s, name)
+		if err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
 	}
 
-	p := path.Join(b.Options.Path, s, path.Join("/", i))
-	err := os.Remove(p)
+	err = os.Rename(tmp, path.Join(b.Options.Path, s, name))
 	if err != nil {
-		if os.IsNotExist(err) {
-			return ErrItemNotFound
-		}
-		return err
+		os.Remove(tmp)
+		return nil, err
 	}
 
-	err = b.updateMetadata(s)
+	err = b.refreshMetadata(s, func(m *Share) {
+		if metadata != nil {
+			m.setItemMetadata(name, *metadata)
+		}
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	return b.GetItem(ctx, s, name)
 }
 
-// GetShare retrieves the metadata for a share with the provided name. It
-// returns an error if the share does not exist or if the name is invalid.
-
-func (b *FileBackend) GetShare(ctx context.Context, s string) (*Share, error) {
-	if !IsShareNameSafe(s) {
-		return nil, ErrInvalidShareName
+// itemExists returns a function telling if share s has an item named n
+func (b *FileBackend) itemExists(s string) func(n string) (bool, error) {
+	return func(n string) (bool, error) {
+		_, err := os.Stat(path.Join(b.Options.Path, s, n))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
 	}
-	fm, err := os.Open(path.Join(b.Options.Path, s, ".metadata"))
+}
+
+// keepVersion moves item i of share s to a new version if it exists. The
+// share lock must be held by the caller.
+func (b *FileBackend) keepVersion(s, i string) error {
+	p := path.Join(b.Options.Path, s, i)
+	_, err := os.Stat(p)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return nil, ErrShareNotFound
+			return nil
 		}
-		return nil, err
+		return err
 	}
-	defer fm.Close()
 
-	var m Share
-	err = json.NewDecoder(fm).Decode(&m)
+	versions, err := b.itemVersions(s, i)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	if m.Downloads == nil {
-		m.Downloads = map[string]int64{}
+	v := path.Join(b.Options.Path, s, versionPath(i, nextVersion(versions)))
+	err = os.MkdirAll(path.Dir(v), 0755)
+	if err != nil {
+		return err
 	}
 
-	return &m, nil
+	return os.Rename(p, v)
 }
 
-// ListShares returns the list of shares available in the backend. It returns
-// an error if the directory can't be read or if the metadata file can't be
-// decoded.
-// The returned shares are sorted by creation date, newest first.
-
-func (b *FileBackend) ListShares(ctx context.Context) ([]Share, error) {
-	d, err := os.ReadDir(b.Options.Path)
+// itemVersions returns the versions of item i of share s
+func (b *FileBackend) itemVersions(s, i string) ([]ItemVersion, error) {
+	d, err := os.ReadDir(path.Join(b.Options.Path, s, versionsDir, i))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return []ItemVersion{}, nil
+		}
 		return nil, err
 	}
-	r := make([]Share, 0, len(d))
 
-	// Shares loop
+	files := []Item{}
 	for _, f := range d {
-		if f.IsDir() {
-			m, err := b.GetShare(ctx, f.Name())
-			if err != nil {
+		info, err := f.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
 				continue
 			}
-			if os.Getenv("DEMO") == "true" {
-				referenceDate := time.Date(2024, time.September, 1, 16, 48, 0, 0, time.UTC)
-				delta := time.Since(referenceDate)
-				m.DateCreated = m.DateCreated.Add(delta)
-			}
-			r = append(r, *m)
+			return nil, err
 		}
+		files = append(files, Item{
+			Path:     path.Join(s, versionsDir, i, f.Name()),
+			ItemInfo: ItemInfo{Size: info.Size(), DateModified: info.ModTime()},
+		})
 	}
-	sort.Slice(r, func(i, j int) bool {
-		return r[i].DateCreated.After(r[j].DateCreated)
-	})
 
-	return r, nil
+	return itemVersions(files), nil
 }
 
-// DeleteShare removes a share and all its content from the backend. It returns
-// an error if the share does not exist or if the name is invalid.
-
-func (b *FileBackend) DeleteShare(ctx context.Context, s string) error {
-	if !IsShareNameSafe(s) {
-		return ErrInvalidShareName
-	}
-	sharePath := path.Join(b.Options.Path, s)
-
-	_, err := os.Stat(sharePath)
+// listVersions returns the versions of every item of share s, Path being
+// relative to the storage directory
+func (b *FileBackend) listVersions(s string) ([]Item, error) {
+	d, err := os.ReadDir(path.Join(b.Options.Path, s, versionsDir))
 	if err != nil {
 		if os.IsNotExist(err) {
-			return ErrShareNotFound
+			return []Item{}, nil
 		}
-		return err
-	}
-	err = os.RemoveAll(sharePath)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-// ListShare returns the list of items in a share. It returns an error if the
-// share does not exist or if the name is invalid. The items are sorted by
-// modification date, newest first.
-// .* files and temporary upload files are excluded from the result.
-
-func (b *FileBackend) ListShare(ctx context.Context, s string) ([]Item, error) {
-	if !IsShareNameSafe(s) {
-		return nil, ErrInvalidShareName
-	}
-
-	d, err := os.ReadDir(path.Join(b.Options.Path, s))
-	if err != nil {
 		return nil, err
 	}
 
-	r := []Item{}
+	result := []Item{}
 	for _, f := range d {
-		// Ignore dotfiles and temporary files
-		if strings.HasPrefix(f.Name(), ".") || strings.HasSuffix(f.Name(), suffix) {
+		if !f.IsDir() || !isItemNameSafe(f.Name()) {
 			continue
 		}
 
-		i, err := b.GetItem(ctx, s, f.Name())
+		versions, err := b.itemVersions(s, f.Name())
 		if err != nil {
 			return nil, err
 		}
-
-		r = append(r, *i)
+		for _, v := range versions {
+			result = append(result, Item{
+				Path:     path.Join(s, versionPath(f.Name(), v.Version)),
+				ItemInfo: v.ItemInfo,
+			})
+		}
 	}
 
-	// Sort items by modification date, newest first
-	sort.Slice(r, func(i, j int) bool {
-		return r[i].ItemInfo.DateModified.After(r[j].ItemInfo.DateModified)
-	})
-
-	return r, nil
+	return result, nil
 }
 
-// GetItem retrieves the metadata for an item in a share. It returns an error if
-// the share or the item do not exist or if the share name is invalid.
-func (b *FileBackend) GetItem(ctx context.Context, s string, i string) (*Item, error) {
+// SetItemMetadata replaces the metadata of item i of share s. It returns an
+// error if the share or the item do not exist.
+func (b *FileBackend) SetItemMetadata(ctx context.Context, s, i string, metadata ItemMetadata) (*Item, error) {
 	if !IsShareNameSafe(s) {
 		return nil, ErrInvalidShareName
 	}
@@ -461,10 +536,13 @@ func (b *FileBackend) GetItem(ctx context.Context, s string, i string) (*Item, e
 		return nil, ErrInvalidItemName
 	}
 
-	// path.Join("/", i) is used to avoid path traversal
-	p := path.Join(b.Options.Path, s, path.Join("/", i))
+	ctx, unlock, err := b.locker.Lock(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
 
-	stat, err := os.Stat(p)
+	_, err = os.Stat(path.Join(b.Options.Path, s, path.Join("/", i)))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return nil, ErrItemNotFound
@@ -472,48 +550,893 @@ func (b *FileBackend) GetItem(ctx context.Context, s string, i string) (*Item, e
 		return nil, err
 	}
 
-	share, err := b.GetShare(ctx, s)
+	m, err := b.GetShare(ctx, s)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Item{
-		Path:      path.Join(s, i),
-		Downloads: share.Downloads[i],
-		ItemInfo:  ItemInfo{Size: stat.Size(), DateModified: stat.ModTime()},
-	}, nil
+	m.setItemMetadata(i, metadata)
+
+	err = SaveShareAtPath(m, path.Join(b.Options.Path, s))
+	if err != nil {
+		return nil, err
+	}
+
+	return b.GetItem(ctx, s, i)
 }
 
-// GetItemData retrieves the content of an item in a share. It returns an error
-// if the share or the item do not exist or if the share name is invalid.
-func (b *FileBackend) GetItemData(ctx context.Context, s string, i string) (io.ReadCloser, error) {
-	if !IsShareNameSafe(s) {
+// CopyItem copies item i of share s to item to of share t. The item is hard
+// linked when both shares are on the same file system, and copied otherwise.
+// Items are never written in place, so replacing one of the links doesn't
+// change the other.
+func (b *FileBackend) CopyItem(ctx context.Context, s, i, t, to string) (*Item, error) {
+	if !IsShareNameSafe(s) || !IsShareNameSafe(t) {
 		return nil, ErrInvalidShareName
 	}
 
-	if !isItemNameSafe(i) {
+	if !isItemNameSafe(i) || !isItemNameSafe(to) {
 		return nil, ErrInvalidItemName
 	}
 
-	// path.Join("/", i) is used to avoid path traversal
-	p := path.Join(b.Options.Path, s, path.Join("/", i))
-
-	f, err := os.Open(p)
+	ctx, unlock, err := b.locker.Lock(ctx, t)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil, ErrItemNotFound
-		}
+		return nil, err
+	}
+	defer unlock()
+
+	// Quota is checked against the destination share once it is locked, so
+	// concurrent uploads can't fill it in the meantime
+	source, share, name, err := b.prepareCopy(ctx, s, i, t, to, true)
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := linkTemp(path.Join(b.Options.Path, s, i), path.Join(b.Options.Path, t), name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrItemNotFound
+		}
+		return nil, err
+	}
+
+	// The lock might have been lost while the content was copied
+	if ctx.Err() != nil {
+		os.Remove(tmp)
+		return nil, context.Cause(ctx)
+	}
+
+	if share.Options.Conflict == ConflictVersion {
+		err = b.keepVersion(t, name)
+		if err != nil {
+			os.Remove(tmp)
+			return nil, err
+		}
+	}
+
+	err = os.Rename(tmp, path.Join(b.Options.Path, t, name))
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	err = b.refreshMetadata(t, func(m *Share) {
+		m.replaceItemMetadata(name, source.Metadata)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.GetItem(ctx, t, name)
+}
+
+// MoveItem moves item i of share s to item to of share t. The item is renamed
+// while both shares are locked, its versions are deleted.
+func (b *FileBackend) MoveItem(ctx context.Context, s, i, t, to string) (*Item, error) {
+	if !IsShareNameSafe(s) || !IsShareNameSafe(t) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) || !isItemNameSafe(to) {
+		return nil, ErrInvalidItemName
+	}
+
+	ctx, unlock, err := lockShares(ctx, b.locker, s, t)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	// Items moved within a share don't change its size
+	source, share, name, err := b.prepareCopy(ctx, s, i, t, to, s != t)
+	if err != nil {
+		return nil, err
+	}
+
+	if share.Options.Conflict == ConflictVersion {
+		err = b.keepVersion(t, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = os.Rename(path.Join(b.Options.Path, s, i), path.Join(b.Options.Path, t, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrItemNotFound
+		}
+		return nil, err
+	}
+
+	err = os.RemoveAll(path.Join(b.Options.Path, s, versionsDir, i))
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.refreshMetadata(t, func(m *Share) {
+		m.replaceItemMetadata(name, source.Metadata)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if s != t {
+		err = b.refreshMetadata(s, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return b.GetItem(ctx, t, name)
+}
+
+// prepareCopy returns source item i of share s, destination share t and the
+// name item i is copied or moved with to item to of t. The quota of t is
+// checked if quota is true. The lock of t must be held by the caller.
+func (b *FileBackend) prepareCopy(ctx context.Context, s, i, t, to string, quota bool) (*Item, *Share, string, error) {
+	source, err := b.GetItem(ctx, s, i)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	share, err := b.GetShare(ctx, t)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	if quota {
+		_, err = itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, share, source.ItemInfo.Size)
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+
+	name, err := share.Options.copyItemName(s, i, t, to, b.itemExists(t))
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	return source, share, name, nil
+}
+
+// linkTemp links or copies file p to a temporary file of directory d named
+// after item i, and returns its path
+func linkTemp(p, d, i string) (string, error) {
+	f, err := os.CreateTemp(d, i+".*"+suffix)
+	if err != nil {
+		return "", err
+	}
+	tmp := f.Name()
+
+	// The temporary file is replaced by the link
+	f.Close()
+	err = os.Remove(tmp)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.Link(p, tmp)
+	if err == nil {
+		return tmp, nil
+	}
+
+	// Links fail across file systems, the content is copied instead
+	err = copyFile(p, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	return tmp, nil
+}
+
+// copyFile copies the content of file p to a new file dst
+func copyFile(p, dst string) error {
+	src, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, src)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+func (b *FileBackend) DeleteItem(ctx context.Context, s string, i string) error {
+	if !IsShareNameSafe(s) {
+		return ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return ErrInvalidItemName
+	}
+
+	p := path.Join(b.Options.Path, s, path.Join("/", i))
+	err := os.Remove(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrItemNotFound
+		}
+		return err
+	}
+
+	// Versions are deleted with their item
+	err = os.RemoveAll(path.Join(b.Options.Path, s, versionsDir, i))
+	if err != nil {
+		return err
+	}
+
+	err = b.updateMetadata(ctx, s)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListItemVersions returns the versions of item i of share s, oldest first.
+// It returns ErrItemNotFound if the item has neither content nor versions.
+func (b *FileBackend) ListItemVersions(ctx context.Context, s, i string) ([]ItemVersion, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	versions, err := b.itemVersions(s, i)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		_, err = b.GetItem(ctx, s, i)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return versions, nil
+}
+
+// GetItemVersionData returns the content of version v of item i of share s
+func (b *FileBackend) GetItemVersionData(ctx context.Context, s, i string, v int) (io.ReadCloser, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	f, err := os.Open(path.Join(b.Options.Path, s, versionPath(i, v)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// DeleteItemVersion deletes version v of item i of share s
+func (b *FileBackend) DeleteItemVersion(ctx context.Context, s, i string, v int) error {
+	if !IsShareNameSafe(s) {
+		return ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return ErrInvalidItemName
+	}
+
+	p := path.Join(b.Options.Path, s, versionPath(i, v))
+	err := os.Remove(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrVersionNotFound
+		}
+		return err
+	}
+
+	// The directory of versions of the item is only removed once empty
+	_ = os.Remove(path.Dir(p))
+
+	return b.updateMetadata(ctx, s)
+}
+
+// GetShare retrieves the metadata for a share with the provided name. It
+// returns an error if the share does not exist or if the name is invalid.
+
+func (b *FileBackend) GetShare(ctx context.Context, s string) (*Share, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+	fm, err := os.Open(path.Join(b.Options.Path, s, ".metadata"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+	defer fm.Close()
+
+	var m Share
+	err = json.NewDecoder(fm).Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+
+	if m.Downloads == nil {
+		m.Downloads = map[string]int64{}
+	}
+
+	return &m, nil
+}
+
+// ListShares returns the list of shares available in the backend. It returns
+// an error if the directory can't be read or if the metadata file can't be
+// decoded.
+// The returned shares are sorted by creation date, newest first.
+
+func (b *FileBackend) ListShares(ctx context.Context) ([]Share, error) {
+	r, err := b.listShares(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sortShares(r)
+
+	return r, nil
+}
+
+// QueryShares returns a page of shares matching q. Only metadata of shares
+// matching q prefix is read, and only for shares of the page when sorted by
+// name.
+func (b *FileBackend) QueryShares(ctx context.Context, q ShareQuery) (*SharePage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if q.ByName() {
+		d, err := os.ReadDir(b.Options.Path)
+		if err != nil {
+			return nil, err
+		}
+		names := []string{}
+		for _, f := range d {
+			if f.IsDir() && IsShareNameSafe(f.Name()) {
+				names = append(names, f.Name())
+			}
+		}
+		return q.ApplyNames(names, func(name string) (*Share, error) {
+			return b.GetShare(ctx, name)
+		})
+	}
+
+	r, err := b.listShares(ctx, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Apply(r)
+}
+
+// listShares returns shares with a name starting with prefix
+func (b *FileBackend) listShares(ctx context.Context, prefix string) ([]Share, error) {
+	d, err := os.ReadDir(b.Options.Path)
+	if err != nil {
+		return nil, err
+	}
+	r := make([]Share, 0, len(d))
+
+	// Shares loop
+	for _, f := range d {
+		if f.IsDir() && strings.HasPrefix(f.Name(), prefix) {
+			m, err := b.GetShare(ctx, f.Name())
+			if err != nil {
+				continue
+			}
+			r = append(r, *m)
+		}
+	}
+
+	return r, nil
+}
+
+// DeleteShare removes a share and all its content from the backend. It returns
+// an error if the share does not exist or if the name is invalid.
+
+func (b *FileBackend) DeleteShare(ctx context.Context, s string) error {
+	if !IsShareNameSafe(s) {
+		return ErrInvalidShareName
+	}
+	sharePath := path.Join(b.Options.Path, s)
+
+	ctx, unlock, err := b.locker.Lock(ctx, s)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = os.Stat(sharePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrShareNotFound
+		}
+		return err
+	}
+	err = os.RemoveAll(sharePath)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// RenameShare renames share s to name by renaming its directory, items and
+// versions are moved with it
+func (b *FileBackend) RenameShare(ctx context.Context, s, name string, until time.Time) (*Share, error) {
+	if !IsShareNameSafe(s) || !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+	if s == name {
+		return nil, fmt.Errorf("%w : %s", ErrShareAlreadyExists, name)
+	}
+
+	ctx, unlock, err := lockShares(ctx, b.locker, s, name)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	share, err := b.GetShare(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := path.Join(b.Options.Path, name)
+	_, err = os.Stat(p)
+	if err == nil {
+		return nil, fmt.Errorf("%w : %s", ErrShareAlreadyExists, name)
+	}
+
+	err = os.Rename(path.Join(b.Options.Path, s), p)
+	if err != nil {
+		return nil, err
+	}
+
+	share.Name = name
+	err = SaveShareAtPath(share, p)
+	if err != nil {
+		return nil, err
+	}
+
+	err = recordRename(ctx, b, s, name, until)
+	if err != nil {
+		return nil, err
+	}
+
+	return share, nil
+}
+
+// GetRenamedShare returns the record of the share previously named name
+func (b *FileBackend) GetRenamedShare(ctx context.Context, name string) (*RenamedShare, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	j, err := os.ReadFile(path.Join(b.Options.Path, renamePath(name)))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+
+	result := &RenamedShare{}
+	err = json.Unmarshal(j, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// putRenamedShare writes the record of r.From
+func (b *FileBackend) putRenamedShare(ctx context.Context, r *RenamedShare) error {
+	j, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	p := path.Join(b.Options.Path, renamePath(r.From))
+
+	err = os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, j)
+}
+
+// PurgeRenamedShares removes records of renamed shares which previous name
+// stopped working before before
+func (b *FileBackend) PurgeRenamedShares(ctx context.Context, before time.Time) ([]string, error) {
+	return purgeRenamedShares(ctx, b, b.locker, before)
+}
+
+// listRenamedShares returns the previous names of renamed shares
+func (b *FileBackend) listRenamedShares(ctx context.Context) ([]string, error) {
+	d, err := os.ReadDir(path.Join(b.Options.Path, renamesPrefix))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	result := []string{}
+	for _, f := range d {
+		if name, ok := strings.CutSuffix(f.Name(), ".json"); ok && IsShareNameSafe(name) {
+			result = append(result, name)
+		}
+	}
+
+	return result, nil
+}
+
+// deleteRenamedShare removes the record of name
+func (b *FileBackend) deleteRenamedShare(ctx context.Context, name string) error {
+	err := os.Remove(path.Join(b.Options.Path, renamePath(name)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// ListShare returns the list of items in a share. It returns an error if the
+// share does not exist or if the name is invalid. The items are sorted by
+// modification date, newest first.
+// .* files and temporary upload files are excluded from the result.
+
+func (b *FileBackend) ListShare(ctx context.Context, s string) ([]Item, error) {
+	r, err := b.listItems(ctx, s, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort items by modification date, newest first
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].ItemInfo.DateModified.After(r[j].ItemInfo.DateModified)
+	})
+
+	return r, nil
+}
+
+// QueryItems returns a page of items in share s matching q
+func (b *FileBackend) QueryItems(ctx context.Context, s string, q ItemQuery) (*ItemPage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := b.listItems(ctx, s, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Apply(r)
+}
+
+// listItems returns items of share s with a name starting with prefix
+func (b *FileBackend) listItems(ctx context.Context, s, prefix string) ([]Item, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	d, err := os.ReadDir(path.Join(b.Options.Path, s))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+
+	r := []Item{}
+	for _, f := range d {
+		// Ignore dotfiles and temporary files
+		if strings.HasPrefix(f.Name(), ".") || strings.HasSuffix(f.Name(), suffix) {
+			continue
+		}
+		if !strings.HasPrefix(f.Name(), prefix) {
+			continue
+		}
+
+		i, err := b.GetItem(ctx, s, f.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		r = append(r, *i)
+	}
+
+	return r, nil
+}
+
+// GetItem retrieves the metadata for an item in a share. It returns an error if
+// the share or the item do not exist or if the share name is invalid.
+func (b *FileBackend) GetItem(ctx context.Context, s string, i string) (*Item, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	// path.Join("/", i) is used to avoid path traversal
+	p := path.Join(b.Options.Path, s, path.Join("/", i))
+
+	stat, err := os.Stat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrItemNotFound
+		}
+		return nil, err
+	}
+
+	share, err := b.GetShare(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Item{
+		Path:      path.Join(s, i),
+		Downloads: share.Downloads[i],
+		Metadata:  share.itemMetadata(i),
+		ItemInfo:  ItemInfo{Size: stat.Size(), DateModified: stat.ModTime()},
+	}, nil
+}
+
+// GetItemData retrieves the content of an item in a share. It returns an error
+// if the share or the item do not exist or if the share name is invalid.
+func (b *FileBackend) GetItemData(ctx context.Context, s string, i string) (io.ReadCloser, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	// path.Join("/", i) is used to avoid path traversal
+	p := path.Join(b.Options.Path, s, path.Join("/", i))
+
+	f, err := os.Open(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrItemNotFound
+		}
 		return nil, err
 	}
 	return f, nil
 }
 
-func (b *FileBackend) updateMetadata(s string) error {
+// Check checks shares metadata against the content of their directory.
+// Temporary files of uploads older than checkGracePeriod are reported as
+// orphans.
+func (b *FileBackend) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	report := newCheckReport(repair)
+
+	d, err := os.ReadDir(b.Options.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range d {
+		// Leases and other files are not shares
+		if !f.IsDir() || !IsShareNameSafe(f.Name()) {
+			continue
+		}
+
+		err = b.checkShare(ctx, f.Name(), report)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	report.sort()
+
+	return report, nil
+}
+
+// checkShare checks share s and adds problems to report
+func (b *FileBackend) checkShare(ctx context.Context, s string, report *CheckReport) error {
+	ctx, unlock, err := b.locker.Lock(ctx, s)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	p := path.Join(b.Options.Path, s)
+
+	d, err := os.ReadDir(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	items := []Item{}
+	for _, f := range d {
+		name := f.Name()
+		if name == ".metadata" || f.IsDir() {
+			continue
+		}
+
+		info, err := f.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return err
+		}
+
+		// Uploads and metadata writes in progress use temporary files
+		if strings.HasSuffix(name, suffix) || strings.HasPrefix(name, ".metadata") {
+			if time.Since(info.ModTime()) < checkGracePeriod {
+				continue
+			}
+			err = nil
+			if report.Repair {
+				err = os.Remove(path.Join(p, name))
+			}
+			report.add(err, Problem{
+				Kind:    ProblemOrphan,
+				Share:   s,
+				Path:    path.Join(s, name),
+				Message: "temporary file left by an interrupted upload",
+			})
+			continue
+		}
+
+		if !isItemNameSafe(name) {
+			continue
+		}
+
+		items = append(items, Item{
+			Path:     path.Join(s, name),
+			ItemInfo: ItemInfo{Size: info.Size(), DateModified: info.ModTime()},
+		})
+	}
+
+	report.Shares++
+	report.Items += len(items)
+
+	metadata := path.Join(s, ".metadata")
+
+	var problem *Problem
+
+	share := NewShare()
+	j, err := os.ReadFile(path.Join(p, ".metadata"))
+	if err == nil {
+		err = json.Unmarshal(j, share)
+	}
+	switch {
+	case os.IsNotExist(err):
+		// Shares are being created until their metadata is written
+		info, err := os.Stat(p)
+		if err != nil || time.Since(info.ModTime()) < checkGracePeriod {
+			report.Shares--
+			report.Items -= len(items)
+			return nil
+		}
+		problem = &Problem{
+			Kind:    ProblemMissingMetadata,
+			Share:   s,
+			Path:    metadata,
+			Message: "share directory has no metadata",
+		}
+	case isCorruptMetadata(err):
+		problem = &Problem{
+			Kind:    ProblemCorruptMetadata,
+			Share:   s,
+			Path:    metadata,
+			Message: fmt.Sprintf("metadata can't be decoded: %v", err),
+		}
+	case err != nil:
+		return err
+	}
+
+	versions, err := b.listVersions(s)
+	if err != nil {
+		return err
+	}
+
+	if problem != nil {
+		err = nil
+		if report.Repair {
+			err = SaveShareAtPath(recoveredShare(s, items, versions), p)
+		}
+		report.add(err, *problem)
+		return nil
+	}
+
+	if share.Downloads == nil {
+		share.Downloads = map[string]int64{}
+	}
+
+	problems := checkShare(share, items, versions, metadata)
+	if len(problems) == 0 {
+		return nil
+	}
+
+	err = nil
+	if report.Repair {
+		err = SaveShareAtPath(share, p)
+	}
+	report.add(err, problems...)
+
+	return nil
+}
+
+// updateMetadata updates size and count of share s after its items changed
+func (b *FileBackend) updateMetadata(ctx context.Context, s string) error {
 	if !IsShareNameSafe(s) {
 		return ErrInvalidShareName
 	}
+
+	ctx, unlock, err := b.locker.Lock(ctx, s)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return b.refreshMetadata(s, nil)
+}
+
+// refreshMetadata computes size and count of share s from its items, and
+// applies update to its metadata if it is not nil. The share lock must be
+// held by the caller.
+func (b *FileBackend) refreshMetadata(s string, update func(*Share)) error {
 	sd, err := os.ReadDir(path.Join(b.Options.Path, s))
 	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrShareNotFound
+		}
 		return err
 	}
 
@@ -522,14 +1445,21 @@ func (b *FileBackend) updateMetadata(s string) error {
 		return err
 	}
 
+	if update != nil {
+		update(m)
+	}
+
 	m.Size = 0
 	m.Count = 0
+	names := map[string]bool{}
 
 	// Share content loop
 	for _, i := range sd {
-		if strings.HasPrefix(i.Name(), ".") {
+		// Skip metadata and uploads in progress
+		if strings.HasPrefix(i.Name(), ".") || strings.HasSuffix(i.Name(), suffix) {
 			continue
 		}
+		names[i.Name()] = true
 		info, err := i.Info()
 		if err != nil {
 			slog.Error("cannot get file info", slog.String("error", err.Error()))
@@ -538,6 +1468,15 @@ func (b *FileBackend) updateMetadata(s string) error {
 		m.Size += info.Size()
 		m.Count += 1
 	}
+	m.pruneItemMetadata(names)
+
+	// Versions of items count in the size of the share
+	versions, err := b.listVersions(s)
+	if err != nil {
+		return err
+	}
+	versionsSize, _ := itemsSize(versions)
+	m.Size += versionsSize
 
 	err = SaveShareAtPath(m, path.Join(b.Options.Path, s))
 	if err != nil {
@@ -546,3 +1485,103 @@ func (b *FileBackend) updateMetadata(s string) error {
 
 	return nil
 }
+
+// lockFileTimeout is the age after which a lock file is considered left over
+// by a crashed instance and removed
+const lockFileTimeout = 10 * time.Second
+
+// AcquireLease acquires lease name for holder until ttl from now, leases are
+// stored in the storage directory so instances sharing it can coordinate
+func (b *FileBackend) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (*Lease, error) {
+	return acquireLease(ctx, b, name, holder, ttl)
+}
+
+// ReleaseLease releases lease name if it is held by holder
+func (b *FileBackend) ReleaseLease(ctx context.Context, name, holder string) error {
+	return releaseLease(ctx, b, name, holder)
+}
+
+// getLease returns lease name and the checksum of its file as ETag
+func (b *FileBackend) getLease(ctx context.Context, name string) (*Lease, string, error) {
+	c, err := os.ReadFile(b.leasePath(name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, "", errLeaseNotFound
+		}
+		return nil, "", err
+	}
+
+	result := &Lease{}
+	err = json.Unmarshal(c, result)
+	if err != nil {
+		return nil, "", err
+	}
+
+	sum := sha256.Sum256(c)
+	return result, hex.EncodeToString(sum[:]), nil
+}
+
+// putLease writes lease if its current ETag is etag. The comparison and the
+// write are made while holding a lock file, so they are atomic for all
+// instances sharing the directory.
+func (b *FileBackend) putLease(ctx context.Context, lease *Lease, etag string) error {
+	p := b.leasePath(lease.Name)
+
+	err := os.MkdirAll(path.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+
+	unlock, err := lockFile(ctx, p+".lock")
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, current, err := b.getLease(ctx, lease.Name)
+	if err != nil && !errors.Is(err, errLeaseNotFound) {
+		return err
+	}
+	if current != etag {
+		return errLeaseConflict
+	}
+
+	j, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(p, j)
+}
+
+func (b *FileBackend) leasePath(name string) string {
+	return path.Join(b.Options.Path, leasesPrefix, name+".json")
+}
+
+// lockFile creates lock file p exclusively, waiting for it to be removed if
+// it exists, and returns the function removing it
+func lockFile(ctx context.Context, p string) (func(), error) {
+	for {
+		f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			f.Close()
+			return func() { os.Remove(p) }, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+
+		info, err := os.Stat(p)
+		if err == nil && time.Since(info.ModTime()) > lockFileTimeout {
+			slog.Warn("removing stale lock file", slog.String("path", p))
+			os.Remove(p)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
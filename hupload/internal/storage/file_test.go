@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -11,10 +12,12 @@ import (
 	"path"
 	"reflect"
 	"slices"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/ybizeul/hupload/internal/storage"
+	"github.com/ybizeul/hupload/internal/storage/storagetest"
 	"gopkg.in/yaml.v3"
 )
 
@@ -32,6 +35,16 @@ func createFileBackend(t *testing.T) *storage.FileBackend {
 
 	return f
 }
+func TestFileConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, l storagetest.Limits) storage.Storage {
+		return storage.NewFileStorage(storage.FileStorageConfig{
+			Path:         t.TempDir(),
+			MaxFileSize:  l.MaxFileSize,
+			MaxShareSize: l.MaxShareSize,
+		})
+	})
+}
+
 func TestCreateShare(t *testing.T) {
 	t.Cleanup(func() {
 		os.RemoveAll("data")
@@ -48,7 +61,7 @@ func TestCreateShare(t *testing.T) {
 				return f.CreateShare(context.Background(), "test", "admin", storage.Options{Validity: 10, Exposure: "upload"})
 			},
 			storage.Share{
-				Version:   1,
+				Version:   storage.MetadataVersion,
 				Name:      "test",
 				Owner:     "admin",
 				Options:   storage.Options{Validity: 10, Exposure: "upload"},
@@ -60,7 +73,7 @@ func TestCreateShare(t *testing.T) {
 				return f.CreateShare(context.Background(), "test", "admin", storage.Options{Validity: 10, Exposure: "both"})
 			},
 			storage.Share{
-				Version:   1,
+				Version:   storage.MetadataVersion,
 				Name:      "test",
 				Owner:     "admin",
 				Options:   storage.Options{Validity: 10, Exposure: "both"},
@@ -72,7 +85,7 @@ func TestCreateShare(t *testing.T) {
 				return f.CreateShare(context.Background(), "test", "admin", storage.Options{Validity: 10, Exposure: "download"})
 			},
 			storage.Share{
-				Version:   1,
+				Version:   storage.MetadataVersion,
 				Name:      "test",
 				Owner:     "admin",
 				Options:   storage.Options{Validity: 10, Exposure: "download"},
@@ -85,11 +98,16 @@ func TestCreateShare(t *testing.T) {
 		t.Run(fmt.Sprintf("Create share %+v", test.expect), func(t *testing.T) {
 
 			share, err := test.f()
-			share.DateCreated = time.Time{}
 			if err != nil {
 				t.Errorf("Expected no error, got %v", err)
 			}
 
+			expires := share.DateCreated.AddDate(0, 0, 10).UTC().Truncate(time.Second)
+			if !share.Options.ExpiresAt.Equal(expires) {
+				t.Errorf("Expected expiration %v, got %v", expires, share.Options.ExpiresAt)
+			}
+			share.DateCreated = time.Time{}
+
 			_, err = os.Stat(path.Join("data", share.Name))
 			if err != nil {
 				t.Errorf("Expected share directory to be created")
@@ -144,6 +162,8 @@ func TestUpdateShare(t *testing.T) {
 		t.Errorf("Expected no error, got %v", err)
 	}
 
+	newOptions.ExpiresAt = share.DateCreated.AddDate(0, 0, 20).UTC().Truncate(time.Second)
+
 	if reflect.DeepEqual(o, newOptions) == false {
 		t.Errorf("Expected %v, got %v", newOptions, o)
 	}
@@ -164,6 +184,52 @@ func TestUpdateShare(t *testing.T) {
 		t.Errorf("Expected %+v, got %+v", share, share2)
 	}
 }
+func TestRestoreShare(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll("data")
+	})
+
+	f := createFileBackend(t)
+
+	share := storage.NewShare().
+		WithName("test").
+		WithOwner("user").
+		WithDateCreated(time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)).
+		WithOptions(storage.Options{Validity: 10, Exposure: "both", Description: "description", Message: "message"})
+	share.Downloads = map[string]int64{"test.txt": 2}
+
+	// Restore creates the share
+	_, err := f.RestoreShare(context.Background(), share)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	_, err = f.CreateItem(context.Background(), "test", "test.txt", 2, bytes.NewReader([]byte("ok")), nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Restore replaces metadata and keeps size and count of items
+	share.Options.Message = "new message"
+	got, err := f.RestoreShare(context.Background(), share)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	want := *share
+	want.Size = 2
+	want.Count = 1
+
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("Expected %+v, got %+v", &want, got)
+	}
+
+	_, err = f.RestoreShare(context.Background(), storage.NewShare().WithName("../test"))
+	if !errors.Is(err, storage.ErrInvalidShareName) {
+		t.Errorf("Expected ErrInvalidShareName, got %v", err)
+	}
+}
+
 func TestCreateItem(t *testing.T) {
 	t.Cleanup(func() {
 		os.RemoveAll("data")
@@ -197,7 +263,7 @@ func TestCreateItem(t *testing.T) {
 		b := bufio.NewReader(bytes.NewBuffer(test.Bytes))
 
 		// Test create item
-		_, err = f.CreateItem(context.Background(), "Test", test.FileName, int64(len(test.Bytes)), b)
+		_, err = f.CreateItem(context.Background(), "Test", test.FileName, int64(len(test.Bytes)), b, nil)
 		if err != nil {
 			t.Errorf("Expected no error, got %v", err)
 		}
@@ -260,7 +326,7 @@ func TestDeleteItem(t *testing.T) {
 	})
 
 	reader := bufio.NewReader(bytes.NewReader([]byte("test")))
-	_, _ = f.CreateItem(context.Background(), share.Name, "test.txt", 0, reader)
+	_, _ = f.CreateItem(context.Background(), share.Name, "test.txt", 0, reader, nil)
 
 	err := f.DeleteItem(context.Background(), share.Name, "test.txt")
 	if err != nil {
@@ -503,6 +569,7 @@ func TestMigrate(t *testing.T) {
 	}
 
 	parsedTime, _ := time.Parse("2006-01-02T15:04:05.99-07:00", "2024-08-08T16:20:25.231034+02:00")
+	expires := parsedTime.AddDate(0, 0, 10)
 
 	tests := []struct {
 		name string
@@ -512,10 +579,10 @@ func TestMigrate(t *testing.T) {
 		{
 			name: "test",
 			want: storage.Share{
-				Version:     1,
+				Version:     storage.MetadataVersion,
 				Name:        "test",
 				Owner:       "admin",
-				Options:     storage.Options{Validity: 10},
+				Options:     storage.Options{Validity: 10, ExpiresAt: expires},
 				Size:        4,
 				Count:       1,
 				DateCreated: parsedTime,
@@ -523,14 +590,14 @@ func TestMigrate(t *testing.T) {
 			},
 		},
 
-		// Migration of a v1 share
+		// Migration of a v1 share, expiration is set from validity
 		{
 			name: "test2",
 			want: storage.Share{
-				Version:     1,
+				Version:     storage.MetadataVersion,
 				Name:        "test2",
 				Owner:       "admin",
-				Options:     storage.Options{Validity: 10},
+				Options:     storage.Options{Validity: 10, ExpiresAt: expires},
 				Size:        4,
 				Count:       1,
 				DateCreated: parsedTime,
@@ -542,11 +609,12 @@ func TestMigrate(t *testing.T) {
 		{
 			name: "test3",
 			want: storage.Share{
-				Version: 1,
+				Version: storage.MetadataVersion,
 				Name:    "test3",
 				Owner:   "admin",
 				Options: storage.Options{
 					Validity:    10,
+					ExpiresAt:   expires,
 					Exposure:    "both",
 					Description: "desc",
 					Message:     "message",
@@ -570,6 +638,84 @@ func TestMigrate(t *testing.T) {
 	}
 }
 
+func TestMigrateSchema(t *testing.T) {
+	dir := t.TempDir()
+
+	err := exec.Command("cp", "-r", "file_testdata/data_old/.", dir).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := storage.FileStorageConfig{
+		Path:         dir,
+		MaxFileSize:  1,
+		MaxShareSize: 2,
+	}
+
+	t.Run("Concurrent migrations should succeed", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for range 4 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				err := storage.NewFileStorage(c).Migrate()
+				if err != nil {
+					t.Errorf("Expected no error, got %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		j, err := os.ReadFile(path.Join(dir, ".hupload", "schema.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := fmt.Sprintf(`{"version":%d}`, storage.MetadataVersion)
+		if string(j) != want {
+			t.Errorf("Expected %s, got %s", want, j)
+		}
+	})
+
+	t.Run("Migrating again should not change metadata", func(t *testing.T) {
+		p := path.Join(dir, "test", ".metadata")
+		before, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Metadata is only read if the schema marker is outdated
+		err = os.Remove(path.Join(dir, ".hupload", "schema.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = storage.NewFileStorage(c).Migrate()
+		if err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+
+		after, err := os.Stat(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !after.ModTime().Equal(before.ModTime()) {
+			t.Error("Expected metadata not to be written")
+		}
+	})
+
+	t.Run("Storage migrated by a newer version should fail", func(t *testing.T) {
+		err := os.WriteFile(path.Join(dir, ".hupload", "schema.json"), []byte(fmt.Sprintf(`{"version":%d}`, storage.MetadataVersion+1)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = storage.NewFileStorage(c).Migrate()
+		if !errors.Is(err, storage.ErrUnsupportedVersion) {
+			t.Errorf("Expected ErrUnsupportedVersion, got %v", err)
+		}
+	})
+}
+
 func TestShareWithDescriptionAndMessage(t *testing.T) {
 	t.Cleanup(func() {
 		os.RemoveAll("datadescription")
@@ -609,3 +755,231 @@ func TestShareWithDescriptionAndMessage(t *testing.T) {
 		t.Errorf("Expected test message, got %v", got.Options.Message)
 	}
 }
+
+func TestFileCopyItem(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := storage.NewFileStorage(storage.FileStorageConfig{Path: dir})
+
+	for _, s := range []string{"from", "to"} {
+		_, err := f.CreateShare(ctx, s, "admin", storage.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err := f.CreateItem(ctx, "from", "item.txt", 5, bytes.NewBufferString("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.CopyItem(ctx, "from", "item.txt", "to", "item.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Copies are hard links to the source
+	source, err := os.Stat(path.Join(dir, "from", "item.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied, err := os.Stat(path.Join(dir, "to", "item.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(source, copied) {
+		t.Errorf("Expected copy to be a hard link")
+	}
+
+	// No temporary file is left
+	d, err := os.ReadDir(path.Join(dir, "to"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range d {
+		if e.Name() != "item.txt" && e.Name() != ".metadata" {
+			t.Errorf("Unexpected file %s", e.Name())
+		}
+	}
+}
+
+func TestFileRenameShare(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := storage.NewFileStorage(storage.FileStorageConfig{Path: dir})
+
+	_, err := f.CreateShare(ctx, "from", "admin", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.CreateItem(ctx, "from", "item.txt", 5, bytes.NewBufferString("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(path.Join(dir, "from", "item.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = f.RenameShare(ctx, "from", "to", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory is renamed, items are not copied
+	_, err = os.Stat(path.Join(dir, "from"))
+	if !os.IsNotExist(err) {
+		t.Errorf("Expected previous directory to be removed, got %v", err)
+	}
+	after, err := os.Stat(path.Join(dir, "to", "item.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(before, after) {
+		t.Errorf("Expected item to be moved")
+	}
+
+	// The record of the rename is not a share
+	_, err = os.Stat(path.Join(dir, ".hupload", "renames", "from.json"))
+	if err != nil {
+		t.Errorf("Expected rename record, got %v", err)
+	}
+	shares, err := f.ListShares(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 1 || shares[0].Name != "to" {
+		t.Errorf("Unexpected shares %+v", shares)
+	}
+}
+
+func TestFileCheck(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	f := storage.NewFileStorage(storage.FileStorageConfig{Path: dir})
+
+	old := time.Now().Add(-2 * time.Hour)
+
+	write := func(p, content string) {
+		err := os.WriteFile(path.Join(dir, p), []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	age := func(p string) {
+		err := os.Chtimes(path.Join(dir, p), old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, s := range []string{"good", "stale"} {
+		_, err := f.CreateShare(ctx, s, "admin", storage.Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = f.CreateItem(ctx, s, "item.txt", 5, bytes.NewBufferString("hello"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Uploads in progress are ignored, interrupted ones are orphans
+	write("good/item.txt.1_huploadtemp", "hel")
+	write("good/item.txt.2_huploadtemp", "hel")
+	age("good/item.txt.1_huploadtemp")
+
+	stale, err := storage.NewShareAtPath(path.Join(dir, "stale"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Size, stale.Count = 0, 0
+	err = storage.SaveShareAtPath(stale, path.Join(dir, "stale"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range []string{"nometa", "corrupt"} {
+		err = os.Mkdir(path.Join(dir, s), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		write(path.Join(s, "item.txt"), "hello")
+	}
+	write("corrupt/.metadata", "{")
+	age("nometa")
+
+	// Leases are not shares
+	_, err = f.AcquireLease(ctx, "leader", "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type problem struct {
+		Kind, Path string
+	}
+	want := []problem{
+		{storage.ProblemCorruptMetadata, "corrupt/.metadata"},
+		{storage.ProblemOrphan, "good/item.txt.1_huploadtemp"},
+		{storage.ProblemMissingMetadata, "nometa/.metadata"},
+		{storage.ProblemStaleSize, "stale/.metadata"},
+	}
+	problems := func(r *storage.CheckReport) []problem {
+		result := []problem{}
+		for _, p := range r.Problems {
+			result = append(result, problem{p.Kind, p.Path})
+		}
+		return result
+	}
+
+	report, err := f.Check(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := problems(report); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	if report.Shares != 4 || report.Items != 4 || report.Problems[0].Repaired {
+		t.Errorf("Unexpected report %+v", report)
+	}
+
+	shares, _ := f.ListShares(ctx)
+	if len(shares) != 2 {
+		t.Errorf("Expected 2 shares before repair, got %d", len(shares))
+	}
+
+	report, err = f.Check(ctx, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := problems(report); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+	for _, p := range report.Problems {
+		if !p.Repaired || p.Error != "" {
+			t.Errorf("Expected %s to be repaired, got %+v", p.Path, p)
+		}
+	}
+
+	// Shares with recreated metadata are listed
+	shares, _ = f.ListShares(ctx)
+	if len(shares) != 4 {
+		t.Errorf("Expected 4 shares after repair, got %d", len(shares))
+	}
+	for _, s := range shares {
+		if s.Size != 5 || s.Count != 1 {
+			t.Errorf("Expected share %s to have 1 item of 5 bytes, got %d and %d", s.Name, s.Count, s.Size)
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, "good/item.txt.2_huploadtemp")); err != nil {
+		t.Errorf("Expected upload in progress to be kept, got %v", err)
+	}
+
+	report, err = f.Check(ctx, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("Expected no problems after repair, got %+v", report.Problems)
+	}
+}
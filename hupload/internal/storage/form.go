@@ -0,0 +1,109 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"regexp"
+	"slices"
+)
+
+var ErrInvalidField = errors.New("invalid field")
+
+// Types of fields
+const (
+	FieldText     = "text"
+	FieldEmail    = "email"
+	FieldSelect   = "select"
+	FieldCheckbox = "checkbox"
+)
+
+// maxFields is the maximum number of fields of a share
+const maxFields = 32
+
+// fieldName is the format of custom field names
+var fieldName = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// ItemField is a custom field of the metadata of items of a share, the fields
+// of a share making the form uploaders fill. Type is FieldText if empty,
+// Choices are the values of FieldSelect fields, and FieldCheckbox fields are
+// "true" when checked, a required checkbox having to be checked, like to
+// accept terms.
+type ItemField struct {
+	Name     string   `json:"name"`
+	Label    string   `json:"label,omitempty"`
+	Type     string   `json:"type,omitempty"`
+	Choices  []string `json:"choices,omitempty"`
+	Required bool     `json:"required,omitempty"`
+}
+
+// ValidateFields returns ErrInvalidField if fields of o don't have a valid
+// and unique name, a valid type or choices for select fields only
+func (o Options) ValidateFields() error {
+	if len(o.Fields) > maxFields {
+		return fmt.Errorf("%w: more than %d fields", ErrInvalidField, maxFields)
+	}
+
+	names := map[string]bool{}
+	for _, f := range o.Fields {
+		if !fieldName.MatchString(f.Name) {
+			return fmt.Errorf("%w: invalid name %q", ErrInvalidField, f.Name)
+		}
+		if names[f.Name] {
+			return fmt.Errorf("%w: duplicate name %s", ErrInvalidField, f.Name)
+		}
+		names[f.Name] = true
+
+		if len(f.Label) > maxMetadataSize {
+			return fmt.Errorf("%w: label of %s is too long", ErrInvalidField, f.Name)
+		}
+
+		switch f.Type {
+		case "", FieldText, FieldEmail, FieldCheckbox:
+			if len(f.Choices) > 0 {
+				return fmt.Errorf("%w: only select fields have choices", ErrInvalidField)
+			}
+		case FieldSelect:
+			if len(f.Choices) == 0 {
+				return fmt.Errorf("%w: select field %s has no choices", ErrInvalidField, f.Name)
+			}
+		default:
+			return fmt.Errorf("%w: invalid type %q", ErrInvalidField, f.Type)
+		}
+	}
+
+	return nil
+}
+
+// validate returns an error if v is not a valid value of f, an empty value
+// being invalid for required fields only
+func (f ItemField) validate(v string) error {
+	if len(v) > maxMetadataSize {
+		return fmt.Errorf("%s can't be longer than %d bytes", f.Name, maxMetadataSize)
+	}
+
+	if v == "" || (f.Type == FieldCheckbox && v == "false") {
+		if f.Required {
+			return fmt.Errorf("missing field %s", f.Name)
+		}
+		return nil
+	}
+
+	switch f.Type {
+	case FieldEmail:
+		_, err := mail.ParseAddress(v)
+		if err != nil {
+			return fmt.Errorf("%s: invalid email address %q", f.Name, v)
+		}
+	case FieldSelect:
+		if !slices.Contains(f.Choices, v) {
+			return fmt.Errorf("%s: invalid choice %q", f.Name, v)
+		}
+	case FieldCheckbox:
+		if v != "true" {
+			return fmt.Errorf("%s: must be true or false", f.Name)
+		}
+	}
+
+	return nil
+}
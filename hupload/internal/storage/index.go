@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"sort"
+)
+
+// indexKey is the object key of the metadata index in object storage
+// backends. It can't collide with share metadata or items as share names
+// can't start with a dot.
+const indexKey = ".hupload/index.json"
+
+// indexRetries is the number of times an index update is retried when the
+// index has been modified concurrently
+const indexRetries = 5
+
+var (
+	errIndexNotFound = errors.New("index not found")
+	errIndexConflict = errors.New("index modified concurrently")
+)
+
+// shareIndex is the metadata index of object storage backends. It holds the
+// metadata of every share so listing shares is a single read instead of one
+// per share.
+type shareIndex struct {
+	Shares map[string]Share `json:"shares"`
+
+	// Building is set while the index is built from share metadata. Shares
+	// updated or removed meanwhile are listed in Updated, so the build
+	// doesn't replace them with the metadata it read before.
+	Building bool     `json:"building,omitempty"`
+	Updated  []string `json:"updated,omitempty"`
+}
+
+// indexBackend is implemented by object storage backends that can maintain a
+// metadata index
+type indexBackend interface {
+	// getIndex returns the current index and its ETag, or errIndexNotFound
+	getIndex(ctx context.Context) (*shareIndex, string, error)
+
+	// putIndex writes index if its current ETag is etag, or if it doesn't
+	// exist when etag is empty. It returns errIndexConflict when the
+	// condition is not met.
+	putIndex(ctx context.Context, index *shareIndex, etag string) error
+
+	// deleteIndex removes the index, it will be rebuilt by the next listing
+	deleteIndex(ctx context.Context) error
+
+	// listSharesMetadata reads the metadata of every share with a name
+	// starting with prefix
+	listSharesMetadata(ctx context.Context, prefix string) ([]Share, error)
+}
+
+// listIndexedShares returns shares from the index of b. The index is built
+// from share metadata when it doesn't exist yet, or when a previous build
+// didn't complete.
+func listIndexedShares(ctx context.Context, b indexBackend) ([]Share, error) {
+	index, _, err := b.getIndex(ctx)
+	if err == nil && !index.Building {
+		return index.list(), nil
+	}
+
+	if err != nil && !errors.Is(err, errIndexNotFound) {
+		return nil, err
+	}
+
+	// Create the index before reading metadata, so shares written during
+	// the build are recorded in the index by updateIndex. Another instance
+	// might be building it at the same time, which is fine as builds only
+	// add metadata of shares that were not updated meanwhile.
+	if err != nil {
+		err = b.putIndex(ctx, &shareIndex{Shares: map[string]Share{}, Building: true}, "")
+		if err != nil && !errors.Is(err, errIndexConflict) {
+			return nil, err
+		}
+	}
+
+	result, err := b.listSharesMetadata(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	for range indexRetries {
+		var etag string
+
+		index, etag, err = b.getIndex(ctx)
+		if err != nil {
+			break
+		}
+		if !index.Building {
+			return index.list(), nil
+		}
+
+		// Metadata read replaces the index, except for shares updated or
+		// removed since the build started
+		shares := make(map[string]Share, len(result))
+		for _, s := range result {
+			shares[s.Name] = s
+		}
+		for _, name := range index.Updated {
+			if s, ok := index.Shares[name]; ok {
+				shares[name] = s
+			} else {
+				delete(shares, name)
+			}
+		}
+		index.Shares = shares
+		index.Building = false
+		index.Updated = nil
+
+		err = b.putIndex(ctx, index, etag)
+		if err == nil {
+			return index.list(), nil
+		}
+		if !errors.Is(err, errIndexConflict) {
+			break
+		}
+	}
+
+	// The index is left for the next listing to build, metadata read is
+	// returned as is.
+	if err != nil && !errors.Is(err, errIndexNotFound) {
+		slog.Warn("cannot write metadata index", slog.String("error", err.Error()))
+	}
+
+	sortShares(result)
+	return result, nil
+}
+
+// IndexRebuilder is implemented by backends keeping a metadata index
+type IndexRebuilder interface {
+	// RebuildIndex rebuilds the metadata index from share metadata, so
+	// changes that couldn't be recorded in it are included
+	RebuildIndex(ctx context.Context) error
+}
+
+// rebuildIndex implements IndexRebuilder.RebuildIndex for b. The index is
+// marked as being built, so it is rebuilt like a new index while updates of
+// shares keep being recorded.
+func rebuildIndex(ctx context.Context, b indexBackend) error {
+	for range indexRetries {
+		index, etag, err := b.getIndex(ctx)
+		if errors.Is(err, errIndexNotFound) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		index.Building = true
+		index.Updated = nil
+
+		err = b.putIndex(ctx, index, etag)
+		if errors.Is(err, errIndexConflict) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	_, err := listIndexedShares(ctx, b)
+	return err
+}
+
+// list returns the shares of index sorted by creation date
+func (i *shareIndex) list() []Share {
+	result := make([]Share, 0, len(i.Shares))
+	for _, s := range i.Shares {
+		result = append(result, s)
+	}
+	sortShares(result)
+	return result
+}
+
+// updateIndex sets the metadata of share name in the index of b, or removes
+// it when share is nil. It must be called after share metadata is written.
+// The index is only updated if it exists, as a build started later reads the
+// new metadata, and is removed when it can't be updated so it is rebuilt
+// from share metadata instead of being out of date.
+func updateIndex(ctx context.Context, b indexBackend, name string, share *Share) {
+	var err error
+
+	for range indexRetries {
+		var (
+			index *shareIndex
+			etag  string
+		)
+
+		index, etag, err = b.getIndex(ctx)
+		if errors.Is(err, errIndexNotFound) {
+			return
+		}
+		if err != nil {
+			break
+		}
+
+		if share == nil {
+			delete(index.Shares, name)
+		} else {
+			index.Shares[name] = *share
+		}
+		if index.Building && !slices.Contains(index.Updated, name) {
+			index.Updated = append(index.Updated, name)
+		}
+
+		err = b.putIndex(ctx, index, etag)
+		if !errors.Is(err, errIndexConflict) {
+			break
+		}
+	}
+
+	if err == nil {
+		return
+	}
+
+	slog.Warn("cannot update metadata index, removing it", slog.String("error", err.Error()), slog.String("share", name))
+
+	err = b.deleteIndex(ctx)
+	if err != nil {
+		slog.Error("cannot remove metadata index", slog.String("error", err.Error()))
+	}
+}
+
+// sortShares sorts shares by creation date, newest first
+func sortShares(shares []Share) {
+	sort.Slice(shares, func(i, j int) bool {
+		return shares[i].DateCreated.After(shares[j].DateCreated)
+	})
+}
@@ -0,0 +1,215 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// memoryIndexBackend is an indexBackend keeping the index in memory
+type memoryIndexBackend struct {
+	shares []Share
+
+	index *shareIndex
+	etag  int
+
+	// conflicts is the number of writes that fail with errIndexConflict
+	conflicts int
+	// putErr is returned by putIndex when set
+	putErr error
+
+	lists int
+	// onList is called by listSharesMetadata after metadata is read
+	onList func()
+}
+
+func (m *memoryIndexBackend) getIndex(ctx context.Context) (*shareIndex, string, error) {
+	if m.index == nil {
+		return nil, "", errIndexNotFound
+	}
+	result := &shareIndex{
+		Shares:   map[string]Share{},
+		Building: m.index.Building,
+		Updated:  slices.Clone(m.index.Updated),
+	}
+	for k, v := range m.index.Shares {
+		result.Shares[k] = v
+	}
+	return result, strconv.Itoa(m.etag), nil
+}
+
+func (m *memoryIndexBackend) putIndex(ctx context.Context, index *shareIndex, etag string) error {
+	if m.putErr != nil {
+		return m.putErr
+	}
+	if m.conflicts > 0 {
+		m.conflicts--
+		return errIndexConflict
+	}
+	if (etag == "" && m.index != nil) || (etag != "" && etag != strconv.Itoa(m.etag)) {
+		return errIndexConflict
+	}
+	m.index = index
+	m.etag++
+	return nil
+}
+
+func (m *memoryIndexBackend) deleteIndex(ctx context.Context) error {
+	m.index = nil
+	return nil
+}
+
+func (m *memoryIndexBackend) listSharesMetadata(ctx context.Context, prefix string) ([]Share, error) {
+	m.lists++
+	result := append([]Share{}, m.shares...)
+	if m.onList != nil {
+		m.onList()
+	}
+	return result, nil
+}
+
+func TestListIndexedShares(t *testing.T) {
+	now := time.Now()
+	b := &memoryIndexBackend{
+		shares: []Share{
+			{Name: "old", DateCreated: now.Add(-time.Hour)},
+			{Name: "new", DateCreated: now},
+		},
+	}
+
+	for range 2 {
+		shares, err := listIndexedShares(context.Background(), b)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if len(shares) != 2 || shares[0].Name != "new" || shares[1].Name != "old" {
+			t.Errorf("Expected shares sorted by date, got %v", shares)
+		}
+	}
+
+	if b.lists != 1 {
+		t.Errorf("Expected metadata to be listed once to build index, got %d", b.lists)
+	}
+}
+
+func TestListIndexedSharesConcurrentUpdates(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	b := &memoryIndexBackend{
+		shares: []Share{
+			{Name: "old", DateCreated: now.Add(-time.Hour)},
+			{Name: "kept", DateCreated: now.Add(-time.Minute)},
+		},
+	}
+
+	// Shares are created and deleted after metadata is read by the build
+	b.onList = func() {
+		b.onList = nil
+		b.shares = []Share{{Name: "kept", DateCreated: now.Add(-time.Minute)}, {Name: "new", DateCreated: now}}
+		updateIndex(ctx, b, "new", &Share{Name: "new", DateCreated: now})
+		updateIndex(ctx, b, "old", nil)
+	}
+
+	_, err := listIndexedShares(ctx, b)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	shares, err := listIndexedShares(ctx, b)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	names := []string{}
+	for _, s := range shares {
+		names = append(names, s.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"new", "kept"}) {
+		t.Errorf("Expected index to have new and kept shares, got %v", names)
+	}
+	if b.index.Building || b.index.Updated != nil {
+		t.Errorf("Expected index build to be complete, got %+v", b.index)
+	}
+
+	// An index left building by an interrupted build is completed by the
+	// next listing
+	b.index.Building = true
+	b.shares = append(b.shares, Share{Name: "missed", DateCreated: now.Add(-time.Second)})
+	shares, err = listIndexedShares(ctx, b)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(shares) != 3 || b.index.Building {
+		t.Errorf("Expected interrupted build to be completed, got %v", shares)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	ctx := context.Background()
+	b := &memoryIndexBackend{
+		index: &shareIndex{Shares: map[string]Share{
+			"stale":   {Name: "stale"},
+			"changed": {Name: "changed", Count: 1},
+		}},
+		shares: []Share{{Name: "changed", Count: 2}, {Name: "missing"}},
+	}
+
+	// Shares changed without updating the index are picked up, shares
+	// removed are dropped
+	err := rebuildIndex(ctx, b)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	want := map[string]Share{"changed": {Name: "changed", Count: 2}, "missing": {Name: "missing"}}
+	if !reflect.DeepEqual(b.index.Shares, want) || b.index.Building {
+		t.Errorf("Expected index %v, got %+v", want, b.index)
+	}
+}
+
+func TestUpdateIndex(t *testing.T) {
+	t.Run("Missing index is not created", func(t *testing.T) {
+		b := &memoryIndexBackend{}
+		updateIndex(context.Background(), b, "test", &Share{Name: "test"})
+		if b.index != nil {
+			t.Errorf("Expected index not to be created")
+		}
+	})
+
+	t.Run("Index is updated after conflicts", func(t *testing.T) {
+		b := &memoryIndexBackend{
+			index:     &shareIndex{Shares: map[string]Share{"old": {Name: "old"}}},
+			conflicts: indexRetries - 1,
+		}
+
+		updateIndex(context.Background(), b, "test", &Share{Name: "test", Count: 1})
+		updateIndex(context.Background(), b, "old", nil)
+
+		want := map[string]Share{"test": {Name: "test", Count: 1}}
+		if b.index == nil || !reflect.DeepEqual(b.index.Shares, want) {
+			t.Errorf("Expected index %v, got %v", want, b.index)
+		}
+	})
+
+	t.Run("Index is removed when it can't be updated", func(t *testing.T) {
+		b := &memoryIndexBackend{
+			index:     &shareIndex{Shares: map[string]Share{}},
+			conflicts: indexRetries,
+		}
+		updateIndex(context.Background(), b, "test", &Share{Name: "test"})
+		if b.index != nil {
+			t.Errorf("Expected index to be removed after too many conflicts")
+		}
+
+		b = &memoryIndexBackend{
+			index:  &shareIndex{Shares: map[string]Share{}},
+			putErr: errors.New("write error"),
+		}
+		updateIndex(context.Background(), b, "test", &Share{Name: "test"})
+		if b.index != nil {
+			t.Errorf("Expected index to be removed after a write error")
+		}
+	})
+}
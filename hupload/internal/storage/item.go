@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/mail"
+)
+
+var ErrInvalidItemMetadata = errors.New("invalid item metadata")
+
+// maxMetadataSize is the maximum length of a value of item metadata
+const maxMetadataSize = 4096
+
+// ItemMetadata is information about an item recorded when it is uploaded.
+// Owner and Guest are set by the server, other values are given by the
+// uploader and can be edited by authenticated users.
+type ItemMetadata struct {
+	// Owner is the authenticated user who uploaded the item
+	Owner string `json:"owner,omitempty"`
+
+	// Guest identifies the guest who uploaded the item, upload tokens of
+	// that guest allow deleting it
+	Guest string `json:"guest,omitempty"`
+
+	UploaderName  string `json:"uploader_name,omitempty"`
+	UploaderEmail string `json:"uploader_email,omitempty"`
+	Note          string `json:"note,omitempty"`
+
+	// Fields are values of the fields of the share by name
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// ValidateItemMetadata returns ErrInvalidItemMetadata if m has values that are
+// too long, an invalid email address or fields that are not defined by o or
+// don't match their type. Fields required by o must be set unless partial is
+// true.
+func (o Options) ValidateItemMetadata(m ItemMetadata, partial bool) error {
+	for _, v := range []string{m.UploaderName, m.UploaderEmail, m.Note} {
+		if len(v) > maxMetadataSize {
+			return fmt.Errorf("%w: values can't be longer than %d bytes", ErrInvalidItemMetadata, maxMetadataSize)
+		}
+	}
+
+	if m.UploaderEmail != "" {
+		_, err := mail.ParseAddress(m.UploaderEmail)
+		if err != nil {
+			return fmt.Errorf("%w: invalid email address %q", ErrInvalidItemMetadata, m.UploaderEmail)
+		}
+	}
+
+	defined := map[string]bool{}
+	for _, f := range o.Fields {
+		defined[f.Name] = true
+		v, ok := m.Fields[f.Name]
+		if !ok && partial {
+			continue
+		}
+		err := f.validate(v)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidItemMetadata, err)
+		}
+	}
+
+	for k := range m.Fields {
+		if !defined[k] {
+			return fmt.Errorf("%w: unknown field %s", ErrInvalidItemMetadata, k)
+		}
+	}
+
+	return nil
+}
+
+// itemMetadata returns the metadata of item i of s, nil if it has none
+func (s *Share) itemMetadata(i string) *ItemMetadata {
+	m, ok := s.Items[i]
+	if !ok {
+		return nil
+	}
+	m.Fields = maps.Clone(m.Fields)
+	return &m
+}
+
+// cloneItemMetadata returns a copy of the metadata of items
+func cloneItemMetadata(items map[string]ItemMetadata) map[string]ItemMetadata {
+	if items == nil {
+		return nil
+	}
+	result := make(map[string]ItemMetadata, len(items))
+	for i, m := range items {
+		m.Fields = maps.Clone(m.Fields)
+		result[i] = m
+	}
+	return result
+}
+
+// setItemMetadata sets the metadata of item i of s
+func (s *Share) setItemMetadata(i string, m ItemMetadata) {
+	if s.Items == nil {
+		s.Items = map[string]ItemMetadata{}
+	}
+	m.Fields = maps.Clone(m.Fields)
+	s.Items[i] = m
+}
+
+// replaceItemMetadata sets the metadata of item i of s to m, or removes it if
+// m is nil
+func (s *Share) replaceItemMetadata(i string, m *ItemMetadata) {
+	if m == nil {
+		delete(s.Items, i)
+		return
+	}
+	s.setItemMetadata(i, *m)
+}
+
+// pruneItemMetadata removes the metadata of items of s that are not in names
+func (s *Share) pruneItemMetadata(names map[string]bool) {
+	for i := range s.Items {
+		if !names[i] {
+			delete(s.Items, i)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// leasesPrefix is the location of leases in backends. It can't collide with
+// shares as share names can't start with a dot.
+const leasesPrefix = ".hupload/leases"
+
+var (
+	// ErrLeaseHeld is returned when a lease is held by another holder
+	ErrLeaseHeld = errors.New("lease held by another instance")
+
+	errInvalidLeaseName = errors.New("invalid lease name")
+	errLeaseNotFound    = errors.New("lease not found")
+	errLeaseConflict    = errors.New("lease modified concurrently")
+)
+
+// Lease is a named lease held by Holder until Expires
+type Lease struct {
+	Name    string    `json:"name"`
+	Holder  string    `json:"holder"`
+	Expires time.Time `json:"expires"`
+}
+
+// LeaseStore is implemented by backends that can store leases shared by
+// several instances, to elect a leader or lock a share.
+type LeaseStore interface {
+	// AcquireLease acquires lease name for holder until ttl from now, or
+	// renews it if holder already holds it. It returns ErrLeaseHeld with
+	// the current lease if another holder holds it. Like share names, lease
+	// names are made of letters, digits, dashes and underscores.
+	AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (*Lease, error)
+
+	// ReleaseLease releases lease name if it is held by holder
+	ReleaseLease(ctx context.Context, name, holder string) error
+}
+
+// leaseBackend is implemented by backends storing leases with conditional
+// writes
+type leaseBackend interface {
+	// getLease returns lease name and its ETag, or errLeaseNotFound
+	getLease(ctx context.Context, name string) (*Lease, string, error)
+
+	// putLease writes lease if its current ETag is etag, or if it doesn't
+	// exist when etag is empty. It returns errLeaseConflict when the
+	// condition is not met.
+	putLease(ctx context.Context, lease *Lease, etag string) error
+}
+
+// acquireLease implements LeaseStore.AcquireLease for b
+func acquireLease(ctx context.Context, b leaseBackend, name, holder string, ttl time.Duration) (*Lease, error) {
+	if !IsShareNameSafe(name) {
+		return nil, errInvalidLeaseName
+	}
+
+	now := time.Now()
+
+	current, etag, err := b.getLease(ctx, name)
+	switch {
+	case errors.Is(err, errLeaseNotFound):
+		etag = ""
+	case err != nil:
+		return nil, err
+	case current.Holder != holder && now.Before(current.Expires):
+		return current, ErrLeaseHeld
+	}
+
+	lease := &Lease{Name: name, Holder: holder, Expires: now.Add(ttl)}
+
+	err = b.putLease(ctx, lease, etag)
+	if err != nil {
+		// Another holder acquired the lease in the meantime
+		if errors.Is(err, errLeaseConflict) {
+			current, _, err = b.getLease(ctx, name)
+			if err != nil {
+				return nil, ErrLeaseHeld
+			}
+			return current, ErrLeaseHeld
+		}
+		return nil, err
+	}
+
+	return lease, nil
+}
+
+// releaseLease implements LeaseStore.ReleaseLease for b. The lease is
+// expired rather than removed, so the write can be conditional.
+func releaseLease(ctx context.Context, b leaseBackend, name, holder string) error {
+	if !IsShareNameSafe(name) {
+		return errInvalidLeaseName
+	}
+
+	current, etag, err := b.getLease(ctx, name)
+	if errors.Is(err, errLeaseNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if current.Holder != holder {
+		return nil
+	}
+
+	err = b.putLease(ctx, &Lease{Name: name, Holder: holder}, etag)
+	if errors.Is(err, errLeaseConflict) {
+		// The lease expired and has been acquired by another holder
+		return nil
+	}
+
+	return err
+}
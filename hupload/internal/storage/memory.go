@@ -0,0 +1,1163 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// MemoryStorageConfig is the configuration structure for the memory backend
+// MaxFileSize is the maximum size in MB for an item
+// MaxShareSize is the maximum size in MB for a share
+// Seed is a fixture file loaded at startup
+// Demo keeps dates of the fixture relative to the current time
+type MemoryStorageConfig struct {
+	MaxFileSize  int64 `yaml:"max_file_mb"`
+	MaxShareSize int64 `yaml:"max_share_mb"`
+
+	Seed string `yaml:"seed,omitempty"`
+	Demo bool   `yaml:"demo,omitempty"`
+}
+
+// MemoryBackend is a backend that keeps shares and items in memory, content
+// is lost when the process exits. It is meant for tests and demonstrations.
+type MemoryBackend struct {
+	Options             MemoryStorageConfig
+	DefaultValidityDays int
+
+	mu     sync.RWMutex
+	shares map[string]*memoryShare
+
+	// leases are versioned so they can be written conditionally
+	leases map[string]memoryLease
+
+	// renames are the records of renamed shares by previous name
+	renames map[string]RenamedShare
+
+	// now returns the current time
+	now func() time.Time
+
+	// reference is the date of the fixture that matches the current time in
+	// demo mode
+	reference time.Time
+}
+
+// memoryShare is a share and its items. Fixture dates are relative in demo
+// mode, they are shifted by the time elapsed since reference when read.
+type memoryShare struct {
+	share    Share
+	relative bool
+	items    map[string]*memoryItem
+
+	// versions are the versions of items by item name and version
+	versions map[string]map[int]*memoryItem
+}
+
+// memoryItem holds the content of an item. Items from fixtures without
+// content have a size but no data, and read as zeros.
+type memoryItem struct {
+	data     []byte
+	size     int64
+	modified time.Time
+	relative bool
+}
+
+// reader returns a reader of the content of i
+func (i *memoryItem) reader() io.ReadCloser {
+	if i.data == nil {
+		return io.NopCloser(io.LimitReader(zeros{}, i.size))
+	}
+
+	return io.NopCloser(bytes.NewReader(i.data))
+}
+
+// NewMemoryStorage creates a new MemoryBackend with the provided options o.
+// It returns nil if the seed file can't be loaded.
+func NewMemoryStorage(o MemoryStorageConfig) *MemoryBackend {
+	r := MemoryBackend{
+		Options: o,
+		shares:  map[string]*memoryShare{},
+		leases:  map[string]memoryLease{},
+		renames: map[string]RenamedShare{},
+		now:     time.Now,
+	}
+
+	if o.Seed != "" {
+		f, err := os.Open(o.Seed)
+		if err != nil {
+			slog.Error("cannot open seed file", slog.String("error", err.Error()), slog.String("path", o.Seed))
+			return nil
+		}
+		defer f.Close()
+
+		err = r.Load(f)
+		if err != nil {
+			slog.Error("cannot load seed file", slog.String("error", err.Error()), slog.String("path", o.Seed))
+			return nil
+		}
+	}
+
+	return &r
+}
+
+// WithClock sets the function returning the current time, used for creation
+// and modification dates, and to shift fixture dates in demo mode
+func (b *MemoryBackend) WithClock(now func() time.Time) *MemoryBackend {
+	b.now = now
+	return b
+}
+
+// Fixture is the content of a seed file
+type Fixture struct {
+	// Reference is the date fixture dates are relative to in demo mode
+	Reference time.Time `yaml:"reference"`
+
+	Shares []FixtureShare `yaml:"shares"`
+}
+
+// FixtureShare is a share of a seed file
+type FixtureShare struct {
+	Name      string           `yaml:"name"`
+	Owner     string           `yaml:"owner"`
+	Created   time.Time        `yaml:"created"`
+	Options   FixtureOptions   `yaml:"options"`
+	Downloads map[string]int64 `yaml:"downloads"`
+	Items     []FixtureItem    `yaml:"items"`
+}
+
+// FixtureOptions are the options of a fixture share
+type FixtureOptions struct {
+	Validity    int       `yaml:"validity"`
+	ExpiresAt   time.Time `yaml:"expires_at"`
+	Exposure    string    `yaml:"exposure"`
+	Description string    `yaml:"description"`
+	Message     string    `yaml:"message"`
+
+	UploadOpensAt    time.Time `yaml:"upload_opens_at"`
+	UploadClosesAt   time.Time `yaml:"upload_closes_at"`
+	DownloadOpensAt  time.Time `yaml:"download_opens_at"`
+	DownloadClosesAt time.Time `yaml:"download_closes_at"`
+
+	MaxDownloads        int64 `yaml:"max_downloads"`
+	MaxItemDownloads    int64 `yaml:"max_item_downloads"`
+	DeleteAfterDownload bool  `yaml:"delete_after_download"`
+
+	Fields []ItemField `yaml:"fields"`
+
+	Conflict string `yaml:"conflict"`
+}
+
+// FixtureItem is an item of a fixture share, Size is only used when Content
+// is empty.
+type FixtureItem struct {
+	Name     string    `yaml:"name"`
+	Content  string    `yaml:"content"`
+	Size     int64     `yaml:"size"`
+	Modified time.Time `yaml:"modified"`
+}
+
+// Load adds shares and items of the YAML fixture read from r, replacing
+// shares with the same name. Quotas are not enforced.
+func (b *MemoryBackend) Load(r io.Reader) error {
+	var f Fixture
+
+	d := yaml.NewDecoder(r)
+	d.KnownFields(true)
+	err := d.Decode(&f)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	relative := b.Options.Demo && !f.Reference.IsZero()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if relative {
+		b.reference = f.Reference
+	}
+
+	for _, s := range f.Shares {
+		if !IsShareNameSafe(s.Name) {
+			return fmt.Errorf("%w: %s", ErrInvalidShareName, s.Name)
+		}
+
+		o := Options(s.Options)
+		if o.Exposure == "" {
+			o.Exposure = "upload"
+		}
+
+		m := &memoryShare{
+			share: *NewShare().
+				WithName(s.Name).
+				WithOwner(s.Owner).
+				WithDateCreated(s.Created),
+			relative: relative,
+			items:    map[string]*memoryItem{},
+		}
+		m.share.updateOptions(o)
+		if s.Downloads != nil {
+			m.share.Downloads = s.Downloads
+		}
+
+		for _, i := range s.Items {
+			if !isItemNameSafe(i.Name) {
+				return fmt.Errorf("%w: %s", ErrInvalidItemName, i.Name)
+			}
+			item := &memoryItem{
+				size:     i.Size,
+				modified: i.Modified,
+				relative: relative,
+			}
+			if i.Content != "" {
+				item.data = []byte(i.Content)
+				item.size = int64(len(item.data))
+			}
+			m.items[i.Name] = item
+		}
+
+		m.updateMetadata()
+		b.shares[s.Name] = m
+	}
+
+	return nil
+}
+
+// shift returns t shifted by the time elapsed since the fixture reference
+// date if it is relative, so fixture dates keep the same age. Zero dates are
+// left unset.
+func (b *MemoryBackend) shift(t time.Time, relative bool) time.Time {
+	if !relative || t.IsZero() {
+		return t
+	}
+	return t.Add(b.now().Sub(b.reference))
+}
+
+// shiftOptions returns o with its dates shifted like shift
+func (b *MemoryBackend) shiftOptions(o Options, relative bool) Options {
+	o.ExpiresAt = b.shift(o.ExpiresAt, relative)
+	o.UploadOpensAt = b.shift(o.UploadOpensAt, relative)
+	o.UploadClosesAt = b.shift(o.UploadClosesAt, relative)
+	o.DownloadOpensAt = b.shift(o.DownloadOpensAt, relative)
+	o.DownloadClosesAt = b.shift(o.DownloadClosesAt, relative)
+	return o
+}
+
+// updateMetadata computes Size and Count from the items of m
+func (m *memoryShare) updateMetadata() {
+	m.share.Size = 0
+	m.share.Count = 0
+	names := map[string]bool{}
+	for n, i := range m.items {
+		m.share.Size += i.size
+		m.share.Count++
+		names[n] = true
+	}
+	m.share.pruneItemMetadata(names)
+
+	// Versions of items count in the size of the share
+	for _, versions := range m.versions {
+		for _, v := range versions {
+			m.share.Size += v.size
+		}
+	}
+}
+
+// exists returns true if m has an item named i
+func (m *memoryShare) exists(i string) (bool, error) {
+	_, ok := m.items[i]
+	return ok, nil
+}
+
+// keepVersion keeps the current content of item i of m as a new version
+func (m *memoryShare) keepVersion(i string, item *memoryItem) {
+	if m.versions == nil {
+		m.versions = map[string]map[int]*memoryItem{}
+	}
+
+	versions, ok := m.versions[i]
+	if !ok {
+		versions = map[int]*memoryItem{}
+		m.versions[i] = versions
+	}
+
+	v := 1
+	for n := range versions {
+		v = max(v, n+1)
+	}
+	versions[v] = item
+}
+
+// getShare returns a copy of share s, b.mu must be held
+func (b *MemoryBackend) getShare(s string) (*Share, error) {
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+
+	r := m.share
+	r.DateCreated = b.shift(r.DateCreated, m.relative)
+	r.Options = b.shiftOptions(r.Options, m.relative)
+	r.Downloads = maps.Clone(m.share.Downloads)
+	r.GuestDownloads = maps.Clone(m.share.GuestDownloads)
+	r.Items = cloneItemMetadata(m.share.Items)
+
+	return &r, nil
+}
+
+// getItem returns item i of share m, b.mu must be held
+func (b *MemoryBackend) getItem(m *memoryShare, i string) (*Item, error) {
+	item, ok := m.items[i]
+	if !ok {
+		return nil, ErrItemNotFound
+	}
+
+	return &Item{
+		Path:      path.Join(m.share.Name, i),
+		Downloads: m.share.Downloads[i],
+		Metadata:  m.share.itemMetadata(i),
+		ItemInfo:  ItemInfo{Size: item.size, DateModified: b.shift(item.modified, item.relative)},
+	}, nil
+}
+
+// Migrate does nothing as memory content is always current
+func (b *MemoryBackend) Migrate() error {
+	return nil
+}
+
+// CreateShare creates a new share
+func (b *MemoryBackend) CreateShare(ctx context.Context, name, owner string, options Options) (*Share, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.shares[name]; ok {
+		return nil, fmt.Errorf("%w : %s", ErrShareAlreadyExists, name)
+	}
+
+	if options.Exposure == "" {
+		options.Exposure = "upload"
+	}
+
+	m := &memoryShare{
+		share: *NewShare().
+			WithName(name).
+			WithOwner(owner).
+			WithDateCreated(b.now()),
+		items: map[string]*memoryItem{},
+	}
+	m.share.updateOptions(options)
+	b.shares[name] = m
+
+	return b.getShare(name)
+}
+
+// UpdateShare updates an existing share
+func (b *MemoryBackend) UpdateShare(ctx context.Context, name string, options *Options, downloads *map[string]int64) (*Options, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.shares[name]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+
+	if options != nil {
+		// Fixture dates are fixed so the expiration is computed from the
+		// creation date clients see
+		m.share.DateCreated = b.shift(m.share.DateCreated, m.relative)
+		m.share.Options = b.shiftOptions(m.share.Options, m.relative)
+		m.relative = false
+		m.share.updateOptions(*options)
+	}
+
+	if downloads != nil {
+		m.share.Downloads = maps.Clone(*downloads)
+	}
+
+	o := m.share.Options
+	return &o, nil
+}
+
+// ReserveDownloads counts a download of items of share by a guest before it
+// is served
+func (b *MemoryBackend) ReserveDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(name, func(s *Share) error { return s.reserveDownloads(items) })
+}
+
+// ReleaseDownloads uncounts a download of items of share by a guest that
+// didn't complete
+func (b *MemoryBackend) ReleaseDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(name, func(s *Share) error { return s.releaseDownloads(items) })
+}
+
+// AddDownloads counts a complete download of items of share
+func (b *MemoryBackend) AddDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(name, func(s *Share) error { return s.addDownloads(items) })
+}
+
+// updateDownloads applies update to the metadata of share name
+func (b *MemoryBackend) updateDownloads(name string, update func(*Share) error) (*Share, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.shares[name]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+
+	err := update(&m.share)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.getShare(name)
+}
+
+// RestoreShare writes the metadata of share as is, creating the share if it
+// doesn't exist. Size and Count are computed from the items of the share.
+func (b *MemoryBackend) RestoreShare(ctx context.Context, share *Share) (*Share, error) {
+	if !IsShareNameSafe(share.Name) {
+		return nil, ErrInvalidShareName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.shares[share.Name]
+	if !ok {
+		m = &memoryShare{items: map[string]*memoryItem{}}
+		b.shares[share.Name] = m
+	}
+
+	m.share = *restoredShare(share)
+	m.share.Downloads = maps.Clone(m.share.Downloads)
+	m.share.GuestDownloads = maps.Clone(m.share.GuestDownloads)
+	m.share.Items = cloneItemMetadata(m.share.Items)
+	m.relative = false
+	m.updateMetadata()
+
+	return b.getShare(share.Name)
+}
+
+// CreateItem creates a new item in a share. The content is read before the share is locked so uploads don't
+// block each other, and quotas are checked again once it has been read.
+func (b *MemoryBackend) CreateItem(ctx context.Context, s string, i string, size int64, r io.Reader, metadata *ItemMetadata) (*Item, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	b.mu.RLock()
+	share, err := b.getShare(s)
+	if err == nil {
+		// Rejected uploads fail before their content is read
+		_, err = share.Options.itemName(i, b.shares[s].exists)
+	}
+	b.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// Check amount of free capacity in share according to current limits
+	maxWrite, err := itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, share, size)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read one more byte than allowed to detect items larger than announced
+	src := r
+	if maxWrite > 0 {
+		src = io.LimitReader(r, maxWrite+1)
+	}
+
+	buf := bytes.Buffer{}
+	written, err := io.Copy(&buf, src)
+	if err != nil {
+		return nil, err
+	}
+
+	if exceedsQuota(maxWrite, written) {
+		return nil, ErrMaxShareSizeReached
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+
+	// Another upload might have filled the share in the meantime
+	_, err = itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, &m.share, written)
+	if err != nil {
+		return nil, err
+	}
+
+	name, err := m.share.Options.itemName(i, m.exists)
+	if err != nil {
+		return nil, err
+	}
+
+	if existing, ok := m.items[name]; ok && m.share.Options.Conflict == ConflictVersion {
+		m.keepVersion(name, existing)
+	}
+
+	m.items[name] = &memoryItem{
+		data:     buf.Bytes(),
+		size:     written,
+		modified: b.now(),
+	}
+	if metadata != nil {
+		m.share.setItemMetadata(name, *metadata)
+	}
+	m.updateMetadata()
+
+	return b.getItem(m, name)
+}
+
+// SetItemMetadata replaces the metadata of item i of share s
+func (b *MemoryBackend) SetItemMetadata(ctx context.Context, s, i string, metadata ItemMetadata) (*Item, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+
+	if _, ok := m.items[i]; !ok {
+		return nil, ErrItemNotFound
+	}
+
+	m.share.setItemMetadata(i, metadata)
+
+	return b.getItem(m, i)
+}
+
+// CopyItem copies item i of share s to item to of share t. Content is never
+// modified in place, so both items share it.
+func (b *MemoryBackend) CopyItem(ctx context.Context, s, i, t, to string) (*Item, error) {
+	if !IsShareNameSafe(s) || !IsShareNameSafe(t) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) || !isItemNameSafe(to) {
+		return nil, ErrInvalidItemName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d, name, err := b.copyItem(s, i, t, to, true)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.getItem(d, name)
+}
+
+// MoveItem moves item i of share s to item to of share t
+func (b *MemoryBackend) MoveItem(ctx context.Context, s, i, t, to string) (*Item, error) {
+	if !IsShareNameSafe(s) || !IsShareNameSafe(t) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) || !isItemNameSafe(to) {
+		return nil, ErrInvalidItemName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Items moved within a share don't change its size
+	d, name, err := b.copyItem(s, i, t, to, s != t)
+	if err != nil {
+		return nil, err
+	}
+
+	m := b.shares[s]
+	delete(m.items, i)
+	delete(m.versions, i)
+	m.updateMetadata()
+
+	return b.getItem(d, name)
+}
+
+// copyItem copies item i of share s to item to of share t, and returns the
+// destination share and the name of the copy. The quota of t is checked if
+// quota is true. b.mu must be held by the caller.
+func (b *MemoryBackend) copyItem(s, i, t, to string, quota bool) (*memoryShare, string, error) {
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, "", ErrShareNotFound
+	}
+
+	item, ok := m.items[i]
+	if !ok {
+		return nil, "", ErrItemNotFound
+	}
+
+	d, ok := b.shares[t]
+	if !ok {
+		return nil, "", ErrShareNotFound
+	}
+
+	if quota {
+		_, err := itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, &d.share, item.size)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	name, err := d.share.Options.copyItemName(s, i, t, to, d.exists)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if existing, ok := d.items[name]; ok && d.share.Options.Conflict == ConflictVersion {
+		d.keepVersion(name, existing)
+	}
+
+	d.items[name] = &memoryItem{
+		data:     item.data,
+		size:     item.size,
+		modified: b.now(),
+	}
+	d.share.replaceItemMetadata(name, m.share.itemMetadata(i))
+	d.updateMetadata()
+
+	return d, name, nil
+}
+
+// DeleteItem deletes an item from a share
+func (b *MemoryBackend) DeleteItem(ctx context.Context, s string, i string) error {
+	if !IsShareNameSafe(s) {
+		return ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return ErrInvalidItemName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return ErrItemNotFound
+	}
+
+	if _, ok := m.items[i]; !ok {
+		return ErrItemNotFound
+	}
+
+	delete(m.items, i)
+	delete(m.versions, i)
+	m.updateMetadata()
+
+	return nil
+}
+
+// ListItemVersions returns the versions of item i of share s, oldest first
+func (b *MemoryBackend) ListItemVersions(ctx context.Context, s, i string) ([]ItemVersion, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, ErrItemNotFound
+	}
+
+	result := []ItemVersion{}
+	for v, item := range m.versions[i] {
+		result = append(result, ItemVersion{
+			Version:  v,
+			ItemInfo: ItemInfo{Size: item.size, DateModified: b.shift(item.modified, item.relative)},
+		})
+	}
+
+	if _, ok := m.items[i]; !ok && len(result) == 0 {
+		return nil, ErrItemNotFound
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+
+	return result, nil
+}
+
+// GetItemVersionData returns the content of version v of item i of share s
+func (b *MemoryBackend) GetItemVersionData(ctx context.Context, s, i string, v int) (io.ReadCloser, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+
+	item, ok := m.versions[i][v]
+	if !ok {
+		return nil, ErrVersionNotFound
+	}
+
+	return item.reader(), nil
+}
+
+// DeleteItemVersion deletes version v of item i of share s
+func (b *MemoryBackend) DeleteItemVersion(ctx context.Context, s, i string, v int) error {
+	if !IsShareNameSafe(s) {
+		return ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return ErrInvalidItemName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return ErrVersionNotFound
+	}
+
+	if _, ok := m.versions[i][v]; !ok {
+		return ErrVersionNotFound
+	}
+
+	delete(m.versions[i], v)
+	if len(m.versions[i]) == 0 {
+		delete(m.versions, i)
+	}
+	m.updateMetadata()
+
+	return nil
+}
+
+// GetShare returns the share identified by s
+func (b *MemoryBackend) GetShare(ctx context.Context, s string) (*Share, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.getShare(s)
+}
+
+// ListShares returns the list of shares available, newest first
+func (b *MemoryBackend) ListShares(ctx context.Context) ([]Share, error) {
+	r := b.listShares("")
+
+	sortShares(r)
+
+	return r, nil
+}
+
+// QueryShares returns a page of shares matching q
+func (b *MemoryBackend) QueryShares(ctx context.Context, q ShareQuery) (*SharePage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Apply(b.listShares(q.Prefix))
+}
+
+// listShares returns shares with a name starting with prefix
+func (b *MemoryBackend) listShares(prefix string) []Share {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r := make([]Share, 0, len(b.shares))
+	for name := range b.shares {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		s, _ := b.getShare(name)
+		r = append(r, *s)
+	}
+
+	return r
+}
+
+// DeleteShare removes a share and all its items
+func (b *MemoryBackend) DeleteShare(ctx context.Context, s string) error {
+	if !IsShareNameSafe(s) {
+		return ErrInvalidShareName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.shares[s]; !ok {
+		return ErrShareNotFound
+	}
+
+	delete(b.shares, s)
+
+	return nil
+}
+
+// RenameShare renames share s to name
+func (b *MemoryBackend) RenameShare(ctx context.Context, s, name string, until time.Time) (*Share, error) {
+	share, err := b.renameShare(s, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = recordRename(ctx, b, s, name, until)
+	if err != nil {
+		return nil, err
+	}
+
+	return share, nil
+}
+
+// renameShare moves share s to name in b.shares
+func (b *MemoryBackend) renameShare(s, name string) (*Share, error) {
+	if !IsShareNameSafe(s) || !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+	if _, ok := b.shares[name]; ok {
+		return nil, fmt.Errorf("%w : %s", ErrShareAlreadyExists, name)
+	}
+
+	delete(b.shares, s)
+	m.share.Name = name
+	b.shares[name] = m
+
+	return b.getShare(name)
+}
+
+// GetRenamedShare returns the record of the share previously named name
+func (b *MemoryBackend) GetRenamedShare(ctx context.Context, name string) (*RenamedShare, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	r, ok := b.renames[name]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+
+	return &r, nil
+}
+
+func (b *MemoryBackend) putRenamedShare(ctx context.Context, r *RenamedShare) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.renames[r.From] = *r
+
+	return nil
+}
+
+// PurgeRenamedShares removes records of renamed shares which previous name
+// stopped working before before
+func (b *MemoryBackend) PurgeRenamedShares(ctx context.Context, before time.Time) ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := []string{}
+	for name, r := range b.renames {
+		if r.end().Before(before) {
+			delete(b.renames, name)
+			result = append(result, name)
+		}
+	}
+	slices.Sort(result)
+
+	return result, nil
+}
+
+func (b *MemoryBackend) listRenamedShares(ctx context.Context) ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return slices.Sorted(maps.Keys(b.renames)), nil
+}
+
+func (b *MemoryBackend) deleteRenamedShare(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.renames, name)
+
+	return nil
+}
+
+// ListShare returns the list of items in a share, newest first
+func (b *MemoryBackend) ListShare(ctx context.Context, s string) ([]Item, error) {
+	r, err := b.listItems(s, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(r, func(i, j int) bool {
+		return r[i].ItemInfo.DateModified.After(r[j].ItemInfo.DateModified)
+	})
+
+	return r, nil
+}
+
+// QueryItems returns a page of items in share s matching q
+func (b *MemoryBackend) QueryItems(ctx context.Context, s string, q ItemQuery) (*ItemPage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := b.listItems(s, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Apply(r)
+}
+
+// listItems returns items of share s with a name starting with prefix,
+// ordered by name
+func (b *MemoryBackend) listItems(s, prefix string) ([]Item, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+
+	r := make([]Item, 0, len(m.items))
+	for name := range m.items {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		i, _ := b.getItem(m, name)
+		r = append(r, *i)
+	}
+
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Path < r[j].Path
+	})
+
+	return r, nil
+}
+
+// GetItem returns the item identified by s and i
+func (b *MemoryBackend) GetItem(ctx context.Context, s string, i string) (*Item, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, ErrItemNotFound
+	}
+
+	return b.getItem(m, i)
+}
+
+// GetItemData returns the content of the item identified by s and i
+func (b *MemoryBackend) GetItemData(ctx context.Context, s string, i string) (io.ReadCloser, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+
+	if !isItemNameSafe(i) {
+		return nil, ErrInvalidItemName
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	m, ok := b.shares[s]
+	if !ok {
+		return nil, ErrItemNotFound
+	}
+
+	item, ok := m.items[i]
+	if !ok {
+		return nil, ErrItemNotFound
+	}
+
+	return item.reader(), nil
+}
+
+// zeros is a reader of zeros, used for fixture items without content
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// memoryLease is a lease and its version, used as ETag
+type memoryLease struct {
+	lease   Lease
+	version int
+}
+
+// Check checks Size, Count and Downloads of shares against their items
+func (b *MemoryBackend) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	report := newCheckReport(repair)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for name, m := range b.shares {
+		items := make([]Item, 0, len(m.items))
+		for i, item := range m.items {
+			items = append(items, Item{
+				Path:     path.Join(name, i),
+				ItemInfo: ItemInfo{Size: item.size},
+			})
+		}
+
+		versions := []Item{}
+		for i, v := range m.versions {
+			for n, item := range v {
+				versions = append(versions, Item{
+					Path:     path.Join(name, versionPath(i, n)),
+					ItemInfo: ItemInfo{Size: item.size},
+				})
+			}
+		}
+
+		report.Shares++
+		report.Items += len(items)
+
+		share := m.share
+		share.Downloads = maps.Clone(m.share.Downloads)
+		share.GuestDownloads = maps.Clone(m.share.GuestDownloads)
+
+		problems := checkShare(&share, items, versions, name)
+		if len(problems) > 0 && repair {
+			m.share = share
+		}
+		report.add(nil, problems...)
+	}
+
+	report.sort()
+
+	return report, nil
+}
+
+// AcquireLease acquires lease name for holder until ttl from now. Leases are
+// only shared by instances using the same backend in a process.
+func (b *MemoryBackend) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (*Lease, error) {
+	return acquireLease(ctx, b, name, holder, ttl)
+}
+
+// ReleaseLease releases lease name if it is held by holder
+func (b *MemoryBackend) ReleaseLease(ctx context.Context, name, holder string) error {
+	return releaseLease(ctx, b, name, holder)
+}
+
+func (b *MemoryBackend) getLease(ctx context.Context, name string) (*Lease, string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	l, ok := b.leases[name]
+	if !ok {
+		return nil, "", errLeaseNotFound
+	}
+	result := l.lease
+
+	return &result, strconv.Itoa(l.version), nil
+}
+
+func (b *MemoryBackend) putLease(ctx context.Context, lease *Lease, etag string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	current := ""
+	l, ok := b.leases[lease.Name]
+	if ok {
+		current = strconv.Itoa(l.version)
+	}
+	if current != etag {
+		return errLeaseConflict
+	}
+
+	b.leases[lease.Name] = memoryLease{lease: *lease, version: l.version + 1}
+
+	return nil
+}
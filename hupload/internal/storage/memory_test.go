@@ -0,0 +1,195 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/storage"
+	"github.com/ybizeul/hupload/internal/storage/storagetest"
+)
+
+func TestMemoryConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, l storagetest.Limits) storage.Storage {
+		return storage.NewMemoryStorage(storage.MemoryStorageConfig{
+			MaxFileSize:  l.MaxFileSize,
+			MaxShareSize: l.MaxShareSize,
+		})
+	})
+}
+
+func TestMemorySeed(t *testing.T) {
+	ctx := context.Background()
+
+	m := storage.NewMemoryStorage(storage.MemoryStorageConfig{Seed: "memory_testdata/seed.yml"})
+	if m == nil {
+		t.Fatal("Expected memory storage to be created")
+	}
+
+	shares, err := m.ListShares(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shares) != 2 || shares[0].Name != "report" {
+		t.Fatalf("Unexpected shares %+v", shares)
+	}
+
+	s := shares[0]
+	if s.Owner != "admin" || s.Options.Exposure != "both" || s.Options.Description != "Quarterly report" ||
+		s.Size != 2053 || s.Count != 2 || s.Downloads["report.pdf"] != 3 {
+		t.Errorf("Unexpected share %+v", s)
+	}
+	if !s.DateCreated.Equal(time.Date(2024, 8, 31, 16, 0, 0, 0, time.UTC)) {
+		t.Errorf("Expected fixture date, got %v", s.DateCreated)
+	}
+	if shares[1].Options.Exposure != "upload" {
+		t.Errorf("Expected default exposure, got %s", shares[1].Options.Exposure)
+	}
+
+	items, err := m.ListShare(ctx, "report")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Path != "report/notes.txt" || items[1].Downloads != 3 {
+		t.Errorf("Unexpected items %+v", items)
+	}
+
+	r, err := m.GetItemData(ctx, "report", "report.pdf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(r)
+	if len(b) != 2048 {
+		t.Errorf("Expected 2048 bytes, got %d", len(b))
+	}
+
+	if storage.NewMemoryStorage(storage.MemoryStorageConfig{Seed: "memory_testdata/missing.yml"}) != nil {
+		t.Errorf("Expected missing seed file to fail")
+	}
+
+	err = storage.NewMemoryStorage(storage.MemoryStorageConfig{}).Load(strings.NewReader("shares:\n  - name: ../invalid\n"))
+	if !errors.Is(err, storage.ErrInvalidShareName) {
+		t.Errorf("Expected ErrInvalidShareName, got %v", err)
+	}
+}
+
+func TestMemoryDemo(t *testing.T) {
+	ctx := context.Background()
+
+	now := time.Date(2025, 3, 1, 16, 0, 0, 0, time.UTC)
+	m := storage.NewMemoryStorage(storage.MemoryStorageConfig{Demo: true}).WithClock(func() time.Time { return now })
+
+	f, err := os.Open("memory_testdata/seed.yml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	err = m.Load(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fixture dates keep their age relative to the reference date
+	for _, delay := range []time.Duration{0, 72 * time.Hour} {
+		now = now.Add(delay)
+
+		s, err := m.GetShare(ctx, "report")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !s.DateCreated.Equal(now.Add(-24 * time.Hour)) {
+			t.Errorf("Expected share created a day ago, got %v", s.DateCreated)
+		}
+
+		i, err := m.GetItem(ctx, "report", "report.pdf")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !i.ItemInfo.DateModified.Equal(now.Add(-6 * time.Hour)) {
+			t.Errorf("Expected item modified 6 hours ago, got %v", i.ItemInfo.DateModified)
+		}
+	}
+
+	// Shares created afterwards use the real date
+	s, err := m.CreateShare(ctx, "new", "admin", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now = now.Add(time.Hour)
+	s, err = m.GetShare(ctx, s.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.DateCreated.Equal(now.Add(-time.Hour)) {
+		t.Errorf("Expected share created an hour ago, got %v", s.DateCreated)
+	}
+}
+
+func TestMemoryQuota(t *testing.T) {
+	ctx := context.Background()
+
+	m := storage.NewMemoryStorage(storage.MemoryStorageConfig{MaxFileSize: 1, MaxShareSize: 2})
+
+	_, err := m.CreateShare(ctx, "share", "admin", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := 1024 * 1024
+
+	_, err = m.CreateItem(ctx, "share", "big", int64(mb+1), bytes.NewReader(make([]byte, mb+1)), nil)
+	if !errors.Is(err, storage.ErrMaxFileSizeReached) {
+		t.Errorf("Expected ErrMaxFileSizeReached, got %v", err)
+	}
+
+	// Size is not known, content is limited while reading
+	_, err = m.CreateItem(ctx, "share", "big", 0, bytes.NewReader(make([]byte, mb+1)), nil)
+	if !errors.Is(err, storage.ErrMaxShareSizeReached) {
+		t.Errorf("Expected ErrMaxShareSizeReached, got %v", err)
+	}
+
+	// Concurrent uploads can't exceed the share size
+	var wg sync.WaitGroup
+	errs := make(chan error, 3)
+	for _, name := range []string{"a", "b", "c"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := m.CreateItem(ctx, "share", name, int64(mb), bytes.NewReader(make([]byte, mb)), nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		if errors.Is(err, storage.ErrMaxShareSizeReached) {
+			failed++
+		} else if err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Expected one upload to fail, got %d", failed)
+	}
+
+	s, err := m.GetShare(ctx, "share")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Size != int64(2*mb) || s.Count != 2 {
+		t.Errorf("Unexpected share size %d and count %d", s.Size, s.Count)
+	}
+
+	_, err = m.CreateItem(ctx, "share", "../escape", 1, bytes.NewReader([]byte("x")), nil)
+	if !errors.Is(err, storage.ErrInvalidItemName) {
+		t.Errorf("Expected ErrInvalidItemName, got %v", err)
+	}
+}
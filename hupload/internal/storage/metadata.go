@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"sync"
+	"time"
+)
+
+// metadataRetries is the number of times a share metadata update is retried
+// when the metadata has been modified concurrently
+const metadataRetries = 10
+
+// metadataRetryDelay is the base delay between two attempts to update share
+// metadata, a random part is added so instances don't retry in lockstep
+const metadataRetryDelay = 20 * time.Millisecond
+
+var errMetadataConflict = errors.New("metadata modified concurrently")
+
+// metadataBackend is implemented by object storage backends that update share
+// metadata with conditional writes
+type metadataBackend interface {
+	// getMetadata returns the metadata of share name and its ETag, or
+	// ErrShareNotFound
+	getMetadata(ctx context.Context, name string) (*Share, string, error)
+
+	// putMetadata writes the metadata of share if its current ETag is
+	// etag, or if it doesn't exist when etag is empty. It returns
+	// errMetadataConflict when the condition is not met.
+	putMetadata(ctx context.Context, share *Share, etag string) error
+}
+
+// updateShareMetadata applies update to the metadata of share name in b and
+// writes it back, unless the metadata has been modified in the meantime, in
+// which case update is applied again to the new metadata.
+func updateShareMetadata(ctx context.Context, b metadataBackend, name string, update func(*Share) error) (*Share, error) {
+	for attempt := range metadataRetries {
+		if attempt > 0 {
+			delay := time.Duration(attempt) * metadataRetryDelay
+			time.Sleep(delay + rand.N(delay))
+		}
+
+		share, etag, err := b.getMetadata(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		err = update(share)
+		if err != nil {
+			return nil, err
+		}
+
+		err = b.putMetadata(ctx, share, etag)
+		if errors.Is(err, errMetadataConflict) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		return share, nil
+	}
+
+	return nil, fmt.Errorf("%w : %s", errMetadataConflict, name)
+}
+
+// Locker serializes metadata updates of shares. Backends use a LocalLocker
+// unless another Locker is set with SetLocker, like one shared by several
+// instances.
+type Locker interface {
+	// Lock locks share name and returns the function to unlock it, along
+	// with a context derived from ctx for operations made while holding the
+	// lock. The context is canceled if the lock is lost before it is
+	// unlocked.
+	Lock(ctx context.Context, name string) (context.Context, func(), error)
+}
+
+// Lockable is implemented by backends which metadata updates can be
+// serialized by a Locker
+type Lockable interface {
+	SetLocker(l Locker)
+}
+
+// LocalLocker is a Locker serializing metadata updates of shares within a
+// process. The zero value is ready to use.
+type LocalLocker struct {
+	mu    sync.Mutex
+	locks map[string]*shareLock
+}
+
+type shareLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// Lock locks share name and returns the function to unlock it. It only
+// returns an error if ctx is done before the lock is acquired. Local locks
+// can't be lost, ctx is returned as is.
+func (l *LocalLocker) Lock(ctx context.Context, name string) (context.Context, func(), error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = map[string]*shareLock{}
+	}
+	sl, ok := l.locks[name]
+	if !ok {
+		sl = &shareLock{ch: make(chan struct{}, 1)}
+		l.locks[name] = sl
+	}
+	sl.refs++
+	l.mu.Unlock()
+
+	release := func() {
+		l.mu.Lock()
+		sl.refs--
+		if sl.refs == 0 {
+			delete(l.locks, name)
+		}
+		l.mu.Unlock()
+	}
+
+	select {
+	case sl.ch <- struct{}{}:
+	case <-ctx.Done():
+		release()
+		return nil, nil, ctx.Err()
+	}
+
+	return ctx, func() {
+		<-sl.ch
+		release()
+	}, nil
+}
+
+// itemsSize returns the total size and the number of items
+func itemsSize(items []Item) (int64, int64) {
+	size := int64(0)
+	for _, i := range items {
+		size += i.ItemInfo.Size
+	}
+	return size, int64(len(items))
+}
+
+// shareSize returns the size of a share with items and versions of its
+// items, and the number of items
+func shareSize(items, versions []Item) (int64, int64) {
+	size, count := itemsSize(items)
+	versionsSize, _ := itemsSize(versions)
+	return size + versionsSize, count
+}
+
+// itemNames returns the set of base names of items
+func itemNames(items []Item) map[string]bool {
+	names := map[string]bool{}
+	for _, i := range items {
+		names[path.Base(i.Path)] = true
+	}
+	return names
+}
@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// memoryMetadataBackend is a metadataBackend keeping one share in memory
+type memoryMetadataBackend struct {
+	share *Share
+	etag  int
+
+	// conflicts is the number of writes that fail with errMetadataConflict
+	conflicts int
+	puts      int
+}
+
+func (m *memoryMetadataBackend) getMetadata(ctx context.Context, name string) (*Share, string, error) {
+	if m.share == nil {
+		return nil, "", ErrShareNotFound
+	}
+	result := *m.share
+	return &result, strconv.Itoa(m.etag), nil
+}
+
+func (m *memoryMetadataBackend) putMetadata(ctx context.Context, share *Share, etag string) error {
+	m.puts++
+	if m.conflicts > 0 {
+		m.conflicts--
+		// Another instance updated the share in the meantime
+		m.share.Count++
+		m.etag++
+		return errMetadataConflict
+	}
+	if etag != "" && etag != strconv.Itoa(m.etag) {
+		return errMetadataConflict
+	}
+	m.share = share
+	m.etag++
+	return nil
+}
+
+func TestUpdateShareMetadata(t *testing.T) {
+	b := &memoryMetadataBackend{share: &Share{Name: "share"}, conflicts: 2}
+
+	share, err := updateShareMetadata(context.Background(), b, "share", func(s *Share) error {
+		s.Size += 10
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// Update is applied on top of concurrent updates
+	if share.Size != 10 || share.Count != 2 || b.share.Count != 2 {
+		t.Errorf("Expected concurrent updates to be kept, got %+v", share)
+	}
+	if b.puts != 3 {
+		t.Errorf("Expected 3 writes, got %d", b.puts)
+	}
+
+	// Conflicts are retried a limited number of times
+	b = &memoryMetadataBackend{share: &Share{Name: "share"}, conflicts: metadataRetries}
+	_, err = updateShareMetadata(context.Background(), b, "share", func(s *Share) error { return nil })
+	if !errors.Is(err, errMetadataConflict) {
+		t.Errorf("Expected errMetadataConflict, got %v", err)
+	}
+
+	// Missing shares and update errors are returned
+	b = &memoryMetadataBackend{}
+	_, err = updateShareMetadata(context.Background(), b, "share", func(s *Share) error { return nil })
+	if !errors.Is(err, ErrShareNotFound) {
+		t.Errorf("Expected ErrShareNotFound, got %v", err)
+	}
+
+	b = &memoryMetadataBackend{share: &Share{Name: "share"}}
+	_, err = updateShareMetadata(context.Background(), b, "share", func(s *Share) error { return ErrItemNotFound })
+	if !errors.Is(err, ErrItemNotFound) || b.puts != 0 {
+		t.Errorf("Expected ErrItemNotFound without write, got %v", err)
+	}
+}
+
+func TestLocalLocker(t *testing.T) {
+	var locks LocalLocker
+
+	counter := 0
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, unlock, err := locks.Lock(context.Background(), "share")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer unlock()
+			c := counter
+			c++
+			counter = c
+		}()
+	}
+	wg.Wait()
+
+	if counter != 50 {
+		t.Errorf("Expected 50, got %d", counter)
+	}
+
+	// Unused locks are released
+	if len(locks.locks) != 0 {
+		t.Errorf("Expected no remaining locks, got %d", len(locks.locks))
+	}
+
+	// Different shares don't block each other
+	_, unlock, _ := locks.Lock(context.Background(), "a")
+	_, unlockB, _ := locks.Lock(context.Background(), "b")
+	unlockB()
+
+	// Waiting for a lock stops when the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _, err := locks.Lock(ctx, "a")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+	unlock()
+
+	if len(locks.locks) != 0 {
+		t.Errorf("Expected no remaining locks, got %d", len(locks.locks))
+	}
+}
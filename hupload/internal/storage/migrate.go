@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// MetadataVersion is the version of share metadata written by this version of
+// Hupload. Metadata with a lower Version is upgraded by Migrate.
+const MetadataVersion = 2
+
+// schemaKey is the location of the schema marker, recording the version of
+// the metadata of all shares in the backend
+const schemaKey = ".hupload/schema.json"
+
+// ErrUnsupportedVersion is returned when storage has been migrated by a newer
+// version of Hupload
+var ErrUnsupportedVersion = errors.New("storage version is not supported")
+
+// migration upgrades share metadata decoded as a map from version From to
+// From+1. Steps work on maps so they can read fields that have since been
+// removed from Share.
+type migration struct {
+	From        int
+	Description string
+	Apply       func(m map[string]any) error
+}
+
+// migrations are the ordered steps applied to metadata older than
+// MetadataVersion, there must be one per version
+var migrations = []migration{
+	{
+		From:        0,
+		Description: "move validity and exposure to options",
+		Apply: func(m map[string]any) error {
+			// Some version 0 shares already have options
+			if o, _ := m["options"].(map[string]any); len(o) == 0 {
+				o = map[string]any{}
+				for _, k := range []string{"validity", "exposure"} {
+					if v, ok := m[k]; ok {
+						o[k] = v
+					}
+				}
+				m["options"] = o
+			}
+			delete(m, "validity")
+			delete(m, "exposure")
+			return nil
+		},
+	},
+	{
+		From:        1,
+		Description: "set expiration date from validity",
+		Apply: func(m map[string]any) error {
+			o, _ := m["options"].(map[string]any)
+			validity, _ := o["validity"].(float64)
+			if validity <= 0 || o["expires_at"] != nil {
+				return nil
+			}
+
+			// Shares without a creation date have always been expired
+			created := time.Time{}
+			if c, ok := m["created"].(string); ok {
+				var err error
+				created, err = time.Parse(time.RFC3339Nano, c)
+				if err != nil {
+					return err
+				}
+			}
+
+			o["expires_at"] = created.AddDate(0, 0, int(validity))
+			return nil
+		},
+	},
+}
+
+// schema is the content of the schema marker
+type schema struct {
+	Version int `json:"version"`
+}
+
+// migrationBackend is implemented by backends which metadata is migrated by
+// migrate
+type migrationBackend interface {
+	// listMetadata returns the names of shares with metadata
+	listMetadata(ctx context.Context) ([]string, error)
+
+	// readMetadata returns the metadata of share name as stored and its
+	// ETag, or ErrShareNotFound
+	readMetadata(ctx context.Context, name string) ([]byte, string, error)
+
+	// putMetadata writes the metadata of share, see metadataBackend
+	putMetadata(ctx context.Context, share *Share, etag string) error
+
+	// readSchema returns the schema marker, or nil if there is none
+	readSchema(ctx context.Context) ([]byte, error)
+
+	// writeSchema writes the schema marker
+	writeSchema(ctx context.Context, b []byte) error
+}
+
+// migrate upgrades the metadata of every share of b to MetadataVersion, and
+// records it in the schema marker so it is only done once. Shares are locked
+// with locker and written conditionally, so instances can migrate the same
+// storage concurrently.
+func migrate(ctx context.Context, b migrationBackend, locker Locker) error {
+	current := schema{}
+	j, err := b.readSchema(ctx)
+	if err != nil {
+		return err
+	}
+	if j != nil {
+		err = json.Unmarshal(j, &current)
+		if err != nil {
+			return fmt.Errorf("%s: %w", schemaKey, err)
+		}
+	}
+
+	switch {
+	case current.Version == MetadataVersion:
+		return nil
+	case current.Version > MetadataVersion:
+		return fmt.Errorf("%w : version %d, expected %d at most", ErrUnsupportedVersion, current.Version, MetadataVersion)
+	}
+
+	names, err := b.listMetadata(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		err = migrateShare(ctx, b, locker, name)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	j, err = json.Marshal(schema{Version: MetadataVersion})
+	if err != nil {
+		return err
+	}
+
+	return b.writeSchema(ctx, j)
+}
+
+// migrateShare upgrades the metadata of share name
+func migrateShare(ctx context.Context, b migrationBackend, locker Locker, name string) error {
+	ctx, unlock, err := locker.Lock(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	for range metadataRetries {
+		j, etag, err := b.readMetadata(ctx, name)
+		if errors.Is(err, ErrShareNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		share, err := upgradeMetadata(j)
+		if err != nil {
+			// Metadata that can't be decoded is reported by Check
+			slog.Warn("cannot migrate share", slog.String("share", name), slog.String("error", err.Error()))
+			return nil
+		}
+		if share == nil {
+			return nil
+		}
+
+		err = b.putMetadata(ctx, share, etag)
+		if errors.Is(err, errMetadataConflict) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if i, ok := b.(shareIndexer); ok {
+			i.indexShare(ctx, name, share)
+		}
+
+		return nil
+	}
+
+	return errMetadataConflict
+}
+
+// shareIndexer is implemented by backends keeping an index of shares
+type shareIndexer interface {
+	indexShare(ctx context.Context, name string, share *Share)
+}
+
+// upgradeMetadata applies migrations to metadata j and returns the upgraded
+// share, or nil if j is already at MetadataVersion
+func upgradeMetadata(j []byte) (*Share, error) {
+	m := map[string]any{}
+	err := json.Unmarshal(j, &m)
+	if err != nil {
+		return nil, err
+	}
+
+	version := 0
+	if v, ok := m["version"]; ok {
+		f, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid version %v", v)
+		}
+		version = int(f)
+	}
+
+	switch {
+	case version == MetadataVersion:
+		return nil, nil
+	case version > MetadataVersion || version < 0:
+		return nil, fmt.Errorf("%w : share version %d", ErrUnsupportedVersion, version)
+	}
+
+	for _, step := range migrations[version:] {
+		err = step.Apply(m)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", step.Description, err)
+		}
+		m["version"] = step.From + 1
+	}
+
+	j, err = json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	result := NewShare()
+	err = json.Unmarshal(j, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -5,10 +5,13 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"path"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -30,6 +33,10 @@ type MinioStorageConfig struct {
 
 	MaxFileSize  int64 `yaml:"max_file_mb"`
 	MaxShareSize int64 `yaml:"max_share_mb"`
+
+	// MetadataIndex keeps the metadata of every share in a single object so
+	// listing shares doesn't read each share metadata
+	MetadataIndex bool `yaml:"metadata_index,omitempty"`
 }
 
 // FileBackend is a backend that stores files on the filesystem
@@ -41,12 +48,17 @@ type MinioBackend struct {
 	DefaultValidityDays int
 
 	Client *minio.Client
+
+	// locker serializes metadata updates of shares, conditional writes
+	// protect them from instances using another Locker
+	locker Locker
 }
 
 // NewFileStorage creates a new FileBackend with the provided options o
 func NewMinioStorage(o MinioStorageConfig) *MinioBackend {
 	r := MinioBackend{
 		Options: o,
+		locker:  &LocalLocker{},
 	}
 
 	err := r.initialize()
@@ -57,6 +69,12 @@ func NewMinioStorage(o MinioStorageConfig) *MinioBackend {
 	return &r
 }
 
+// SetLocker sets the Locker serializing metadata updates of shares. It must
+// be set before the backend is used.
+func (b *MinioBackend) SetLocker(l Locker) {
+	b.locker = l
+}
+
 func (b *MinioBackend) initialize() error {
 	c, err := minio.New(b.Options.Endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(b.Options.AWSKey, b.Options.AWSSecret, ""),
@@ -81,10 +99,52 @@ func (b *MinioBackend) initialize() error {
 	return nil
 }
 
-// Migrate will be called at initialization to give an opportunity to
-// the backend to migrate data from a previous version to the current one
+// Migrate upgrades the metadata of shares to MetadataVersion
 func (b *MinioBackend) Migrate() error {
-	return nil
+	return migrate(context.Background(), b, b.locker)
+}
+
+// listMetadata returns the names of shares with metadata
+func (b *MinioBackend) listMetadata(ctx context.Context) ([]string, error) {
+	objects, err := b.listKeys(ctx, "shares/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, o := range objects {
+		parts := strings.Split(o.Path, "/")
+		if len(parts) == 3 && parts[2] == ".metadata" && IsShareNameSafe(parts[1]) {
+			result = append(result, parts[1])
+		}
+	}
+
+	return result, nil
+}
+
+// readSchema returns the schema marker, or nil if there is none
+func (b *MinioBackend) readSchema(ctx context.Context) ([]byte, error) {
+	output, err := b.Client.GetObject(ctx, b.Options.Bucket, schemaKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+
+	j, err := io.ReadAll(output)
+	if err != nil {
+		if isMinioNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// writeSchema writes the schema marker
+func (b *MinioBackend) writeSchema(ctx context.Context, j []byte) error {
+	_, err := b.Client.PutObject(ctx, b.Options.Bucket, schemaKey, bytes.NewReader(j), int64(len(j)), minio.PutObjectOptions{})
+	return err
 }
 
 // CreateShare creates a new share
@@ -105,25 +165,15 @@ func (b *MinioBackend) CreateShare(ctx context.Context, name, owner string, opti
 	share := NewShare().
 		WithName(name).
 		WithOwner(owner).
-		WithOptions(options).
 		WithDateCreated(time.Now())
+	share.updateOptions(options)
 
-	path := path.Join("shares", name, ".metadata")
-	j, err := json.Marshal(share)
+	err = b.putMetadata(ctx, share, "")
 	if err != nil {
 		return nil, err
 	}
-	r := bytes.NewReader(j)
 
-	_, err = b.Client.PutObject(ctx, b.Options.Bucket, path, r, int64(len(j)), minio.PutObjectOptions{UserMetadata: map[string]string{
-		"metadata": "true",
-		"owner":    owner,
-		"name":     name,
-	},
-	})
-	if err != nil {
-		return nil, err
-	}
+	b.indexShare(ctx, name, share)
 
 	return share, nil
 }
@@ -134,357 +184,1256 @@ func (b *MinioBackend) UpdateShare(ctx context.Context, name string, options *Op
 		return nil, ErrInvalidShareName
 	}
 
-	share, err := b.GetShare(ctx, name)
+	ctx, unlock, err := b.locker.Lock(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	if options != nil {
-		share.Options = *options
-	}
-
-	if downloads != nil {
-		share.Downloads = *downloads
-	}
+	share, err := updateShareMetadata(ctx, b, name, func(share *Share) error {
+		if options != nil {
+			share.updateOptions(*options)
+		}
 
-	path := path.Join("shares", name, ".metadata")
-	j, err := json.Marshal(share)
-	if err != nil {
-		return nil, err
-	}
-	r := bytes.NewReader(j)
+		if downloads != nil {
+			share.Downloads = *downloads
+		}
 
-	_, err = b.Client.PutObject(ctx, b.Options.Bucket, path, r, int64(len(j)), minio.PutObjectOptions{UserMetadata: map[string]string{
-		"metadata": "true",
-		"owner":    share.Owner,
-		"name":     name,
-	},
+		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
 
+	b.indexShare(ctx, name, share)
+
 	return &share.Options, nil
 }
 
-// CreateItem creates a new item in a share
-func (b *MinioBackend) CreateItem(ctx context.Context, name, item string, size int64, r io.Reader) (*Item, error) {
+// ReserveDownloads counts a download of items of share by a guest before it
+// is served
+func (b *MinioBackend) ReserveDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(ctx, name, func(s *Share) error { return s.reserveDownloads(items) })
+}
+
+// ReleaseDownloads uncounts a download of items of share by a guest that
+// didn't complete
+func (b *MinioBackend) ReleaseDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(ctx, name, func(s *Share) error { return s.releaseDownloads(items) })
+}
+
+// AddDownloads counts a complete download of items of share
+func (b *MinioBackend) AddDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(ctx, name, func(s *Share) error { return s.addDownloads(items) })
+}
+
+// updateDownloads applies update to the metadata of share name while it is
+// locked
+func (b *MinioBackend) updateDownloads(ctx context.Context, name string, update func(*Share) error) (*Share, error) {
 	if !IsShareNameSafe(name) {
 		return nil, ErrInvalidShareName
 	}
-	if !isItemNameSafe(item) {
-		return nil, ErrInvalidItemName
-	}
 
-	share, err := b.GetShare(ctx, name)
+	ctx, unlock, err := b.locker.Lock(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	// Check amount of free capacity in share according to current limits
-	maxWrite := int64(0)
-
-	maxShare := b.Options.MaxShareSize * 1024 * 1024
-	if maxShare > 0 {
-		maxWrite = maxShare - share.Size
-		if maxWrite <= 0 {
-			return nil, ErrMaxShareSizeReached
-		}
+	share, err := updateShareMetadata(ctx, b, name, update)
+	if err != nil {
+		return nil, err
 	}
 
-	maxItem := b.Options.MaxFileSize * 1024 * 1024
-	if maxItem > 0 {
-		if maxItem < size {
-			return nil, ErrMaxFileSizeReached
-		}
-		if maxWrite > maxItem || maxWrite == 0 {
-			maxWrite = maxItem
-		}
-	}
+	b.indexShare(ctx, name, share)
 
-	// maxWrite is the actual allowed size for the item, so we fix the limit
-	// to one more byte
-	if maxWrite > 0 {
-		maxWrite++
+	return share, nil
+}
 
-		if maxWrite < size {
-			return nil, ErrMaxShareSizeReached
-		}
+// SetItemMetadata replaces the metadata of item of share
+func (b *MinioBackend) SetItemMetadata(ctx context.Context, share, item string, metadata ItemMetadata) (*Item, error) {
+	if !IsShareNameSafe(share) {
+		return nil, ErrInvalidShareName
 	}
-	src := r
 
-	// Substitute bufio.Reader with a limited reader
-	if maxWrite != 0 {
-		src = bufio.NewReader(io.LimitReader(r, maxWrite))
+	if !isItemNameSafe(item) {
+		return nil, ErrInvalidItemName
 	}
 
-	path := path.Join(name, item)
-
-	_, err = b.Client.PutObject(ctx, b.Options.Bucket, path, src, size, minio.PutObjectOptions{})
+	ctx, unlock, err := b.locker.Lock(ctx, share)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	err = b.updateMetadata(ctx, name)
+	_, err = b.GetItem(ctx, share, item)
 	if err != nil {
 		return nil, err
 	}
 
-	result, err := b.GetItem(ctx, name, item)
+	s, err := updateShareMetadata(ctx, b, share, func(s *Share) error {
+		s.setItemMetadata(item, metadata)
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return result, nil
+	b.indexShare(ctx, share, s)
+
+	return b.GetItem(ctx, share, item)
 }
 
-// CreateItem creates a new item in a share
-func (b *MinioBackend) DeleteItem(ctx context.Context, share, item string) error {
-	if !IsShareNameSafe(share) {
-		return ErrInvalidShareName
-	}
-	if !isItemNameSafe(item) {
-		return ErrInvalidItemName
+// RestoreShare writes the metadata of share as is, creating the share if it
+// doesn't exist
+func (b *MinioBackend) RestoreShare(ctx context.Context, share *Share) (*Share, error) {
+	if !IsShareNameSafe(share.Name) {
+		return nil, ErrInvalidShareName
 	}
 
-	path := path.Join(share, item)
-
-	_, err := b.GetItem(ctx, share, item)
+	ctx, unlock, err := b.locker.Lock(ctx, share.Name)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer unlock()
 
-	err = b.Client.RemoveObject(ctx, b.Options.Bucket, path, minio.RemoveObjectOptions{})
+	// Compute size and count from items
+	items, err := b.listObjects(ctx, share.Name, "")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	versions, err := listObjectVersions(ctx, b, share.Name)
+	if err != nil {
+		return nil, err
 	}
 
-	err = b.updateMetadata(ctx, share)
+	result := restoredShare(share)
+	result.Size, result.Count = shareSize(items, versions)
+
+	// Metadata is replaced as is, concurrent updates are applied again on
+	// top of it as their conditional writes fail
+	err = b.putMetadata(ctx, result, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	b.indexShare(ctx, share.Name, result)
+
+	return result, nil
 }
 
-// GetShare returns the share identified by share
-func (b *MinioBackend) GetShare(ctx context.Context, name string) (*Share, error) {
+// CreateItem creates a new item in a share
+func (b *MinioBackend) CreateItem(ctx context.Context, name, item string, size int64, r io.Reader, metadata *ItemMetadata) (*Item, error) {
 	if !IsShareNameSafe(name) {
 		return nil, ErrInvalidShareName
 	}
-	path := path.Join("shares", name, ".metadata")
-	output, err := b.Client.GetObject(ctx, b.Options.Bucket, path, minio.GetObjectOptions{})
+	if !isItemNameSafe(item) {
+		return nil, ErrInvalidItemName
+	}
+
+	share, err := b.GetShare(ctx, name)
 	if err != nil {
 		return nil, err
 	}
 
-	result := NewShare()
-	err = json.NewDecoder(output).Decode(result)
+	// Check amount of free capacity in share according to current limits
+	maxWrite, err := itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, share, size)
 	if err != nil {
 		return nil, err
 	}
 
-	return result, nil
-}
-
-// ListShares returns the list of shares available
-func (b *MinioBackend) ListShares(ctx context.Context) ([]Share, error) {
-	prefix := "shares/"
-	output := b.Client.ListObjects(ctx, b.Options.Bucket, minio.ListObjectsOptions{
-		Prefix:    prefix,
-		Recursive: true,
+	item, err = share.Options.itemName(item, func(n string) (bool, error) {
+		_, err := b.GetItem(ctx, name, n)
+		if errors.Is(err, ErrItemNotFound) {
+			return false, nil
+		}
+		return err == nil, err
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	result := []Share{}
-	for item := range output {
-		gOutput, err := b.Client.GetObject(ctx, b.Options.Bucket, item.Key, minio.GetObjectOptions{})
+	// The current content is copied to a version before it is replaced, the
+	// share stays locked until the metadata is updated so the item can't
+	// change in the meantime
+	var unlock func()
+	version := ""
+	if share.Options.Conflict == ConflictVersion {
+		ctx, unlock, err = b.locker.Lock(ctx, name)
 		if err != nil {
 			return nil, err
 		}
-		share := NewShare()
-		err = json.NewDecoder(gOutput).Decode(share)
+		defer unlock()
+
+		version, err = b.copyVersion(ctx, name, item)
 		if err != nil {
 			return nil, err
 		}
-		result = append(result, *share)
 	}
 
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].DateCreated.After(result[j].DateCreated)
-	})
+	src := r
 
-	return result, nil
-}
+	// Substitute bufio.Reader with a limited reader, reading one more byte
+	// than allowed to detect items larger than announced
+	if maxWrite != 0 {
+		src = bufio.NewReader(io.LimitReader(r, maxWrite+1))
+	}
 
-// ListShare returns the list of items in a share
-func (b *MinioBackend) ListShare(ctx context.Context, name string) ([]Item, error) {
-	if !IsShareNameSafe(name) {
-		return nil, ErrInvalidShareName
+	path := path.Join(name, item)
+
+	// Items created concurrently with the same name are not replaced
+	options := minio.PutObjectOptions{}
+	if share.Options.Conflict == ConflictReject || share.Options.Conflict == ConflictRename {
+		options.SetMatchETagExcept("*")
 	}
-	output := b.Client.ListObjects(ctx, b.Options.Bucket, minio.ListObjectsOptions{
-		Prefix:    name + "/",
-		Recursive: true,
-	})
 
-	// Get current share downloads statistics
-	share, err := b.GetShare(ctx, name)
+	_, err = b.Client.PutObject(ctx, b.Options.Bucket, path, src, size, options)
 	if err != nil {
+		if version != "" {
+			_ = b.deleteKey(ctx, version)
+		}
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			return nil, fmt.Errorf("%w : %s", ErrItemAlreadyExists, item)
+		}
 		return nil, err
 	}
 
-	downloads := share.Downloads
-
-	result := []Item{}
-	for infos := range output {
-		item := &Item{
-			Path: infos.Key,
-			ItemInfo: ItemInfo{
-				Size:         infos.Size,
-				DateModified: infos.LastModified,
-			},
+	if unlock == nil {
+		ctx, unlock, err = b.locker.Lock(ctx, name)
+		if err != nil {
+			return nil, err
 		}
+		defer unlock()
+	}
 
-		if d, ok := downloads[path.Base(item.Path)]; ok {
-			item.Downloads = d
+	err = b.refreshMetadata(ctx, name, func(s *Share) error {
+		// Another upload might have filled the share in the meantime
+		err := storedItemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, s, size)
+		if err != nil {
+			return err
 		}
-
-		result = append(result, *item)
+		if metadata != nil {
+			s.setItemMetadata(item, *metadata)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrMaxShareSizeReached) {
+		_ = restoreObject(ctx, b, path, version)
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	// Sort items by modification date, newest first
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].ItemInfo.DateModified.After(result[j].ItemInfo.DateModified)
-	})
+	result, err := b.GetItem(ctx, name, item)
+	if err != nil {
+		return nil, err
+	}
 
 	return result, nil
 }
 
-// ListShare returns the list of items in a share
-func (b *MinioBackend) DeleteShare(ctx context.Context, name string) error {
-	if !IsShareNameSafe(name) {
-		return ErrInvalidShareName
+// copyVersion copies item of share to a new version if it exists, and returns
+// the key of the version. The share lock must be held by the caller.
+func (b *MinioBackend) copyVersion(ctx context.Context, share, item string) (string, error) {
+	current, err := b.GetItem(ctx, share, item)
+	if err != nil {
+		if errors.Is(err, ErrItemNotFound) {
+			return "", nil
+		}
+		return "", err
 	}
 
-	_, err := b.GetShare(ctx, name)
+	versions, err := objectItemVersions(ctx, b, share, item)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	content, err := b.ListShare(ctx, name)
+	key := path.Join(share, versionPath(item, nextVersion(versions)))
+	err = b.copyKey(ctx, path.Join(share, item), key, current.ItemInfo.Size)
 	if err != nil {
-		return err
-	}
-	for _, item := range content {
-		err = b.DeleteItem(ctx, name, path.Base(item.Path))
-		if err != nil {
-			return err
-		}
+		return "", err
 	}
 
-	path := path.Join("shares", name, ".metadata")
+	return key, nil
+}
 
-	err = b.Client.RemoveObject(ctx, b.Options.Bucket, path, minio.RemoveObjectOptions{})
-	if err != nil {
-		return err
+// copyKey copies object from of size bytes to object to. Objects larger than
+// maxCopySize are copied in parts with ComposeObject.
+func (b *MinioBackend) copyKey(ctx context.Context, from, to string, size int64) error {
+	dst := minio.CopyDestOptions{Bucket: b.Options.Bucket, Object: to}
+	src := minio.CopySrcOptions{Bucket: b.Options.Bucket, Object: from}
+
+	var err error
+	if size <= maxCopySize {
+		_, err = b.Client.CopyObject(ctx, dst, src)
+	} else {
+		_, err = b.Client.ComposeObject(ctx, dst, src)
 	}
 
-	return nil
+	return err
 }
 
-// GetItem returns the item identified by share and item
-func (b *MinioBackend) GetItem(ctx context.Context, s, item string) (*Item, error) {
-	if !IsShareNameSafe(s) {
+// CopyItem copies item of share to toItem of toShare with a server side copy.
+// Copies can't be conditional like uploads, so the destination share is
+// locked while its conflict policy is applied.
+func (b *MinioBackend) CopyItem(ctx context.Context, share, item, toShare, toItem string) (*Item, error) {
+	if !IsShareNameSafe(share) || !IsShareNameSafe(toShare) {
 		return nil, ErrInvalidShareName
 	}
-	if !isItemNameSafe(item) {
+	if !isItemNameSafe(item) || !isItemNameSafe(toItem) {
 		return nil, ErrInvalidItemName
 	}
 
-	path := path.Join(s, item)
-
-	aOutput, err := b.Client.GetObjectAttributes(ctx, b.Options.Bucket, path, minio.ObjectAttributesOptions{})
-
-	if err != nil {
-		return nil, err
-	}
-
-	share, err := b.GetShare(ctx, s)
+	ctx, unlock, err := b.locker.Lock(ctx, toShare)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	result := &Item{
-		Path: path,
-		ItemInfo: ItemInfo{
-			DateModified: aOutput.LastModified,
-		},
-		Downloads: share.Downloads[item],
-	}
-	result.ItemInfo.Size = int64(aOutput.ObjectSize)
-
-	return result, nil
+	return b.copyItem(ctx, share, item, toShare, toItem, true)
 }
 
-// GetItem returns the item identified by share and item
-func (b *MinioBackend) GetItemData(ctx context.Context, share, item string) (io.ReadCloser, error) {
-	if !IsShareNameSafe(share) {
+// MoveItem moves item of share to toItem of toShare. The item is copied then
+// deleted while both shares are locked, its versions are deleted.
+func (b *MinioBackend) MoveItem(ctx context.Context, share, item, toShare, toItem string) (*Item, error) {
+	if !IsShareNameSafe(share) || !IsShareNameSafe(toShare) {
 		return nil, ErrInvalidShareName
 	}
-	if !isItemNameSafe(item) {
+	if !isItemNameSafe(item) || !isItemNameSafe(toItem) {
 		return nil, ErrInvalidItemName
 	}
 
-	_, err := b.GetItem(ctx, share, item)
+	ctx, unlock, err := lockShares(ctx, b.locker, share, toShare)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	path := path.Join(share, item)
-
-	aOutput, err := b.Client.GetObject(ctx, b.Options.Bucket, path, minio.GetObjectOptions{})
-
+	result, err := b.copyItem(ctx, share, item, toShare, toItem, share != toShare)
 	if err != nil {
 		return nil, err
 	}
 
-	return aOutput, err
-}
-
-func (b *MinioBackend) updateMetadata(ctx context.Context, s string) error {
-	if !IsShareNameSafe(s) {
-		return ErrInvalidShareName
+	err = b.deleteKey(ctx, path.Join(share, item))
+	if err != nil {
+		return nil, fmt.Errorf("cannot delete %s after copy: %w", item, err)
 	}
 
-	c, err := b.ListShare(ctx, s)
+	err = deleteObjectVersions(ctx, b, share, item)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	count := 0
-	capacity := int64(0)
-	for _, i := range c {
-		count += 1
-		capacity += i.ItemInfo.Size
+	err = b.refreshMetadata(ctx, share, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	share, err := b.GetShare(ctx, s)
+	return result, nil
+}
+
+// copyItem copies item of share to toItem of toShare, the quota of toShare is
+// checked if quota is true. The lock of toShare must be held by the caller.
+func (b *MinioBackend) copyItem(ctx context.Context, share, item, toShare, toItem string, quota bool) (*Item, error) {
+	source, err := b.GetItem(ctx, share, item)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	share.Count = int64(count)
-	share.Size = capacity
 
-	j, err := json.Marshal(share)
+	dest, err := b.GetShare(ctx, toShare)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	// Items moved within a share don't change its size
+	if quota {
+		_, err = itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, dest, source.ItemInfo.Size)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	name, err := dest.Options.copyItemName(share, item, toShare, toItem, func(n string) (bool, error) {
+		_, err := b.GetItem(ctx, toShare, n)
+		if errors.Is(err, ErrItemNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The current content is copied to a version before it is replaced
+	version := ""
+	if dest.Options.Conflict == ConflictVersion {
+		version, err = b.copyVersion(ctx, toShare, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = b.copyKey(ctx, path.Join(share, item), path.Join(toShare, name), source.ItemInfo.Size)
+	if err != nil {
+		if version != "" {
+			_ = b.deleteKey(ctx, version)
+		}
+		// The item was deleted in the meantime
+		if isMinioNotFound(err) {
+			return nil, ErrItemNotFound
+		}
+		return nil, err
+	}
+
+	err = b.refreshMetadata(ctx, toShare, func(s *Share) error {
+		s.replaceItemMetadata(name, source.Metadata)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.GetItem(ctx, toShare, name)
+}
+
+// CreateItem creates a new item in a share
+func (b *MinioBackend) DeleteItem(ctx context.Context, share, item string) error {
+	if !IsShareNameSafe(share) {
+		return ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return ErrInvalidItemName
+	}
+
+	path := path.Join(share, item)
+
+	_, err := b.GetItem(ctx, share, item)
+	if err != nil {
+		return err
+	}
+
+	err = b.Client.RemoveObject(ctx, b.Options.Bucket, path, minio.RemoveObjectOptions{})
+	if err != nil {
+		return err
+	}
+
+	// Versions are deleted with their item
+	err = deleteObjectVersions(ctx, b, share, item)
+	if err != nil {
+		return err
+	}
+
+	err = b.updateMetadata(ctx, share, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListItemVersions returns the versions of item of share, oldest first
+func (b *MinioBackend) ListItemVersions(ctx context.Context, share, item string) ([]ItemVersion, error) {
+	if !IsShareNameSafe(share) {
+		return nil, ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return nil, ErrInvalidItemName
+	}
+
+	versions, err := objectItemVersions(ctx, b, share, item)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		_, err = b.GetItem(ctx, share, item)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return versions, nil
+}
+
+// GetItemVersionData returns the content of version of item of share
+func (b *MinioBackend) GetItemVersionData(ctx context.Context, share, item string, version int) (io.ReadCloser, error) {
+	if !IsShareNameSafe(share) {
+		return nil, ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return nil, ErrInvalidItemName
+	}
+
+	key := path.Join(share, versionPath(item, version))
+
+	// Objects are only read once returned, missing objects are detected
+	// before
+	_, err := b.Client.StatObject(ctx, b.Options.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isMinioNotFound(err) {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+
+	return b.Client.GetObject(ctx, b.Options.Bucket, key, minio.GetObjectOptions{})
+}
+
+// DeleteItemVersion deletes version of item of share
+func (b *MinioBackend) DeleteItemVersion(ctx context.Context, share, item string, version int) error {
+	if !IsShareNameSafe(share) {
+		return ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return ErrInvalidItemName
+	}
+
+	key := path.Join(share, versionPath(item, version))
+
+	// Deleting a missing object doesn't fail
+	_, err := b.Client.StatObject(ctx, b.Options.Bucket, key, minio.StatObjectOptions{})
+	if err != nil {
+		if isMinioNotFound(err) {
+			return ErrVersionNotFound
+		}
+		return err
+	}
+
+	err = b.deleteKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return b.updateMetadata(ctx, share, nil)
+}
+
+// GetShare returns the share identified by share
+func (b *MinioBackend) GetShare(ctx context.Context, name string) (*Share, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	result, _, err := b.getMetadata(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ListShares returns the list of shares available
+func (b *MinioBackend) ListShares(ctx context.Context) ([]Share, error) {
+	if b.Options.MetadataIndex {
+		return listIndexedShares(ctx, b)
+	}
+
+	result, err := b.listSharesMetadata(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sortShares(result)
+
+	return result, nil
+}
+
+// QueryShares returns a page of shares matching q. Shares are read from the
+// metadata index when enabled. Otherwise only metadata of shares matching q
+// prefix is read, and only for shares of the page when sorted by name.
+func (b *MinioBackend) QueryShares(ctx context.Context, q ShareQuery) (*SharePage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var shares []Share
+	switch {
+	case b.Options.MetadataIndex:
+		shares, err = listIndexedShares(ctx, b)
+	case q.ByName():
+		names, err := b.listShareNames(ctx, q.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		return q.ApplyNames(names, func(name string) (*Share, error) {
+			return b.GetShare(ctx, name)
+		})
+	default:
+		shares, err = b.listSharesMetadata(ctx, q.Prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Apply(shares)
+}
+
+// listShareNames returns the names of shares starting with prefix, without
+// reading their metadata
+func (b *MinioBackend) listShareNames(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := b.listKeys(ctx, "shares/"+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, o := range objects {
+		if path.Base(o.Path) == ".metadata" {
+			result = append(result, path.Base(path.Dir(o.Path)))
+		}
+	}
+
+	return result, nil
+}
+
+// listSharesMetadata reads the metadata of every share with a name starting
+// with prefix
+func (b *MinioBackend) listSharesMetadata(ctx context.Context, prefix string) ([]Share, error) {
+	prefix = "shares/" + prefix
+	output := b.Client.ListObjects(ctx, b.Options.Bucket, minio.ListObjectsOptions{
+		Prefix:    prefix,
+		Recursive: true,
+	})
+
+	result := []Share{}
+	for item := range output {
+		// Listing errors are reported in the last object
+		if item.Err != nil {
+			return nil, item.Err
+		}
+		if path.Base(item.Key) != ".metadata" {
+			continue
+		}
+		gOutput, err := b.Client.GetObject(ctx, b.Options.Bucket, item.Key, minio.GetObjectOptions{})
+		if err != nil {
+			return nil, err
+		}
+		share := NewShare()
+		err = json.NewDecoder(gOutput).Decode(share)
+		gOutput.Close()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *share)
+	}
+
+	return result, nil
+}
+
+// ListShare returns the list of items in a share
+func (b *MinioBackend) ListShare(ctx context.Context, name string) ([]Item, error) {
+	result, err := b.listItems(ctx, name, "")
+	if err != nil {
+		return nil, err
+	}
+
+	// Sort items by modification date, newest first
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ItemInfo.DateModified.After(result[j].ItemInfo.DateModified)
+	})
+
+	return result, nil
+}
+
+// QueryItems returns a page of items in share name matching q. Only items
+// matching q prefix are listed, and listing stops once the page is filled
+// when sorted by name.
+func (b *MinioBackend) QueryItems(ctx context.Context, name string, q ItemQuery) (*ItemPage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if q.InOrder() {
+		after, err := q.After()
+		if err != nil {
+			return nil, err
+		}
+		items, err := b.itemsAfter(ctx, name, q.Prefix, after)
+		if err != nil {
+			return nil, err
+		}
+		return q.ApplyInOrder(items)
+	}
+
+	result, err := b.listItems(ctx, name, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Apply(result)
+}
+
+// listItems returns items of share name with a name starting with prefix
+func (b *MinioBackend) listItems(ctx context.Context, name, prefix string) ([]Item, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+	// Get current share downloads statistics
+	share, err := b.GetShare(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := b.listObjects(ctx, name, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range result {
+		result[i].Downloads = share.Downloads[path.Base(result[i].Path)]
+		result[i].Metadata = share.itemMetadata(path.Base(result[i].Path))
+	}
+
+	return result, nil
+}
+
+// itemsAfter lists items of share name with a name starting with prefix in
+// name order, after item after when it is set
+func (b *MinioBackend) itemsAfter(ctx context.Context, name, prefix, after string) (iter.Seq2[Item, error], error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+	// Get current share downloads statistics
+	share, err := b.GetShare(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	start := ""
+	if after != "" {
+		start = name + "/" + after
+	}
+
+	return func(yield func(Item, error) bool) {
+		for o, err := range b.keys(ctx, name+"/"+prefix, start) {
+			if err != nil {
+				yield(Item{}, err)
+				return
+			}
+			n := strings.TrimPrefix(o.Path, name+"/")
+			if !isItemNameSafe(n) {
+				continue
+			}
+			o.Downloads = share.Downloads[n]
+			o.Metadata = share.itemMetadata(n)
+			if !yield(o, nil) {
+				return
+			}
+		}
+	}, nil
+}
+
+// listObjects returns items of share name with a name starting with prefix,
+// without reading share metadata. Versions of items are not returned.
+func (b *MinioBackend) listObjects(ctx context.Context, name, prefix string) ([]Item, error) {
+	objects, err := b.listKeys(ctx, name+"/"+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Item{}
+	for _, o := range objects {
+		if isItemNameSafe(strings.TrimPrefix(o.Path, name+"/")) {
+			result = append(result, o)
+		}
+	}
+
+	return result, nil
+}
+
+// listKeys returns objects with a key starting with prefix, Path being the
+// key of the object
+func (b *MinioBackend) listKeys(ctx context.Context, prefix string) ([]Item, error) {
+	result := []Item{}
+	for o, err := range b.keys(ctx, prefix, "") {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, o)
+	}
+
+	return result, nil
+}
+
+// keys lists objects with a key starting with prefix in key order, after key
+// after when it is set, Path being the key of the object. Listing stops with
+// the iteration.
+func (b *MinioBackend) keys(ctx context.Context, prefix, after string) iter.Seq2[Item, error] {
+	return func(yield func(Item, error) bool) {
+		// Stops the listing goroutine when iteration stops early
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+
+		output := b.Client.ListObjects(ctx, b.Options.Bucket, minio.ListObjectsOptions{
+			Prefix:     prefix,
+			Recursive:  true,
+			StartAfter: after,
+		})
+
+		for infos := range output {
+			// Listing errors are reported in the last object
+			if infos.Err != nil {
+				yield(Item{}, infos.Err)
+				return
+			}
+
+			if !yield(Item{
+				Path: infos.Key,
+				ItemInfo: ItemInfo{
+					Size:         infos.Size,
+					DateModified: infos.LastModified,
+				},
+			}, nil) {
+				return
+			}
+		}
+	}
+}
+
+// ListShare returns the list of items in a share
+func (b *MinioBackend) DeleteShare(ctx context.Context, name string) error {
+	if !IsShareNameSafe(name) {
+		return ErrInvalidShareName
+	}
+
+	_, err := b.GetShare(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	content, err := b.ListShare(ctx, name)
+	if err != nil {
+		return err
+	}
+	for _, item := range content {
+		err = b.DeleteItem(ctx, name, path.Base(item.Path))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Versions of items deleted in the meantime are left over
+	err = deleteObjectVersions(ctx, b, name, "")
+	if err != nil {
+		return err
+	}
+
+	path := path.Join("shares", name, ".metadata")
+
+	err = b.Client.RemoveObject(ctx, b.Options.Bucket, path, minio.RemoveObjectOptions{})
+	if err != nil {
+		return err
+	}
+
+	b.indexShare(ctx, name, nil)
+
+	return nil
+}
+
+// RenameShare renames share name to to, objects of the share are copied to
+// the new name then deleted
+func (b *MinioBackend) RenameShare(ctx context.Context, name, to string, until time.Time) (*Share, error) {
+	return renameObjectShare(ctx, b, b.locker, name, to, until)
+}
+
+// GetRenamedShare returns the record of the share previously named name
+func (b *MinioBackend) GetRenamedShare(ctx context.Context, name string) (*RenamedShare, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	output, err := b.Client.GetObject(ctx, b.Options.Bucket, renamePath(name), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Close()
+
+	result := &RenamedShare{}
+	err = json.NewDecoder(output).Decode(result)
+	if err != nil {
+		// Errors are only returned when the object is accessed
+		if isMinioNotFound(err) {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// putRenamedShare writes the record of r.From
+func (b *MinioBackend) putRenamedShare(ctx context.Context, r *RenamedShare) error {
+	j, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.Client.PutObject(ctx, b.Options.Bucket, renamePath(r.From), bytes.NewReader(j), int64(len(j)), minio.PutObjectOptions{})
+	return err
+}
+
+// PurgeRenamedShares removes records of renamed shares which previous name
+// stopped working before before
+func (b *MinioBackend) PurgeRenamedShares(ctx context.Context, before time.Time) ([]string, error) {
+	return purgeRenamedShares(ctx, b, b.locker, before)
+}
+
+// listRenamedShares returns the previous names of renamed shares
+func (b *MinioBackend) listRenamedShares(ctx context.Context) ([]string, error) {
+	objects, err := b.listKeys(ctx, renamesPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, o := range objects {
+		if name, ok := strings.CutSuffix(path.Base(o.Path), ".json"); ok && IsShareNameSafe(name) {
+			result = append(result, name)
+		}
+	}
+
+	return result, nil
+}
+
+// deleteRenamedShare removes the record of name
+func (b *MinioBackend) deleteRenamedShare(ctx context.Context, name string) error {
+	return b.deleteKey(ctx, renamePath(name))
+}
+
+// Check checks shares metadata against objects of the bucket, objects
+// outside any share are reported as orphans
+func (b *MinioBackend) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	return checkObjects(ctx, b, b.locker, repair)
+}
+
+// deleteKey deletes object key
+func (b *MinioBackend) deleteKey(ctx context.Context, key string) error {
+	return b.Client.RemoveObject(ctx, b.Options.Bucket, key, minio.RemoveObjectOptions{})
+}
+
+// GetItem returns the item identified by share and item
+func (b *MinioBackend) GetItem(ctx context.Context, s, item string) (*Item, error) {
+	if !IsShareNameSafe(s) {
+		return nil, ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return nil, ErrInvalidItemName
+	}
+
+	path := path.Join(s, item)
+
+	aOutput, err := b.Client.GetObjectAttributes(ctx, b.Options.Bucket, path, minio.ObjectAttributesOptions{})
+
+	if err != nil {
+		if isMinioNotFound(err) {
+			return nil, ErrItemNotFound
+		}
+		return nil, err
+	}
+
+	share, err := b.GetShare(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Item{
+		Path: path,
+		ItemInfo: ItemInfo{
+			DateModified: aOutput.LastModified,
+		},
+		Downloads: share.Downloads[item],
+		Metadata:  share.itemMetadata(item),
+	}
+	result.ItemInfo.Size = int64(aOutput.ObjectSize)
+
+	return result, nil
+}
+
+// GetItem returns the item identified by share and item
+func (b *MinioBackend) GetItemData(ctx context.Context, share, item string) (io.ReadCloser, error) {
+	if !IsShareNameSafe(share) {
+		return nil, ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return nil, ErrInvalidItemName
+	}
+
+	_, err := b.GetItem(ctx, share, item)
+	if err != nil {
+		return nil, err
+	}
+
+	path := path.Join(share, item)
+
+	aOutput, err := b.Client.GetObject(ctx, b.Options.Bucket, path, minio.GetObjectOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return aOutput, err
+}
+
+// updateMetadata locks share s, computes its size and count from its items,
+// and applies update to its metadata if it is not nil
+func (b *MinioBackend) updateMetadata(ctx context.Context, s string, update func(*Share) error) error {
+	if !IsShareNameSafe(s) {
+		return ErrInvalidShareName
+	}
+
+	ctx, unlock, err := b.locker.Lock(ctx, s)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return b.refreshMetadata(ctx, s, update)
+}
+
+// refreshMetadata computes size and count of share s from its items, and
+// applies update to its metadata if it is not nil. The metadata isn't written
+// if update returns an error. The share lock must be held by the caller.
+func (b *MinioBackend) refreshMetadata(ctx context.Context, s string, update func(*Share) error) error {
+	// Items are listed again on every attempt, so a concurrent update
+	// can't be overwritten with a stale size
+	share, err := updateShareMetadata(ctx, b, s, func(share *Share) error {
+		items, err := b.listObjects(ctx, s, "")
+		if err != nil {
+			return err
+		}
+		versions, err := listObjectVersions(ctx, b, s)
+		if err != nil {
+			return err
+		}
+		share.Size, share.Count = shareSize(items, versions)
+		share.pruneItemMetadata(itemNames(items))
+		if update != nil {
+			return update(share)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	b.indexShare(ctx, s, share)
+
+	return nil
+}
+
+// getMetadata returns the metadata of share name and its ETag
+func (b *MinioBackend) getMetadata(ctx context.Context, name string) (*Share, string, error) {
+	j, etag, err := b.readMetadata(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result := NewShare()
+	err = json.Unmarshal(j, result)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, etag, nil
+}
+
+// readMetadata returns the metadata of share name as stored and its ETag
+func (b *MinioBackend) readMetadata(ctx context.Context, name string) ([]byte, string, error) {
+	output, err := b.Client.GetObject(ctx, b.Options.Bucket, path.Join("shares", name, ".metadata"), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Close()
+
+	// Errors are only returned when the object is accessed
+	info, err := output.Stat()
+	if err != nil {
+		if isMinioNotFound(err) {
+			return nil, "", ErrShareNotFound
+		}
+		return nil, "", err
+	}
+
+	j, err := io.ReadAll(output)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return j, info.ETag, nil
+}
+
+// putMetadata writes the metadata of share, with a conditional write on etag
+// unless it is empty
+func (b *MinioBackend) putMetadata(ctx context.Context, share *Share, etag string) error {
+	j, err := json.Marshal(share)
+	if err != nil {
+		return err
+	}
+
+	options := minio.PutObjectOptions{UserMetadata: map[string]string{
+		"metadata": "true",
+		"owner":    share.Owner,
+		"name":     share.Name,
+	}}
+	if etag != "" {
+		options.SetMatchETag(etag)
+	}
+
+	key := path.Join("shares", share.Name, ".metadata")
+	_, err = b.Client.PutObject(ctx, b.Options.Bucket, key, bytes.NewReader(j), int64(len(j)), options)
+	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "PreconditionFailed":
+			return errMetadataConflict
+		case "NoSuchKey":
+			// The share has been deleted since metadata was read
+			return ErrShareNotFound
+		}
+		return err
 	}
 
-	path := path.Join("shares", s, ".metadata")
+	return nil
+}
+
+// isMinioNotFound returns true if err is returned for a missing object
+func isMinioNotFound(err error) bool {
+	return minio.ToErrorResponse(err).Code == "NoSuchKey"
+}
+
+// RebuildIndex rebuilds the metadata index if it is enabled
+func (b *MinioBackend) RebuildIndex(ctx context.Context) error {
+	if !b.Options.MetadataIndex {
+		return nil
+	}
+	return rebuildIndex(ctx, b)
+}
+
+// indexShare updates share name in the metadata index if it is enabled
+func (b *MinioBackend) indexShare(ctx context.Context, name string, share *Share) {
+	if b.Options.MetadataIndex {
+		updateIndex(ctx, b, name, share)
+	}
+}
+
+// getIndex returns the metadata index and its ETag
+func (b *MinioBackend) getIndex(ctx context.Context) (*shareIndex, string, error) {
+	output, err := b.Client.GetObject(ctx, b.Options.Bucket, indexKey, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Close()
+
+	// Errors are only returned when the object is accessed
+	info, err := output.Stat()
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+			return nil, "", errIndexNotFound
+		}
+		return nil, "", err
+	}
+
+	result := &shareIndex{}
+	err = json.NewDecoder(output).Decode(result)
+	if err != nil {
+		return nil, "", err
+	}
+	if result.Shares == nil {
+		result.Shares = map[string]Share{}
+	}
+
+	return result, info.ETag, nil
+}
+
+// putIndex writes the metadata index with a conditional write on etag
+func (b *MinioBackend) putIndex(ctx context.Context, index *shareIndex, etag string) error {
+	j, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	options := minio.PutObjectOptions{}
+	if etag == "" {
+		options.SetMatchETagExcept("*")
+	} else {
+		options.SetMatchETag(etag)
+	}
+
+	_, err = b.Client.PutObject(ctx, b.Options.Bucket, indexKey, bytes.NewReader(j), int64(len(j)), options)
+	if err != nil {
+		if minio.ToErrorResponse(err).Code == "PreconditionFailed" {
+			return errIndexConflict
+		}
+		return err
+	}
+
+	return nil
+}
+
+// deleteIndex removes the metadata index
+func (b *MinioBackend) deleteIndex(ctx context.Context) error {
+	return b.Client.RemoveObject(ctx, b.Options.Bucket, indexKey, minio.RemoveObjectOptions{})
+}
+
+// AcquireLease acquires lease name for holder until ttl from now, leases are
+// stored in the bucket so instances sharing it can coordinate
+func (b *MinioBackend) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (*Lease, error) {
+	return acquireLease(ctx, b, name, holder, ttl)
+}
+
+// ReleaseLease releases lease name if it is held by holder
+func (b *MinioBackend) ReleaseLease(ctx context.Context, name, holder string) error {
+	return releaseLease(ctx, b, name, holder)
+}
+
+// getLease returns lease name and its ETag
+func (b *MinioBackend) getLease(ctx context.Context, name string) (*Lease, string, error) {
+	output, err := b.Client.GetObject(ctx, b.Options.Bucket, path.Join(leasesPrefix, name+".json"), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, "", err
+	}
+	defer output.Close()
 
-	r := bytes.NewReader(j)
+	// Errors are only returned when the object is accessed
+	info, err := output.Stat()
+	if err != nil {
+		if isMinioNotFound(err) {
+			return nil, "", errLeaseNotFound
+		}
+		return nil, "", err
+	}
+
+	result := &Lease{}
+	err = json.NewDecoder(output).Decode(result)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, info.ETag, nil
+}
+
+// putLease writes lease with a conditional write on etag
+func (b *MinioBackend) putLease(ctx context.Context, lease *Lease, etag string) error {
+	j, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	options := minio.PutObjectOptions{}
+	if etag == "" {
+		options.SetMatchETagExcept("*")
+	} else {
+		options.SetMatchETag(etag)
+	}
 
-	_, err = b.Client.PutObject(ctx, b.Options.Bucket, path, r, int64(len(j)), minio.PutObjectOptions{})
+	key := path.Join(leasesPrefix, lease.Name+".json")
+	_, err = b.Client.PutObject(ctx, b.Options.Bucket, key, bytes.NewReader(j), int64(len(j)), options)
 	if err != nil {
+		switch minio.ToErrorResponse(err).Code {
+		case "PreconditionFailed", "NoSuchKey":
+			return errLeaseConflict
+		}
 		return err
 	}
 
@@ -11,11 +11,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/minio/minio-go/v7"
 	"github.com/ybizeul/hupload/internal/storage"
+	"github.com/ybizeul/hupload/internal/storage/storagetest"
 )
 
-func createMinioBackend(t *testing.T) *storage.MinioBackend {
-	c := storage.MinioStorageConfig{
+// minioConfig returns the backend configuration for tests from environment
+func minioConfig() storage.MinioStorageConfig {
+	return storage.MinioStorageConfig{
 		Endpoint:     os.Getenv("MINIO_ENDPOINT"),
 		Region:       os.Getenv("MINIO_DEFAULT_REGION"),
 		AWSKey:       os.Getenv("MINIO_ACCESS_KEY_ID"),
@@ -25,7 +28,13 @@ func createMinioBackend(t *testing.T) *storage.MinioBackend {
 		MaxFileSize:  4,
 		MaxShareSize: 5,
 	}
+}
+
+func createMinioBackend(t *testing.T) *storage.MinioBackend {
+	return createMinioBackendWithConfig(t, minioConfig())
+}
 
+func createMinioBackendWithConfig(t *testing.T, c storage.MinioStorageConfig) *storage.MinioBackend {
 	f := storage.NewMinioStorage(c)
 	if f == nil {
 		t.Errorf("Expected S3 Storage to be created")
@@ -34,6 +43,14 @@ func createMinioBackend(t *testing.T) *storage.MinioBackend {
 	return f
 }
 
+func TestMinioConformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, l storagetest.Limits) storage.Storage {
+		c := minioConfig()
+		c.MaxFileSize, c.MaxShareSize = l.MaxFileSize, l.MaxShareSize
+		return createMinioBackendWithConfig(t, c)
+	})
+}
+
 func TestMinioCreateShare(t *testing.T) {
 	f := createMinioBackend(t)
 
@@ -80,6 +97,41 @@ func TestMinioUpdateShare(t *testing.T) {
 	}
 }
 
+func TestMinioRestoreShare(t *testing.T) {
+	f := createMinioBackend(t)
+
+	t.Cleanup(func() {
+		_ = f.DeleteShare(context.Background(), "Test")
+	})
+
+	created := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	share := storage.NewShare().
+		WithName("Test").
+		WithOwner("user").
+		WithDateCreated(created).
+		WithOptions(storage.DefaultOptions())
+	share.Downloads = map[string]int64{"test.txt": 1}
+
+	got, err := f.RestoreShare(context.Background(), share)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(got, share) {
+		t.Errorf("Expected %+v, got %+v", share, got)
+	}
+}
+
+func TestMinioMigrate(t *testing.T) {
+	f := createMinioBackend(t)
+
+	testObjectMigrate(t, f, func(key string, b []byte) error {
+		_, err := f.Client.PutObject(context.Background(), f.Options.Bucket, key, bytes.NewReader(b), int64(len(b)), minio.PutObjectOptions{})
+		return err
+	})
+}
+
 func TestCreateMinioItem(t *testing.T) {
 	f := createMinioBackend(t)
 
@@ -113,7 +165,7 @@ func TestCreateMinioItem(t *testing.T) {
 		b := bufio.NewReader(bytes.NewBuffer(test.Bytes))
 
 		// Test create item
-		_, err = f.CreateItem(context.Background(), "Test", test.FileName, int64(len(test.Bytes)), b)
+		_, err = f.CreateItem(context.Background(), "Test", test.FileName, int64(len(test.Bytes)), b, nil)
 		if err != nil {
 			t.Errorf("Expected no error, got %v", err)
 		}
@@ -242,3 +294,15 @@ func TestMinioListShares(t *testing.T) {
 		t.Errorf("Expected shares to be %v, got %v", got, want)
 	}
 }
+
+func TestMinioLargeListings(t *testing.T) {
+	t.Run("Without index", func(t *testing.T) {
+		testLargeListings(t, createMinioBackend(t))
+	})
+
+	t.Run("With index", func(t *testing.T) {
+		c := minioConfig()
+		c.MetadataIndex = true
+		testLargeListings(t, createMinioBackendWithConfig(t, c))
+	})
+}
@@ -0,0 +1,440 @@
+package storage
+
+import (
+	"cmp"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"iter"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ShareQuery selects, sorts and paginates shares. The zero value returns
+// every share, newest first.
+type ShareQuery struct {
+	// Owner only returns shares created by Owner
+	Owner string
+
+	// Status is "valid" or "expired" to only return shares in that state
+	Status string
+
+	// Exposure only returns shares with this exposure
+	Exposure string
+
+	// Prefix only returns shares with a name starting with Prefix
+	Prefix string
+
+	// CreatedAfter and CreatedBefore only return shares created in that
+	// range, zero values are ignored
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+
+	// Sort is one of created, size, count, name or owner, prefixed with "-"
+	// for descending order. Defaults to -created.
+	Sort string
+
+	// Limit is the maximum number of shares returned, 0 for no limit
+	Limit int
+
+	// Cursor is the Next value of the previous page
+	Cursor string
+}
+
+// ItemQuery selects, sorts and paginates items of a share. The zero value
+// returns every item, newest first.
+type ItemQuery struct {
+	// Prefix only returns items with a name starting with Prefix
+	Prefix string
+
+	// Names only returns items with one of these names, unless it is nil
+	Names []string
+
+	// ModifiedAfter and ModifiedBefore only return items modified in that
+	// range, zero values are ignored
+	ModifiedAfter  time.Time
+	ModifiedBefore time.Time
+
+	// Sort is one of modified, size or name, prefixed with "-" for
+	// descending order. Defaults to -modified.
+	Sort string
+
+	// Limit is the maximum number of items returned, 0 for no limit
+	Limit int
+
+	// Cursor is the Next value of the previous page
+	Cursor string
+}
+
+// SharePage is a page of shares returned by QueryShares
+type SharePage struct {
+	Shares []Share
+
+	// Total is the number of shares matching the query in all pages, -1
+	// when it is unknown
+	Total int
+
+	// Next is the cursor of the next page, empty on the last page
+	Next string
+}
+
+// ItemPage is a page of items returned by QueryItems
+type ItemPage struct {
+	Items []Item
+
+	// Total is the number of items matching the query in all pages, -1 when
+	// it is unknown
+	Total int
+
+	// Next is the cursor of the next page, empty on the last page
+	Next string
+}
+
+var shareSorts = map[string]func(a, b *Share) int{
+	"created": func(a, b *Share) int { return a.DateCreated.Compare(b.DateCreated) },
+	"size":    func(a, b *Share) int { return cmp.Compare(a.Size, b.Size) },
+	"count":   func(a, b *Share) int { return cmp.Compare(a.Count, b.Count) },
+	"name":    func(a, b *Share) int { return 0 },
+	"owner":   func(a, b *Share) int { return strings.Compare(a.Owner, b.Owner) },
+}
+
+var itemSorts = map[string]func(a, b *Item) int{
+	"modified": func(a, b *Item) int { return a.ItemInfo.DateModified.Compare(b.ItemInfo.DateModified) },
+	"size":     func(a, b *Item) int { return cmp.Compare(a.ItemInfo.Size, b.ItemInfo.Size) },
+	"name":     func(a, b *Item) int { return 0 },
+}
+
+// shareKey returns the values of s used by sorts
+func shareKey(s Share) Share {
+	return Share{Name: s.Name, DateCreated: s.DateCreated, Size: s.Size, Count: s.Count, Owner: s.Owner}
+}
+
+// itemKey returns the values of i used by sorts
+func itemKey(i Item) Item {
+	return Item{Path: i.Path, ItemInfo: i.ItemInfo}
+}
+
+// compareFunc returns the comparison function for sort s in sorts, with
+// entries of equal value ordered by name so the order is total.
+func compareFunc[T any](sorts map[string]func(a, b *T) int, s, def string, name func(*T) string) (func(a, b *T) int, error) {
+	if s == "" {
+		s = def
+	}
+
+	key, desc := strings.CutPrefix(s, "-")
+	f, ok := sorts[key]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown sort %s", ErrInvalidQuery, key)
+	}
+
+	return func(a, b *T) int {
+		r := f(a, b)
+		if r == 0 {
+			r = strings.Compare(name(a), name(b))
+		}
+		if desc {
+			r = -r
+		}
+		return r
+	}, nil
+}
+
+// paginate sorts entries with compare and returns at most limit of them
+// after cursor, along with the cursor of the next page. Cursors hold the
+// sort values of the last entry of a page, returned by key, so pages stay
+// consistent when entries are added or removed between calls.
+func paginate[T any](entries []T, compare func(a, b *T) int, key func(T) T, limit int, cursor string) ([]T, string, error) {
+	slices.SortFunc(entries, func(a, b T) int { return compare(&a, &b) })
+
+	if cursor != "" {
+		var last T
+		err := decodeCursor(cursor, &last)
+		if err != nil {
+			return nil, "", err
+		}
+		i, _ := slices.BinarySearchFunc(entries, last, func(e, t T) int {
+			if compare(&e, &t) <= 0 {
+				return -1
+			}
+			return 1
+		})
+		entries = entries[i:]
+	}
+
+	if limit <= 0 || len(entries) <= limit {
+		return entries, "", nil
+	}
+
+	entries = entries[:limit]
+
+	next, err := encodeCursor(key(entries[limit-1]))
+	if err != nil {
+		return nil, "", err
+	}
+
+	return entries, next, nil
+}
+
+// paginateInOrder returns the first limit entries of entries matching match,
+// along with the cursor of the next page. entries are read in sort order,
+// starting after the cursor, and reading stops once the page is filled, so
+// backends only read what is returned.
+func paginateInOrder[T any](entries iter.Seq2[T, error], match func(*T) bool, key func(T) T, limit int) ([]T, string, error) {
+	result := []T{}
+	next := ""
+
+	for e, err := range entries {
+		if err != nil {
+			return nil, "", err
+		}
+		if !match(&e) {
+			continue
+		}
+		if len(result) == limit {
+			next, err = encodeCursor(key(result[limit-1]))
+			if err != nil {
+				return nil, "", err
+			}
+			break
+		}
+		result = append(result, e)
+	}
+
+	return result, next, nil
+}
+
+// encodeCursor returns the cursor of a page ending with sort values last
+func encodeCursor(last any) (string, error) {
+	b, err := json.Marshal(last)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeCursor decodes the sort values of cursor in last
+func decodeCursor(cursor string, last any) error {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return fmt.Errorf("%w: invalid cursor", ErrInvalidQuery)
+	}
+	err = json.Unmarshal(b, last)
+	if err != nil {
+		return fmt.Errorf("%w: invalid cursor", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// Validate checks q can be applied
+func (q *ShareQuery) Validate() error {
+	switch q.Status {
+	case "", "valid", "expired":
+	default:
+		return fmt.Errorf("%w: unknown status %s", ErrInvalidQuery, q.Status)
+	}
+	if q.Limit < 0 {
+		return fmt.Errorf("%w: negative limit", ErrInvalidQuery)
+	}
+	_, err := q.compare()
+	return err
+}
+
+func (q *ShareQuery) compare() (func(a, b *Share) int, error) {
+	return compareFunc(shareSorts, q.Sort, "-created", func(s *Share) string { return s.Name })
+}
+
+// Match returns true if share s matches the filters of q
+func (q *ShareQuery) Match(s *Share) bool {
+	switch {
+	case q.Owner != "" && s.Owner != q.Owner,
+		q.Exposure != "" && s.Options.Exposure != q.Exposure,
+		q.Prefix != "" && !strings.HasPrefix(s.Name, q.Prefix),
+		q.Status == "valid" && !s.IsValid(),
+		q.Status == "expired" && s.IsValid(),
+		!q.CreatedAfter.IsZero() && !s.DateCreated.After(q.CreatedAfter),
+		!q.CreatedBefore.IsZero() && !s.DateCreated.Before(q.CreatedBefore):
+		return false
+	}
+	return true
+}
+
+// Apply filters, sorts and paginates shares according to q. It is used by
+// backends once they have retrieved shares, which might already be filtered
+// by prefix.
+func (q *ShareQuery) Apply(shares []Share) (*SharePage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+	compare, _ := q.compare()
+
+	shares = slices.DeleteFunc(shares, func(s Share) bool { return !q.Match(&s) })
+
+	result := &SharePage{Total: len(shares)}
+
+	result.Shares, result.Next, err = paginate(shares, compare, shareKey, q.Limit, q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ByName returns true if q sorts shares by name and is limited, so backends
+// listing share names before reading their metadata can use ApplyNames
+func (q *ShareQuery) ByName() bool {
+	return q.Limit > 0 && strings.TrimPrefix(q.Sort, "-") == "name"
+}
+
+// filtersMetadata returns true if q filters shares on more than their name
+func (q *ShareQuery) filtersMetadata() bool {
+	return q.Owner != "" || q.Status != "" || q.Exposure != "" ||
+		!q.CreatedAfter.IsZero() || !q.CreatedBefore.IsZero()
+}
+
+// ApplyNames returns a page of shares according to q, a ByName query, among
+// shares named names. Metadata is read with get in name order, starting after
+// the cursor, and only until the page is filled. Total is -1 when q filters
+// shares on their metadata, as counting them would require reading every
+// share.
+func (q *ShareQuery) ApplyNames(names []string, get func(name string) (*Share, error)) (*SharePage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	names = slices.DeleteFunc(slices.Clone(names), func(n string) bool { return !strings.HasPrefix(n, q.Prefix) })
+	slices.Sort(names)
+	desc := strings.HasPrefix(q.Sort, "-")
+	if desc {
+		slices.Reverse(names)
+	}
+
+	result := &SharePage{Total: len(names)}
+	if q.filtersMetadata() {
+		result.Total = -1
+	}
+
+	if q.Cursor != "" {
+		var last Share
+		err = decodeCursor(q.Cursor, &last)
+		if err != nil {
+			return nil, err
+		}
+		names = slices.DeleteFunc(names, func(n string) bool {
+			return (!desc && n <= last.Name) || (desc && n >= last.Name)
+		})
+	}
+
+	shares := func(yield func(Share, error) bool) {
+		for _, n := range names {
+			s, err := get(n)
+			// Share was deleted after names were listed
+			if errors.Is(err, ErrShareNotFound) {
+				continue
+			}
+			if err != nil {
+				yield(Share{}, err)
+				return
+			}
+			if !yield(*s, nil) {
+				return
+			}
+		}
+	}
+
+	result.Shares, result.Next, err = paginateInOrder(shares, q.Match, shareKey, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// Validate checks q can be applied
+func (q *ItemQuery) Validate() error {
+	if q.Limit < 0 {
+		return fmt.Errorf("%w: negative limit", ErrInvalidQuery)
+	}
+	_, err := q.compare()
+	return err
+}
+
+func (q *ItemQuery) compare() (func(a, b *Item) int, error) {
+	return compareFunc(itemSorts, q.Sort, "-modified", func(i *Item) string { return path.Base(i.Path) })
+}
+
+// Match returns true if item i matches the filters of q
+func (q *ItemQuery) Match(i *Item) bool {
+	m := i.ItemInfo.DateModified
+	switch {
+	case q.Prefix != "" && !strings.HasPrefix(path.Base(i.Path), q.Prefix),
+		q.Names != nil && !slices.Contains(q.Names, path.Base(i.Path)),
+		!q.ModifiedAfter.IsZero() && !m.After(q.ModifiedAfter),
+		!q.ModifiedBefore.IsZero() && !m.Before(q.ModifiedBefore):
+		return false
+	}
+	return true
+}
+
+// Apply filters, sorts and paginates items according to q
+func (q *ItemQuery) Apply(items []Item) (*ItemPage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+	compare, _ := q.compare()
+
+	items = slices.DeleteFunc(items, func(i Item) bool { return !q.Match(&i) })
+
+	result := &ItemPage{Total: len(items)}
+
+	result.Items, result.Next, err = paginate(items, compare, itemKey, q.Limit, q.Cursor)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// InOrder returns true if q sorts items by ascending name and is limited, so
+// backends listing items in name order can use ApplyInOrder
+func (q *ItemQuery) InOrder() bool {
+	return q.Limit > 0 && q.Sort == "name"
+}
+
+// After returns the name of the last item of the previous page, listings
+// used with ApplyInOrder start after it
+func (q *ItemQuery) After() (string, error) {
+	if q.Cursor == "" {
+		return "", nil
+	}
+	var last Item
+	err := decodeCursor(q.Cursor, &last)
+	if err != nil {
+		return "", err
+	}
+	return path.Base(last.Path), nil
+}
+
+// ApplyInOrder returns a page of items according to q, an InOrder query.
+// items are listed in name order after After, and listing is stopped once the
+// page is filled. Total is -1 as items after the page are not listed.
+func (q *ItemQuery) ApplyInOrder(items iter.Seq2[Item, error]) (*ItemPage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &ItemPage{Total: -1}
+
+	result.Items, result.Next, err = paginateInOrder(items, q.Match, itemKey, q.Limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
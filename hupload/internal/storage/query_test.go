@@ -0,0 +1,370 @@
+package storage_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+func shareNames(shares []storage.Share) []string {
+	result := []string{}
+	for _, s := range shares {
+		result = append(result, s.Name)
+	}
+	return result
+}
+
+func TestShareQuery(t *testing.T) {
+	now := time.Now()
+	shares := func() []storage.Share {
+		return []storage.Share{
+			{Name: "a", Owner: "admin", DateCreated: now.AddDate(0, 0, -10), Size: 30, Count: 1, Options: storage.Options{Validity: 5, Exposure: "upload"}},
+			{Name: "b", Owner: "user", DateCreated: now.AddDate(0, 0, -1), Size: 10, Count: 3, Options: storage.Options{Validity: 5, Exposure: "download"}},
+			{Name: "ab", Owner: "admin", DateCreated: now, Size: 20, Count: 2, Options: storage.Options{Exposure: "both"}},
+			{Name: "c", Owner: "user", DateCreated: now.AddDate(0, 0, -2), Size: 20, Count: 0, Options: storage.Options{Exposure: "upload"}},
+		}
+	}
+
+	tests := []struct {
+		Name  string
+		Query storage.ShareQuery
+		Want  []string
+	}{
+		{"Default is newest first", storage.ShareQuery{}, []string{"ab", "b", "c", "a"}},
+		{"Sort by name", storage.ShareQuery{Sort: "name"}, []string{"a", "ab", "b", "c"}},
+		{"Sort by size, ties by name", storage.ShareQuery{Sort: "-size"}, []string{"a", "c", "ab", "b"}},
+		{"Sort by count", storage.ShareQuery{Sort: "count"}, []string{"c", "a", "ab", "b"}},
+		{"Sort by owner", storage.ShareQuery{Sort: "owner"}, []string{"a", "ab", "b", "c"}},
+		{"Owner", storage.ShareQuery{Owner: "user"}, []string{"b", "c"}},
+		{"Valid", storage.ShareQuery{Status: "valid", Sort: "name"}, []string{"ab", "b", "c"}},
+		{"Expired", storage.ShareQuery{Status: "expired"}, []string{"a"}},
+		{"Exposure", storage.ShareQuery{Exposure: "upload"}, []string{"c", "a"}},
+		{"Prefix", storage.ShareQuery{Prefix: "a"}, []string{"ab", "a"}},
+		{"Created range", storage.ShareQuery{CreatedAfter: now.AddDate(0, 0, -3), CreatedBefore: now.Add(-time.Hour)}, []string{"b", "c"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			page, err := test.Query.Apply(shares())
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if got := shareNames(page.Shares); !slices.Equal(got, test.Want) {
+				t.Errorf("Expected %v, got %v", test.Want, got)
+			}
+			if page.Total != len(test.Want) || page.Next != "" {
+				t.Errorf("Expected total %d and no next page, got %d and %q", len(test.Want), page.Total, page.Next)
+			}
+		})
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		q := storage.ShareQuery{Sort: "name", Limit: 3}
+		page, err := q.Apply(shares())
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if got := shareNames(page.Shares); !slices.Equal(got, []string{"a", "ab", "b"}) || page.Total != 4 || page.Next == "" {
+			t.Fatalf("Unexpected first page %v, total %d, next %q", got, page.Total, page.Next)
+		}
+
+		// Shares created or deleted between pages don't shift the next page
+		next := append(shares()[1:], storage.Share{Name: "aa"}, storage.Share{Name: "d"})
+
+		q.Cursor = page.Next
+		page, err = q.Apply(next)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if got := shareNames(page.Shares); !slices.Equal(got, []string{"c", "d"}) || page.Next != "" {
+			t.Errorf("Unexpected second page %v, next %q", got, page.Next)
+		}
+	})
+
+	t.Run("Invalid queries", func(t *testing.T) {
+		for _, q := range []storage.ShareQuery{
+			{Sort: "date"},
+			{Status: "old"},
+			{Limit: -1},
+			{Cursor: "not a cursor"},
+		} {
+			_, err := q.Apply(shares())
+			if !errors.Is(err, storage.ErrInvalidQuery) {
+				t.Errorf("Expected ErrInvalidQuery for %+v, got %v", q, err)
+			}
+		}
+	})
+}
+
+func TestShareQueryApplyNames(t *testing.T) {
+	now := time.Now()
+	shares := map[string]*storage.Share{
+		"a":  {Name: "a", Owner: "admin", DateCreated: now},
+		"ab": {Name: "ab", Owner: "user", DateCreated: now},
+		"b":  {Name: "b", Owner: "admin", DateCreated: now},
+		"c":  {Name: "c", Owner: "admin", DateCreated: now},
+		"d":  {Name: "d", Owner: "user", DateCreated: now},
+	}
+	names := []string{"d", "c", "b", "ab", "a", "deleted"}
+
+	reads := []string{}
+	get := func(name string) (*storage.Share, error) {
+		reads = append(reads, name)
+		s, ok := shares[name]
+		if !ok {
+			return nil, storage.ErrShareNotFound
+		}
+		return s, nil
+	}
+
+	t.Run("Only shares of the page are read", func(t *testing.T) {
+		reads = []string{}
+		q := storage.ShareQuery{Sort: "name", Limit: 2}
+		page, err := q.ApplyNames(names, get)
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if got := shareNames(page.Shares); !slices.Equal(got, []string{"a", "ab"}) || page.Total != 6 || page.Next == "" {
+			t.Errorf("Unexpected page %v, total %d, next %q", got, page.Total, page.Next)
+		}
+		if !slices.Equal(reads, []string{"a", "ab", "b"}) {
+			t.Errorf("Expected page and next share to be read, got %v", reads)
+		}
+
+		// Cursors are the same as Apply
+		q.Cursor = page.Next
+		page, err = q.Apply([]storage.Share{*shares["a"], *shares["ab"], *shares["b"], *shares["c"]})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if got := shareNames(page.Shares); !slices.Equal(got, []string{"b", "c"}) {
+			t.Errorf("Unexpected second page %v", got)
+		}
+	})
+
+	t.Run("Filters on metadata", func(t *testing.T) {
+		q := storage.ShareQuery{Owner: "admin", Sort: "-name", Limit: 2}
+		got := []string{}
+		for range 3 {
+			reads = []string{}
+			page, err := q.ApplyNames(names, get)
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if page.Total != -1 {
+				t.Errorf("Expected unknown total, got %d", page.Total)
+			}
+			got = append(got, shareNames(page.Shares)...)
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+		if !slices.Equal(got, []string{"c", "b", "a"}) {
+			t.Errorf("Unexpected shares %v", got)
+		}
+		if !slices.Equal(reads, []string{"ab", "a"}) {
+			t.Errorf("Expected last page to read shares after cursor, got %v", reads)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		q := storage.ShareQuery{Sort: "name", Limit: 2}
+		_, err := q.ApplyNames(names, func(name string) (*storage.Share, error) {
+			return nil, errors.New("read error")
+		})
+		if err == nil || err.Error() != "read error" {
+			t.Errorf("Expected read error, got %v", err)
+		}
+
+		q.Cursor = "not a cursor"
+		_, err = q.ApplyNames(names, get)
+		if !errors.Is(err, storage.ErrInvalidQuery) {
+			t.Errorf("Expected ErrInvalidQuery, got %v", err)
+		}
+	})
+}
+
+func TestItemQueryApplyInOrder(t *testing.T) {
+	items := []storage.Item{
+		{Path: "s/a.txt"},
+		{Path: "s/b.bin"},
+		{Path: "s/c.txt"},
+		{Path: "s/d.txt"},
+		{Path: "s/e.txt"},
+	}
+
+	q := storage.ItemQuery{Sort: "name", Limit: 2, Names: []string{"a.txt", "c.txt", "d.txt", "e.txt"}}
+	if !q.InOrder() {
+		t.Fatalf("Expected query to be served in order")
+	}
+
+	got := []string{}
+	listed := 0
+	for range 3 {
+		after, err := q.After()
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+
+		listed = 0
+		page, err := q.ApplyInOrder(func(yield func(storage.Item, error) bool) {
+			for _, i := range items {
+				if path.Base(i.Path) <= after {
+					continue
+				}
+				listed++
+				if !yield(i, nil) {
+					return
+				}
+			}
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %v", err)
+		}
+		if page.Total != -1 {
+			t.Errorf("Expected unknown total, got %d", page.Total)
+		}
+		for _, i := range page.Items {
+			got = append(got, i.Path)
+		}
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+
+	if !slices.Equal(got, []string{"s/a.txt", "s/c.txt", "s/d.txt", "s/e.txt"}) {
+		t.Errorf("Unexpected items %v", got)
+	}
+	if listed != 2 {
+		t.Errorf("Expected last page to list items after cursor only, got %d", listed)
+	}
+
+	// Only ascending names are listing order
+	for _, q := range []storage.ItemQuery{{Sort: "-name", Limit: 2}, {Sort: "name"}, {Limit: 2}} {
+		if q.InOrder() {
+			t.Errorf("Expected %+v not to be served in order", q)
+		}
+	}
+}
+
+func TestItemQuery(t *testing.T) {
+	now := time.Now()
+	items := []storage.Item{
+		{Path: "s/b.txt", ItemInfo: storage.ItemInfo{Size: 1, DateModified: now}},
+		{Path: "s/a.txt", ItemInfo: storage.ItemInfo{Size: 3, DateModified: now.Add(-time.Hour)}},
+		{Path: "s/c.bin", ItemInfo: storage.ItemInfo{Size: 2, DateModified: now.Add(-2 * time.Hour)}},
+	}
+
+	tests := []struct {
+		Name  string
+		Query storage.ItemQuery
+		Want  []string
+	}{
+		{"Default is newest first", storage.ItemQuery{}, []string{"s/b.txt", "s/a.txt", "s/c.bin"}},
+		{"Sort by name", storage.ItemQuery{Sort: "name"}, []string{"s/a.txt", "s/b.txt", "s/c.bin"}},
+		{"Sort by size", storage.ItemQuery{Sort: "-size"}, []string{"s/a.txt", "s/c.bin", "s/b.txt"}},
+		{"Prefix", storage.ItemQuery{Prefix: "c"}, []string{"s/c.bin"}},
+		{"Modified range", storage.ItemQuery{ModifiedAfter: now.Add(-90 * time.Minute), ModifiedBefore: now}, []string{"s/a.txt"}},
+		{"Names", storage.ItemQuery{Names: []string{"c.bin", "a.txt", "d.txt"}, Sort: "name"}, []string{"s/a.txt", "s/c.bin"}},
+		{"No names", storage.ItemQuery{Names: []string{}}, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			page, err := test.Query.Apply(slices.Clone(items))
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			got := []string{}
+			for _, i := range page.Items {
+				got = append(got, i.Path)
+			}
+			if !slices.Equal(got, test.Want) {
+				t.Errorf("Expected %v, got %v", test.Want, got)
+			}
+		})
+	}
+
+	t.Run("Pagination", func(t *testing.T) {
+		q := storage.ItemQuery{Limit: 2}
+		got := []string{}
+		for range 3 {
+			page, err := q.Apply(slices.Clone(items))
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			for _, i := range page.Items {
+				got = append(got, i.Path)
+			}
+			if page.Next == "" {
+				break
+			}
+			q.Cursor = page.Next
+		}
+		if !slices.Equal(got, []string{"s/b.txt", "s/a.txt", "s/c.bin"}) {
+			t.Errorf("Unexpected items %v", got)
+		}
+	})
+}
+
+func TestFileQuery(t *testing.T) {
+	t.Cleanup(func() {
+		os.RemoveAll("data")
+	})
+
+	f := createFileBackend(t)
+	ctx := context.Background()
+
+	for _, n := range []string{"query-a", "query-b", "other"} {
+		_, err := f.CreateShare(ctx, n, "admin", storage.DefaultOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := range 5 {
+		_, err := f.CreateItem(ctx, "query-a", fmt.Sprintf("item-%d", i), 1, bytes.NewReader([]byte("x")), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shares, err := f.QueryShares(ctx, storage.ShareQuery{Prefix: "query-", Sort: "-name"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if got := shareNames(shares.Shares); !slices.Equal(got, []string{"query-b", "query-a"}) {
+		t.Errorf("Unexpected shares %v", got)
+	}
+
+	items, err := f.QueryItems(ctx, "query-a", storage.ItemQuery{Sort: "name", Limit: 3})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(items.Items) != 3 || items.Total != 5 || items.Next == "" {
+		t.Fatalf("Unexpected page %+v", items)
+	}
+
+	items, err = f.QueryItems(ctx, "query-a", storage.ItemQuery{Sort: "name", Limit: 3, Cursor: items.Next})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if len(items.Items) != 2 || items.Items[0].Path != "query-a/item-3" || items.Next != "" {
+		t.Errorf("Unexpected page %+v", items)
+	}
+
+	_, err = f.QueryShares(ctx, storage.ShareQuery{Sort: "unknown"})
+	if !errors.Is(err, storage.ErrInvalidQuery) {
+		t.Errorf("Expected ErrInvalidQuery, got %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package storage
+
+// itemQuota returns the maximum number of bytes that can be written for an
+// item of size bytes in share, with limits in MB, 0 meaning no limit. The
+// result is 0 when there is no limit. It returns ErrMaxFileSizeReached or
+// ErrMaxShareSizeReached when size doesn't fit.
+//
+// Backends read one more byte than the returned value so items larger than
+// announced are detected with exceedsQuota.
+func itemQuota(maxFileMB, maxShareMB int64, share *Share, size int64) (int64, error) {
+	maxWrite := int64(0)
+
+	maxShare := maxShareMB * 1024 * 1024
+	if maxShare > 0 {
+		maxWrite = maxShare - share.Size
+		if maxWrite <= 0 {
+			return 0, ErrMaxShareSizeReached
+		}
+	}
+
+	maxItem := maxFileMB * 1024 * 1024
+	if maxItem > 0 {
+		if size > maxItem {
+			return 0, ErrMaxFileSizeReached
+		}
+		if maxWrite > maxItem || maxWrite == 0 {
+			maxWrite = maxItem
+		}
+	}
+
+	if maxWrite > 0 && size > maxWrite {
+		return 0, ErrMaxShareSizeReached
+	}
+
+	return maxWrite, nil
+}
+
+// exceedsQuota returns true if written bytes are more than maxWrite returned
+// by itemQuota
+func exceedsQuota(maxWrite, written int64) bool {
+	return maxWrite > 0 && written > maxWrite
+}
+
+// storedItemQuota is itemQuota for an item of size bytes which is already
+// counted in the size of share, like an object once it has been uploaded
+func storedItemQuota(maxFileMB, maxShareMB int64, share *Share, size int64) error {
+	_, err := itemQuota(maxFileMB, maxShareMB, &Share{Size: share.Size - size}, size)
+	return err
+}
@@ -0,0 +1,307 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// renamesPrefix is the location of records of renamed shares in backends.
+// It can't collide with shares as share names can't start with a dot.
+const renamesPrefix = ".hupload/renames"
+
+// maxRenameHops is the number of renames followed to find the current name
+// of a share renamed several times
+const maxRenameHops = 10
+
+// ErrShareRenamed is returned for the previous name of a renamed share once
+// its grace period is over
+var ErrShareRenamed = errors.New("share renamed")
+
+// ErrRenameIncomplete is returned by RenameShare with the renamed share when
+// objects of its previous name couldn't be deleted. They are reported by
+// Check, which deletes them when repairing.
+var ErrRenameIncomplete = errors.New("share renamed, objects of the previous name left over")
+
+// RenamedShare records that share From was renamed to Name. Requests to From
+// keep working until Until, which is zero when From stopped working
+// immediately.
+type RenamedShare struct {
+	From        string    `json:"from"`
+	Name        string    `json:"name"`
+	DateRenamed time.Time `json:"renamed"`
+	Until       time.Time `json:"until,omitzero"`
+}
+
+// Active returns true if requests to the previous name of the share still
+// work at t
+func (r *RenamedShare) Active(t time.Time) bool {
+	return t.Before(r.Until)
+}
+
+// end returns the time at which requests to the previous name of the share
+// stopped working
+func (r *RenamedShare) end() time.Time {
+	if r.Until.IsZero() {
+		return r.DateRenamed
+	}
+	return r.Until
+}
+
+// renameBackend is implemented by backends storing records of renamed shares
+type renameBackend interface {
+	GetRenamedShare(ctx context.Context, name string) (*RenamedShare, error)
+
+	// putRenamedShare creates or replaces the record of r.From
+	putRenamedShare(ctx context.Context, r *RenamedShare) error
+
+	// deleteRenamedShare removes the record of name if there is one
+	deleteRenamedShare(ctx context.Context, name string) error
+
+	// listRenamedShares returns the previous names of renamed shares
+	listRenamedShares(ctx context.Context) ([]string, error)
+}
+
+// recordRename records in b that share from was renamed to to, working until
+// until. A record of to is removed as the name is now used by a share.
+func recordRename(ctx context.Context, b renameBackend, from, to string, until time.Time) error {
+	r := &RenamedShare{
+		From:        from,
+		Name:        to,
+		DateRenamed: time.Now().UTC().Truncate(time.Second),
+	}
+	if !until.IsZero() {
+		r.Until = until.UTC().Truncate(time.Second)
+	}
+
+	err := b.putRenamedShare(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	return b.deleteRenamedShare(ctx, to)
+}
+
+// purgeRenamedShares implements Storage.PurgeRenamedShares for b. Records are
+// removed while their name is locked, so a share renamed again meanwhile
+// keeps its new record.
+func purgeRenamedShares(ctx context.Context, b renameBackend, locker Locker, before time.Time) ([]string, error) {
+	names, err := b.listRenamedShares(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, name := range names {
+		purged, err := purgeRenamedShare(ctx, b, locker, name, before)
+		if err != nil {
+			return result, err
+		}
+		if purged {
+			result = append(result, name)
+		}
+	}
+
+	return result, nil
+}
+
+// purgeRenamedShare removes the record of name if it stopped working before
+// before, and returns true if it was removed
+func purgeRenamedShare(ctx context.Context, b renameBackend, locker Locker, name string, before time.Time) (bool, error) {
+	ctx, unlock, err := locker.Lock(ctx, name)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	r, err := b.GetRenamedShare(ctx, name)
+	if errors.Is(err, ErrShareNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if !r.end().Before(before) {
+		return false, nil
+	}
+
+	return true, b.deleteRenamedShare(ctx, name)
+}
+
+// renamePath returns the path of the record of share name relative to the
+// root of a backend
+func renamePath(name string) string {
+	return path.Join(renamesPrefix, name+".json")
+}
+
+// lockShares locks shares a and b with l in a consistent order, so operations
+// locking the same shares concurrently can't deadlock, or only a if both are
+// the same share. The context returned is canceled if any of the locks is
+// lost.
+func lockShares(ctx context.Context, l Locker, a, b string) (context.Context, func(), error) {
+	if a == b {
+		return l.Lock(ctx, a)
+	}
+
+	names := []string{a, b}
+	slices.Sort(names)
+
+	ctx, first, err := l.Lock(ctx, names[0])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ctx, second, err := l.Lock(ctx, names[1])
+	if err != nil {
+		first()
+		return nil, nil, err
+	}
+
+	return ctx, func() {
+		second()
+		first()
+	}, nil
+}
+
+// ResolveShare returns the current name of share name in s, following renames
+// within their grace period. It returns name if there is no such share and it
+// was never renamed, and ErrShareRenamed once the grace period of a rename
+// is over.
+func ResolveShare(ctx context.Context, s Storage, name string) (string, error) {
+	current := name
+	now := time.Now()
+
+	for range maxRenameHops {
+		_, err := s.GetShare(ctx, current)
+		if !errors.Is(err, ErrShareNotFound) {
+			return current, err
+		}
+
+		r, err := s.GetRenamedShare(ctx, current)
+		if errors.Is(err, ErrShareNotFound) {
+			return name, nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if !r.Active(now) {
+			return "", ErrShareRenamed
+		}
+		current = r.Name
+	}
+
+	return name, nil
+}
+
+// copyBackend is implemented by object storage backends that copy objects
+// server side
+type copyBackend interface {
+	objectBackend
+
+	// copyKey copies object from of size bytes to object to
+	copyKey(ctx context.Context, from, to string, size int64) error
+}
+
+// renameObjectShare implements Storage.RenameShare for object storage
+// backends. Objects can't be renamed, they are copied to the new name, which
+// is removed if the rename fails before it is recorded. The previous share is
+// then deleted, its metadata first so its name is only resolved with the
+// record, and objects left over are returned with ErrRenameIncomplete.
+func renameObjectShare(ctx context.Context, b copyBackend, locker Locker, from, to string, until time.Time) (*Share, error) {
+	if !IsShareNameSafe(from) || !IsShareNameSafe(to) {
+		return nil, ErrInvalidShareName
+	}
+	if from == to {
+		return nil, fmt.Errorf("%w : %s", ErrShareAlreadyExists, to)
+	}
+
+	ctx, unlock, err := lockShares(ctx, locker, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	share, _, err := b.getMetadata(ctx, from)
+	if err != nil {
+		return nil, err
+	}
+
+	_, _, err = b.getMetadata(ctx, to)
+	if err == nil {
+		return nil, fmt.Errorf("%w : %s", ErrShareAlreadyExists, to)
+	}
+	if !errors.Is(err, ErrShareNotFound) {
+		return nil, err
+	}
+
+	// Items and versions
+	objects, err := b.listKeys(ctx, from+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	// rollback deletes objects written for the new name, newest first so
+	// its metadata goes before its items, and returns cause with the
+	// objects that couldn't be deleted. It doesn't stop if a lock is lost,
+	// the objects would be left over otherwise.
+	written := []string{}
+	rollback := func(cause error) error {
+		ctx := context.WithoutCancel(ctx)
+		errs := []error{cause}
+		for _, key := range slices.Backward(written) {
+			err := b.deleteKey(ctx, key)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("cannot delete %s: %w", key, err))
+			}
+		}
+		return errors.Join(errs...)
+	}
+
+	for _, o := range objects {
+		key := to + "/" + strings.TrimPrefix(o.Path, from+"/")
+		err = b.copyKey(ctx, o.Path, key, o.ItemInfo.Size)
+		if err != nil {
+			return nil, rollback(err)
+		}
+		written = append(written, key)
+	}
+
+	share.Name = to
+	err = b.putMetadata(ctx, share, "")
+	if err != nil {
+		return nil, rollback(err)
+	}
+	written = append(written, path.Join("shares", to, ".metadata"))
+
+	err = recordRename(ctx, b, from, to, until)
+	if err != nil {
+		// The record may have been written before the error
+		written = append(written, renamePath(from))
+		return nil, rollback(err)
+	}
+	b.indexShare(ctx, to, share)
+
+	// The share is renamed. Objects are only deleted once its metadata is,
+	// so the previous share never loses items while it can be requested.
+	key := path.Join("shares", from, ".metadata")
+	err = b.deleteKey(ctx, key)
+	if err != nil {
+		return share, fmt.Errorf("%w: cannot delete %s: %w", ErrRenameIncomplete, key, err)
+	}
+	b.indexShare(ctx, from, nil)
+
+	for _, o := range objects {
+		err = b.deleteKey(ctx, o.Path)
+		if err != nil {
+			return share, fmt.Errorf("%w: cannot delete %s: %w", ErrRenameIncomplete, o.Path, err)
+		}
+	}
+
+	return share, nil
+}
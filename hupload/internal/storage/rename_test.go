@@ -0,0 +1,211 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"maps"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryObjectBackend is a copyBackend keeping objects in memory. Reads and
+// writes of keys of fail, and deletes of keys of failDelete, return the
+// error.
+type memoryObjectBackend struct {
+	objects    map[string][]byte
+	fail       map[string]error
+	failDelete map[string]error
+}
+
+func newMemoryObjectBackend() *memoryObjectBackend {
+	return &memoryObjectBackend{
+		objects:    map[string][]byte{},
+		fail:       map[string]error{},
+		failDelete: map[string]error{},
+	}
+}
+
+func (m *memoryObjectBackend) get(key string) ([]byte, error) {
+	if err := m.fail[key]; err != nil {
+		return nil, err
+	}
+	content, ok := m.objects[key]
+	if !ok {
+		return nil, ErrShareNotFound
+	}
+	return content, nil
+}
+
+func (m *memoryObjectBackend) put(key string, v any) error {
+	if err := m.fail[key]; err != nil {
+		return err
+	}
+	j, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	m.objects[key] = j
+	return nil
+}
+
+func (m *memoryObjectBackend) getMetadata(ctx context.Context, name string) (*Share, string, error) {
+	j, err := m.get(path.Join("shares", name, ".metadata"))
+	if err != nil {
+		return nil, "", err
+	}
+	result := NewShare()
+	return result, "", json.Unmarshal(j, result)
+}
+
+func (m *memoryObjectBackend) putMetadata(ctx context.Context, share *Share, etag string) error {
+	return m.put(path.Join("shares", share.Name, ".metadata"), share)
+}
+
+func (m *memoryObjectBackend) GetRenamedShare(ctx context.Context, name string) (*RenamedShare, error) {
+	j, err := m.get(renamePath(name))
+	if err != nil {
+		return nil, err
+	}
+	result := &RenamedShare{}
+	return result, json.Unmarshal(j, result)
+}
+
+func (m *memoryObjectBackend) putRenamedShare(ctx context.Context, r *RenamedShare) error {
+	return m.put(renamePath(r.From), r)
+}
+
+func (m *memoryObjectBackend) deleteRenamedShare(ctx context.Context, name string) error {
+	return m.deleteKey(ctx, renamePath(name))
+}
+
+func (m *memoryObjectBackend) listRenamedShares(ctx context.Context) ([]string, error) {
+	return nil, nil
+}
+
+func (m *memoryObjectBackend) listKeys(ctx context.Context, prefix string) ([]Item, error) {
+	result := []Item{}
+	for _, key := range slices.Sorted(maps.Keys(m.objects)) {
+		if strings.HasPrefix(key, prefix) {
+			result = append(result, Item{Path: key, ItemInfo: ItemInfo{Size: int64(len(m.objects[key]))}})
+		}
+	}
+	return result, nil
+}
+
+func (m *memoryObjectBackend) deleteKey(ctx context.Context, key string) error {
+	if err := m.failDelete[key]; err != nil {
+		return err
+	}
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memoryObjectBackend) copyKey(ctx context.Context, from, to string, size int64) error {
+	if err := m.fail[to]; err != nil {
+		return err
+	}
+	m.objects[to] = m.objects[from]
+	return nil
+}
+
+func (m *memoryObjectBackend) indexShare(ctx context.Context, name string, share *Share) {}
+
+// keys returns the keys of m, without records of renamed shares
+func (m *memoryObjectBackend) keys() []string {
+	result := []string{}
+	for _, key := range slices.Sorted(maps.Keys(m.objects)) {
+		if !strings.HasPrefix(key, renamesPrefix) {
+			result = append(result, key)
+		}
+	}
+	return result
+}
+
+func TestRenameObjectShare(t *testing.T) {
+	ctx := context.Background()
+	errFailed := errors.New("failed")
+
+	newBackend := func(t *testing.T) *memoryObjectBackend {
+		t.Helper()
+		b := newMemoryObjectBackend()
+		share := NewShare().WithName("from")
+		share.Size, share.Count = 2, 2
+		err := b.putMetadata(ctx, share, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b.objects["from/a.txt"] = []byte("a")
+		b.objects["from/b.txt"] = []byte("b")
+		return b
+	}
+	before := []string{"from/a.txt", "from/b.txt", "shares/from/.metadata"}
+
+	t.Run("Failed copies are rolled back", func(t *testing.T) {
+		b := newBackend(t)
+		b.fail["to/b.txt"] = errFailed
+
+		_, err := renameObjectShare(ctx, b, &LocalLocker{}, "from", "to", time.Time{})
+		if !errors.Is(err, errFailed) {
+			t.Errorf("Expected copy error, got %v", err)
+		}
+		if got := b.keys(); !slices.Equal(got, before) {
+			t.Errorf("Expected %v, got %v", before, got)
+		}
+	})
+
+	t.Run("Failed records are rolled back", func(t *testing.T) {
+		b := newBackend(t)
+		b.fail[renamePath("from")] = errFailed
+
+		_, err := renameObjectShare(ctx, b, &LocalLocker{}, "from", "to", time.Time{})
+		if !errors.Is(err, errFailed) {
+			t.Errorf("Expected record error, got %v", err)
+		}
+		if got := b.keys(); !slices.Equal(got, before) {
+			t.Errorf("Expected %v, got %v", before, got)
+		}
+	})
+
+	t.Run("Failed rollbacks are returned", func(t *testing.T) {
+		b := newBackend(t)
+		b.fail["to/b.txt"] = errFailed
+		b.failDelete["to/a.txt"] = errFailed
+
+		_, err := renameObjectShare(ctx, b, &LocalLocker{}, "from", "to", time.Time{})
+		if !errors.Is(err, errFailed) || !strings.Contains(err.Error(), "cannot delete to/a.txt") {
+			t.Errorf("Expected rollback error, got %v", err)
+		}
+	})
+
+	t.Run("Objects left over are reported and deleted by Check", func(t *testing.T) {
+		b := newBackend(t)
+		b.failDelete["from/b.txt"] = errFailed
+
+		share, err := renameObjectShare(ctx, b, &LocalLocker{}, "from", "to", time.Time{})
+		if !errors.Is(err, ErrRenameIncomplete) || share == nil || share.Name != "to" {
+			t.Errorf("Expected renamed share with ErrRenameIncomplete, got %+v %v", share, err)
+		}
+
+		_, _, err = b.getMetadata(ctx, "from")
+		if !errors.Is(err, ErrShareNotFound) {
+			t.Errorf("Expected previous share to be deleted, got %v", err)
+		}
+
+		delete(b.failDelete, "from/b.txt")
+		report, err := checkObjects(ctx, b, &LocalLocker{}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Problems) != 1 || report.Problems[0].Kind != ProblemOrphan || report.Problems[0].Path != "from/b.txt" || !report.Problems[0].Repaired {
+			t.Errorf("Expected repaired left over object, got %+v", report.Problems)
+		}
+		want := []string{"shares/to/.metadata", "to/a.txt", "to/b.txt"}
+		if got := b.keys(); !slices.Equal(got, want) {
+			t.Errorf("Expected %v, got %v", want, got)
+		}
+	})
+}
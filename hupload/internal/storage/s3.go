@@ -7,9 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"iter"
 	"net/http"
+	"net/url"
 	"path"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
@@ -17,6 +20,7 @@ import (
 	"github.com/aws/aws-sdk-go-v2/credentials"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
 // S3StorageConfig is the configuration structure for the s3 backend
@@ -34,6 +38,10 @@ type S3StorageConfig struct {
 
 	MaxFileSize  int64 `yaml:"max_file_mb"`
 	MaxShareSize int64 `yaml:"max_share_mb"`
+
+	// MetadataIndex keeps the metadata of every share in a single object so
+	// listing shares doesn't read each share metadata
+	MetadataIndex bool `yaml:"metadata_index,omitempty"`
 }
 
 // FileBackend is a backend that stores files on the filesystem
@@ -45,12 +53,17 @@ type S3Backend struct {
 	DefaultValidityDays int
 
 	Client *s3.Client
+
+	// locker serializes metadata updates of shares, conditional writes
+	// protect them from instances using another Locker
+	locker Locker
 }
 
 // NewFileStorage creates a new FileBackend with the provided options o
 func NewS3Storage(o S3StorageConfig) *S3Backend {
 	r := S3Backend{
 		Options: o,
+		locker:  &LocalLocker{},
 	}
 
 	err := r.initialize()
@@ -61,6 +74,12 @@ func NewS3Storage(o S3StorageConfig) *S3Backend {
 	return &r
 }
 
+// SetLocker sets the Locker serializing metadata updates of shares. It must
+// be set before the backend is used.
+func (b *S3Backend) SetLocker(l Locker) {
+	b.locker = l
+}
+
 func (b *S3Backend) initialize() error {
 	c, err := config.LoadDefaultConfig(
 		context.Background(),
@@ -97,10 +116,57 @@ func (b *S3Backend) initialize() error {
 	return nil
 }
 
-// Migrate will be called at initialization to give an opportunity to
-// the backend to migrate data from a previous version to the current one
+// Migrate upgrades the metadata of shares to MetadataVersion
 func (b *S3Backend) Migrate() error {
-	return nil
+	return migrate(context.Background(), b, b.locker)
+}
+
+// listMetadata returns the names of shares with metadata
+func (b *S3Backend) listMetadata(ctx context.Context) ([]string, error) {
+	objects, err := b.listKeys(ctx, "shares/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, o := range objects {
+		parts := strings.Split(o.Path, "/")
+		if len(parts) == 3 && parts[2] == ".metadata" && IsShareNameSafe(parts[1]) {
+			result = append(result, parts[1])
+		}
+	}
+
+	return result, nil
+}
+
+// readSchema returns the schema marker, or nil if there is none
+func (b *S3Backend) readSchema(ctx context.Context) ([]byte, error) {
+	key := schemaKey
+	output, err := b.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var bne *types.NoSuchKey
+		if errors.As(err, &bne) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	return io.ReadAll(output.Body)
+}
+
+// writeSchema writes the schema marker
+func (b *S3Backend) writeSchema(ctx context.Context, j []byte) error {
+	key := schemaKey
+	_, err := b.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(j),
+	})
+	return err
 }
 
 // CreateShare creates a new share
@@ -121,75 +187,165 @@ func (b *S3Backend) CreateShare(ctx context.Context, name, owner string, options
 	share := NewShare().
 		WithName(name).
 		WithOwner(owner).
-		WithOptions(options).
 		WithDateCreated(time.Now())
+	share.updateOptions(options)
 
-	path := path.Join("shares", name, ".metadata")
-	j := bytes.NewBuffer([]byte{})
-	err = json.NewEncoder(j).Encode(share)
+	err = b.putMetadata(ctx, share, "")
 	if err != nil {
 		return nil, err
 	}
 
-	_, err = b.Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &b.Options.Bucket,
-		Key:    &path,
-		Body:   j,
-		Metadata: map[string]string{
-			"metadata": "true",
-			"owner":    owner,
-			"name":     name,
-		},
-	})
+	b.indexShare(ctx, name, share)
+
+	return share, nil
+}
+
+// UpdateShare updates an existing share
+func (b *S3Backend) UpdateShare(ctx context.Context, name string, options *Options, downloads *map[string]int64) (*Options, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
 
+	ctx, unlock, err := b.locker.Lock(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	return share, nil
+	share, err := updateShareMetadata(ctx, b, name, func(share *Share) error {
+		if options != nil {
+			share.updateOptions(*options)
+		}
+
+		if downloads != nil {
+			share.Downloads = *downloads
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.indexShare(ctx, name, share)
+
+	return &share.Options, nil
 }
 
-// UpdateShare updates an existing share
-func (b *S3Backend) UpdateShare(ctx context.Context, name string, options *Options, downloads *map[string]int64) (*Options, error) {
+// ReserveDownloads counts a download of items of share by a guest before it
+// is served
+func (b *S3Backend) ReserveDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(ctx, name, func(s *Share) error { return s.reserveDownloads(items) })
+}
+
+// ReleaseDownloads uncounts a download of items of share by a guest that
+// didn't complete
+func (b *S3Backend) ReleaseDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(ctx, name, func(s *Share) error { return s.releaseDownloads(items) })
+}
+
+// AddDownloads counts a complete download of items of share
+func (b *S3Backend) AddDownloads(ctx context.Context, name string, items []string) (*Share, error) {
+	return b.updateDownloads(ctx, name, func(s *Share) error { return s.addDownloads(items) })
+}
+
+// updateDownloads applies update to the metadata of share name while it is
+// locked
+func (b *S3Backend) updateDownloads(ctx context.Context, name string, update func(*Share) error) (*Share, error) {
 	if !IsShareNameSafe(name) {
 		return nil, ErrInvalidShareName
 	}
 
-	share, err := b.GetShare(ctx, name)
+	ctx, unlock, err := b.locker.Lock(ctx, name)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	if options != nil {
-		share.Options = *options
+	share, err := updateShareMetadata(ctx, b, name, update)
+	if err != nil {
+		return nil, err
 	}
 
-	if downloads != nil {
-		share.Downloads = *downloads
+	b.indexShare(ctx, name, share)
+
+	return share, nil
+}
+
+// SetItemMetadata replaces the metadata of item of share
+func (b *S3Backend) SetItemMetadata(ctx context.Context, share, item string, metadata ItemMetadata) (*Item, error) {
+	if !IsShareNameSafe(share) {
+		return nil, ErrInvalidShareName
 	}
 
-	path := path.Join("shares", name, ".metadata")
-	j := bytes.NewBuffer([]byte{})
-	err = json.NewEncoder(j).Encode(share)
+	if !isItemNameSafe(item) {
+		return nil, ErrInvalidItemName
+	}
+
+	ctx, unlock, err := b.locker.Lock(ctx, share)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	_, err = b.Client.PutObject(ctx, &s3.PutObjectInput{
-		Bucket: &b.Options.Bucket,
-		Key:    &path,
-		Body:   j,
+	_, err = b.GetItem(ctx, share, item)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := updateShareMetadata(ctx, b, share, func(s *Share) error {
+		s.setItemMetadata(item, metadata)
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.indexShare(ctx, share, s)
+
+	return b.GetItem(ctx, share, item)
+}
+
+// RestoreShare writes the metadata of share as is, creating the share if it
+// doesn't exist
+func (b *S3Backend) RestoreShare(ctx context.Context, share *Share) (*Share, error) {
+	if !IsShareNameSafe(share.Name) {
+		return nil, ErrInvalidShareName
+	}
 
+	ctx, unlock, err := b.locker.Lock(ctx, share.Name)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	return &share.Options, nil
+	// Compute size and count from items
+	items, err := b.listObjects(ctx, share.Name, "")
+	if err != nil {
+		return nil, err
+	}
+	versions, err := listObjectVersions(ctx, b, share.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	result := restoredShare(share)
+	result.Size, result.Count = shareSize(items, versions)
+
+	// Metadata is replaced as is, concurrent updates are applied again on
+	// top of it as their conditional writes fail
+	err = b.putMetadata(ctx, result, "")
+	if err != nil {
+		return nil, err
+	}
+
+	b.indexShare(ctx, share.Name, result)
+
+	return result, nil
 }
 
 // CreateItem creates a new item in a share
-func (b *S3Backend) CreateItem(ctx context.Context, name, item string, size int64, r io.Reader) (*Item, error) {
+func (b *S3Backend) CreateItem(ctx context.Context, name, item string, size int64, r io.Reader, metadata *ItemMetadata) (*Item, error) {
 	if !IsShareNameSafe(name) {
 		return nil, ErrInvalidShareName
 	}
@@ -203,40 +359,46 @@ func (b *S3Backend) CreateItem(ctx context.Context, name, item string, size int6
 	}
 
 	// Check amount of free capacity in share according to current limits
-	maxWrite := int64(0)
-
-	maxShare := b.Options.MaxShareSize * 1024 * 1024
-	if maxShare > 0 {
-		maxWrite = maxShare - share.Size
-		if maxWrite <= 0 {
-			return nil, ErrMaxShareSizeReached
-		}
+	maxWrite, err := itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, share, size)
+	if err != nil {
+		return nil, err
 	}
 
-	maxItem := b.Options.MaxFileSize * 1024 * 1024
-	if maxItem > 0 {
-		if maxItem < size {
-			return nil, ErrMaxFileSizeReached
-		}
-		if maxWrite > maxItem || maxWrite == 0 {
-			maxWrite = maxItem
+	item, err = share.Options.itemName(item, func(n string) (bool, error) {
+		_, err := b.GetItem(ctx, name, n)
+		if errors.Is(err, ErrItemNotFound) {
+			return false, nil
 		}
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	// maxWrite is the actual allowed size for the item, so we fix the limit
-	// to one more byte
-	if maxWrite > 0 {
-		maxWrite++
+	// The current content is copied to a version before it is replaced, the
+	// share stays locked until the metadata is updated so the item can't
+	// change in the meantime
+	var unlock func()
+	version := ""
+	if share.Options.Conflict == ConflictVersion {
+		ctx, unlock, err = b.locker.Lock(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
 
-		if maxWrite < size {
-			return nil, ErrMaxShareSizeReached
+		version, err = b.copyVersion(ctx, name, item)
+		if err != nil {
+			return nil, err
 		}
 	}
+
 	src := r
 
-	// Substitute bufio.Reader with a limited reader
+	// Substitute bufio.Reader with a limited reader, reading one more byte
+	// than allowed to detect items larger than announced
 	if maxWrite != 0 {
-		src = io.LimitReader(r, maxWrite)
+		src = io.LimitReader(r, maxWrite+1)
 	}
 
 	path := path.Join(name, item)
@@ -246,16 +408,54 @@ func (b *S3Backend) CreateItem(ctx context.Context, name, item string, size int6
 		Body:          src,
 		ContentLength: &size,
 	}
+
+	// Items created concurrently with the same name are not replaced
+	if share.Options.Conflict == ConflictReject || share.Options.Conflict == ConflictRename {
+		input.IfNoneMatch = aws.String("*")
+	}
+
 	_, err = b.Client.PutObject(ctx, input) // s3.WithAPIOptions(
 	// 	v4.AddUnsignedPayloadMiddleware,
 	// 	v4.RemoveComputePayloadSHA256Middleware,
 	// ),
 
 	if err != nil {
+		if version != "" {
+			_ = b.deleteKey(ctx, version)
+		}
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "PreconditionFailed", "ConditionalRequestConflict":
+				return nil, fmt.Errorf("%w : %s", ErrItemAlreadyExists, item)
+			}
+		}
 		return nil, err
 	}
 
-	err = b.updateMetadata(ctx, name)
+	if unlock == nil {
+		ctx, unlock, err = b.locker.Lock(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
+
+	err = b.refreshMetadata(ctx, name, func(s *Share) error {
+		// Another upload might have filled the share in the meantime
+		err := storedItemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, s, size)
+		if err != nil {
+			return err
+		}
+		if metadata != nil {
+			s.setItemMetadata(item, *metadata)
+		}
+		return nil
+	})
+	if errors.Is(err, ErrMaxShareSizeReached) {
+		_ = restoreObject(ctx, b, path, version)
+		return nil, err
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -268,157 +468,474 @@ func (b *S3Backend) CreateItem(ctx context.Context, name, item string, size int6
 	return result, nil
 }
 
-// CreateItem creates a new item in a share
-func (b *S3Backend) DeleteItem(ctx context.Context, share, item string) error {
-	if !IsShareNameSafe(share) {
-		return ErrInvalidShareName
-	}
-	if !isItemNameSafe(item) {
-		return ErrInvalidItemName
+// copyVersion copies item of share to a new version if it exists, and returns
+// the key of the version. The share lock must be held by the caller.
+func (b *S3Backend) copyVersion(ctx context.Context, share, item string) (string, error) {
+	current, err := b.GetItem(ctx, share, item)
+	if err != nil {
+		if errors.Is(err, ErrItemNotFound) {
+			return "", nil
+		}
+		return "", err
 	}
 
-	path := path.Join(share, item)
+	versions, err := objectItemVersions(ctx, b, share, item)
+	if err != nil {
+		return "", err
+	}
 
-	_, err := b.GetItem(ctx, share, item)
+	key := path.Join(share, versionPath(item, nextVersion(versions)))
+	err = b.copyKey(ctx, path.Join(share, item), key, current.ItemInfo.Size)
 	if err != nil {
+		return "", err
+	}
+
+	return key, nil
+}
+
+// maxCopySize is the size of the largest object S3 copies in one request
+const maxCopySize = 5 * 1024 * 1024 * 1024
+
+// copyPartSize is the size of the parts of larger objects, which are copied
+// with a multipart upload
+const copyPartSize = 512 * 1024 * 1024
+
+// copyKey copies object from of size bytes to object to
+func (b *S3Backend) copyKey(ctx context.Context, from, to string, size int64) error {
+	source := (&url.URL{Path: path.Join(b.Options.Bucket, from)}).EscapedPath()
+
+	if size <= maxCopySize {
+		_, err := b.Client.CopyObject(ctx, &s3.CopyObjectInput{
+			Bucket:     &b.Options.Bucket,
+			Key:        &to,
+			CopySource: &source,
+		})
 		return err
 	}
 
-	_, err = b.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+	upload, err := b.Client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
 		Bucket: &b.Options.Bucket,
-		Key:    &path,
+		Key:    &to,
 	})
-
 	if err != nil {
-		var bne *types.NoSuchKey
-		if errors.As(err, &bne) {
-			return ErrItemNotFound
-		}
 		return err
 	}
 
-	err = b.updateMetadata(ctx, share)
-	if err != nil {
+	abort := func(err error) error {
+		_, _ = b.Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   &b.Options.Bucket,
+			Key:      &to,
+			UploadId: upload.UploadId,
+		})
 		return err
 	}
 
+	parts := []types.CompletedPart{}
+	for start := int64(0); start < size; start += copyPartSize {
+		n := aws.Int32(int32(len(parts) + 1))
+		r := fmt.Sprintf("bytes=%d-%d", start, min(start+copyPartSize, size)-1)
+		output, err := b.Client.UploadPartCopy(ctx, &s3.UploadPartCopyInput{
+			Bucket:          &b.Options.Bucket,
+			Key:             &to,
+			UploadId:        upload.UploadId,
+			PartNumber:      n,
+			CopySource:      &source,
+			CopySourceRange: &r,
+		})
+		if err != nil {
+			return abort(err)
+		}
+		parts = append(parts, types.CompletedPart{ETag: output.CopyPartResult.ETag, PartNumber: n})
+	}
+
+	_, err = b.Client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          &b.Options.Bucket,
+		Key:             &to,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return abort(err)
+	}
+
 	return nil
 }
 
-// GetShare returns the share identified by share
-func (b *S3Backend) GetShare(ctx context.Context, name string) (*Share, error) {
-	if !IsShareNameSafe(name) {
+// CopyItem copies item of share to toItem of toShare with a server side copy.
+// Copies can't be conditional like uploads, so the destination share is
+// locked while its conflict policy is applied.
+func (b *S3Backend) CopyItem(ctx context.Context, share, item, toShare, toItem string) (*Item, error) {
+	if !IsShareNameSafe(share) || !IsShareNameSafe(toShare) {
 		return nil, ErrInvalidShareName
 	}
-	path := path.Join("shares", name, ".metadata")
-	output, err := b.Client.GetObject(ctx, &s3.GetObjectInput{
-		Bucket: &b.Options.Bucket,
-		Key:    &path,
-	})
+	if !isItemNameSafe(item) || !isItemNameSafe(toItem) {
+		return nil, ErrInvalidItemName
+	}
+
+	ctx, unlock, err := b.locker.Lock(ctx, toShare)
 	if err != nil {
-		var bne *types.NoSuchKey
-		if errors.As(err, &bne) {
-			return nil, ErrShareNotFound
-		}
 		return nil, err
 	}
+	defer unlock()
 
-	result := NewShare()
+	return b.copyItem(ctx, share, item, toShare, toItem, true)
+}
 
-	err = json.NewDecoder(output.Body).Decode(result)
+// MoveItem moves item of share to toItem of toShare. The item is copied then
+// deleted while both shares are locked, its versions are deleted.
+func (b *S3Backend) MoveItem(ctx context.Context, share, item, toShare, toItem string) (*Item, error) {
+	if !IsShareNameSafe(share) || !IsShareNameSafe(toShare) {
+		return nil, ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) || !isItemNameSafe(toItem) {
+		return nil, ErrInvalidItemName
+	}
+
+	ctx, unlock, err := lockShares(ctx, b.locker, share, toShare)
 	if err != nil {
 		return nil, err
 	}
+	defer unlock()
 
-	return result, nil
-}
-
-// ListShares returns the list of shares available
-func (b *S3Backend) ListShares(ctx context.Context) ([]Share, error) {
-	prefix := "shares/"
-	output, err := b.Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket: &b.Options.Bucket,
-		Prefix: &prefix,
-	})
+	result, err := b.copyItem(ctx, share, item, toShare, toItem, share != toShare)
 	if err != nil {
 		return nil, err
 	}
 
-	result := []Share{}
-	for _, item := range output.Contents {
-		gOutput, err := b.Client.GetObject(ctx, &s3.GetObjectInput{
-			Bucket: &b.Options.Bucket,
-			Key:    item.Key,
-		})
-		if err != nil {
-			return nil, err
-		}
-		share := NewShare()
-		err = json.NewDecoder(gOutput.Body).Decode(share)
-		if err != nil {
-			return nil, err
-		}
-		result = append(result, *share)
+	err = b.deleteKey(ctx, path.Join(share, item))
+	if err != nil {
+		return nil, fmt.Errorf("cannot delete %s after copy: %w", item, err)
 	}
 
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].DateCreated.After(result[j].DateCreated)
-	})
+	err = deleteObjectVersions(ctx, b, share, item)
+	if err != nil {
+		return nil, err
+	}
+
+	err = b.refreshMetadata(ctx, share, nil)
+	if err != nil {
+		return nil, err
+	}
 
 	return result, nil
 }
 
-// ListShare returns the list of items in a share
-func (b *S3Backend) ListShare(ctx context.Context, name string) ([]Item, error) {
-	if !IsShareNameSafe(name) {
-		return nil, ErrInvalidShareName
-	}
-	prefix := name + "/"
-	output, err := b.Client.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
-		Bucket: &b.Options.Bucket,
-		Prefix: &prefix,
-	})
+// copyItem copies item of share to toItem of toShare, the quota of toShare is
+// checked if quota is true. The lock of toShare must be held by the caller.
+func (b *S3Backend) copyItem(ctx context.Context, share, item, toShare, toItem string, quota bool) (*Item, error) {
+	source, err := b.GetItem(ctx, share, item)
 	if err != nil {
-		var bne *types.NoSuchKey
-		if errors.As(err, &bne) {
-			return nil, ErrShareNotFound
-		}
 		return nil, err
 	}
 
-	// Get current share downloads statistics
-	share, err := b.GetShare(ctx, name)
+	dest, err := b.GetShare(ctx, toShare)
 	if err != nil {
 		return nil, err
 	}
 
-	downloads := share.Downloads
-
-	result := []Item{}
-	for _, item := range output.Contents {
-		inputs := s3.HeadObjectInput{
-			Bucket: &b.Options.Bucket,
-			Key:    item.Key,
-		}
-
-		gOutput, err := b.Client.HeadObject(ctx, &inputs)
+	// Items moved within a share don't change its size
+	if quota {
+		_, err = itemQuota(b.Options.MaxFileSize, b.Options.MaxShareSize, dest, source.ItemInfo.Size)
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		item := &Item{
-			Path: *item.Key,
-			ItemInfo: ItemInfo{
-				Size:         *gOutput.ContentLength,
-				DateModified: *gOutput.LastModified,
-			},
+	name, err := dest.Options.copyItemName(share, item, toShare, toItem, func(n string) (bool, error) {
+		_, err := b.GetItem(ctx, toShare, n)
+		if errors.Is(err, ErrItemNotFound) {
+			return false, nil
 		}
+		return err == nil, err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The current content is copied to a version before it is replaced
+	version := ""
+	if dest.Options.Conflict == ConflictVersion {
+		version, err = b.copyVersion(ctx, toShare, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = b.copyKey(ctx, path.Join(share, item), path.Join(toShare, name), source.ItemInfo.Size)
+	if err != nil {
+		if version != "" {
+			_ = b.deleteKey(ctx, version)
+		}
+		// The item was deleted in the meantime
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchKey" {
+			return nil, ErrItemNotFound
+		}
+		return nil, err
+	}
+
+	err = b.refreshMetadata(ctx, toShare, func(s *Share) error {
+		s.replaceItemMetadata(name, source.Metadata)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return b.GetItem(ctx, toShare, name)
+}
+
+// CreateItem creates a new item in a share
+func (b *S3Backend) DeleteItem(ctx context.Context, share, item string) error {
+	if !IsShareNameSafe(share) {
+		return ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return ErrInvalidItemName
+	}
+
+	path := path.Join(share, item)
+
+	_, err := b.GetItem(ctx, share, item)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &path,
+	})
+
+	if err != nil {
+		var bne *types.NoSuchKey
+		if errors.As(err, &bne) {
+			return ErrItemNotFound
+		}
+		return err
+	}
+
+	// Versions are deleted with their item
+	err = deleteObjectVersions(ctx, b, share, item)
+	if err != nil {
+		return err
+	}
 
-		if d, ok := downloads[path.Base(item.Path)]; ok {
-			item.Downloads = d
+	err = b.updateMetadata(ctx, share, nil)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ListItemVersions returns the versions of item of share, oldest first
+func (b *S3Backend) ListItemVersions(ctx context.Context, share, item string) ([]ItemVersion, error) {
+	if !IsShareNameSafe(share) {
+		return nil, ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return nil, ErrInvalidItemName
+	}
+
+	versions, err := objectItemVersions(ctx, b, share, item)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(versions) == 0 {
+		_, err = b.GetItem(ctx, share, item)
+		if err != nil {
+			return nil, err
 		}
+	}
+
+	return versions, nil
+}
 
-		result = append(result, *item)
+// GetItemVersionData returns the content of version of item of share
+func (b *S3Backend) GetItemVersionData(ctx context.Context, share, item string, version int) (io.ReadCloser, error) {
+	if !IsShareNameSafe(share) {
+		return nil, ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return nil, ErrInvalidItemName
+	}
+
+	key := path.Join(share, versionPath(item, version))
+	output, err := b.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var bne *types.NoSuchKey
+		if errors.As(err, &bne) {
+			return nil, ErrVersionNotFound
+		}
+		return nil, err
+	}
+
+	return output.Body, nil
+}
+
+// DeleteItemVersion deletes version of item of share
+func (b *S3Backend) DeleteItemVersion(ctx context.Context, share, item string, version int) error {
+	if !IsShareNameSafe(share) {
+		return ErrInvalidShareName
+	}
+	if !isItemNameSafe(item) {
+		return ErrInvalidItemName
+	}
+
+	key := path.Join(share, versionPath(item, version))
+
+	// Deleting a missing object doesn't fail
+	_, err := b.Client.GetObjectAttributes(ctx, &s3.GetObjectAttributesInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+		ObjectAttributes: []types.ObjectAttributes{
+			types.ObjectAttributesObjectSize,
+		},
+	})
+	if err != nil {
+		var bne *types.NoSuchKey
+		if errors.As(err, &bne) {
+			return ErrVersionNotFound
+		}
+		return err
+	}
+
+	err = b.deleteKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	return b.updateMetadata(ctx, share, nil)
+}
+
+// GetShare returns the share identified by share
+func (b *S3Backend) GetShare(ctx context.Context, name string) (*Share, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	result, _, err := b.getMetadata(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// ListShares returns the list of shares available
+func (b *S3Backend) ListShares(ctx context.Context) ([]Share, error) {
+	if b.Options.MetadataIndex {
+		return listIndexedShares(ctx, b)
+	}
+
+	result, err := b.listSharesMetadata(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+
+	sortShares(result)
+
+	return result, nil
+}
+
+// QueryShares returns a page of shares matching q. Shares are read from the
+// metadata index when enabled. Otherwise only metadata of shares matching q
+// prefix is read, and only for shares of the page when sorted by name.
+func (b *S3Backend) QueryShares(ctx context.Context, q ShareQuery) (*SharePage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	var shares []Share
+	switch {
+	case b.Options.MetadataIndex:
+		shares, err = listIndexedShares(ctx, b)
+	case q.ByName():
+		names, err := b.listShareNames(ctx, q.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		return q.ApplyNames(names, func(name string) (*Share, error) {
+			return b.GetShare(ctx, name)
+		})
+	default:
+		shares, err = b.listSharesMetadata(ctx, q.Prefix)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Apply(shares)
+}
+
+// listShareNames returns the names of shares starting with prefix, without
+// reading their metadata
+func (b *S3Backend) listShareNames(ctx context.Context, prefix string) ([]string, error) {
+	objects, err := b.listKeys(ctx, "shares/"+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, o := range objects {
+		if path.Base(o.Path) == ".metadata" {
+			result = append(result, path.Base(path.Dir(o.Path)))
+		}
+	}
+
+	return result, nil
+}
+
+// listSharesMetadata reads the metadata of every share with a name starting
+// with prefix
+func (b *S3Backend) listSharesMetadata(ctx context.Context, prefix string) ([]Share, error) {
+	prefix = "shares/" + prefix
+	paginator := s3.NewListObjectsV2Paginator(b.Client, &s3.ListObjectsV2Input{
+		Bucket: &b.Options.Bucket,
+		Prefix: &prefix,
+	})
+
+	result := []Share{}
+	for paginator.HasMorePages() {
+		output, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, item := range output.Contents {
+			if path.Base(*item.Key) != ".metadata" {
+				continue
+			}
+			gOutput, err := b.Client.GetObject(ctx, &s3.GetObjectInput{
+				Bucket: &b.Options.Bucket,
+				Key:    item.Key,
+			})
+			if err != nil {
+				return nil, err
+			}
+			share := NewShare()
+			err = json.NewDecoder(gOutput.Body).Decode(share)
+			gOutput.Body.Close()
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, *share)
+		}
+	}
+
+	return result, nil
+}
+
+// ListShare returns the list of items in a share
+func (b *S3Backend) ListShare(ctx context.Context, name string) ([]Item, error) {
+	result, err := b.listItems(ctx, name, "")
+	if err != nil {
+		return nil, err
 	}
 
 	// Sort items by modification date, newest first
@@ -429,6 +946,163 @@ func (b *S3Backend) ListShare(ctx context.Context, name string) ([]Item, error)
 	return result, nil
 }
 
+// QueryItems returns a page of items in share name matching q. Only items
+// matching q prefix are listed, and listing stops once the page is filled
+// when sorted by name.
+func (b *S3Backend) QueryItems(ctx context.Context, name string, q ItemQuery) (*ItemPage, error) {
+	err := q.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if q.InOrder() {
+		after, err := q.After()
+		if err != nil {
+			return nil, err
+		}
+		items, err := b.itemsAfter(ctx, name, q.Prefix, after)
+		if err != nil {
+			return nil, err
+		}
+		return q.ApplyInOrder(items)
+	}
+
+	result, err := b.listItems(ctx, name, q.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return q.Apply(result)
+}
+
+// listItems returns items of share name with a name starting with prefix
+func (b *S3Backend) listItems(ctx context.Context, name, prefix string) ([]Item, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+	// Get current share downloads statistics
+	share, err := b.GetShare(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := b.listObjects(ctx, name, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range result {
+		result[i].Downloads = share.Downloads[path.Base(result[i].Path)]
+		result[i].Metadata = share.itemMetadata(path.Base(result[i].Path))
+	}
+
+	return result, nil
+}
+
+// itemsAfter lists items of share name with a name starting with prefix in
+// name order, after item after when it is set
+func (b *S3Backend) itemsAfter(ctx context.Context, name, prefix, after string) (iter.Seq2[Item, error], error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+	// Get current share downloads statistics
+	share, err := b.GetShare(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	start := ""
+	if after != "" {
+		start = name + "/" + after
+	}
+
+	return func(yield func(Item, error) bool) {
+		for o, err := range b.keys(ctx, name+"/"+prefix, start) {
+			if err != nil {
+				yield(Item{}, err)
+				return
+			}
+			n := strings.TrimPrefix(o.Path, name+"/")
+			if !isItemNameSafe(n) {
+				continue
+			}
+			o.Downloads = share.Downloads[n]
+			o.Metadata = share.itemMetadata(n)
+			if !yield(o, nil) {
+				return
+			}
+		}
+	}, nil
+}
+
+// listObjects returns items of share name with a name starting with prefix,
+// without reading share metadata. Versions of items are not returned.
+func (b *S3Backend) listObjects(ctx context.Context, name, prefix string) ([]Item, error) {
+	objects, err := b.listKeys(ctx, name+"/"+prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Item{}
+	for _, o := range objects {
+		if isItemNameSafe(strings.TrimPrefix(o.Path, name+"/")) {
+			result = append(result, o)
+		}
+	}
+
+	return result, nil
+}
+
+// listKeys returns objects with a key starting with prefix, Path being the
+// key of the object
+func (b *S3Backend) listKeys(ctx context.Context, prefix string) ([]Item, error) {
+	result := []Item{}
+	for o, err := range b.keys(ctx, prefix, "") {
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, o)
+	}
+
+	return result, nil
+}
+
+// keys lists objects with a key starting with prefix in key order, after key
+// after when it is set, Path being the key of the object. Listing stops with
+// the iteration.
+func (b *S3Backend) keys(ctx context.Context, prefix, after string) iter.Seq2[Item, error] {
+	return func(yield func(Item, error) bool) {
+		input := &s3.ListObjectsV2Input{
+			Bucket: &b.Options.Bucket,
+			Prefix: &prefix,
+		}
+		if after != "" {
+			input.StartAfter = &after
+		}
+		paginator := s3.NewListObjectsV2Paginator(b.Client, input)
+
+		for paginator.HasMorePages() {
+			output, err := paginator.NextPage(ctx)
+			if err != nil {
+				yield(Item{}, err)
+				return
+			}
+
+			for _, object := range output.Contents {
+				if !yield(Item{
+					Path: *object.Key,
+					ItemInfo: ItemInfo{
+						Size:         aws.ToInt64(object.Size),
+						DateModified: aws.ToTime(object.LastModified),
+					},
+				}, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
 // ListShare returns the list of items in a share
 func (b *S3Backend) DeleteShare(ctx context.Context, name string) error {
 	if !IsShareNameSafe(name) {
@@ -451,6 +1125,12 @@ func (b *S3Backend) DeleteShare(ctx context.Context, name string) error {
 		}
 	}
 
+	// Versions of items deleted in the meantime are left over
+	err = deleteObjectVersions(ctx, b, name, "")
+	if err != nil {
+		return err
+	}
+
 	path := path.Join("shares", name, ".metadata")
 
 	_, err = b.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
@@ -462,9 +1142,105 @@ func (b *S3Backend) DeleteShare(ctx context.Context, name string) error {
 		return err
 	}
 
+	b.indexShare(ctx, name, nil)
+
 	return nil
 }
 
+// RenameShare renames share name to to, objects of the share are copied to
+// the new name then deleted
+func (b *S3Backend) RenameShare(ctx context.Context, name, to string, until time.Time) (*Share, error) {
+	return renameObjectShare(ctx, b, b.locker, name, to, until)
+}
+
+// GetRenamedShare returns the record of the share previously named name
+func (b *S3Backend) GetRenamedShare(ctx context.Context, name string) (*RenamedShare, error) {
+	if !IsShareNameSafe(name) {
+		return nil, ErrInvalidShareName
+	}
+
+	key := renamePath(name)
+	output, err := b.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var bne *types.NoSuchKey
+		if errors.As(err, &bne) {
+			return nil, ErrShareNotFound
+		}
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	result := &RenamedShare{}
+	err = json.NewDecoder(output.Body).Decode(result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// putRenamedShare writes the record of r.From
+func (b *S3Backend) putRenamedShare(ctx context.Context, r *RenamedShare) error {
+	j, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	key := renamePath(r.From)
+	_, err = b.Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(j),
+	})
+	return err
+}
+
+// PurgeRenamedShares removes records of renamed shares which previous name
+// stopped working before before
+func (b *S3Backend) PurgeRenamedShares(ctx context.Context, before time.Time) ([]string, error) {
+	return purgeRenamedShares(ctx, b, b.locker, before)
+}
+
+// listRenamedShares returns the previous names of renamed shares
+func (b *S3Backend) listRenamedShares(ctx context.Context) ([]string, error) {
+	objects, err := b.listKeys(ctx, renamesPrefix+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, o := range objects {
+		if name, ok := strings.CutSuffix(path.Base(o.Path), ".json"); ok && IsShareNameSafe(name) {
+			result = append(result, name)
+		}
+	}
+
+	return result, nil
+}
+
+// deleteRenamedShare removes the record of name
+func (b *S3Backend) deleteRenamedShare(ctx context.Context, name string) error {
+	return b.deleteKey(ctx, renamePath(name))
+}
+
+// Check checks shares metadata against objects of the bucket, objects
+// outside any share are reported as orphans
+func (b *S3Backend) Check(ctx context.Context, repair bool) (*CheckReport, error) {
+	return checkObjects(ctx, b, b.locker, repair)
+}
+
+// deleteKey deletes object key
+func (b *S3Backend) deleteKey(ctx context.Context, key string) error {
+	_, err := b.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+	})
+	return err
+}
+
 // GetItem returns the item identified by share and item
 func (b *S3Backend) GetItem(ctx context.Context, s, item string) (*Item, error) {
 	if !IsShareNameSafe(s) {
@@ -503,6 +1279,7 @@ func (b *S3Backend) GetItem(ctx context.Context, s, item string) (*Item, error)
 			DateModified: *aOutput.LastModified,
 		},
 		Downloads: share.Downloads[item],
+		Metadata:  share.itemMetadata(item),
 	}
 
 	if aOutput.ObjectSize != nil {
@@ -540,45 +1317,285 @@ func (b *S3Backend) GetItemData(ctx context.Context, share, item string) (io.Rea
 	return aOutput.Body, err
 }
 
-func (b *S3Backend) updateMetadata(ctx context.Context, s string) error {
+// updateMetadata locks share s, computes its size and count from its items,
+// and applies update to its metadata if it is not nil
+func (b *S3Backend) updateMetadata(ctx context.Context, s string, update func(*Share) error) error {
 	if !IsShareNameSafe(s) {
 		return ErrInvalidShareName
 	}
 
-	c, err := b.ListShare(ctx, s)
+	ctx, unlock, err := b.locker.Lock(ctx, s)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	count := 0
-	capacity := int64(0)
-	for _, i := range c {
-		count += 1
-		capacity += i.ItemInfo.Size
+	return b.refreshMetadata(ctx, s, update)
+}
+
+// refreshMetadata computes size and count of share s from its items, and
+// applies update to its metadata if it is not nil. The metadata isn't written
+// if update returns an error. The share lock must be held by the caller.
+func (b *S3Backend) refreshMetadata(ctx context.Context, s string, update func(*Share) error) error {
+	// Items are listed again on every attempt, so a concurrent update
+	// can't be overwritten with a stale size
+	share, err := updateShareMetadata(ctx, b, s, func(share *Share) error {
+		items, err := b.listObjects(ctx, s, "")
+		if err != nil {
+			return err
+		}
+		versions, err := listObjectVersions(ctx, b, s)
+		if err != nil {
+			return err
+		}
+		share.Size, share.Count = shareSize(items, versions)
+		share.pruneItemMetadata(itemNames(items))
+		if update != nil {
+			return update(share)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
-	share, err := b.GetShare(ctx, s)
+	b.indexShare(ctx, s, share)
+
+	return nil
+}
+
+// getMetadata returns the metadata of share name and its ETag
+func (b *S3Backend) getMetadata(ctx context.Context, name string) (*Share, string, error) {
+	j, etag, err := b.readMetadata(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result := NewShare()
+	err = json.Unmarshal(j, result)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, etag, nil
+}
+
+// readMetadata returns the metadata of share name as stored and its ETag
+func (b *S3Backend) readMetadata(ctx context.Context, name string) ([]byte, string, error) {
+	key := path.Join("shares", name, ".metadata")
+	output, err := b.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var bne *types.NoSuchKey
+		if errors.As(err, &bne) {
+			return nil, "", ErrShareNotFound
+		}
+		return nil, "", err
+	}
+	defer output.Body.Close()
+
+	j, err := io.ReadAll(output.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return j, aws.ToString(output.ETag), nil
+}
+
+// putMetadata writes the metadata of share, with a conditional write on etag
+// unless it is empty
+func (b *S3Backend) putMetadata(ctx context.Context, share *Share, etag string) error {
+	j, err := json.Marshal(share)
 	if err != nil {
 		return err
 	}
-	share.Count = int64(count)
-	share.Size = capacity
 
-	j := bytes.NewBuffer([]byte{})
-	err = json.NewEncoder(j).Encode(share)
+	key := path.Join("shares", share.Name, ".metadata")
+	input := &s3.PutObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(j),
+		Metadata: map[string]string{
+			"metadata": "true",
+			"owner":    share.Owner,
+			"name":     share.Name,
+		},
+	}
+	if etag != "" {
+		input.IfMatch = &etag
+	}
+
+	_, err = b.Client.PutObject(ctx, input)
 	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "PreconditionFailed", "ConditionalRequestConflict":
+				return errMetadataConflict
+			case "NoSuchKey":
+				// The share has been deleted since metadata was read
+				return ErrShareNotFound
+			}
+		}
 		return err
 	}
 
-	path := path.Join("shares", s, ".metadata")
+	return nil
+}
 
-	_, err = b.Client.PutObject(ctx, &s3.PutObjectInput{
+// RebuildIndex rebuilds the metadata index if it is enabled
+func (b *S3Backend) RebuildIndex(ctx context.Context) error {
+	if !b.Options.MetadataIndex {
+		return nil
+	}
+	return rebuildIndex(ctx, b)
+}
+
+// indexShare updates share name in the metadata index if it is enabled
+func (b *S3Backend) indexShare(ctx context.Context, name string, share *Share) {
+	if b.Options.MetadataIndex {
+		updateIndex(ctx, b, name, share)
+	}
+}
+
+// getIndex returns the metadata index and its ETag
+func (b *S3Backend) getIndex(ctx context.Context) (*shareIndex, string, error) {
+	key := indexKey
+	output, err := b.Client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: &b.Options.Bucket,
-		Key:    &path,
-		Body:   j,
+		Key:    &key,
 	})
+	if err != nil {
+		var bne *types.NoSuchKey
+		if errors.As(err, &bne) {
+			return nil, "", errIndexNotFound
+		}
+		return nil, "", err
+	}
+	defer output.Body.Close()
 
+	result := &shareIndex{}
+	err = json.NewDecoder(output.Body).Decode(result)
 	if err != nil {
+		return nil, "", err
+	}
+	if result.Shares == nil {
+		result.Shares = map[string]Share{}
+	}
+
+	return result, aws.ToString(output.ETag), nil
+}
+
+// putIndex writes the metadata index with a conditional write on etag
+func (b *S3Backend) putIndex(ctx context.Context, index *shareIndex, etag string) error {
+	j, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	key := indexKey
+	input := &s3.PutObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(j),
+	}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = &etag
+	}
+
+	_, err = b.Client.PutObject(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "PreconditionFailed", "ConditionalRequestConflict":
+				return errIndexConflict
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// deleteIndex removes the metadata index
+func (b *S3Backend) deleteIndex(ctx context.Context) error {
+	key := indexKey
+	_, err := b.Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+	})
+	return err
+}
+
+// AcquireLease acquires lease name for holder until ttl from now, leases are
+// stored in the bucket so instances sharing it can coordinate
+func (b *S3Backend) AcquireLease(ctx context.Context, name, holder string, ttl time.Duration) (*Lease, error) {
+	return acquireLease(ctx, b, name, holder, ttl)
+}
+
+// ReleaseLease releases lease name if it is held by holder
+func (b *S3Backend) ReleaseLease(ctx context.Context, name, holder string) error {
+	return releaseLease(ctx, b, name, holder)
+}
+
+// getLease returns lease name and its ETag
+func (b *S3Backend) getLease(ctx context.Context, name string) (*Lease, string, error) {
+	key := path.Join(leasesPrefix, name+".json")
+	output, err := b.Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		var bne *types.NoSuchKey
+		if errors.As(err, &bne) {
+			return nil, "", errLeaseNotFound
+		}
+		return nil, "", err
+	}
+	defer output.Body.Close()
+
+	result := &Lease{}
+	err = json.NewDecoder(output.Body).Decode(result)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return result, aws.ToString(output.ETag), nil
+}
+
+// putLease writes lease with a conditional write on etag
+func (b *S3Backend) putLease(ctx context.Context, lease *Lease, etag string) error {
+	j, err := json.Marshal(lease)
+	if err != nil {
+		return err
+	}
+
+	key := path.Join(leasesPrefix, lease.Name+".json")
+	input := &s3.PutObjectInput{
+		Bucket: &b.Options.Bucket,
+		Key:    &key,
+		Body:   bytes.NewReader(j),
+	}
+	if etag == "" {
+		input.IfNoneMatch = aws.String("*")
+	} else {
+		input.IfMatch = &etag
+	}
+
+	_, err = b.Client.PutObject(ctx, input)
+	if err != nil {
+		var apiErr smithy.APIError
+		if errors.As(err, &apiErr) {
+			switch apiErr.ErrorCode() {
+			case "PreconditionFailed", "ConditionalRequestConflict", "NoSuchKey":
+				return errLeaseConflict
+			}
+		}
 		return err
 	}
 
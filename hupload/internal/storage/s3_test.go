@@ -9,11 +9,14 @@ import (
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/ybizeul/hupload/internal/storage"
+	"github.com/ybizeul/hupload/internal/storage/storagetest"
 )
 
-func createS3Backend(t *testing.T) *storage.S3Backend {
-	c := storage.S3StorageConfig{
+// s3Config returns the backend configuration for tests from environment
+func s3Config() storage.S3StorageConfig {
+	return storage.S3StorageConfig{
 		Endpoint:     os.Getenv("AWS_ENDPOINT_URL"),
 		Region:       os.Getenv("AWS_DEFAULT_REGION"),
 		AWSKey:       os.Getenv("AWS_ACCESS_KEY_ID"),
@@ -23,7 +26,13 @@ func createS3Backend(t *testing.T) *storage.S3Backend {
 		MaxFileSize:  4,
 		MaxShareSize: 5,
 	}
+}
+
+func createS3Backend(t *testing.T) *storage.S3Backend {
+	return createS3BackendWithConfig(t, s3Config())
+}
 
+func createS3BackendWithConfig(t *testing.T, c storage.S3StorageConfig) *storage.S3Backend {
 	f := storage.NewS3Storage(c)
 	if f == nil {
 		t.Errorf("Expected S3 Storage to be created")
@@ -32,6 +41,14 @@ func createS3Backend(t *testing.T) *storage.S3Backend {
 	return f
 }
 
+func TestS3Conformance(t *testing.T) {
+	storagetest.Run(t, func(t *testing.T, l storagetest.Limits) storage.Storage {
+		c := s3Config()
+		c.MaxFileSize, c.MaxShareSize = l.MaxFileSize, l.MaxShareSize
+		return createS3BackendWithConfig(t, c)
+	})
+}
+
 func TestS3CreateShare(t *testing.T) {
 	f := createS3Backend(t)
 
@@ -78,6 +95,45 @@ func TestS3UpdateShare(t *testing.T) {
 	}
 }
 
+func TestS3RestoreShare(t *testing.T) {
+	f := createS3Backend(t)
+
+	t.Cleanup(func() {
+		_ = f.DeleteShare(context.Background(), "Test")
+	})
+
+	created := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	share := storage.NewShare().
+		WithName("Test").
+		WithOwner("user").
+		WithDateCreated(created).
+		WithOptions(storage.DefaultOptions())
+	share.Downloads = map[string]int64{"test.txt": 1}
+
+	got, err := f.RestoreShare(context.Background(), share)
+	if err != nil {
+		t.Errorf("Expected no error, got %v", err)
+		return
+	}
+
+	if !reflect.DeepEqual(got, share) {
+		t.Errorf("Expected %+v, got %+v", share, got)
+	}
+}
+
+func TestS3Migrate(t *testing.T) {
+	f := createS3Backend(t)
+
+	testObjectMigrate(t, f, func(key string, b []byte) error {
+		_, err := f.Client.PutObject(context.Background(), &s3.PutObjectInput{
+			Bucket: &f.Options.Bucket,
+			Key:    &key,
+			Body:   bytes.NewReader(b),
+		})
+		return err
+	})
+}
+
 func TestCreateS3Item(t *testing.T) {
 	f := createS3Backend(t)
 
@@ -112,7 +168,7 @@ func TestCreateS3Item(t *testing.T) {
 
 		size := len(test.Bytes)
 		// Test create item
-		_, err = f.CreateItem(context.Background(), "Test", test.FileName, int64(size), b)
+		_, err = f.CreateItem(context.Background(), "Test", test.FileName, int64(size), b, nil)
 		if err != nil {
 			t.Errorf("Expected no error, got %v", err)
 		}
@@ -237,3 +293,15 @@ func TestS3ListShares(t *testing.T) {
 		t.Errorf("Expected shares to be %v, got %v", got, want)
 	}
 }
+
+func TestS3LargeListings(t *testing.T) {
+	t.Run("Without index", func(t *testing.T) {
+		testLargeListings(t, createS3Backend(t))
+	})
+
+	t.Run("With index", func(t *testing.T) {
+		c := s3Config()
+		c.MetadataIndex = true
+		testLargeListings(t, createS3BackendWithConfig(t, c))
+	})
+}
@@ -3,17 +3,54 @@ package storage
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"math"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"time"
 )
 
+// Options are the settings of a share. ExpiresAt is when the share expires,
+// Validity is the number of days from the creation of the share to ExpiresAt,
+// rounded up, for clients that only know about days. Zero values of both mean
+// the share never expires.
+//
+// Upload and download windows restrict when guests can upload and download
+// within the exposure of the share, zero times leaving them open on that
+// side.
+//
+// MaxDownloads limits the number of item downloads of the share, a share
+// download counting once per item, and MaxItemDownloads the number of
+// downloads of each item. Only downloads by guests are counted. Items of
+// shares with DeleteAfterDownload are deleted after their first complete
+// download by a guest.
+//
+// Fields are custom fields uploaders fill in the metadata of items.
+//
+// Conflict is the policy applied when an item is uploaded with the name of
+// an existing item, one of the Conflict constants.
 type Options struct {
-	Validity    int    `json:"validity,omitempty"`
-	Exposure    string `json:"exposure"`
-	Description string `json:"description,omitempty"`
-	Message     string `json:"message"`
+	Validity    int       `json:"validity,omitempty"`
+	ExpiresAt   time.Time `json:"expires_at,omitzero"`
+	Exposure    string    `json:"exposure"`
+	Description string    `json:"description,omitempty"`
+	Message     string    `json:"message"`
+
+	UploadOpensAt    time.Time `json:"upload_opens_at,omitzero"`
+	UploadClosesAt   time.Time `json:"upload_closes_at,omitzero"`
+	DownloadOpensAt  time.Time `json:"download_opens_at,omitzero"`
+	DownloadClosesAt time.Time `json:"download_closes_at,omitzero"`
+
+	MaxDownloads        int64 `json:"max_downloads,omitempty"`
+	MaxItemDownloads    int64 `json:"max_item_downloads,omitempty"`
+	DeleteAfterDownload bool  `json:"delete_after_download,omitempty"`
+
+	Fields []ItemField `json:"fields,omitempty"`
+
+	Conflict string `json:"conflict,omitempty"`
 }
 
 func DefaultOptions() Options {
@@ -34,11 +71,18 @@ type Share struct {
 	Count int64 `json:"count,omitempty"`
 
 	Downloads map[string]int64 `json:"downloads,omitempty"`
+
+	// GuestDownloads is the number of downloads by guests by item name,
+	// including downloads in progress, download limits apply to it
+	GuestDownloads map[string]int64 `json:"guest_downloads,omitempty"`
+
+	// Items is the metadata of items by name
+	Items map[string]ItemMetadata `json:"items,omitempty"`
 }
 
 func NewShare() *Share {
 	return &Share{
-		Version:   1,
+		Version:   MetadataVersion,
 		Downloads: map[string]int64{},
 	}
 }
@@ -74,45 +118,178 @@ func NewShareAtPath(p string) (*Share, error) {
 }
 
 func SaveShareAtPath(s *Share, p string) error {
-	f, err := os.Create(path.Join(p, ".metadata"))
+	j, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path.Join(p, ".metadata"), j)
+}
+
+// writeFileAtomic writes b to a temporary file first and renames it to p, so
+// neither readers nor a crash can leave a partially written file
+func writeFileAtomic(p string, b []byte) error {
+	f, err := os.CreateTemp(path.Dir(p), "."+path.Base(p)+"*")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer os.Remove(f.Name())
 
-	err = json.NewEncoder(f).Encode(s)
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
 	if err != nil {
+		f.Close()
 		return err
 	}
-	return nil
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+// restoredShare returns a copy of s to be written by RestoreShare, with
+// defaults set for values missing from older metadata
+func restoredShare(s *Share) *Share {
+	r := *s
+	if r.Version == 0 {
+		r.Version = MetadataVersion
+	}
+	if r.Downloads == nil {
+		r.Downloads = map[string]int64{}
+	}
+	return &r
+}
+
+// updateOptions sets the options of s to o. A Validity different from the
+// current one with an unchanged ExpiresAt sets ExpiresAt to Validity days
+// after creation, so clients sending back options they don't know about can
+// still renew shares. Otherwise ExpiresAt is kept if o doesn't set it, and
+// Validity is updated to match ExpiresAt.
+func (s *Share) updateOptions(o Options) {
+	previous := s.Options
+
+	switch {
+	case o.ExpiresAt.IsZero() && o.Validity == previous.Validity:
+		o.ExpiresAt = previous.ExpiresAt
+	case o.ExpiresAt.IsZero(), o.ExpiresAt.Equal(previous.ExpiresAt) && o.Validity != previous.Validity:
+		o.ExpiresAt = time.Time{}
+		if o.Validity > 0 {
+			o.ExpiresAt = s.DateCreated.AddDate(0, 0, o.Validity)
+		}
+	}
+
+	if !o.ExpiresAt.IsZero() {
+		o.ExpiresAt = o.ExpiresAt.UTC().Truncate(time.Second)
+		days := math.Ceil(o.ExpiresAt.Sub(s.DateCreated).Hours() / 24)
+		o.Validity = max(1, int(days))
+	}
+
+	s.Options = o
+}
+
+// ParseExpiration returns the expiration date described by v, either an
+// RFC 3339 date or a duration from now like 4h, 90m or 3d. It also parses the
+// dates of upload and download windows.
+func ParseExpiration(v string, now time.Time) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, v)
+	if err == nil {
+		return t, nil
+	}
+
+	var d time.Duration
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		var n int
+		n, err = strconv.Atoi(days)
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		d, err = time.ParseDuration(v)
+	}
+	if err != nil || d <= 0 {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidExpiration, v)
+	}
+
+	return now.Add(d), nil
 }
+
+// Expiration returns when s expires, or the zero time if it never does
+func (s *Share) Expiration() time.Time {
+	// Shares restored from metadata older than ExpiresAt only have Validity
+	if s.Options.ExpiresAt.IsZero() && s.Options.Validity > 0 {
+		return s.DateCreated.AddDate(0, 0, s.Options.Validity)
+	}
+
+	return s.Options.ExpiresAt
+}
+
+// IsValid returns false if the share has expired
 func (s *Share) IsValid() bool {
-	if s.Options.Validity == 0 {
+	validUntil := s.Expiration()
+	if validUntil.IsZero() {
 		return true
 	}
 
-	validUntil := s.DateCreated.AddDate(0, 0, s.Options.Validity)
-
 	return validUntil.After(time.Now())
 }
 
 type PublicShare struct {
 	Name    string        `json:"name"`
 	Options PublicOptions `json:"options,omitempty"`
+
+	// RemainingDownloads is the number of item downloads left, nil if the
+	// share has no download limit
+	RemainingDownloads *int64 `json:"remaining_downloads,omitempty"`
 }
 
 type PublicOptions struct {
-	Exposure string `json:"exposure"`
-	Message  string `json:"message"`
+	Exposure  string    `json:"exposure"`
+	Message   string    `json:"message"`
+	ExpiresAt time.Time `json:"expires_at,omitzero"`
+
+	UploadOpensAt    time.Time `json:"upload_opens_at,omitzero"`
+	UploadClosesAt   time.Time `json:"upload_closes_at,omitzero"`
+	DownloadOpensAt  time.Time `json:"download_opens_at,omitzero"`
+	DownloadClosesAt time.Time `json:"download_closes_at,omitzero"`
+
+	MaxDownloads        int64 `json:"max_downloads,omitempty"`
+	MaxItemDownloads    int64 `json:"max_item_downloads,omitempty"`
+	DeleteAfterDownload bool  `json:"delete_after_download,omitempty"`
+
+	Fields []ItemField `json:"fields,omitempty"`
+
+	Conflict string `json:"conflict,omitempty"`
 }
 
 func (s *Share) PublicShare() *PublicShare {
+	var remaining *int64
+	if r := s.RemainingDownloads(); r >= 0 {
+		remaining = &r
+	}
+
 	return &PublicShare{
 		Name: s.Name,
 		Options: PublicOptions{
-			Exposure: s.Options.Exposure,
-			Message:  s.Options.Message,
+			Exposure:  s.Options.Exposure,
+			Message:   s.Options.Message,
+			ExpiresAt: s.Options.ExpiresAt,
+
+			UploadOpensAt:    s.Options.UploadOpensAt,
+			UploadClosesAt:   s.Options.UploadClosesAt,
+			DownloadOpensAt:  s.Options.DownloadOpensAt,
+			DownloadClosesAt: s.Options.DownloadClosesAt,
+
+			MaxDownloads:        s.Options.MaxDownloads,
+			MaxItemDownloads:    s.Options.MaxItemDownloads,
+			DeleteAfterDownload: s.Options.DeleteAfterDownload,
+
+			Fields: s.Options.Fields,
+
+			Conflict: s.Options.Conflict,
 		},
+		RemainingDownloads: remaining,
 	}
 }
 
@@ -128,7 +305,8 @@ func PublicShares(shares []Share) []PublicShare {
 
 type Item struct {
 	Path      string
-	Downloads int64 `json:"Downloads,omitempty"`
+	Downloads int64         `json:"Downloads,omitempty"`
+	Metadata  *ItemMetadata `json:"Metadata,omitempty"`
 	ItemInfo  ItemInfo
 }
 
@@ -149,12 +327,61 @@ type Storage interface {
 	// UpdateShare updates an existing share
 	UpdateShare(ctx context.Context, name string, options *Options, downloads *map[string]int64) (*Options, error)
 
-	// CreateItem creates a new item in a share
-	CreateItem(ctx context.Context, share, item string, size int64, reader io.Reader) (*Item, error)
+	// ReserveDownloads counts a download of items of share by a guest before
+	// it is served. Nothing is counted and ErrDownloadLimitReached is
+	// returned when it would exceed the download limits of the share.
+	// Concurrent calls are applied atomically, across instances when shares
+	// are locked by a cluster.
+	ReserveDownloads(ctx context.Context, share string, items []string) (*Share, error)
+
+	// ReleaseDownloads uncounts a download of items of share reserved with
+	// ReserveDownloads that didn't complete
+	ReleaseDownloads(ctx context.Context, share string, items []string) (*Share, error)
+
+	// AddDownloads counts a complete download of items of share, whether by
+	// a guest or an authenticated user, without checking download limits
+	AddDownloads(ctx context.Context, share string, items []string) (*Share, error)
+
+	// RestoreShare creates or replaces the metadata of a share, including
+	// DateCreated, Owner and Downloads, to copy shares between backends. Size
+	// and Count are computed from the items of the share.
+	RestoreShare(ctx context.Context, share *Share) (*Share, error)
+
+	// CreateItem creates a new item in a share. An existing item with the
+	// same name is handled according to the conflict policy of the share,
+	// and the name of the returned item can differ from item. metadata
+	// replaces the metadata of the item in the same update as its creation,
+	// the metadata of a replaced item is kept if it is nil.
+	CreateItem(ctx context.Context, share, item string, size int64, reader io.Reader, metadata *ItemMetadata) (*Item, error)
+
+	// SetItemMetadata replaces the metadata of an item
+	SetItemMetadata(ctx context.Context, share, item string, metadata ItemMetadata) (*Item, error)
+
+	// CopyItem copies an item and its metadata to toItem in share toShare,
+	// which can be the same share. The copy is subject to the limits and the
+	// conflict policy of toShare, and the name of the returned item can
+	// differ from toItem. Download counts and versions are not copied.
+	CopyItem(ctx context.Context, share, item, toShare, toItem string) (*Item, error)
+
+	// MoveItem moves an item and its metadata to toItem in share toShare,
+	// which can be the same share, with the limits and the conflict policy
+	// of CopyItem. Versions of the item are deleted.
+	MoveItem(ctx context.Context, share, item, toShare, toItem string) (*Item, error)
 
 	// CreateItem creates a new item in a share
 	DeleteItem(ctx context.Context, share, item string) error
 
+	// ListItemVersions returns the previous versions of an item, oldest
+	// first. Versions are kept when an item is replaced in a share with
+	// ConflictVersion, and deleted with the item.
+	ListItemVersions(ctx context.Context, share, item string) ([]ItemVersion, error)
+
+	// GetItemVersionData returns the content of a version of an item
+	GetItemVersionData(ctx context.Context, share, item string, version int) (io.ReadCloser, error)
+
+	// DeleteItemVersion deletes a version of an item
+	DeleteItemVersion(ctx context.Context, share, item string, version int) error
+
 	// GetShare returns the share identified by share
 	GetShare(ctx context.Context, share string) (*Share, error)
 
@@ -164,12 +391,36 @@ type Storage interface {
 	// ListShare returns the list of items in a share
 	ListShare(ctx context.Context, share string) ([]Item, error)
 
+	// QueryShares returns a page of shares matching q
+	QueryShares(ctx context.Context, q ShareQuery) (*SharePage, error)
+
+	// QueryItems returns a page of items in share matching q
+	QueryItems(ctx context.Context, share string, q ItemQuery) (*ItemPage, error)
+
 	// ListShare returns the list of items in a share
 	DeleteShare(ctx context.Context, share string) error
 
+	// RenameShare renames share to name with its items, versions and
+	// metadata. The previous name is recorded so requests to it can keep
+	// working until until, see ResolveShare.
+	RenameShare(ctx context.Context, share, name string, until time.Time) (*Share, error)
+
+	// GetRenamedShare returns the record of the share previously named
+	// name, or ErrShareNotFound if no share was renamed from name
+	GetRenamedShare(ctx context.Context, name string) (*RenamedShare, error)
+
+	// PurgeRenamedShares removes records of renamed shares which previous
+	// name stopped working before before, and returns their previous names.
+	// Requests to these names then fail as if they never existed.
+	PurgeRenamedShares(ctx context.Context, before time.Time) ([]string, error)
+
 	// GetItem returns the item identified by share and item
 	GetItem(ctx context.Context, share, item string) (*Item, error)
 
 	// GetItem returns the item identified by share and item
 	GetItemData(ctx context.Context, share string, item string) (io.ReadCloser, error)
+
+	// Check checks the consistency of shares metadata with their content,
+	// and repairs problems found if repair is true
+	Check(ctx context.Context, repair bool) (*CheckReport, error)
 }
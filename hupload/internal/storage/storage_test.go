@@ -1,6 +1,7 @@
 package storage_test
 
 import (
+	"errors"
 	"reflect"
 	"testing"
 	"time"
@@ -38,6 +39,25 @@ func TestShouldBeInvalid(t *testing.T) {
 	}
 }
 
+func TestExpiresAt(t *testing.T) {
+	share := storage.NewShare().
+		WithName("test").
+		WithOwner("admin").
+		WithOptions(storage.Options{Validity: 10, ExpiresAt: time.Now().Add(-time.Hour)}).
+		WithDateCreated(time.Now())
+
+	// The expiration date takes precedence over validity
+	if share.IsValid() == true {
+		t.Errorf("Expected share to be invalid")
+	}
+
+	share.Options.ExpiresAt = time.Now().Add(time.Hour)
+
+	if share.IsValid() == false {
+		t.Errorf("Expected share to be valid")
+	}
+}
+
 func TestPublicShare(t *testing.T) {
 	share := storage.NewShare().
 		WithName("test").
@@ -63,3 +83,177 @@ func TestPublicShare(t *testing.T) {
 		t.Errorf("Expected public share to be %v, got %v", want, publicShare)
 	}
 }
+
+func TestParseExpiration(t *testing.T) {
+	now := time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"2024-09-01T18:00:00+02:00", time.Date(2024, 9, 1, 16, 0, 0, 0, time.UTC)},
+		{"4h", now.Add(4 * time.Hour)},
+		{"90m", now.Add(90 * time.Minute)},
+		{"3d", now.AddDate(0, 0, 3)},
+		{"", time.Time{}},
+		{"soon", time.Time{}},
+		{"-1h", time.Time{}},
+		{"0d", time.Time{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, err := storage.ParseExpiration(test.value, now)
+			if test.want.IsZero() {
+				if !errors.Is(err, storage.ErrInvalidExpiration) {
+					t.Errorf("Expected ErrInvalidExpiration, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got %v", err)
+			}
+			if !got.Equal(test.want) {
+				t.Errorf("Expected %v, got %v", test.want, got)
+			}
+		})
+	}
+}
+
+func TestShareWindows(t *testing.T) {
+	opens := time.Date(2024, 9, 1, 12, 0, 0, 0, time.UTC)
+	closes := opens.Add(time.Hour)
+
+	share := storage.NewShare()
+	share.Options.UploadOpensAt = opens
+	share.Options.UploadClosesAt = closes
+	share.Options.DownloadOpensAt = closes
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		upload   error
+		download error
+	}{
+		{"Before upload opens", opens.Add(-time.Minute), storage.ErrUploadNotOpen, storage.ErrDownloadNotOpen},
+		{"When upload opens", opens, nil, storage.ErrDownloadNotOpen},
+		{"When upload closes", closes, storage.ErrUploadClosed, nil},
+		{"After download opens", closes.AddDate(1, 0, 0), storage.ErrUploadClosed, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := share.CanUpload(test.now); !errors.Is(err, test.upload) || (err == nil) != (test.upload == nil) {
+				t.Errorf("Expected upload error %v, got %v", test.upload, err)
+			}
+			if err := share.CanDownload(test.now); !errors.Is(err, test.download) || (err == nil) != (test.download == nil) {
+				t.Errorf("Expected download error %v, got %v", test.download, err)
+			}
+		})
+	}
+
+	t.Run("Validate windows", func(t *testing.T) {
+		if err := share.Options.ValidateWindows(); err != nil {
+			t.Errorf("Expected no error, got %v", err)
+		}
+		o := storage.Options{DownloadOpensAt: closes, DownloadClosesAt: opens}
+		if err := o.ValidateWindows(); !errors.Is(err, storage.ErrInvalidWindow) {
+			t.Errorf("Expected ErrInvalidWindow, got %v", err)
+		}
+	})
+}
+
+func TestDownloadLimits(t *testing.T) {
+	share := storage.NewShare().WithOptions(storage.Options{MaxDownloads: 3})
+	share.GuestDownloads = map[string]int64{"a": 1}
+
+	// Downloads by authenticated users don't count
+	share.Downloads = map[string]int64{"a": 5, "b": 5}
+
+	if r := share.PublicShare().RemainingDownloads; r == nil || *r != 2 {
+		t.Errorf("Expected 2 remaining downloads, got %v", r)
+	}
+	if err := share.CheckDownloads([]string{"a", "b"}); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+	if err := share.CheckDownloads([]string{"a", "b", "c"}); !errors.Is(err, storage.ErrDownloadLimitReached) {
+		t.Errorf("Expected ErrDownloadLimitReached, got %v", err)
+	}
+
+	// Items deleted after download can only be downloaded once
+	share.Options.DeleteAfterDownload = true
+	if err := share.CheckDownloads([]string{"a"}); !errors.Is(err, storage.ErrDownloadLimitReached) {
+		t.Errorf("Expected ErrDownloadLimitReached, got %v", err)
+	}
+
+	share.Options = storage.Options{}
+	if r := share.PublicShare().RemainingDownloads; r != nil {
+		t.Errorf("Expected no remaining downloads, got %d", *r)
+	}
+
+	o := storage.Options{MaxItemDownloads: -1}
+	if err := o.ValidateDownloadLimits(); !errors.Is(err, storage.ErrInvalidDownloadLimit) {
+		t.Errorf("Expected ErrInvalidDownloadLimit, got %v", err)
+	}
+}
+
+func TestItemFields(t *testing.T) {
+	o := storage.Options{Fields: []storage.ItemField{
+		{Name: "case", Required: true},
+		{Name: "version"},
+		{Name: "contact", Type: storage.FieldEmail},
+		{Name: "product", Type: storage.FieldSelect, Choices: []string{"a", "b"}},
+		{Name: "terms", Type: storage.FieldCheckbox, Label: "I accept the terms"},
+	}}
+	if err := o.ValidateFields(); err != nil {
+		t.Errorf("Expected no error, got %v", err)
+	}
+
+	for _, fields := range [][]storage.ItemField{
+		{{Name: ""}},
+		{{Name: "case number"}},
+		{{Name: "case"}, {Name: "case"}},
+		{{Name: "case", Type: "number"}},
+		{{Name: "product", Type: storage.FieldSelect}},
+		{{Name: "case", Choices: []string{"a"}}},
+	} {
+		invalid := storage.Options{Fields: fields}
+		if err := invalid.ValidateFields(); !errors.Is(err, storage.ErrInvalidField) {
+			t.Errorf("%v: expected ErrInvalidField, got %v", fields, err)
+		}
+	}
+
+	tests := []struct {
+		metadata storage.ItemMetadata
+		partial  bool
+		valid    bool
+	}{
+		{storage.ItemMetadata{Fields: map[string]string{"case": "1"}}, false, true},
+		{storage.ItemMetadata{UploaderEmail: "Jane <jane@example.com>", Fields: map[string]string{"case": "1"}}, false, true},
+		{storage.ItemMetadata{Fields: map[string]string{"version": "2"}}, false, false},
+		{storage.ItemMetadata{Fields: map[string]string{"version": "2"}}, true, true},
+		{storage.ItemMetadata{Fields: map[string]string{"case": "1", "other": "x"}}, false, false},
+		{storage.ItemMetadata{UploaderEmail: "jane", Fields: map[string]string{"case": "1"}}, false, false},
+		{storage.ItemMetadata{Fields: map[string]string{"case": "1", "contact": "jane@example.com", "product": "b", "terms": "true"}}, false, true},
+		{storage.ItemMetadata{Fields: map[string]string{"case": "1", "contact": "jane"}}, false, false},
+		{storage.ItemMetadata{Fields: map[string]string{"case": "1", "product": "c"}}, false, false},
+		{storage.ItemMetadata{Fields: map[string]string{"case": "1", "terms": "yes"}}, false, false},
+		{storage.ItemMetadata{Fields: map[string]string{"case": "1", "terms": "false"}}, false, true},
+	}
+
+	for _, test := range tests {
+		err := o.ValidateItemMetadata(test.metadata, test.partial)
+		if test.valid != (err == nil) || (err != nil && !errors.Is(err, storage.ErrInvalidItemMetadata)) {
+			t.Errorf("%+v: unexpected error %v", test.metadata, err)
+		}
+	}
+
+	// Required checkboxes must be checked
+	o.Fields[4].Required = true
+	for v, valid := range map[string]bool{"true": true, "false": false, "": false} {
+		err := o.ValidateItemMetadata(storage.ItemMetadata{Fields: map[string]string{"case": "1", "terms": v}}, false)
+		if valid != (err == nil) {
+			t.Errorf("terms %q: unexpected error %v", v, err)
+		}
+	}
+}
@@ -0,0 +1,1819 @@
+// Package storagetest is a conformance test suite for storage.Storage
+// implementations. Every backend runs it from its own tests, and a new
+// backend must pass it to be accepted.
+//
+//	func TestConformance(t *testing.T) {
+//		storagetest.Run(t, func(t *testing.T, l storagetest.Limits) storage.Storage {
+//			return NewBackend(Options{MaxFileSize: l.MaxFileSize, MaxShareSize: l.MaxShareSize})
+//		})
+//	}
+//
+// Tests only use shares with a random prefix and delete them when done, so
+// backends can share their content between tests, like a bucket.
+package storagetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// MB is the unit of limits
+const MB = 1024 * 1024
+
+// Limits are the quotas in MB a backend must enforce, 0 meaning no limit
+type Limits struct {
+	MaxFileSize  int64
+	MaxShareSize int64
+}
+
+// Factory returns a backend enforcing limits
+type Factory func(t *testing.T, limits Limits) storage.Storage
+
+// Run runs the conformance suite against backends returned by f
+func Run(t *testing.T, f Factory) {
+	tests := []struct {
+		name   string
+		limits Limits
+		test   func(t *testing.T, s *suite)
+	}{
+		{"ShareNames", Limits{}, testShareNames},
+		{"ItemNames", Limits{}, testItemNames},
+		{"ShareMetadata", Limits{}, testShareMetadata},
+		{"Expiration", Limits{}, testExpiration},
+		{"DownloadLimits", Limits{}, testDownloadLimits},
+		{"RestoreShare", Limits{}, testRestoreShare},
+		{"Items", Limits{}, testItems},
+		{"ItemMetadata", Limits{}, testItemMetadata},
+		{"Quotas", Limits{MaxFileSize: 1, MaxShareSize: 2}, testQuotas},
+		{"ConflictPolicies", Limits{}, testConflictPolicies},
+		{"Versions", Limits{}, testVersions},
+		{"VersionQuotas", Limits{MaxShareSize: 2}, testVersionQuotas},
+		{"CopyItem", Limits{}, testCopyItem},
+		{"CopyConflicts", Limits{}, testCopyConflicts},
+		{"CopyQuotas", Limits{MaxShareSize: 2}, testCopyQuotas},
+		{"MoveItem", Limits{}, testMoveItem},
+		{"MoveQuotas", Limits{MaxShareSize: 2}, testMoveQuotas},
+		{"RenameShare", Limits{}, testRenameShare},
+		{"ConcurrentUploads", Limits{}, testConcurrentUploads},
+		{"Stress", Limits{MaxShareSize: 1}, testStress},
+		{"ListingOrder", Limits{}, testListingOrder},
+		{"Deletes", Limits{}, testDeletes},
+		{"Errors", Limits{}, testErrors},
+		{"Leases", Limits{}, testLeases},
+		{"Check", Limits{}, testCheck},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &suite{
+				Storage: f(t, test.limits),
+				ctx:     context.Background(),
+				prefix:  randomPrefix(),
+			}
+			t.Cleanup(func() { s.cleanup(t) })
+
+			test.test(t, s)
+		})
+	}
+}
+
+// suite holds the backend of a test and the shares it created
+type suite struct {
+	storage.Storage
+
+	ctx    context.Context
+	prefix string
+
+	mu     sync.Mutex
+	shares []string
+}
+
+// randomPrefix returns a prefix for share names of a test
+func randomPrefix() string {
+	b := make([]byte, 4)
+	_, _ = rand.Read(b)
+	return "st" + hex.EncodeToString(b) + "-"
+}
+
+// name returns the name of a share for this test
+func (s *suite) name(n string) string {
+	return s.prefix + n
+}
+
+// createShare creates share n and registers it for cleanup
+func (s *suite) createShare(t *testing.T, n string, options storage.Options) *storage.Share {
+	t.Helper()
+
+	share, err := s.CreateShare(s.ctx, s.name(n), "admin", options)
+	if err != nil {
+		t.Fatalf("CreateShare(%s): %v", n, err)
+	}
+	s.track(share.Name)
+
+	return share
+}
+
+// createItem creates item i in share with content and fails the test on
+// error
+func (s *suite) createItem(t *testing.T, share, i string, content []byte) *storage.Item {
+	t.Helper()
+
+	item, err := s.CreateItem(s.ctx, share, i, int64(len(content)), bytes.NewReader(content), nil)
+	if err != nil {
+		t.Fatalf("CreateItem(%s, %s): %v", share, i, err)
+	}
+
+	return item
+}
+
+// getShare returns share n and fails the test on error
+func (s *suite) getShare(t *testing.T, n string) *storage.Share {
+	t.Helper()
+
+	share, err := s.GetShare(s.ctx, n)
+	if err != nil {
+		t.Fatalf("GetShare(%s): %v", n, err)
+	}
+
+	return share
+}
+
+func (s *suite) track(n string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.shares = append(s.shares, n)
+}
+
+func (s *suite) cleanup(t *testing.T) {
+	for _, n := range s.shares {
+		err := s.DeleteShare(s.ctx, n)
+		if err != nil && !errors.Is(err, storage.ErrShareNotFound) {
+			t.Errorf("DeleteShare(%s): %v", n, err)
+		}
+	}
+}
+
+// expectError fails the test if err is not target
+func expectError(t *testing.T, op string, err, target error) {
+	t.Helper()
+
+	if !errors.Is(err, target) {
+		t.Errorf("%s: expected %v, got %v", op, target, err)
+	}
+}
+
+func testShareNames(t *testing.T, s *suite) {
+	for _, n := range []string{"", "../share", "a b", "a/b", ".share", "é"} {
+		_, err := s.CreateShare(s.ctx, n, "admin", storage.Options{})
+		expectError(t, fmt.Sprintf("CreateShare(%q)", n), err, storage.ErrInvalidShareName)
+
+		_, err = s.RestoreShare(s.ctx, storage.NewShare().WithName(n))
+		expectError(t, fmt.Sprintf("RestoreShare(%q)", n), err, storage.ErrInvalidShareName)
+
+		_, err = s.GetShare(s.ctx, n)
+		expectError(t, fmt.Sprintf("GetShare(%q)", n), err, storage.ErrInvalidShareName)
+
+		_, err = s.UpdateShare(s.ctx, n, &storage.Options{}, nil)
+		expectError(t, fmt.Sprintf("UpdateShare(%q)", n), err, storage.ErrInvalidShareName)
+
+		_, err = s.ListShare(s.ctx, n)
+		expectError(t, fmt.Sprintf("ListShare(%q)", n), err, storage.ErrInvalidShareName)
+
+		err = s.DeleteShare(s.ctx, n)
+		expectError(t, fmt.Sprintf("DeleteShare(%q)", n), err, storage.ErrInvalidShareName)
+
+		_, err = s.CreateItem(s.ctx, n, "item", 1, bytes.NewReader([]byte("x")), nil)
+		expectError(t, fmt.Sprintf("CreateItem(%q)", n), err, storage.ErrInvalidShareName)
+	}
+
+	// Letters, digits, dashes and underscores are allowed
+	s.createShare(t, "Valid_name-0", storage.Options{})
+}
+
+func testItemNames(t *testing.T, s *suite) {
+	share := s.createShare(t, "items", storage.Options{})
+
+	for _, n := range []string{"", ".metadata", ".hidden", "a/b", "../item"} {
+		_, err := s.CreateItem(s.ctx, share.Name, n, 1, bytes.NewReader([]byte("x")), nil)
+		expectError(t, fmt.Sprintf("CreateItem(%q)", n), err, storage.ErrInvalidItemName)
+
+		_, err = s.GetItem(s.ctx, share.Name, n)
+		expectError(t, fmt.Sprintf("GetItem(%q)", n), err, storage.ErrInvalidItemName)
+
+		_, err = s.GetItemData(s.ctx, share.Name, n)
+		expectError(t, fmt.Sprintf("GetItemData(%q)", n), err, storage.ErrInvalidItemName)
+
+		err = s.DeleteItem(s.ctx, share.Name, n)
+		expectError(t, fmt.Sprintf("DeleteItem(%q)", n), err, storage.ErrInvalidItemName)
+	}
+
+	// Metadata must not have been overwritten
+	got := s.getShare(t, share.Name)
+	if got.Count != 0 || got.Owner != "admin" {
+		t.Errorf("Expected share to be unchanged, got %+v", got)
+	}
+
+	// Spaces, dots and unicode are allowed
+	for _, n := range []string{"file name.tar.gz", "résumé.pdf", "a..b"} {
+		s.createItem(t, share.Name, n, []byte("x"))
+	}
+}
+
+func testShareMetadata(t *testing.T, s *suite) {
+	before := time.Now().Add(-time.Second)
+
+	options := storage.Options{Validity: 10, Exposure: "both", Description: "description", Message: "message"}
+	share := s.createShare(t, "metadata", options)
+
+	// The expiration date is set from validity
+	options.ExpiresAt = expiresAfter(share, 10)
+
+	if share.Name != s.name("metadata") || share.Owner != "admin" || !reflect.DeepEqual(share.Options, options) || share.Version != storage.MetadataVersion {
+		t.Errorf("Unexpected share %+v", share)
+	}
+	if share.DateCreated.Before(before) || share.DateCreated.After(time.Now().Add(time.Second)) {
+		t.Errorf("Unexpected creation date %v", share.DateCreated)
+	}
+
+	got := s.getShare(t, share.Name)
+	if !got.DateCreated.Equal(share.DateCreated) {
+		t.Errorf("Expected creation date %v, got %v", share.DateCreated, got.DateCreated)
+	}
+	if got.Name != share.Name || got.Owner != share.Owner || !reflect.DeepEqual(got.Options, share.Options) {
+		t.Errorf("Expected %+v, got %+v", share, got)
+	}
+
+	// Default exposure
+	def := s.createShare(t, "default", storage.Options{})
+	if def.Options.Exposure != "upload" {
+		t.Errorf("Expected default exposure upload, got %q", def.Options.Exposure)
+	}
+
+	// Update options and downloads
+	newOptions := storage.Options{Validity: 20, Exposure: "download", Description: "new description", Message: "new message"}
+	o, err := s.UpdateShare(s.ctx, share.Name, &newOptions, &map[string]int64{"item": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newOptions.ExpiresAt = expiresAfter(share, 20)
+	if !reflect.DeepEqual(*o, newOptions) {
+		t.Errorf("Expected %+v, got %+v", newOptions, *o)
+	}
+
+	got = s.getShare(t, share.Name)
+	if !reflect.DeepEqual(got.Options, newOptions) || got.Downloads["item"] != 2 || !got.DateCreated.Equal(share.DateCreated) || got.Owner != "admin" {
+		t.Errorf("Unexpected share after update %+v", got)
+	}
+
+	// Nil values are left unchanged
+	_, err = s.UpdateShare(s.ctx, share.Name, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = s.getShare(t, share.Name)
+	if !reflect.DeepEqual(got.Options, newOptions) || got.Downloads["item"] != 2 {
+		t.Errorf("Unexpected share after empty update %+v", got)
+	}
+}
+
+// expiresAfter returns the expiration date of share after days
+func expiresAfter(share *storage.Share, days int) time.Time {
+	return share.DateCreated.AddDate(0, 0, days).UTC().Truncate(time.Second)
+}
+
+func testExpiration(t *testing.T, s *suite) {
+	expires := time.Now().Add(4 * time.Hour).UTC().Truncate(time.Second)
+
+	// An explicit expiration date sets validity, rounded up to a day
+	share := s.createShare(t, "expiration", storage.Options{Validity: 10, ExpiresAt: expires, Exposure: "both"})
+	if !share.Options.ExpiresAt.Equal(expires) || share.Options.Validity != 1 {
+		t.Errorf("Expected expiration %v and validity 1, got %v and %d", expires, share.Options.ExpiresAt, share.Options.Validity)
+	}
+	if !share.IsValid() {
+		t.Error("Expected share to be valid")
+	}
+
+	update := func(o storage.Options) storage.Options {
+		t.Helper()
+		_, err := s.UpdateShare(s.ctx, share.Name, &o, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.getShare(t, share.Name).Options
+	}
+
+	// Options without expiration date and the same validity keep it
+	got := update(storage.Options{Validity: 1, Exposure: "upload"})
+	if !got.ExpiresAt.Equal(expires) || got.Exposure != "upload" {
+		t.Errorf("Expected expiration to be kept, got %+v", got)
+	}
+
+	// A new validity with the same expiration date renews the share
+	got = update(storage.Options{Validity: 3, ExpiresAt: expires, Exposure: "upload"})
+	if !got.ExpiresAt.Equal(expiresAfter(share, 3)) || got.Validity != 3 {
+		t.Errorf("Expected expiration 3 days after creation, got %+v", got)
+	}
+
+	// A past expiration date expires the share
+	past := time.Now().Add(-time.Hour)
+	got = update(storage.Options{Validity: 3, ExpiresAt: past, Exposure: "upload"})
+	if !got.ExpiresAt.Equal(past.UTC().Truncate(time.Second)) {
+		t.Errorf("Expected expiration %v, got %v", past, got.ExpiresAt)
+	}
+	if s.getShare(t, share.Name).IsValid() {
+		t.Error("Expected share to be expired")
+	}
+
+	// No validity and no expiration date never expire
+	got = update(storage.Options{Exposure: "upload"})
+	if !got.ExpiresAt.IsZero() || got.Validity != 0 {
+		t.Errorf("Expected no expiration, got %+v", got)
+	}
+	if !s.getShare(t, share.Name).IsValid() {
+		t.Error("Expected share to be valid")
+	}
+}
+
+func testDownloadLimits(t *testing.T, s *suite) {
+	share := s.createShare(t, "limits", storage.Options{Exposure: "download", MaxDownloads: 3, MaxItemDownloads: 2})
+
+	reserve := func(items ...string) error {
+		_, err := s.ReserveDownloads(s.ctx, share.Name, items)
+		return err
+	}
+
+	for _, items := range [][]string{{"a"}, {"a"}, {"b"}} {
+		err := reserve(items...)
+		if err != nil {
+			t.Fatalf("ReserveDownloads(%v): %v", items, err)
+		}
+	}
+
+	// Item limit, then share limit, are reached without counting anything
+	expectError(t, "ReserveDownloads(a)", reserve("a"), storage.ErrDownloadLimitReached)
+	expectError(t, "ReserveDownloads(b)", reserve("b"), storage.ErrDownloadLimitReached)
+
+	got := s.getShare(t, share.Name)
+	if got.GuestDownloads["a"] != 2 || got.GuestDownloads["b"] != 1 || got.RemainingDownloads() != 0 {
+		t.Errorf("Expected 2 and 1 guest downloads with none left, got %v", got.GuestDownloads)
+	}
+
+	// Released downloads can be reserved again
+	_, err := s.ReleaseDownloads(s.ctx, share.Name, []string{"b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got = s.getShare(t, share.Name)
+	if got.GuestDownloads["b"] != 0 || got.RemainingDownloads() != 1 {
+		t.Errorf("Expected released download to be uncounted, got %v", got.GuestDownloads)
+	}
+	err = reserve("b")
+	if err != nil {
+		t.Fatalf("ReserveDownloads(b) after release: %v", err)
+	}
+
+	// Complete downloads are counted whatever the limits
+	for range 3 {
+		_, err = s.AddDownloads(s.ctx, share.Name, []string{"a", "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	got = s.getShare(t, share.Name)
+	if got.Downloads["a"] != 3 || got.Downloads["b"] != 3 || got.GuestDownloads["a"] != 2 {
+		t.Errorf("Expected 3 downloads of each item, got %v and %v by guests", got.Downloads, got.GuestDownloads)
+	}
+
+	for _, f := range []func(context.Context, string, []string) (*storage.Share, error){s.ReserveDownloads, s.ReleaseDownloads, s.AddDownloads} {
+		_, err = f(s.ctx, s.name("missing"), []string{"a"})
+		expectError(t, "Downloads of missing share", err, storage.ErrShareNotFound)
+	}
+
+	// Concurrent downloads can't exceed the limit
+	const limit, downloads = 5, 20
+	share = s.createShare(t, "concurrent-limits", storage.Options{Exposure: "download", MaxDownloads: limit})
+
+	errs := make(chan error, downloads)
+	var wg sync.WaitGroup
+	for range downloads {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- reserve("item")
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	succeeded := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, storage.ErrDownloadLimitReached):
+			t.Errorf("Concurrent download failed: %v", err)
+		}
+	}
+	if succeeded != limit {
+		t.Errorf("Expected %d downloads to be counted, got %d", limit, succeeded)
+	}
+	if got := s.getShare(t, share.Name); got.GuestDownloads["item"] != limit {
+		t.Errorf("Expected %d downloads, got %d", limit, got.GuestDownloads["item"])
+	}
+}
+
+func testRestoreShare(t *testing.T, s *suite) {
+	share := storage.NewShare().
+		WithName(s.name("restored")).
+		WithOwner("user").
+		WithDateCreated(time.Date(2024, 9, 1, 16, 48, 0, 0, time.UTC)).
+		WithOptions(storage.Options{Validity: 3, Exposure: "both", Description: "d", Message: "m"})
+	share.Downloads = map[string]int64{"item.txt": 4}
+	share.Size, share.Count = 1000, 10
+
+	// Restore creates the share
+	got, err := s.RestoreShare(s.ctx, share)
+	s.track(share.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Size and count are computed from items
+	want := *share
+	want.Size, want.Count = 0, 0
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("Expected %+v, got %+v", &want, got)
+	}
+
+	item := s.createItem(t, share.Name, "item.txt", []byte("hello"))
+	if item.Downloads != 4 {
+		t.Errorf("Expected 4 downloads, got %d", item.Downloads)
+	}
+
+	// Restore replaces metadata of an existing share
+	share.Options.Message = "new message"
+	_, err = s.RestoreShare(s.ctx, share)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = *share
+	want.Size, want.Count = 5, 1
+	got = s.getShare(t, share.Name)
+	if !reflect.DeepEqual(got, &want) {
+		t.Errorf("Expected %+v, got %+v", &want, got)
+	}
+}
+
+func testItems(t *testing.T, s *suite) {
+	share := s.createShare(t, "items", storage.Options{})
+
+	item := s.createItem(t, share.Name, "item.txt", []byte("hello"))
+	if item.Path != path.Join(share.Name, "item.txt") || item.ItemInfo.Size != 5 {
+		t.Errorf("Unexpected item %+v", item)
+	}
+
+	got, err := s.GetItem(s.ctx, share.Name, "item.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Path != item.Path || got.ItemInfo.Size != 5 || got.ItemInfo.DateModified.IsZero() {
+		t.Errorf("Unexpected item %+v", got)
+	}
+
+	expectContent(t, s, share.Name, "item.txt", []byte("hello"))
+
+	// Empty items are allowed
+	s.createItem(t, share.Name, "empty.txt", []byte{})
+	expectContent(t, s, share.Name, "empty.txt", []byte{})
+
+	expectSize(t, s, share.Name, 5, 2)
+
+	// Items are replaced
+	s.createItem(t, share.Name, "item.txt", []byte("hello world"))
+	expectContent(t, s, share.Name, "item.txt", []byte("hello world"))
+	expectSize(t, s, share.Name, 11, 2)
+
+	// Downloads are reported in items
+	_, err = s.UpdateShare(s.ctx, share.Name, nil, &map[string]int64{"item.txt": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = s.GetItem(s.ctx, share.Name, "item.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Downloads != 3 {
+		t.Errorf("Expected 3 downloads, got %d", got.Downloads)
+	}
+	items, err := s.ListShare(s.ctx, share.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range items {
+		if path.Base(i.Path) == "item.txt" && i.Downloads != 3 {
+			t.Errorf("Expected 3 downloads in listing, got %d", i.Downloads)
+		}
+	}
+}
+
+// expectContent fails the test if the content of item is not want
+func testItemMetadata(t *testing.T, s *suite) {
+	share := s.createShare(t, "item-metadata", storage.Options{Exposure: "both"})
+	s.createItem(t, share.Name, "a", []byte("a"))
+	s.createItem(t, share.Name, "b", []byte("b"))
+
+	if item, err := s.GetItem(s.ctx, share.Name, "a"); err != nil || item.Metadata != nil {
+		t.Fatalf("Expected no metadata, got %v, %v", item, err)
+	}
+
+	want := storage.ItemMetadata{Owner: "admin", UploaderName: "Jane", Note: "n", Fields: map[string]string{"case": "1"}}
+	item, err := s.SetItemMetadata(s.ctx, share.Name, "a", want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Metadata == nil || !reflect.DeepEqual(*item.Metadata, want) {
+		t.Errorf("Expected metadata %v, got %v", want, item.Metadata)
+	}
+
+	_, err = s.SetItemMetadata(s.ctx, share.Name, "b", storage.ItemMetadata{Guest: "g"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := s.ListShare(s.ctx, share.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range items {
+		if i.Metadata == nil {
+			t.Errorf("Expected metadata of %s to be listed", i.Path)
+		}
+	}
+
+	// Metadata of deleted items is removed
+	err = s.DeleteItem(s.ctx, share.Name, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := s.getShare(t, share.Name)
+	if _, ok := got.Items["a"]; ok || got.Items["b"].Guest != "g" {
+		t.Errorf("Expected only metadata of b, got %v", got.Items)
+	}
+
+	_, err = s.SetItemMetadata(s.ctx, share.Name, "a", want)
+	expectError(t, "SetItemMetadata(a)", err, storage.ErrItemNotFound)
+
+	_, err = s.SetItemMetadata(s.ctx, s.name("missing"), "a", want)
+	if err == nil {
+		t.Errorf("SetItemMetadata(missing): expected an error")
+	}
+
+	// Metadata is written with the item, and replaces the metadata of the
+	// item it replaces
+	for _, m := range []storage.ItemMetadata{want, {Guest: "other"}} {
+		item, err = s.CreateItem(s.ctx, share.Name, "c", 1, bytes.NewReader([]byte("c")), &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if item.Metadata == nil || !reflect.DeepEqual(*item.Metadata, m) {
+			t.Errorf("Expected metadata %v, got %v", m, item.Metadata)
+		}
+	}
+
+	// Metadata of a replaced item is kept without new metadata
+	item, err = s.CreateItem(s.ctx, share.Name, "c", 1, bytes.NewReader([]byte("c")), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Metadata == nil || item.Metadata.Guest != "other" {
+		t.Errorf("Expected metadata to be kept, got %v", item.Metadata)
+	}
+}
+
+func expectContent(t *testing.T, s *suite, share, item string, want []byte) {
+	t.Helper()
+
+	r, err := s.GetItemData(s.ctx, share, item)
+	if err != nil {
+		t.Fatalf("GetItemData(%s): %v", item, err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Errorf("Expected content %q of %s, got %q", want, item, b)
+	}
+}
+
+// expectSize fails the test if share size and count are not size and count
+func expectSize(t *testing.T, s *suite, share string, size, count int64) {
+	t.Helper()
+
+	got := s.getShare(t, share)
+	if got.Size != size || got.Count != count {
+		t.Errorf("Expected size %d and count %d, got %d and %d", size, count, got.Size, got.Count)
+	}
+}
+
+func testQuotas(t *testing.T, s *suite) {
+	share := s.createShare(t, "quotas", storage.Options{})
+
+	// Items larger than the file limit are rejected
+	_, err := s.CreateItem(s.ctx, share.Name, "big", MB+1, bytes.NewReader(make([]byte, MB+1)), nil)
+	expectError(t, "CreateItem(big)", err, storage.ErrMaxFileSizeReached)
+
+	// Items at the limit are accepted, and empty items regardless of limits
+	s.createItem(t, share.Name, "empty", []byte{})
+	s.createItem(t, share.Name, "first", make([]byte, MB))
+	expectSize(t, s, share.Name, MB, 2)
+
+	// Items larger than the space left in the share are rejected
+	s.createItem(t, share.Name, "half", make([]byte, MB/2))
+	_, err = s.CreateItem(s.ctx, share.Name, "second", MB, bytes.NewReader(make([]byte, MB)), nil)
+	expectError(t, "CreateItem(second)", err, storage.ErrMaxShareSizeReached)
+
+	// Share is full
+	s.createItem(t, share.Name, "last", make([]byte, MB/2))
+	_, err = s.CreateItem(s.ctx, share.Name, "more", 1, bytes.NewReader([]byte("x")), nil)
+	expectError(t, "CreateItem(more)", err, storage.ErrMaxShareSizeReached)
+	expectSize(t, s, share.Name, 2*MB, 4)
+
+	_, err = s.GetItem(s.ctx, share.Name, "more")
+	expectError(t, "GetItem(more)", err, storage.ErrItemNotFound)
+
+	// Deleting items frees space
+	err = s.DeleteItem(s.ctx, share.Name, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.createItem(t, share.Name, "more", make([]byte, MB))
+
+	// Limits are per share
+	other := s.createShare(t, "other", storage.Options{})
+	s.createItem(t, other.Name, "first", make([]byte, MB))
+}
+
+func testConflictPolicies(t *testing.T, s *suite) {
+	// Items are replaced by default
+	overwrite := s.createShare(t, "overwrite", storage.Options{})
+	s.createItem(t, overwrite.Name, "support.tgz", []byte("first"))
+	s.createItem(t, overwrite.Name, "support.tgz", []byte("second"))
+	expectContent(t, s, overwrite.Name, "support.tgz", []byte("second"))
+	expectSize(t, s, overwrite.Name, 6, 1)
+
+	// Existing items are kept
+	reject := s.createShare(t, "reject", storage.Options{Conflict: storage.ConflictReject})
+	s.createItem(t, reject.Name, "support.tgz", []byte("first"))
+	_, err := s.CreateItem(s.ctx, reject.Name, "support.tgz", 6, bytes.NewReader([]byte("second")), nil)
+	expectError(t, "CreateItem(support.tgz)", err, storage.ErrItemAlreadyExists)
+	expectContent(t, s, reject.Name, "support.tgz", []byte("first"))
+	expectSize(t, s, reject.Name, 5, 1)
+
+	// New items are given a free name
+	rename := s.createShare(t, "rename", storage.Options{Conflict: storage.ConflictRename})
+	for i, want := range []string{"support.tgz", "support (1).tgz", "support (2).tgz"} {
+		item := s.createItem(t, rename.Name, "support.tgz", []byte{byte('a' + i)})
+		if item.Path != path.Join(rename.Name, want) {
+			t.Errorf("Expected item %s, got %s", want, item.Path)
+		}
+		expectContent(t, s, rename.Name, want, []byte{byte('a' + i)})
+	}
+	item := s.createItem(t, rename.Name, "README", []byte("a"))
+	s.createItem(t, rename.Name, "README", []byte("b"))
+	if item.Path != path.Join(rename.Name, "README") {
+		t.Errorf("Expected item README, got %s", item.Path)
+	}
+	expectContent(t, s, rename.Name, "README (1)", []byte("b"))
+	expectSize(t, s, rename.Name, 5, 5)
+
+	// Policies can be changed
+	options := storage.Options{Conflict: storage.ConflictReject}
+	_, err = s.UpdateShare(s.ctx, overwrite.Name, &options, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateItem(s.ctx, overwrite.Name, "support.tgz", 5, bytes.NewReader([]byte("third")), nil)
+	expectError(t, "CreateItem(support.tgz) after update", err, storage.ErrItemAlreadyExists)
+}
+
+func testVersions(t *testing.T, s *suite) {
+	share := s.createShare(t, "versions", storage.Options{Conflict: storage.ConflictVersion})
+
+	// Items without previous content have no versions
+	s.createItem(t, share.Name, "support.tgz", []byte("a"))
+	versions, err := s.ListItemVersions(s.ctx, share.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 0 {
+		t.Errorf("Expected no versions, got %+v", versions)
+	}
+	_, err = s.ListItemVersions(s.ctx, share.Name, "missing")
+	expectError(t, "ListItemVersions(missing)", err, storage.ErrItemNotFound)
+
+	// Replaced content is kept as versions, oldest first
+	s.createItem(t, share.Name, "support.tgz", []byte("bb"))
+	s.createItem(t, share.Name, "support.tgz", []byte("ccc"))
+	expectContent(t, s, share.Name, "support.tgz", []byte("ccc"))
+
+	versions, err = s.ListItemVersions(s.ctx, share.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 1 || versions[0].ItemInfo.Size != 1 || versions[1].Version != 2 || versions[1].ItemInfo.Size != 2 {
+		t.Fatalf("Unexpected versions %+v", versions)
+	}
+	for v, want := range map[int]string{1: "a", 2: "bb"} {
+		r, err := s.GetItemVersionData(s.ctx, share.Name, "support.tgz", v)
+		if err != nil {
+			t.Fatalf("GetItemVersionData(%d): %v", v, err)
+		}
+		b, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != want {
+			t.Errorf("Expected version %d to be %q, got %q", v, want, b)
+		}
+	}
+	_, err = s.GetItemVersionData(s.ctx, share.Name, "support.tgz", 3)
+	expectError(t, "GetItemVersionData(3)", err, storage.ErrVersionNotFound)
+
+	// Versions count in the size of the share but are not items
+	expectSize(t, s, share.Name, 6, 1)
+	items, err := s.ListShare(s.ctx, share.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Path != path.Join(share.Name, "support.tgz") {
+		t.Errorf("Expected only support.tgz, got %+v", items)
+	}
+	if p := checkProblems(t, s, false); len(p) != 0 {
+		t.Errorf("Expected no problems with versions, got %+v", p)
+	}
+
+	// Deleted versions are not renumbered, and new ones follow the last
+	err = s.DeleteItemVersion(s.ctx, share.Name, "support.tgz", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeleteItemVersion(s.ctx, share.Name, "support.tgz", 1)
+	expectError(t, "DeleteItemVersion(1) after delete", err, storage.ErrVersionNotFound)
+	expectSize(t, s, share.Name, 5, 1)
+
+	s.createItem(t, share.Name, "support.tgz", []byte("dddd"))
+	versions, err = s.ListItemVersions(s.ctx, share.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Version != 2 || versions[1].Version != 3 || versions[1].ItemInfo.Size != 3 {
+		t.Errorf("Unexpected versions after delete %+v", versions)
+	}
+
+	// Versions are deleted with their item
+	err = s.DeleteItem(s.ctx, share.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.ListItemVersions(s.ctx, share.Name, "support.tgz")
+	expectError(t, "ListItemVersions after delete", err, storage.ErrItemNotFound)
+	expectSize(t, s, share.Name, 0, 0)
+
+	// Concurrent uploads each keep the content they replace as a version
+	const n = 6
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content := bytes.Repeat([]byte("x"), i+1)
+			_, err := s.CreateItem(s.ctx, share.Name, "concurrent.txt", int64(len(content)), bytes.NewReader(content), nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent upload failed: %v", err)
+		}
+	}
+
+	versions, err = s.ListItemVersions(s.ctx, share.Name, "concurrent.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := s.GetItem(s.ctx, share.Name, "concurrent.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sizes := []int64{item.ItemInfo.Size}
+	for _, v := range versions {
+		sizes = append(sizes, v.ItemInfo.Size)
+	}
+	slices.Sort(sizes)
+	if want := []int64{1, 2, 3, 4, 5, 6}; !slices.Equal(sizes, want) {
+		t.Errorf("Expected item and versions of sizes %v, got %v", want, sizes)
+	}
+	expectSize(t, s, share.Name, n*(n+1)/2, 1)
+}
+
+func testVersionQuotas(t *testing.T, s *suite) {
+	share := s.createShare(t, "versionquotas", storage.Options{Conflict: storage.ConflictVersion})
+
+	// Versions use the space of the share
+	s.createItem(t, share.Name, "item", make([]byte, MB))
+	s.createItem(t, share.Name, "item", make([]byte, MB))
+	expectSize(t, s, share.Name, 2*MB, 1)
+
+	_, err := s.CreateItem(s.ctx, share.Name, "more", 1, bytes.NewReader([]byte("x")), nil)
+	expectError(t, "CreateItem(more)", err, storage.ErrMaxShareSizeReached)
+
+	// Deleting versions frees space
+	err = s.DeleteItemVersion(s.ctx, share.Name, "item", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.createItem(t, share.Name, "more", []byte("x"))
+	expectSize(t, s, share.Name, MB+1, 2)
+}
+
+func testCopyItem(t *testing.T, s *suite) {
+	from := s.createShare(t, "copyfrom", storage.Options{})
+	to := s.createShare(t, "copyto", storage.Options{})
+
+	s.createItem(t, from.Name, "support.tgz", []byte("content"))
+	metadata := storage.ItemMetadata{Guest: "g", UploaderName: "Jane", Fields: map[string]string{"case": "1"}}
+	_, err := s.SetItemMetadata(s.ctx, from.Name, "support.tgz", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items are copied with their metadata
+	item, err := s.CopyItem(s.ctx, from.Name, "support.tgz", to.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Path != path.Join(to.Name, "support.tgz") || item.ItemInfo.Size != 7 || item.Metadata == nil || !reflect.DeepEqual(*item.Metadata, metadata) {
+		t.Errorf("Unexpected copy %+v", item)
+	}
+	expectContent(t, s, to.Name, "support.tgz", []byte("content"))
+	expectSize(t, s, to.Name, 7, 1)
+	expectSize(t, s, from.Name, 7, 1)
+
+	// Copies are independent of their source
+	s.createItem(t, to.Name, "support.tgz", []byte("replaced"))
+	expectContent(t, s, from.Name, "support.tgz", []byte("content"))
+	err = s.DeleteItem(s.ctx, to.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, s, from.Name, "support.tgz", []byte("content"))
+
+	// Items can be copied in the same share with another name, but not over
+	// themselves
+	_, err = s.CopyItem(s.ctx, from.Name, "support.tgz", from.Name, "copy.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, s, from.Name, "copy.tgz", []byte("content"))
+	expectSize(t, s, from.Name, 14, 2)
+	_, err = s.CopyItem(s.ctx, from.Name, "support.tgz", from.Name, "support.tgz")
+	expectError(t, "CopyItem over itself", err, storage.ErrItemAlreadyExists)
+
+	// Replaced items get the metadata of the copy
+	s.createItem(t, to.Name, "other.tgz", []byte("other"))
+	_, err = s.SetItemMetadata(s.ctx, to.Name, "other.tgz", storage.ItemMetadata{Note: "stale"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.createItem(t, from.Name, "plain.tgz", []byte("plain"))
+	item, err = s.CopyItem(s.ctx, from.Name, "plain.tgz", to.Name, "other.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Metadata != nil {
+		t.Errorf("Expected no metadata, got %+v", item.Metadata)
+	}
+
+	_, err = s.CopyItem(s.ctx, from.Name, "missing", to.Name, "missing")
+	expectError(t, "CopyItem(missing)", err, storage.ErrItemNotFound)
+	_, err = s.CopyItem(s.ctx, from.Name, "support.tgz", s.name("missing"), "support.tgz")
+	expectError(t, "CopyItem to missing share", err, storage.ErrShareNotFound)
+	_, err = s.CopyItem(s.ctx, from.Name, "support.tgz", to.Name, "../support.tgz")
+	expectError(t, "CopyItem to invalid name", err, storage.ErrInvalidItemName)
+
+	if p := checkProblems(t, s, false); len(p) != 0 {
+		t.Errorf("Expected no problems after copies, got %+v", p)
+	}
+}
+
+func testCopyConflicts(t *testing.T, s *suite) {
+	from := s.createShare(t, "conflictfrom", storage.Options{})
+	s.createItem(t, from.Name, "support.tgz", []byte("new"))
+
+	// The conflict policy of the destination applies
+	reject := s.createShare(t, "conflictreject", storage.Options{Conflict: storage.ConflictReject})
+	s.createItem(t, reject.Name, "support.tgz", []byte("old"))
+	_, err := s.CopyItem(s.ctx, from.Name, "support.tgz", reject.Name, "support.tgz")
+	expectError(t, "CopyItem to reject", err, storage.ErrItemAlreadyExists)
+	expectContent(t, s, reject.Name, "support.tgz", []byte("old"))
+
+	rename := s.createShare(t, "conflictrename", storage.Options{Conflict: storage.ConflictRename})
+	s.createItem(t, rename.Name, "support.tgz", []byte("old"))
+	item, err := s.CopyItem(s.ctx, from.Name, "support.tgz", rename.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Path != path.Join(rename.Name, "support (1).tgz") {
+		t.Errorf("Expected renamed copy, got %s", item.Path)
+	}
+
+	// An item copied in its share with ConflictRename is renamed
+	item, err = s.CopyItem(s.ctx, rename.Name, "support.tgz", rename.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Path != path.Join(rename.Name, "support (2).tgz") {
+		t.Errorf("Expected renamed copy, got %s", item.Path)
+	}
+
+	version := s.createShare(t, "conflictversion", storage.Options{Conflict: storage.ConflictVersion})
+	s.createItem(t, version.Name, "support.tgz", []byte("old"))
+	_, err = s.CopyItem(s.ctx, from.Name, "support.tgz", version.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContent(t, s, version.Name, "support.tgz", []byte("new"))
+	versions, err := s.ListItemVersions(s.ctx, version.Name, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].ItemInfo.Size != 3 {
+		t.Errorf("Expected previous content as a version, got %+v", versions)
+	}
+	expectSize(t, s, version.Name, 6, 1)
+}
+
+func testCopyQuotas(t *testing.T, s *suite) {
+	from := s.createShare(t, "copyquotafrom", storage.Options{})
+	to := s.createShare(t, "copyquotato", storage.Options{})
+	s.createItem(t, from.Name, "item", make([]byte, MB))
+
+	// Copies use the space of the destination share
+	_, err := s.CopyItem(s.ctx, from.Name, "item", to.Name, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CopyItem(s.ctx, from.Name, "item", to.Name, "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CopyItem(s.ctx, from.Name, "item", to.Name, "third")
+	expectError(t, "CopyItem(third)", err, storage.ErrMaxShareSizeReached)
+	expectSize(t, s, to.Name, 2*MB, 2)
+
+	// Concurrent copies can't exceed the quota of the destination
+	concurrent := s.createShare(t, "copyquotaconcurrent", storage.Options{})
+
+	const n = 4
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := s.CopyItem(s.ctx, from.Name, "item", concurrent.Name, fmt.Sprintf("item%d", i))
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	copied := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			copied++
+		case !errors.Is(err, storage.ErrMaxShareSizeReached):
+			t.Errorf("Concurrent copy failed: %v", err)
+		}
+	}
+	if copied != 2 {
+		t.Errorf("Expected 2 concurrent copies, got %d", copied)
+	}
+	expectSize(t, s, concurrent.Name, 2*MB, 2)
+}
+
+func testMoveItem(t *testing.T, s *suite) {
+	from := s.createShare(t, "movefrom", storage.Options{Conflict: storage.ConflictVersion})
+	to := s.createShare(t, "moveto", storage.Options{})
+
+	s.createItem(t, from.Name, "support.tgz", []byte("old"))
+	s.createItem(t, from.Name, "support.tgz", []byte("content"))
+	metadata := storage.ItemMetadata{Guest: "g", UploaderName: "Jane"}
+	_, err := s.SetItemMetadata(s.ctx, from.Name, "support.tgz", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items are moved with their metadata, and their versions are deleted
+	item, err := s.MoveItem(s.ctx, from.Name, "support.tgz", to.Name, "moved.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Path != path.Join(to.Name, "moved.tgz") || item.ItemInfo.Size != 7 || item.Metadata == nil || !reflect.DeepEqual(*item.Metadata, metadata) {
+		t.Errorf("Unexpected item %+v", item)
+	}
+	expectContent(t, s, to.Name, "moved.tgz", []byte("content"))
+	expectSize(t, s, to.Name, 7, 1)
+	expectSize(t, s, from.Name, 0, 0)
+	_, err = s.GetItem(s.ctx, from.Name, "support.tgz")
+	expectError(t, "GetItem(moved)", err, storage.ErrItemNotFound)
+	_, err = s.ListItemVersions(s.ctx, from.Name, "support.tgz")
+	expectError(t, "ListItemVersions(moved)", err, storage.ErrItemNotFound)
+
+	// Items can be renamed in their share, but not moved over themselves
+	item, err = s.MoveItem(s.ctx, to.Name, "moved.tgz", to.Name, "renamed.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Metadata == nil || !reflect.DeepEqual(*item.Metadata, metadata) {
+		t.Errorf("Expected metadata to be kept, got %+v", item.Metadata)
+	}
+	expectContent(t, s, to.Name, "renamed.tgz", []byte("content"))
+	expectSize(t, s, to.Name, 7, 1)
+	_, err = s.MoveItem(s.ctx, to.Name, "renamed.tgz", to.Name, "renamed.tgz")
+	expectError(t, "MoveItem over itself", err, storage.ErrItemAlreadyExists)
+	expectContent(t, s, to.Name, "renamed.tgz", []byte("content"))
+
+	// The conflict policy of the destination applies
+	s.createItem(t, from.Name, "renamed.tgz", []byte("new"))
+	item, err = s.MoveItem(s.ctx, to.Name, "renamed.tgz", from.Name, "renamed.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Metadata == nil || !reflect.DeepEqual(*item.Metadata, metadata) {
+		t.Errorf("Expected metadata of the moved item, got %+v", item.Metadata)
+	}
+	expectContent(t, s, from.Name, "renamed.tgz", []byte("content"))
+	versions, err := s.ListItemVersions(s.ctx, from.Name, "renamed.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].ItemInfo.Size != 3 {
+		t.Errorf("Expected replaced content as a version, got %+v", versions)
+	}
+	expectSize(t, s, to.Name, 0, 0)
+
+	_, err = s.MoveItem(s.ctx, from.Name, "missing", to.Name, "missing")
+	expectError(t, "MoveItem(missing)", err, storage.ErrItemNotFound)
+	_, err = s.MoveItem(s.ctx, from.Name, "renamed.tgz", s.name("missing"), "renamed.tgz")
+	expectError(t, "MoveItem to missing share", err, storage.ErrShareNotFound)
+	_, err = s.MoveItem(s.ctx, from.Name, "renamed.tgz", to.Name, "../renamed.tgz")
+	expectError(t, "MoveItem to invalid name", err, storage.ErrInvalidItemName)
+	expectContent(t, s, from.Name, "renamed.tgz", []byte("content"))
+
+	if p := checkProblems(t, s, false); len(p) != 0 {
+		t.Errorf("Expected no problems after moves, got %+v", p)
+	}
+}
+
+func testMoveQuotas(t *testing.T, s *suite) {
+	from := s.createShare(t, "movequotafrom", storage.Options{})
+	to := s.createShare(t, "movequotato", storage.Options{})
+	s.createItem(t, from.Name, "first", make([]byte, MB))
+	s.createItem(t, from.Name, "second", make([]byte, MB))
+	s.createItem(t, to.Name, "item", make([]byte, MB))
+
+	// Moves use the space of the destination share
+	_, err := s.MoveItem(s.ctx, from.Name, "first", to.Name, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.MoveItem(s.ctx, from.Name, "second", to.Name, "second")
+	expectError(t, "MoveItem(second)", err, storage.ErrMaxShareSizeReached)
+	expectSize(t, s, to.Name, 2*MB, 2)
+	expectContent(t, s, from.Name, "second", make([]byte, MB))
+
+	// Items of a full share can be renamed
+	_, err = s.MoveItem(s.ctx, to.Name, "item", to.Name, "renamed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectSize(t, s, to.Name, 2*MB, 2)
+}
+
+func testRenameShare(t *testing.T, s *suite) {
+	from := s.createShare(t, "renamefrom", storage.Options{Message: "hello", Conflict: storage.ConflictVersion})
+	s.createItem(t, from.Name, "support.tgz", []byte("old"))
+	s.createItem(t, from.Name, "support.tgz", []byte("content"))
+	metadata := storage.ItemMetadata{UploaderName: "Jane"}
+	_, err := s.SetItemMetadata(s.ctx, from.Name, "support.tgz", metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.AddDownloads(s.ctx, from.Name, []string{"support.tgz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Items, versions and metadata are moved to the new name
+	to := s.name("renameto")
+	until := time.Now().Add(time.Hour)
+	share, err := s.RenameShare(s.ctx, from.Name, to, until)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.track(to)
+	if share.Name != to || share.Owner != "admin" || share.Options.Message != "hello" || !share.DateCreated.Equal(from.DateCreated) {
+		t.Errorf("Unexpected share %+v", share)
+	}
+
+	_, err = s.GetShare(s.ctx, from.Name)
+	expectError(t, "GetShare(previous name)", err, storage.ErrShareNotFound)
+	_, err = s.ListShare(s.ctx, from.Name)
+	expectError(t, "ListShare(previous name)", err, storage.ErrShareNotFound)
+
+	got := s.getShare(t, to)
+	if got.Downloads["support.tgz"] != 1 {
+		t.Errorf("Expected downloads to be kept, got %v", got.Downloads)
+	}
+	expectSize(t, s, to, 10, 1)
+	expectContent(t, s, to, "support.tgz", []byte("content"))
+	item, err := s.GetItem(s.ctx, to, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Path != path.Join(to, "support.tgz") || item.Metadata == nil || !reflect.DeepEqual(*item.Metadata, metadata) {
+		t.Errorf("Unexpected item %+v", item)
+	}
+	versions, err := s.ListItemVersions(s.ctx, to, "support.tgz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].ItemInfo.Size != 3 {
+		t.Errorf("Unexpected versions %+v", versions)
+	}
+
+	// The previous name resolves to the share until the end of the grace
+	// period
+	r, err := s.GetRenamedShare(s.ctx, from.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.From != from.Name || r.Name != to || !r.Until.Equal(until.UTC().Truncate(time.Second)) {
+		t.Errorf("Unexpected rename %+v", r)
+	}
+	name, err := storage.ResolveShare(s.ctx, s, from.Name)
+	if err != nil || name != to {
+		t.Errorf("Expected %s to resolve to %s, got %s, %v", from.Name, to, name, err)
+	}
+	name, err = storage.ResolveShare(s.ctx, s, s.name("unknown"))
+	if err != nil || name != s.name("unknown") {
+		t.Errorf("Expected unknown share to resolve to itself, got %s, %v", name, err)
+	}
+	_, err = s.GetRenamedShare(s.ctx, s.name("unknown"))
+	expectError(t, "GetRenamedShare(unknown)", err, storage.ErrShareNotFound)
+
+	// A rename without grace period ends the previous ones
+	again := s.name("renameagain")
+	_, err = s.RenameShare(s.ctx, to, again, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.track(again)
+	for _, n := range []string{from.Name, to} {
+		_, err = storage.ResolveShare(s.ctx, s, n)
+		expectError(t, fmt.Sprintf("ResolveShare(%s)", n), err, storage.ErrShareRenamed)
+	}
+
+	// Shares can get a previous name back
+	_, err = s.RenameShare(s.ctx, again, from.Name, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.GetRenamedShare(s.ctx, from.Name)
+	expectError(t, "GetRenamedShare(current name)", err, storage.ErrShareNotFound)
+	expectContent(t, s, from.Name, "support.tgz", []byte("content"))
+
+	other := s.createShare(t, "renameother", storage.Options{})
+	_, err = s.RenameShare(s.ctx, from.Name, other.Name, time.Time{})
+	expectError(t, "RenameShare to existing share", err, storage.ErrShareAlreadyExists)
+	_, err = s.RenameShare(s.ctx, from.Name, from.Name, time.Time{})
+	expectError(t, "RenameShare to itself", err, storage.ErrShareAlreadyExists)
+	_, err = s.RenameShare(s.ctx, s.name("missing"), s.name("renamed"), time.Time{})
+	expectError(t, "RenameShare(missing)", err, storage.ErrShareNotFound)
+	for _, n := range []string{"", "../share", ".share"} {
+		_, err = s.RenameShare(s.ctx, from.Name, n, time.Time{})
+		expectError(t, fmt.Sprintf("RenameShare to %q", n), err, storage.ErrInvalidShareName)
+		_, err = s.RenameShare(s.ctx, n, from.Name, time.Time{})
+		expectError(t, fmt.Sprintf("RenameShare(%q)", n), err, storage.ErrInvalidShareName)
+	}
+	expectContent(t, s, from.Name, "support.tgz", []byte("content"))
+
+	// Records are only purged once they stopped working before the given
+	// time
+	purged, err := s.PurgeRenamedShares(s.ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{to, again} {
+		if slices.Contains(purged, n) {
+			t.Errorf("Expected record of %s to be kept, got %v", n, purged)
+		}
+	}
+	purged, err = s.PurgeRenamedShares(s.ctx, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range []string{to, again} {
+		if !slices.Contains(purged, n) {
+			t.Errorf("Expected record of %s to be purged, got %v", n, purged)
+		}
+		_, err = s.GetRenamedShare(s.ctx, n)
+		expectError(t, fmt.Sprintf("GetRenamedShare(%s) after purge", n), err, storage.ErrShareNotFound)
+	}
+
+	if p := checkProblems(t, s, false); len(p) != 0 {
+		t.Errorf("Expected no problems after renames, got %+v", p)
+	}
+}
+
+func testConcurrentUploads(t *testing.T, s *suite) {
+	share := s.createShare(t, "concurrent", storage.Options{})
+
+	const n = 8
+
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			content := bytes.Repeat([]byte("x"), i+1)
+			_, err := s.CreateItem(s.ctx, share.Name, fmt.Sprintf("item%d", i), int64(len(content)), bytes.NewReader(content), nil)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent upload failed: %v", err)
+		}
+	}
+
+	items, err := s.ListShare(s.ctx, share.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != n {
+		t.Errorf("Expected %d items, got %d", n, len(items))
+	}
+
+	expectSize(t, s, share.Name, n*(n+1)/2, n)
+}
+
+// testStress runs parallel uploads, deletes and downloads on one share and
+// checks that no metadata update is lost, then fills another share with
+// parallel uploads and checks its limit is enforced
+func testStress(t *testing.T, s *suite) {
+	share := s.createShare(t, "stress", storage.Options{})
+	s.createItem(t, share.Name, "download.txt", []byte("download"))
+
+	const (
+		workers   = 8
+		uploads   = 6
+		downloads = 20
+	)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers*uploads*3+downloads*2)
+
+	// Uploaders create items, delete half of them, and all replace the same
+	// item with content of different sizes
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range uploads {
+				n := fmt.Sprintf("item-%d-%d", w, u)
+				content := bytes.Repeat([]byte("x"), w+u+1)
+				_, err := s.CreateItem(s.ctx, share.Name, n, int64(len(content)), bytes.NewReader(content), nil)
+				errs <- err
+
+				content = bytes.Repeat([]byte{byte('a' + w)}, 100*(w+1))
+				_, err = s.CreateItem(s.ctx, share.Name, "same.txt", int64(len(content)), bytes.NewReader(content), nil)
+				errs <- err
+
+				if u%2 == 1 {
+					errs <- s.DeleteItem(s.ctx, share.Name, n)
+				}
+			}
+		}()
+	}
+
+	// Downloads are counted one after the other, concurrent item updates
+	// must not reset the count
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for range downloads {
+			r, err := s.GetItemData(s.ctx, share.Name, "download.txt")
+			if err != nil {
+				errs <- err
+				continue
+			}
+			_, err = io.Copy(io.Discard, r)
+			r.Close()
+			errs <- err
+
+			current, err := s.GetShare(s.ctx, share.Name)
+			if err != nil {
+				errs <- err
+				continue
+			}
+			current.Downloads["download.txt"]++
+			_, err = s.UpdateShare(s.ctx, share.Name, nil, &current.Downloads)
+			errs <- err
+		}
+	}()
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Concurrent operation failed: %v", err)
+		}
+	}
+
+	got := s.getShare(t, share.Name)
+	if got.Downloads["download.txt"] != downloads {
+		t.Errorf("Expected %d downloads, got %d", downloads, got.Downloads["download.txt"])
+	}
+
+	items, err := s.ListShare(s.ctx, share.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// download.txt, same.txt and the items that were not deleted
+	if want := 2 + workers*uploads/2; len(items) != want {
+		t.Errorf("Expected %d items, got %d", want, len(items))
+	}
+
+	size := int64(0)
+	for _, i := range items {
+		size += i.ItemInfo.Size
+	}
+	if got.Size != size || got.Count != int64(len(items)) {
+		t.Errorf("Expected size %d and count %d, got %d and %d", size, len(items), got.Size, got.Count)
+	}
+
+	// Replaced item holds the complete content of one of the uploads
+	r, err := s.GetItemData(s.ctx, share.Name, "same.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := int(b[0] - 'a')
+	if len(b) != 100*(w+1) || !bytes.Equal(b, bytes.Repeat(b[:1], len(b))) {
+		t.Errorf("Unexpected content of replaced item, %d bytes", len(b))
+	}
+
+	// Parallel uploads to a share can't exceed its limit
+	full := s.createShare(t, "stressquota", storage.Options{})
+
+	errs = make(chan error, workers*uploads)
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for u := range uploads {
+				content := make([]byte, MB/4)
+				_, err := s.CreateItem(s.ctx, full.Name, fmt.Sprintf("item-%d-%d", w, u), int64(len(content)), bytes.NewReader(content), nil)
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	uploaded := int64(0)
+	for err := range errs {
+		switch {
+		case err == nil:
+			uploaded++
+		case !errors.Is(err, storage.ErrMaxShareSizeReached):
+			t.Errorf("Concurrent upload failed: %v", err)
+		}
+	}
+	if uploaded == 0 {
+		t.Error("Expected concurrent uploads to fill the share")
+	}
+
+	got = s.getShare(t, full.Name)
+	if got.Size > MB {
+		t.Errorf("Expected size of at most %d, got %d", MB, got.Size)
+	}
+	expectSize(t, s, full.Name, uploaded*MB/4, uploaded)
+}
+
+func testListingOrder(t *testing.T, s *suite) {
+	// Shares are listed newest first
+	created := time.Date(2024, 9, 1, 0, 0, 0, 0, time.UTC)
+	for i, n := range []string{"b", "c", "a"} {
+		share := storage.NewShare().
+			WithName(s.name(n)).
+			WithOwner("admin").
+			WithDateCreated(created.Add(time.Duration(i) * time.Hour)).
+			WithOptions(storage.DefaultOptions())
+		_, err := s.RestoreShare(s.ctx, share)
+		s.track(share.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	shares, err := s.ListShares(s.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, share := range shares {
+		if len(share.Name) > len(s.prefix) && share.Name[:len(s.prefix)] == s.prefix {
+			got = append(got, share.Name[len(s.prefix):])
+		}
+	}
+	if want := []string{"a", "c", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected shares %v, got %v", want, got)
+	}
+
+	// Queries filter by prefix, sort and paginate
+	page, err := s.QueryShares(s.ctx, storage.ShareQuery{Prefix: s.prefix, Sort: "name", Limit: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 3 || len(page.Shares) != 2 || page.Shares[0].Name != s.name("a") || page.Next == "" {
+		t.Errorf("Unexpected page %+v", page)
+	}
+	page, err = s.QueryShares(s.ctx, storage.ShareQuery{Prefix: s.prefix, Sort: "name", Limit: 2, Cursor: page.Next})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Shares) != 1 || page.Shares[0].Name != s.name("c") || page.Next != "" {
+		t.Errorf("Unexpected page %+v", page)
+	}
+
+	// Items are listed newest first
+	for _, n := range []string{"x.txt", "y.txt", "z.txt"} {
+		s.createItem(t, s.name("a"), n, []byte(n))
+	}
+
+	items, err := s.ListShare(s.ctx, s.name("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("Expected 3 items, got %+v", items)
+	}
+	if !slices.IsSortedFunc(items, func(a, b storage.Item) int {
+		return b.ItemInfo.DateModified.Compare(a.ItemInfo.DateModified)
+	}) {
+		t.Errorf("Expected items sorted newest first, got %+v", items)
+	}
+
+	itemPage, err := s.QueryItems(s.ctx, s.name("a"), storage.ItemQuery{Prefix: "y", Sort: "-name"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if itemPage.Total != 1 || itemPage.Items[0].Path != path.Join(s.name("a"), "y.txt") {
+		t.Errorf("Unexpected page %+v", itemPage)
+	}
+
+	// Pages by name are the same when backends stop reading once the page
+	// is filled
+	got = []string{}
+	q := storage.ShareQuery{Prefix: s.prefix, Owner: "admin", Sort: "-name", Limit: 2}
+	for range 3 {
+		page, err = s.QueryShares(s.ctx, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, shareNamesWithoutPrefix(s, page.Shares)...)
+		if page.Next == "" {
+			break
+		}
+		q.Cursor = page.Next
+	}
+	if want := []string{"c", "b", "a"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected shares %v, got %v", want, got)
+	}
+
+	got = []string{}
+	iq := storage.ItemQuery{Sort: "name", Limit: 2}
+	for range 3 {
+		itemPage, err = s.QueryItems(s.ctx, s.name("a"), iq)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, i := range itemPage.Items {
+			got = append(got, path.Base(i.Path))
+		}
+		if itemPage.Next == "" {
+			break
+		}
+		iq.Cursor = itemPage.Next
+	}
+	if want := []string{"x.txt", "y.txt", "z.txt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected items %v, got %v", want, got)
+	}
+}
+
+// shareNamesWithoutPrefix returns names of shares without the prefix of s
+func shareNamesWithoutPrefix(s *suite, shares []storage.Share) []string {
+	result := []string{}
+	for _, share := range shares {
+		result = append(result, strings.TrimPrefix(share.Name, s.prefix))
+	}
+	return result
+}
+
+func testDeletes(t *testing.T, s *suite) {
+	share := s.createShare(t, "deletes", storage.Options{})
+	s.createItem(t, share.Name, "a.txt", []byte("a"))
+	s.createItem(t, share.Name, "b.txt", []byte("bb"))
+
+	err := s.DeleteItem(s.ctx, share.Name, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.GetItem(s.ctx, share.Name, "a.txt")
+	expectError(t, "GetItem after delete", err, storage.ErrItemNotFound)
+	_, err = s.GetItemData(s.ctx, share.Name, "a.txt")
+	expectError(t, "GetItemData after delete", err, storage.ErrItemNotFound)
+	err = s.DeleteItem(s.ctx, share.Name, "a.txt")
+	expectError(t, "DeleteItem after delete", err, storage.ErrItemNotFound)
+
+	expectSize(t, s, share.Name, 2, 1)
+
+	err = s.DeleteShare(s.ctx, share.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s.GetShare(s.ctx, share.Name)
+	expectError(t, "GetShare after delete", err, storage.ErrShareNotFound)
+	_, err = s.ListShare(s.ctx, share.Name)
+	expectError(t, "ListShare after delete", err, storage.ErrShareNotFound)
+	_, err = s.GetItem(s.ctx, share.Name, "b.txt")
+	expectError(t, "GetItem after share delete", err, storage.ErrItemNotFound)
+	err = s.DeleteShare(s.ctx, share.Name)
+	expectError(t, "DeleteShare after delete", err, storage.ErrShareNotFound)
+
+	shares, err := s.ListShares(s.ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sh := range shares {
+		if sh.Name == share.Name {
+			t.Errorf("Expected deleted share not to be listed")
+		}
+	}
+
+	// A deleted share can be created again, empty
+	s.createShare(t, "deletes", storage.Options{})
+	expectSize(t, s, share.Name, 0, 0)
+}
+
+func testErrors(t *testing.T, s *suite) {
+	missing := s.name("missing")
+
+	_, err := s.GetShare(s.ctx, missing)
+	expectError(t, "GetShare", err, storage.ErrShareNotFound)
+
+	_, err = s.UpdateShare(s.ctx, missing, &storage.Options{}, nil)
+	expectError(t, "UpdateShare", err, storage.ErrShareNotFound)
+
+	err = s.DeleteShare(s.ctx, missing)
+	expectError(t, "DeleteShare", err, storage.ErrShareNotFound)
+
+	_, err = s.ListShare(s.ctx, missing)
+	expectError(t, "ListShare", err, storage.ErrShareNotFound)
+
+	_, err = s.QueryItems(s.ctx, missing, storage.ItemQuery{})
+	expectError(t, "QueryItems", err, storage.ErrShareNotFound)
+
+	_, err = s.CreateItem(s.ctx, missing, "item", 1, bytes.NewReader([]byte("x")), nil)
+	expectError(t, "CreateItem", err, storage.ErrShareNotFound)
+
+	// Item operations report missing items, whether the share exists or not
+	_, err = s.GetItem(s.ctx, missing, "item")
+	expectError(t, "GetItem", err, storage.ErrItemNotFound)
+
+	share := s.createShare(t, "errors", storage.Options{})
+
+	_, err = s.CreateShare(s.ctx, share.Name, "admin", storage.Options{})
+	expectError(t, "CreateShare", err, storage.ErrShareAlreadyExists)
+
+	_, err = s.GetItem(s.ctx, share.Name, "item")
+	expectError(t, "GetItem", err, storage.ErrItemNotFound)
+
+	_, err = s.GetItemData(s.ctx, share.Name, "item")
+	expectError(t, "GetItemData", err, storage.ErrItemNotFound)
+
+	err = s.DeleteItem(s.ctx, share.Name, "item")
+	expectError(t, "DeleteItem", err, storage.ErrItemNotFound)
+
+	_, err = s.QueryShares(s.ctx, storage.ShareQuery{Sort: "unknown"})
+	expectError(t, "QueryShares", err, storage.ErrInvalidQuery)
+
+	_, err = s.QueryItems(s.ctx, share.Name, storage.ItemQuery{Limit: -1})
+	expectError(t, "QueryItems", err, storage.ErrInvalidQuery)
+}
+
+// testLeases checks backends implementing storage.LeaseStore
+func testLeases(t *testing.T, s *suite) {
+	store, ok := s.Storage.(storage.LeaseStore)
+	if !ok {
+		t.Skip("backend doesn't store leases")
+	}
+
+	name := s.name("lease")
+
+	l, err := store.AcquireLease(s.ctx, name, "a", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Name != name || l.Holder != "a" || time.Until(l.Expires) < 50*time.Second {
+		t.Errorf("Unexpected lease %+v", l)
+	}
+
+	// Lease is held by a until released
+	l, err = store.AcquireLease(s.ctx, name, "b", time.Minute)
+	expectError(t, "AcquireLease(b)", err, storage.ErrLeaseHeld)
+	if l == nil || l.Holder != "a" {
+		t.Errorf("Expected current lease held by a, got %+v", l)
+	}
+
+	_, err = store.AcquireLease(s.ctx, name, "a", time.Minute)
+	if err != nil {
+		t.Errorf("Expected lease to be renewed, got %v", err)
+	}
+
+	// Only the holder can release a lease
+	err = store.ReleaseLease(s.ctx, name, "b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.AcquireLease(s.ctx, name, "b", time.Minute)
+	expectError(t, "AcquireLease(b)", err, storage.ErrLeaseHeld)
+
+	err = store.ReleaseLease(s.ctx, name, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = store.AcquireLease(s.ctx, name, "b", 100*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Expected released lease to be acquired, got %v", err)
+	}
+
+	// Expired leases can be acquired
+	time.Sleep(200 * time.Millisecond)
+	_, err = store.AcquireLease(s.ctx, name, "a", time.Minute)
+	if err != nil {
+		t.Errorf("Expected expired lease to be acquired, got %v", err)
+	}
+
+	// Only one holder acquires a free lease
+	other := s.name("concurrent")
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		holders []string
+	)
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			holder := fmt.Sprintf("holder%d", i)
+			_, err := store.AcquireLease(s.ctx, other, holder, time.Minute)
+			if err == nil {
+				mu.Lock()
+				holders = append(holders, holder)
+				mu.Unlock()
+			} else if !errors.Is(err, storage.ErrLeaseHeld) {
+				t.Errorf("AcquireLease(%s): %v", holder, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(holders) != 1 {
+		t.Errorf("Expected one holder, got %v", holders)
+	}
+
+	_, err = store.AcquireLease(s.ctx, "../lease", "a", time.Minute)
+	if err == nil {
+		t.Errorf("Expected invalid lease name to be rejected")
+	}
+}
+
+// checkProblems runs Check and returns the problems found in shares of the
+// test, as other tests may use the same backend
+func checkProblems(t *testing.T, s *suite, repair bool) []storage.Problem {
+	t.Helper()
+
+	report, err := s.Check(s.ctx, repair)
+	if err != nil {
+		t.Fatalf("Check(%v): %v", repair, err)
+	}
+	if report.Repair != repair {
+		t.Errorf("Expected report repair to be %v", repair)
+	}
+
+	result := []storage.Problem{}
+	for _, p := range report.Problems {
+		if strings.HasPrefix(p.Share, s.prefix) {
+			result = append(result, p)
+		}
+	}
+
+	return result
+}
+
+func testCheck(t *testing.T, s *suite) {
+	clean := s.createShare(t, "clean", storage.Options{})
+	s.createItem(t, clean.Name, "item", []byte("hello"))
+
+	if p := checkProblems(t, s, false); len(p) != 0 {
+		t.Fatalf("Expected no problems, got %+v", p)
+	}
+
+	// Download counts of deleted items are stale
+	share := s.createShare(t, "stale", storage.Options{})
+	s.createItem(t, share.Name, "kept", []byte("hello"))
+	s.createItem(t, share.Name, "deleted", []byte("hello"))
+
+	downloads := map[string]int64{"kept": 1, "deleted": 2}
+	_, err := s.UpdateShare(s.ctx, share.Name, nil, &downloads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.ReserveDownloads(s.ctx, share.Name, []string{"deleted"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.DeleteItem(s.ctx, share.Name, "deleted")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, repair := range []bool{false, true} {
+		p := checkProblems(t, s, repair)
+		if len(p) != 1 || p[0].Kind != storage.ProblemStaleDownloads || p[0].Share != share.Name || p[0].Repaired != repair {
+			t.Errorf("Check(%v): expected stale downloads of %s, got %+v", repair, share.Name, p)
+		}
+	}
+
+	if p := checkProblems(t, s, false); len(p) != 0 {
+		t.Errorf("Expected no problems after repair, got %+v", p)
+	}
+
+	got := s.getShare(t, share.Name)
+	if !reflect.DeepEqual(got.Downloads, map[string]int64{"kept": 1}) || len(got.GuestDownloads) != 0 || got.Size != 5 || got.Count != 1 {
+		t.Errorf("Unexpected share after repair %+v", got)
+	}
+}
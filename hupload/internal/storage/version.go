@@ -0,0 +1,244 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrItemAlreadyExists = errors.New("item already exists")
+	ErrVersionNotFound   = errors.New("version not found")
+	ErrInvalidConflict   = errors.New("invalid conflict policy")
+)
+
+// Conflict policies define what happens when an item is uploaded with the
+// name of an existing item. ConflictOverwrite, the default, replaces it,
+// ConflictReject refuses the upload, ConflictRename gives the new item a name
+// like "support (1).tgz" and ConflictVersion replaces it but keeps its
+// previous content as a version.
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictReject    = "reject"
+	ConflictRename    = "rename"
+	ConflictVersion   = "version"
+)
+
+// maxRenames is the number of names tried for an item uploaded to a share
+// with ConflictRename
+const maxRenames = 1000
+
+// versionsDir is the directory of a share where versions of its items are
+// kept, in versionsDir/<item>/<version>. Its name is not a valid item name.
+const versionsDir = ".versions"
+
+// ItemVersion is a previous content of an item, kept when the item was
+// replaced in a share with ConflictVersion. Versions are numbered from 1 in
+// the order they were replaced, and count in the size of the share.
+type ItemVersion struct {
+	Version  int
+	ItemInfo ItemInfo
+}
+
+// ValidConflict returns true if c is a known conflict policy, empty meaning
+// ConflictOverwrite
+func ValidConflict(c string) bool {
+	switch c {
+	case "", ConflictOverwrite, ConflictReject, ConflictRename, ConflictVersion:
+		return true
+	}
+	return false
+}
+
+// ValidateConflict returns ErrInvalidConflict if the conflict policy of o is
+// unknown
+func (o Options) ValidateConflict() error {
+	if !ValidConflict(o.Conflict) {
+		return fmt.Errorf("%w: %s", ErrInvalidConflict, o.Conflict)
+	}
+	return nil
+}
+
+// itemName returns the name item i is created with in a share with options
+// o, exists telling if an item exists. It returns ErrItemAlreadyExists if i
+// exists and o rejects conflicts.
+func (o Options) itemName(i string, exists func(string) (bool, error)) (string, error) {
+	if o.Conflict != ConflictReject && o.Conflict != ConflictRename {
+		return i, nil
+	}
+
+	for n := range maxRenames {
+		name := i
+		if n > 0 {
+			name = renamedItem(i, n)
+		}
+
+		found, err := exists(name)
+		if err != nil {
+			return "", err
+		}
+		if !found {
+			return name, nil
+		}
+
+		if o.Conflict == ConflictReject {
+			break
+		}
+	}
+
+	return "", fmt.Errorf("%w : %s", ErrItemAlreadyExists, i)
+}
+
+// AvailableItemName returns the name item i is created with in share of s
+// when conflicting items are renamed, i if there is no item named i.
+func AvailableItemName(ctx context.Context, s Storage, share, i string) (string, error) {
+	return Options{Conflict: ConflictRename}.itemName(i, func(n string) (bool, error) {
+		_, err := s.GetItem(ctx, share, n)
+		if errors.Is(err, ErrItemNotFound) {
+			return false, nil
+		}
+		return err == nil, err
+	})
+}
+
+// copyItemName returns the name item i of share s is copied with to item to
+// of share t with options o. An item can't be copied over itself, it returns
+// ErrItemAlreadyExists unless o renames the copy.
+func (o Options) copyItemName(s, i, t, to string, exists func(string) (bool, error)) (string, error) {
+	name, err := o.itemName(to, exists)
+	if err != nil {
+		return "", err
+	}
+
+	if s == t && name == i {
+		return "", fmt.Errorf("%w : %s", ErrItemAlreadyExists, i)
+	}
+
+	return name, nil
+}
+
+// renamedItem returns name with n added before its extension, like
+// "support (1).tgz"
+func renamedItem(name string, n int) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), n, ext)
+}
+
+// versionPath returns the path of version v of item i relative to its share
+func versionPath(i string, v int) string {
+	return path.Join(versionsDir, i, strconv.Itoa(v))
+}
+
+// itemVersions returns the versions of objects, which paths end with the
+// version number, sorted by version
+func itemVersions(objects []Item) []ItemVersion {
+	result := []ItemVersion{}
+	for _, o := range objects {
+		v, err := strconv.Atoi(path.Base(o.Path))
+		if err != nil || v < 1 {
+			continue
+		}
+		result = append(result, ItemVersion{Version: v, ItemInfo: o.ItemInfo})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Version < result[j].Version
+	})
+
+	return result
+}
+
+// nextVersion returns the number of the version following versions
+func nextVersion(versions []ItemVersion) int {
+	if len(versions) == 0 {
+		return 1
+	}
+	return versions[len(versions)-1].Version + 1
+}
+
+// isVersionPath returns true if p, relative to a share, is the path of a
+// version of an item
+func isVersionPath(p string) bool {
+	parts := strings.Split(p, "/")
+	if len(parts) != 3 || parts[0] != versionsDir || !isItemNameSafe(parts[1]) {
+		return false
+	}
+	v, err := strconv.Atoi(parts[2])
+	return err == nil && v > 0
+}
+
+// listObjectVersions returns the objects of versions of every item of share
+// in object storage backend b
+func listObjectVersions(ctx context.Context, b objectBackend, share string) ([]Item, error) {
+	objects, err := b.listKeys(ctx, path.Join(share, versionsDir)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Item{}
+	for _, o := range objects {
+		if isVersionPath(strings.TrimPrefix(o.Path, share+"/")) {
+			result = append(result, o)
+		}
+	}
+
+	return result, nil
+}
+
+// objectItemVersions returns the versions of item of share in object storage
+// backend b
+func objectItemVersions(ctx context.Context, b objectBackend, share, item string) ([]ItemVersion, error) {
+	objects, err := b.listKeys(ctx, path.Join(share, versionsDir, item)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	return itemVersions(objects), nil
+}
+
+// deleteObjectVersions deletes the versions of item of share in object
+// storage backend b, or the versions of every item if item is empty
+func deleteObjectVersions(ctx context.Context, b objectBackend, share, item string) error {
+	objects, err := b.listKeys(ctx, path.Join(share, versionsDir, item)+"/")
+	if err != nil {
+		return err
+	}
+
+	for _, o := range objects {
+		err = b.deleteKey(ctx, o.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// restoreObject deletes object key of an upload which is rejected, or puts
+// back its previous content from object version if it is not empty
+func restoreObject(ctx context.Context, b copyBackend, key, version string) error {
+	if version == "" {
+		return b.deleteKey(ctx, key)
+	}
+
+	objects, err := b.listKeys(ctx, version)
+	if err != nil {
+		return err
+	}
+	i := slices.IndexFunc(objects, func(o Item) bool { return o.Path == version })
+	if i < 0 {
+		return ErrVersionNotFound
+	}
+
+	err = b.copyKey(ctx, version, key, objects[i].ItemInfo.Size)
+	if err != nil {
+		return err
+	}
+
+	return b.deleteKey(ctx, version)
+}
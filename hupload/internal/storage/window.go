@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrUploadNotOpen   = errors.New("upload not open yet")
+	ErrUploadClosed    = errors.New("upload closed")
+	ErrDownloadNotOpen = errors.New("download not open yet")
+	ErrDownloadClosed  = errors.New("download closed")
+
+	ErrInvalidWindow = errors.New("invalid window")
+)
+
+// checkWindow returns notOpen before opens and closed from closes, zero
+// times leaving the window open on that side
+func checkWindow(now, opens, closes time.Time, notOpen, closed error) error {
+	switch {
+	case !opens.IsZero() && now.Before(opens):
+		return fmt.Errorf("%w, opens at %s", notOpen, opens.UTC().Format(time.RFC3339))
+	case !closes.IsZero() && !now.Before(closes):
+		return fmt.Errorf("%w at %s", closed, closes.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// CanUpload returns ErrUploadNotOpen or ErrUploadClosed if guests can't
+// upload to or delete items from s at now because of its upload window
+func (s *Share) CanUpload(now time.Time) error {
+	return checkWindow(now, s.Options.UploadOpensAt, s.Options.UploadClosesAt, ErrUploadNotOpen, ErrUploadClosed)
+}
+
+// CanDownload returns ErrDownloadNotOpen or ErrDownloadClosed if guests can't
+// download items of s at now because of its download window
+func (s *Share) CanDownload(now time.Time) error {
+	return checkWindow(now, s.Options.DownloadOpensAt, s.Options.DownloadClosesAt, ErrDownloadNotOpen, ErrDownloadClosed)
+}
+
+// ValidateWindows returns ErrInvalidWindow if a window of o closes before it
+// opens
+func (o Options) ValidateWindows() error {
+	if !o.UploadOpensAt.IsZero() && !o.UploadClosesAt.IsZero() && !o.UploadClosesAt.After(o.UploadOpensAt) {
+		return fmt.Errorf("%w: upload closes before it opens", ErrInvalidWindow)
+	}
+	if !o.DownloadOpensAt.IsZero() && !o.DownloadClosesAt.IsZero() && !o.DownloadClosesAt.After(o.DownloadOpensAt) {
+		return fmt.Errorf("%w: download closes before it opens", ErrInvalidWindow)
+	}
+	return nil
+}
@@ -0,0 +1,283 @@
+// Package transfer copies shares and items from one storage backend to
+// another, preserving share metadata.
+//
+// A transfer can be interrupted and run again, items already present in the
+// destination with the same size, or the same checksum when verifying, are
+// skipped.
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+var (
+	ErrSizeMismatch     = errors.New("size mismatch")
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+)
+
+// Actions reported in events
+const (
+	ActionRestore = "restore" // share metadata is written to destination
+	ActionCopy    = "copy"    // item is copied to destination
+	ActionReplace = "replace" // item in destination differs and is replaced
+	ActionSkip    = "skip"    // item is already in destination
+)
+
+// Event is reported for each share and item processed. Item is empty for
+// share metadata.
+type Event struct {
+	Share  string `json:"share"`
+	Item   string `json:"item,omitempty"`
+	Action string `json:"action"`
+	Size   int64  `json:"size,omitempty"`
+}
+
+// Report sums up a transfer
+type Report struct {
+	Shares  int   `json:"shares"`
+	Copied  int   `json:"copied"`
+	Skipped int   `json:"skipped"`
+	Bytes   int64 `json:"bytes"`
+	DryRun  bool  `json:"dry_run,omitempty"`
+}
+
+// Transfer copies shares from Source to Destination
+type Transfer struct {
+	Source      storage.Storage
+	Destination storage.Storage
+
+	// Shares are the names of shares to copy, all shares when empty
+	Shares []string
+
+	// DryRun only reports what would be done
+	DryRun bool
+
+	// Verify compares SHA-256 checksums of items instead of sizes, and reads
+	// back copied items to check their checksum
+	Verify bool
+
+	// OnEvent is called for each share and item processed if not nil
+	OnEvent func(Event)
+}
+
+// New returns a transfer of every share from src to dst
+func New(src, dst storage.Storage) *Transfer {
+	return &Transfer{
+		Source:      src,
+		Destination: dst,
+	}
+}
+
+func (t *Transfer) WithShares(shares ...string) *Transfer {
+	t.Shares = shares
+	return t
+}
+func (t *Transfer) WithDryRun(dryRun bool) *Transfer {
+	t.DryRun = dryRun
+	return t
+}
+func (t *Transfer) WithVerify(verify bool) *Transfer {
+	t.Verify = verify
+	return t
+}
+func (t *Transfer) WithOnEvent(f func(Event)) *Transfer {
+	t.OnEvent = f
+	return t
+}
+
+// Run copies shares and stops at the first error, which is wrapped with the
+// name of the share or item. Running it again resumes the transfer.
+func (t *Transfer) Run(ctx context.Context) (*Report, error) {
+	shares, err := t.Source.ListShares(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(t.Shares) > 0 {
+		for _, name := range t.Shares {
+			if !slices.ContainsFunc(shares, func(s storage.Share) bool { return s.Name == name }) {
+				return nil, fmt.Errorf("%w: %s", storage.ErrShareNotFound, name)
+			}
+		}
+		shares = slices.DeleteFunc(shares, func(s storage.Share) bool {
+			return !slices.Contains(t.Shares, s.Name)
+		})
+	}
+
+	report := &Report{DryRun: t.DryRun}
+
+	for _, share := range shares {
+		err = t.share(ctx, &share, report)
+		if err != nil {
+			return report, fmt.Errorf("%s: %w", share.Name, err)
+		}
+	}
+
+	return report, nil
+}
+
+// share copies share metadata and items
+func (t *Transfer) share(ctx context.Context, share *storage.Share, report *Report) error {
+	// Metadata is restored first as items can only be created in an existing
+	// share. Backends keep it when items are added.
+	exists := true
+	if !t.DryRun {
+		_, err := t.Destination.RestoreShare(ctx, share)
+		if err != nil {
+			return err
+		}
+	} else {
+		_, err := t.Destination.GetShare(ctx, share.Name)
+		if errors.Is(err, storage.ErrShareNotFound) {
+			exists = false
+		} else if err != nil {
+			return err
+		}
+	}
+	report.Shares++
+	t.event(Event{Share: share.Name, Action: ActionRestore})
+
+	items, err := t.Source.ListShare(ctx, share.Name)
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]storage.Item{}
+	if exists {
+		dst, err := t.Destination.ListShare(ctx, share.Name)
+		if err != nil {
+			return err
+		}
+		for _, i := range dst {
+			existing[path.Base(i.Path)] = i
+		}
+	}
+
+	for _, item := range items {
+		name := path.Base(item.Path)
+
+		err = t.item(ctx, share.Name, name, item.ItemInfo.Size, existing, report)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// item copies item of size bytes unless it is already in existing items of
+// the destination
+func (t *Transfer) item(ctx context.Context, share, item string, size int64, existing map[string]storage.Item, report *Report) error {
+	action := ActionCopy
+
+	if d, ok := existing[item]; ok {
+		same := d.ItemInfo.Size == size
+		if same && t.Verify {
+			a, err := checksum(ctx, t.Source, share, item)
+			if err != nil {
+				return err
+			}
+			b, err := checksum(ctx, t.Destination, share, item)
+			if err != nil {
+				return err
+			}
+			same = bytes.Equal(a, b)
+		}
+
+		if same {
+			report.Skipped++
+			t.event(Event{Share: share, Item: item, Action: ActionSkip, Size: size})
+			return nil
+		}
+
+		action = ActionReplace
+	}
+
+	if !t.DryRun {
+		err := t.copy(ctx, share, item, size, action == ActionReplace)
+		if err != nil {
+			return err
+		}
+	}
+
+	report.Copied++
+	report.Bytes += size
+	t.event(Event{Share: share, Item: item, Action: action, Size: size})
+
+	return nil
+}
+
+// copy streams item from source to destination and checks the result
+func (t *Transfer) copy(ctx context.Context, share, item string, size int64, replace bool) error {
+	// Remove the previous version first so it doesn't count in the share
+	// size limit of the destination
+	if replace {
+		err := t.Destination.DeleteItem(ctx, share, item)
+		if err != nil && !errors.Is(err, storage.ErrItemNotFound) {
+			return err
+		}
+	}
+
+	r, err := t.Source.GetItemData(ctx, share, item)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+
+	result, err := t.Destination.CreateItem(ctx, share, item, size, io.TeeReader(r, h), nil)
+	if err != nil {
+		return err
+	}
+
+	if result.ItemInfo.Size != size {
+		return fmt.Errorf("%w: %d bytes copied, expected %d", ErrSizeMismatch, result.ItemInfo.Size, size)
+	}
+
+	if !t.Verify {
+		return nil
+	}
+
+	c, err := checksum(ctx, t.Destination, share, item)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(c, h.Sum(nil)) {
+		return ErrChecksumMismatch
+	}
+
+	return nil
+}
+
+func (t *Transfer) event(e Event) {
+	if t.OnEvent != nil {
+		t.OnEvent(e)
+	}
+}
+
+// checksum returns the SHA-256 checksum of item in s
+func checksum(ctx context.Context, s storage.Storage, share, item string) ([]byte, error) {
+	r, err := s.GetItemData(ctx, share, item)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, r)
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
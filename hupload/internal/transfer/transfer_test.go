@@ -0,0 +1,206 @@
+package transfer_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"path"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/storage"
+	"github.com/ybizeul/hupload/internal/transfer"
+)
+
+func backend(t *testing.T) *storage.FileBackend {
+	return storage.NewFileStorage(storage.FileStorageConfig{Path: t.TempDir()})
+}
+
+func createItem(t *testing.T, s storage.Storage, share, item, content string) {
+	_, err := s.CreateItem(context.Background(), share, item, int64(len(content)), bytes.NewReader([]byte(content)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func itemContent(t *testing.T, s storage.Storage, share, item string) string {
+	r, err := s.GetItemData(context.Background(), share, item)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestTransfer(t *testing.T) {
+	ctx := context.Background()
+
+	src := backend(t)
+	dst := backend(t)
+
+	created := time.Now().Add(-48 * time.Hour).UTC().Truncate(time.Second)
+	_, err := src.RestoreShare(ctx, storage.NewShare().
+		WithName("share").
+		WithOwner("user").
+		WithDateCreated(created).
+		WithOptions(storage.Options{Validity: 3, Exposure: "both", Description: "d", Message: "m"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	createItem(t, src, "share", "a.txt", "hello")
+	createItem(t, src, "share", "b.txt", "world!")
+	_, err = src.UpdateShare(ctx, "share", nil, &map[string]int64{"a.txt": 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = src.CreateShare(ctx, "other", "admin", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("Dry run doesn't write", func(t *testing.T) {
+		report, err := transfer.New(src, dst).WithDryRun(true).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &transfer.Report{Shares: 2, Copied: 2, Bytes: 11, DryRun: true}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("Expected %+v, got %+v", want, report)
+		}
+
+		shares, err := dst.ListShares(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(shares) != 0 {
+			t.Errorf("Expected no shares, got %+v", shares)
+		}
+	})
+
+	t.Run("Shares and items are copied", func(t *testing.T) {
+		events := []transfer.Event{}
+		report, err := transfer.New(src, dst).
+			WithShares("share").
+			WithOnEvent(func(e transfer.Event) { events = append(events, e) }).
+			Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &transfer.Report{Shares: 1, Copied: 2, Bytes: 11}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("Expected %+v, got %+v", want, report)
+		}
+		if len(events) != 3 || events[0].Action != transfer.ActionRestore || events[1].Action != transfer.ActionCopy {
+			t.Errorf("Unexpected events %+v", events)
+		}
+
+		a, err := src.GetShare(ctx, "share")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := dst.GetShare(ctx, "share")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !a.DateCreated.Equal(b.DateCreated) {
+			t.Errorf("Expected creation date %v, got %v", a.DateCreated, b.DateCreated)
+		}
+		a.DateCreated, b.DateCreated = time.Time{}, time.Time{}
+		if !reflect.DeepEqual(a, b) {
+			t.Errorf("Expected %+v, got %+v", a, b)
+		}
+
+		if c := itemContent(t, dst, "share", "b.txt"); c != "world!" {
+			t.Errorf("Expected world!, got %s", c)
+		}
+
+		_, err = dst.GetShare(ctx, "other")
+		if !errors.Is(err, storage.ErrShareNotFound) {
+			t.Errorf("Expected ErrShareNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Transfer is resumed", func(t *testing.T) {
+		err := dst.DeleteItem(ctx, "share", "b.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		report, err := transfer.New(src, dst).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &transfer.Report{Shares: 2, Copied: 1, Skipped: 1, Bytes: 6}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("Expected %+v, got %+v", want, report)
+		}
+	})
+
+	t.Run("Different items are replaced when verifying", func(t *testing.T) {
+		err := dst.DeleteItem(ctx, "share", "a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		createItem(t, dst, "share", "a.txt", "HELLO")
+
+		report, err := transfer.New(src, dst).Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Copied != 0 {
+			t.Errorf("Expected items of same size to be skipped, got %+v", report)
+		}
+
+		events := []transfer.Event{}
+		report, err = transfer.New(src, dst).
+			WithVerify(true).
+			WithOnEvent(func(e transfer.Event) { events = append(events, e) }).
+			Run(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := &transfer.Report{Shares: 2, Copied: 1, Skipped: 1, Bytes: 5}
+		if !reflect.DeepEqual(report, want) {
+			t.Errorf("Expected %+v, got %+v", want, report)
+		}
+		if !slices.Contains(events, transfer.Event{Share: "share", Item: "a.txt", Action: transfer.ActionReplace, Size: 5}) {
+			t.Errorf("Expected a.txt to be replaced, got %+v", events)
+		}
+		if c := itemContent(t, dst, "share", "a.txt"); c != "hello" {
+			t.Errorf("Expected hello, got %s", c)
+		}
+	})
+
+	t.Run("Unknown share should fail", func(t *testing.T) {
+		_, err := transfer.New(src, dst).WithShares("missing").Run(ctx)
+		if !errors.Is(err, storage.ErrShareNotFound) {
+			t.Errorf("Expected ErrShareNotFound, got %v", err)
+		}
+	})
+}
+
+func TestTransferSizeLimit(t *testing.T) {
+	ctx := context.Background()
+
+	src := backend(t)
+	dst := storage.NewFileStorage(storage.FileStorageConfig{Path: path.Join(t.TempDir(), "dst"), MaxFileSize: 1})
+
+	_, err := src.CreateShare(ctx, "share", "admin", storage.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	createItem(t, src, "share", "big.bin", string(make([]byte, 2*1024*1024)))
+
+	_, err = transfer.New(src, dst).Run(ctx)
+	if !errors.Is(err, storage.ErrMaxFileSizeReached) {
+		t.Errorf("Expected ErrMaxFileSizeReached, got %v", err)
+	}
+}
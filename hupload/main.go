@@ -2,10 +2,7 @@ package main
 
 import (
 	"embed"
-	"log/slog"
 	"os"
-
-	"github.com/ybizeul/hupload/internal/config"
 )
 
 //go:embed admin-ui
@@ -16,23 +13,10 @@ var uiFS embed.FS
 //var cfg config.Config
 
 func main() {
-	initLogging()
-	slog.Info("Start Hupload")
-
-	// Create configuration struct
-	cfgPath := os.Getenv("CONFIG")
-	if cfgPath == "" {
-		cfgPath = "config.yml"
-	}
-	cfg := config.Config{
-		Path: cfgPath,
-	}
-
-	h, err := NewHupload(&cfg)
-	if err != nil {
-		panic(err)
+	args := os.Args[1:]
+	if len(args) == 0 {
+		args = []string{"serve"}
 	}
 
-	// Start the web server
-	h.Start()
+	os.Exit(runCommand(args, os.Stdout, os.Stderr))
 }
@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPI is the OpenAPI document describing the REST API. Every route
+// registered in setup must be described, which is checked by tests.
+//
+//go:embed openapi.json
+var openAPI []byte
+
+// getOpenAPI returns the OpenAPI document
+func (h *Hupload) getOpenAPI(w http.ResponseWriter, r *http.Request) {
+	setJSONHeaders(w)
+	_, _ = w.Write(openAPI)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/config"
+	"github.com/ybizeul/hupload/internal/search"
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// openAPIDocument is the subset of the OpenAPI document used by tests
+type openAPIDocument struct {
+	OpenAPI  string                                 `json:"openapi"`
+	Security []map[string][]string                  `json:"security"`
+	Paths    map[string]map[string]openAPIOperation `json:"paths"`
+
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]any `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	Security []map[string][]string `json:"security"`
+}
+
+// UnmarshalJSON ignores path items keys that are not operations
+func (o *openAPIOperation) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '[' {
+		return nil
+	}
+	type operation openAPIOperation
+	return json.Unmarshal(b, (*operation)(o))
+}
+
+func getOpenAPIDocument(t *testing.T, h *Hupload) *openAPIDocument {
+	req := httptest.NewRequest("GET", "/api/v1/openapi.json", nil)
+	w := httptest.NewRecorder()
+
+	h.API.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	result := &openAPIDocument{}
+	err := json.NewDecoder(w.Body).Decode(result)
+	if err != nil {
+		t.Fatalf("Failed to decode OpenAPI document: %v", err)
+	}
+
+	if result.OpenAPI != "3.1.0" {
+		t.Errorf("Expected OpenAPI version 3.1.0, got %s", result.OpenAPI)
+	}
+
+	return result
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	h := getHupload(t, cfgs["file"].Config)
+	doc := getOpenAPIDocument(t, h)
+
+	described := []string{}
+	for p, item := range doc.Paths {
+		for m := range item {
+			if m == "parameters" {
+				continue
+			}
+			described = append(described, strings.ToUpper(m)+" "+p)
+		}
+	}
+
+	registered := []string{}
+	for _, r := range h.routes {
+		registered = append(registered, r.Pattern)
+
+		method, p, _ := strings.Cut(r.Pattern, " ")
+		op, ok := doc.Paths[p][strings.ToLower(method)]
+		if !ok {
+			t.Errorf("Route %s is not described in openapi.json", r.Pattern)
+			continue
+		}
+
+		security := op.Security
+		if security == nil {
+			security = doc.Security
+		}
+		anonymous := len(security) == 0 || slices.ContainsFunc(security, func(s map[string][]string) bool {
+			return len(s) == 0
+		})
+		if anonymous != r.Public {
+			t.Errorf("Route %s is public: %v, described as anonymous: %v", r.Pattern, r.Public, anonymous)
+		}
+	}
+
+	for _, d := range described {
+		if !slices.Contains(registered, d) {
+			t.Errorf("Operation %s is described in openapi.json but not registered", d)
+		}
+	}
+}
+
+// TestOpenAPISchemas checks JSON properties of API types are the ones
+// described in openapi.json
+func TestOpenAPISchemas(t *testing.T) {
+	h := getHupload(t, cfgs["file"].Config)
+	doc := getOpenAPIDocument(t, h)
+
+	now := time.Now()
+	options := storage.Options{
+		Validity:         1,
+		ExpiresAt:        now.AddDate(0, 0, 1),
+		Exposure:         "both",
+		Description:      "d",
+		Message:          "m",
+		UploadOpensAt:    now,
+		UploadClosesAt:   now.Add(time.Hour),
+		DownloadOpensAt:  now,
+		DownloadClosesAt: now.Add(time.Hour),
+
+		MaxDownloads:        2,
+		MaxItemDownloads:    1,
+		DeleteAfterDownload: true,
+
+		Fields: []storage.ItemField{{Name: "case", Label: "Case", Type: storage.FieldSelect, Choices: []string{"1"}, Required: true}},
+
+		Conflict: storage.ConflictVersion,
+	}
+	share := storage.Share{
+		Version:        1,
+		Name:           "share",
+		DateCreated:    now,
+		Owner:          "admin",
+		Options:        options,
+		Size:           1,
+		Count:          1,
+		Downloads:      map[string]int64{"item": 1},
+		GuestDownloads: map[string]int64{"item": 1},
+		Items:          map[string]storage.ItemMetadata{"item": {Owner: "admin", Guest: "g", UploaderName: "n", UploaderEmail: "e@example.com", Note: "n", Fields: map[string]string{"case": "1"}}},
+	}
+	item := storage.Item{Path: "share/item", Downloads: 1, Metadata: &storage.ItemMetadata{Owner: "admin", Guest: "g", UploaderName: "n", UploaderEmail: "e@example.com", Note: "n", Fields: map[string]string{"case": "1"}}, ItemInfo: storage.ItemInfo{Size: 1, DateModified: now}}
+	problem := storage.Problem{Kind: storage.ProblemOrphan, Share: "share", Path: "share/item", Message: "m", Repaired: false, Error: "e"}
+
+	tests := map[string]any{
+		"APIResult":       APIResult{Status: "success", Message: "m"},
+		"Options":         options,
+		"Share":           share,
+		"PublicOptions":   share.PublicShare().Options,
+		"PublicShare":     share.PublicShare(),
+		"Item":            item,
+		"ItemInfo":        item.ItemInfo,
+		"ItemVersion":     storage.ItemVersion{Version: 1, ItemInfo: item.ItemInfo},
+		"ItemMetadata":    *item.Metadata,
+		"ItemField":       options.Fields[0],
+		"MessageTemplate": config.MessageTemplate{Title: "t", Message: "m"},
+		"FormTemplate":    config.FormTemplate{Title: "t", Fields: options.Fields},
+		"SearchResult":    search.Result{Share: "share", Item: "item", Owner: "admin", Score: 1},
+		"Problem":         problem,
+		"CheckReport":     storage.CheckReport{Repair: true, Shares: 1, Items: 1, Problems: []storage.Problem{problem}},
+	}
+
+	for name, v := range tests {
+		t.Run(name, func(t *testing.T) {
+			schema, ok := doc.Components.Schemas[name]
+			if !ok {
+				t.Fatalf("Schema %s is not described in openapi.json", name)
+			}
+
+			b, err := json.Marshal(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := map[string]any{}
+			err = json.Unmarshal(b, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for k := range got {
+				if _, ok := schema.Properties[k]; !ok {
+					t.Errorf("Property %s of %s is not described", k, name)
+				}
+			}
+			for k := range schema.Properties {
+				if _, ok := got[k]; !ok {
+					t.Errorf("Property %s of %s is described but not in JSON", k, name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// shareQuery returns the storage query for share listing parameters in v
+func shareQuery(v url.Values) (*storage.ShareQuery, error) {
+	var err error
+
+	q := &storage.ShareQuery{
+		Owner:    v.Get("owner"),
+		Status:   v.Get("status"),
+		Exposure: v.Get("exposure"),
+		Prefix:   v.Get("prefix"),
+		Sort:     v.Get("sort"),
+		Cursor:   v.Get("cursor"),
+	}
+
+	q.Limit, err = queryInt(v, "limit")
+	if err != nil {
+		return nil, err
+	}
+	q.CreatedAfter, err = queryTime(v, "created_after")
+	if err != nil {
+		return nil, err
+	}
+	q.CreatedBefore, err = queryTime(v, "created_before")
+	if err != nil {
+		return nil, err
+	}
+
+	return q, q.Validate()
+}
+
+// itemQuery returns the storage query for item listing parameters in v
+func itemQuery(v url.Values) (*storage.ItemQuery, error) {
+	var err error
+
+	q := &storage.ItemQuery{
+		Prefix: v.Get("prefix"),
+		Sort:   v.Get("sort"),
+		Cursor: v.Get("cursor"),
+	}
+
+	q.Limit, err = queryInt(v, "limit")
+	if err != nil {
+		return nil, err
+	}
+	q.ModifiedAfter, err = queryTime(v, "modified_after")
+	if err != nil {
+		return nil, err
+	}
+	q.ModifiedBefore, err = queryTime(v, "modified_before")
+	if err != nil {
+		return nil, err
+	}
+
+	return q, q.Validate()
+}
+
+// queryInt returns parameter k of v as an integer, 0 if not set
+func queryInt(v url.Values, k string) (int, error) {
+	if v.Get(k) == "" {
+		return 0, nil
+	}
+	i, err := strconv.Atoi(v.Get(k))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s is not a number", storage.ErrInvalidQuery, k)
+	}
+	return i, nil
+}
+
+// queryTime returns parameter k of v as a time, formatted as RFC 3339 or as
+// a date. It returns the zero time if not set.
+func queryTime(v url.Values, k string) (time.Time, error) {
+	s := v.Get(k)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%w: %s is not a date", storage.ErrInvalidQuery, k)
+}
+
+// setPageHeaders sets listing headers with the total number of results and
+// the cursor of the next page
+func setPageHeaders(w http.ResponseWriter, total int, next string) {
+	if total >= 0 {
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	}
+	if next != "" {
+		w.Header().Set("X-Next-Cursor", next)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// receiptCookie is the name of the cookie holding the receipt of a share
+const receiptCookie = "hupload-receipt"
+
+// maxReceiptSize is the maximum size of a receipt cookie, older items are
+// dropped from receipts that would be larger
+const maxReceiptSize = 3072
+
+// uploadTokenHeader is the response header of guest uploads holding the
+// upload token of the item, and the request header to send it with
+const uploadTokenHeader = "X-Upload-Token"
+
+// renamedFromValue is the path value set by publicShare to the name a request
+// was sent to when it is the previous name of the share
+const renamedFromValue = "renamed_from"
+
+// receipts keep the identity of guests and the names of items they uploaded
+// in signed session cookies, so guests can see and delete what they uploaded
+// without listing the share
+type receipts struct {
+	key []byte
+}
+
+// receipt is the content of a receipt cookie
+type receipt struct {
+	// Guest identifies the guest in the metadata of items they uploaded
+	Guest string `json:"guest"`
+
+	// Items are the names of items uploaded by the guest
+	Items []string `json:"items"`
+}
+
+// newReceipts returns receipts signed with JWT_SECRET so they are accepted
+// by every instance, or with a random key if it is not set
+func newReceipts() *receipts {
+	key := []byte(os.Getenv("JWT_SECRET"))
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		_, _ = rand.Read(key)
+	}
+	return &receipts{key: key}
+}
+
+// sign returns the signature of payload for share
+func (rc *receipts) sign(share, payload string) string {
+	mac := hmac.New(sha256.New, rc.key)
+	mac.Write([]byte(share + "/" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// valid returns true if signature is the signature of payload for share, or
+// for the previous name of share r was sent to. Receipts and tokens issued
+// before a rename keep working with the previous name of the share.
+func (rc *receipts) valid(r *http.Request, share, payload, signature string) bool {
+	names := []string{share}
+	if from := r.PathValue(renamedFromValue); from != "" {
+		names = append(names, from)
+	}
+	return slices.ContainsFunc(names, func(name string) bool {
+		return hmac.Equal([]byte(signature), []byte(rc.sign(name, payload)))
+	})
+}
+
+// receipt returns the receipt of share sent with r, an empty receipt if there
+// is none or it is not valid
+func (rc *receipts) receipt(r *http.Request, share string) receipt {
+	result := receipt{Items: []string{}}
+
+	c, err := r.Cookie(receiptCookie)
+	if err != nil {
+		return result
+	}
+
+	payload, signature, ok := strings.Cut(c.Value, ".")
+	if !ok || !rc.valid(r, share, payload, signature) {
+		return result
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return result
+	}
+
+	var decoded receipt
+	err = json.Unmarshal(b, &decoded)
+	if err != nil {
+		return result
+	}
+	if decoded.Items == nil {
+		decoded.Items = []string{}
+	}
+
+	return decoded
+}
+
+// items returns the names of items in the receipt of share sent with r
+func (rc *receipts) items(r *http.Request, share string) []string {
+	return rc.receipt(r, share).Items
+}
+
+// guest returns the guest identity in the receipt of share sent with r, or a
+// new identity if there is none
+func (rc *receipts) guest(r *http.Request, share string) string {
+	guest := rc.receipt(r, share).Guest
+	if guest == "" {
+		b := make([]byte, 16)
+		_, _ = rand.Read(b)
+		guest = base64.RawURLEncoding.EncodeToString(b)
+	}
+	return guest
+}
+
+// add adds item uploaded by guest to the receipt of share sent with r and
+// sets the new receipt on w. It must be called before the response is
+// written.
+func (rc *receipts) add(w http.ResponseWriter, r *http.Request, share, guest, item string) {
+	c := rc.receipt(r, share)
+	if c.Guest != guest {
+		c = receipt{Guest: guest, Items: []string{}}
+	}
+	if !slices.Contains(c.Items, item) {
+		c.Items = append(c.Items, item)
+	}
+
+	rc.set(w, r, share, c)
+}
+
+// rekey sets the receipt sent with r to the previous name of share on w,
+// signed for share, so it is also sent with requests to its current name
+func (rc *receipts) rekey(w http.ResponseWriter, r *http.Request, share string) {
+	if r.PathValue(renamedFromValue) == "" {
+		return
+	}
+
+	c := rc.receipt(r, share)
+	if c.Guest == "" {
+		return
+	}
+
+	rc.set(w, r, share, c)
+}
+
+// set sets receipt c of share on w, older items are dropped if it is too large
+func (rc *receipts) set(w http.ResponseWriter, r *http.Request, share string, c receipt) {
+	var value string
+	for {
+		b, _ := json.Marshal(c)
+		payload := base64.RawURLEncoding.EncodeToString(b)
+		value = payload + "." + rc.sign(share, payload)
+		if len(value) <= maxReceiptSize || len(c.Items) == 1 {
+			break
+		}
+		c.Items = c.Items[1:]
+	}
+
+	// Without expiration, the cookie only lasts for the browser session
+	http.SetCookie(w, &http.Cookie{
+		Name:     receiptCookie,
+		Value:    value,
+		Path:     path.Join("/api/v1/shares", share),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+
+// token returns the upload token of item of share uploaded by guest. Tokens
+// are signed with an "upload/" prefix, which base64 receipt payloads can't
+// start with.
+func (rc *receipts) token(share, item, guest string) string {
+	return guest + "." + rc.sign(share, "upload/"+item+"/"+guest)
+}
+
+// uploader returns the guest identity proven by the upload token of item sent
+// with r, or by the receipt of share if there is no token. It returns an empty
+// string if neither is valid.
+func (rc *receipts) uploader(r *http.Request, share, item string) string {
+	if t := r.Header.Get(uploadTokenHeader); t != "" {
+		guest, signature, ok := strings.Cut(t, ".")
+		if !ok || !rc.valid(r, share, "upload/"+item+"/"+guest, signature) {
+			return ""
+		}
+		return guest
+	}
+	return rc.receipt(r, share).Guest
+}
@@ -1,22 +1,60 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"log/slog"
 
 	"github.com/ybizeul/apiws"
+	"github.com/ybizeul/hupload/internal/cluster"
 	"github.com/ybizeul/hupload/internal/config"
+	"github.com/ybizeul/hupload/internal/search"
+	"github.com/ybizeul/hupload/internal/storage"
 	"github.com/ybizeul/hupload/middleware"
 )
 
 type Hupload struct {
 	Config *config.Config
 	API    *apiws.APIWS
+
+	// Search is the full-text index of shares and items
+	Search *search.Index
+
+	// Cluster coordinates this instance with other instances using the same
+	// storage, it is nil unless enabled in configuration
+	Cluster *cluster.Cluster
+
+	// receipts are the items uploaded by guests to drop-box shares
+	receipts *receipts
+
+	// backend is the storage backend before it is wrapped to update the
+	// search index
+	backend storage.Storage
+
+	// stop stops background work started by StartBackground
+	stop func()
+
+	// routes are the routes registered in setup
+	routes []route
+}
+
+// route is a route registered in setup, Pattern is normalized with a single
+// space between method and path, i.e. "GET /health"
+type route struct {
+	Pattern string
+	Public  bool
 }
 
 func NewHupload(c *config.Config) (*Hupload, error) {
@@ -36,6 +74,24 @@ func NewHupload(c *config.Config) (*Hupload, error) {
 		return nil, err
 	}
 
+	// The metadata index isn't maintained while it is disabled, it is rebuilt
+	// before it is read so changes made meanwhile are included
+	if r, ok := c.Storage.(storage.IndexRebuilder); ok {
+		err = r.RebuildIndex(context.Background())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Build search index and keep it up to date with storage changes
+	index := search.NewIndex()
+	err = index.Rebuild(context.Background(), c.Storage)
+	if err != nil {
+		return nil, err
+	}
+	backend := c.Storage
+	c.Storage = search.NewStorage(c.Storage, index)
+
 	// Create API web service with the embedded UI
 	api, err := apiws.New(uiFS, c.Values)
 	if err != nil {
@@ -44,8 +100,19 @@ func NewHupload(c *config.Config) (*Hupload, error) {
 
 	api.WithAuthentication(c.Authentication)
 	result := &Hupload{
-		Config: c,
-		API:    api,
+		Config:  c,
+		API:     api,
+		Search:  index,
+		Cluster: c.Cluster,
+
+		receipts: newReceipts(),
+		backend:  backend,
+	}
+
+	// Sessions are signed with a random key unless JWT_SECRET is set, they
+	// would only be valid on the instance that opened them
+	if result.Cluster != nil && os.Getenv("JWT_SECRET") == "" {
+		slog.Warn("JWT_SECRET is not set, sessions won't be shared by instances")
 	}
 
 	result.setup()
@@ -54,46 +121,225 @@ func NewHupload(c *config.Config) (*Hupload, error) {
 }
 
 func (h *Hupload) Start() {
+	h.StartBackground(context.Background())
+
+	// Hand leadership over to another instance when stopped
+	go func() {
+		ch := make(chan os.Signal, 1)
+		signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+		<-ch
+		slog.Info("Stop Hupload")
+		h.Stop()
+		os.Exit(0)
+	}()
+
 	h.API.Start()
 }
 
+// renameRetention is how long records of renamed shares are kept after
+// requests to the previous name stopped working
+const renameRetention = 30 * 24 * time.Hour
+
+// backgroundTask is maintenance run every interval, on the leader when the
+// cluster is enabled
+type backgroundTask struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+// tasks returns the maintenance tasks enabled in configuration
+func (h *Hupload) tasks() []backgroundTask {
+	result := []backgroundTask{
+		{"purge-renamed-shares", time.Hour, h.purgeRenamedShares},
+	}
+	if h.Config.Values.PurgeExpired {
+		result = append(result, backgroundTask{"purge-expired", time.Hour, h.purgeExpiredShares})
+	}
+	if r, ok := h.backend.(storage.IndexRebuilder); ok {
+		result = append(result, backgroundTask{"rebuild-index", time.Hour, r.RebuildIndex})
+	}
+	return result
+}
+
+// StartBackground starts maintenance tasks, and when the cluster is enabled,
+// coordinating with other instances and refreshing the search index with
+// their changes. Maintenance tasks only run on the leader of the cluster. It
+// runs until ctx is done or Stop is called.
+func (h *Hupload) StartBackground(ctx context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	var wg sync.WaitGroup
+
+	if h.Cluster == nil {
+		for _, t := range h.tasks() {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runTask(ctx, t)
+			}()
+		}
+
+		h.stop = func() {
+			cancel()
+			wg.Wait()
+		}
+		return
+	}
+
+	for _, t := range h.tasks() {
+		h.Cluster.AddTask(t.name, t.interval, t.run)
+	}
+	h.Cluster.Start(ctx)
+
+	interval := cluster.DefaultRefreshInterval
+	if s := h.Config.Values.Cluster.RefreshSeconds; s > 0 {
+		interval = time.Duration(s) * time.Second
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.refreshSearch(ctx, interval)
+	}()
+
+	h.stop = func() {
+		cancel()
+		wg.Wait()
+		h.Cluster.Stop()
+	}
+}
+
+// runTask runs t now and then every interval until ctx is done
+func runTask(ctx context.Context, t backgroundTask) {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		err := t.run(ctx)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("task failed", slog.String("task", t.name), slog.String("error", err.Error()))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// purgeExpiredShares deletes every expired share
+func (h *Hupload) purgeExpiredShares(ctx context.Context) error {
+	shares, err := h.Config.Storage.ListShares(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range shares {
+		if s.IsValid() {
+			continue
+		}
+		err = h.Config.Storage.DeleteShare(ctx, s.Name)
+		if err != nil && !errors.Is(err, storage.ErrShareNotFound) {
+			return fmt.Errorf("%s: %w", s.Name, err)
+		}
+		slog.Info("expired share deleted", slog.String("share", s.Name))
+	}
+
+	return nil
+}
+
+// purgeRenamedShares removes records of renamed shares kept longer than
+// renameRetention
+func (h *Hupload) purgeRenamedShares(ctx context.Context) error {
+	purged, err := h.Config.Storage.PurgeRenamedShares(ctx, time.Now().Add(-renameRetention))
+	for _, name := range purged {
+		slog.Info("renamed share record deleted", slog.String("share", name))
+	}
+	return err
+}
+
+// Stop stops background work and hands leadership over to another instance
+func (h *Hupload) Stop() {
+	if h.stop != nil {
+		h.stop()
+	}
+}
+
+// refreshSearch rebuilds the search index every interval, so it includes
+// shares and items changed by other instances
+func (h *Hupload) refreshSearch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		err := h.Search.Rebuild(ctx, h.Config.Storage)
+		if err != nil && ctx.Err() == nil {
+			slog.Error("cannot refresh search index", slog.String("error", err.Error()))
+		}
+	}
+}
+
 func (h *Hupload) setup() {
 
 	api := h.API
 
-	// Setup routes
+	// Setup routes, they must be described in openapi.json
 
 	// Guests can access a share and post new files in it
 	// That's Hupload principle, the security is based on the share name
 	// which is usually a random string.
 
-	api.AddPublicRoute("GET    /health", http.HandlerFunc(h.getHealth))
+	h.addPublicRoute("GET    /health", http.HandlerFunc(h.getHealth))
+	h.addPublicRoute("GET    /api/v1/openapi.json", http.HandlerFunc(h.getOpenAPI))
 
-	api.AddPublicRoute("GET    /api/v1/shares/{share}", shareCheck(http.HandlerFunc(h.getShare)))
-	api.AddPublicRoute("GET    /api/v1/shares/{share}/items", shareCheck(http.HandlerFunc(h.getShareItems)))
-	api.AddPublicRoute("GET    /api/v1/shares/{share}/items/{item}", shareAndItemCheck(http.HandlerFunc(h.getItem)))
+	h.addPublicRoute("GET    /api/v1/shares/{share}", shareCheck(http.HandlerFunc(h.getShare)))
+	h.addPublicRoute("GET    /api/v1/shares/{share}/items", shareCheck(http.HandlerFunc(h.getShareItems)))
+	h.addPublicRoute("GET    /api/v1/shares/{share}/items/{item}", shareAndItemCheck(http.HandlerFunc(h.getItem)))
 
-	api.AddPublicRoute("POST   /api/v1/shares/{share}/items/{item}", shareAndItemCheck(http.HandlerFunc(h.postItem)))
-	api.AddPublicRoute("DELETE /api/v1/shares/{share}/items/{item}", shareAndItemCheck(http.HandlerFunc(h.deleteItem)))
+	h.addPublicRoute("POST   /api/v1/shares/{share}/items/{item}", shareAndItemCheck(http.HandlerFunc(h.postItem)))
+	h.addPublicRoute("DELETE /api/v1/shares/{share}/items/{item}", shareAndItemCheck(http.HandlerFunc(h.deleteItem)))
 
-	api.AddPublicRoute("GET    /d/{share}", shareCheck(http.HandlerFunc(h.downloadShare)))
-	api.AddPublicRoute("GET    /d/{share}/{item}", shareAndItemCheck(http.HandlerFunc(h.getItem)))
+	h.addPublicRoute("GET    /d/{share}", shareCheck(http.HandlerFunc(h.downloadShare)))
+	h.addPublicRoute("GET    /d/{share}/{item}", shareAndItemCheck(http.HandlerFunc(h.getItem)))
 
 	// Protected routes
 
-	api.AddRoute("GET    /api/v1/defaults", http.HandlerFunc(h.getDefaults))
+	h.addRoute("GET    /api/v1/defaults", http.HandlerFunc(h.getDefaults))
 
-	api.AddRoute("GET    /api/v1/shares", http.HandlerFunc(h.getShares))
-	api.AddRoute("POST   /api/v1/shares", http.HandlerFunc(h.postShare))
-	api.AddRoute("POST   /api/v1/shares/{share}", shareCheck(http.HandlerFunc(h.postShare)))
-	api.AddRoute("PATCH  /api/v1/shares/{share}", shareCheck(http.HandlerFunc(h.patchShare)))
-	api.AddRoute("DELETE /api/v1/shares/{share}", shareCheck(http.HandlerFunc(h.deleteShare)))
+	h.addRoute("GET    /api/v1/shares", http.HandlerFunc(h.getShares))
+	h.addRoute("POST   /api/v1/shares", http.HandlerFunc(h.postShare))
+	h.addRoute("POST   /api/v1/shares/{share}", shareCheck(http.HandlerFunc(h.postShare)))
+	h.addRoute("PATCH  /api/v1/shares/{share}", shareCheck(http.HandlerFunc(h.patchShare)))
+	h.addRoute("POST   /api/v1/shares/{share}/rename", shareCheck(http.HandlerFunc(h.renameShare)))
+	h.addRoute("PATCH  /api/v1/shares/{share}/items/{item}", shareAndItemCheck(http.HandlerFunc(h.patchItem)))
+	h.addRoute("GET    /api/v1/shares/{share}/items/{item}/versions", shareAndItemCheck(http.HandlerFunc(h.getItemVersions)))
+	h.addRoute("GET    /api/v1/shares/{share}/items/{item}/versions/{version}", shareAndItemCheck(http.HandlerFunc(h.getItemVersion)))
+	h.addRoute("DELETE /api/v1/shares/{share}/items/{item}/versions/{version}", shareAndItemCheck(http.HandlerFunc(h.deleteItemVersion)))
+	h.addRoute("POST   /api/v1/shares/{share}/items/{item}/copy", shareAndItemCheck(http.HandlerFunc(h.copyItem)))
+	h.addRoute("POST   /api/v1/shares/{share}/items/{item}/move", shareAndItemCheck(http.HandlerFunc(h.moveItem)))
+	h.addRoute("DELETE /api/v1/shares/{share}", shareCheck(http.HandlerFunc(h.deleteShare)))
 
-	api.AddRoute("GET    /api/v1/messages/{index}", http.HandlerFunc(h.getMessage))
-	api.AddRoute("GET    /api/v1/messages", http.HandlerFunc(h.getMessages))
+	h.addRoute("GET    /api/v1/search", http.HandlerFunc(h.getSearch))
 
-	api.AddRoute("GET    /api/v1/version", http.HandlerFunc(h.getVersion))
+	h.addRoute("GET    /api/v1/messages/{index}", http.HandlerFunc(h.getMessage))
+	h.addRoute("GET    /api/v1/messages", http.HandlerFunc(h.getMessages))
+	h.addRoute("GET    /api/v1/forms/{index}", http.HandlerFunc(h.getForm))
+	h.addRoute("GET    /api/v1/forms", http.HandlerFunc(h.getForms))
 
+	h.addRoute("GET    /api/v1/version", http.HandlerFunc(h.getVersion))
+
+	h.addRoute("GET    /api/v1/admin/check", http.HandlerFunc(h.getCheck))
+	h.addRoute("POST   /api/v1/admin/check", http.HandlerFunc(h.postCheck))
+
+	// Fallback for unknown API calls, not part of the API
 	api.AddRoute("GET    /api/v1/*", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "Error")
 	}))
@@ -108,6 +354,18 @@ func (h *Hupload) setup() {
 	}
 }
 
+// addRoute registers a protected route and records its pattern
+func (h *Hupload) addRoute(pattern string, handler http.Handler) {
+	h.routes = append(h.routes, route{Pattern: strings.Join(strings.Fields(pattern), " ")})
+	h.API.AddRoute(pattern, handler)
+}
+
+// addPublicRoute registers a route open to guests and records its pattern
+func (h *Hupload) addPublicRoute(pattern string, handler http.Handler) {
+	h.routes = append(h.routes, route{Pattern: strings.Join(strings.Fields(pattern), " "), Public: true})
+	h.API.AddPublicRoute(pattern, handler)
+}
+
 func shareCheck(h http.Handler) http.Handler {
 	return middleware.ShareNameCheckMiddleware(h)
 }
@@ -116,6 +374,38 @@ func shareAndItemCheck(h http.Handler) http.Handler {
 	return middleware.ShareNameCheckMiddleware(middleware.ItemNameCheckMiddleware(h))
 }
 
+// publicShare returns the share of a request to a public route. Requests to
+// the previous name of a renamed share are served with the share until the
+// end of the grace period of the rename, the share path value is set to its
+// current name and the receipt of the guest is moved to it. They get
+// ErrShareRenamed after it. Renames are only looked up for shares that don't
+// exist.
+func (h *Hupload) publicShare(w http.ResponseWriter, r *http.Request) (*storage.Share, error) {
+	share, err := h.Config.Storage.GetShare(r.Context(), r.PathValue("share"))
+	if !errors.Is(err, storage.ErrShareNotFound) {
+		return share, err
+	}
+
+	from := r.PathValue("share")
+	name, err := storage.ResolveShare(r.Context(), h.Config.Storage, from)
+	if err != nil {
+		return nil, err
+	}
+
+	share, err = h.Config.Storage.GetShare(r.Context(), name)
+	if err != nil {
+		return nil, err
+	}
+
+	r.SetPathValue("share", name)
+	if name != from {
+		r.SetPathValue(renamedFromValue, from)
+		h.receipts.rekey(w, r, name)
+	}
+
+	return share, nil
+}
+
 func generateRandomString(length int) string {
 	b := make([]byte, length)
 	_, err := rand.Read(b)
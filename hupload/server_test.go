@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ybizeul/hupload/internal/config"
+	"github.com/ybizeul/hupload/internal/storage"
+)
+
+// clusterConfig is the configuration of instances sharing a storage directory
+const clusterConfig = `storage:
+  type: file
+  options:
+    path: %s
+auth:
+  type: file
+  options:
+    path: handlers_testdata/users.yml
+cluster:
+  enabled: true
+  id: %s
+  lease_seconds: 1
+  refresh_seconds: 1
+`
+
+// tasksConfig is the configuration of a single instance purging expired
+// shares
+const tasksConfig = `storage:
+  type: file
+  options:
+    path: %s
+auth:
+  type: file
+  options:
+    path: handlers_testdata/users.yml
+purge_expired: true
+`
+
+// waitFor waits until cond is true or fails after d
+func waitFor(t *testing.T, d time.Duration, msg string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(d)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal(msg)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestCluster(t *testing.T) {
+	dir := t.TempDir()
+
+	// Two instances using the same storage directory
+	instances := []*Hupload{}
+	for _, id := range []string{"a", "b"} {
+		p := path.Join(dir, id+".yml")
+		err := os.WriteFile(p, []byte(fmt.Sprintf(clusterConfig, path.Join(dir, "data"), id)), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := getHupload(t, &config.Config{Path: p})
+		if h.Cluster == nil {
+			t.Fatal("Expected cluster to be enabled")
+		}
+		h.StartBackground(context.Background())
+		t.Cleanup(h.Stop)
+
+		instances = append(instances, h)
+	}
+	a, b := instances[0], instances[1]
+
+	leaders := func() []*Hupload {
+		r := []*Hupload{}
+		for _, h := range instances {
+			if h.Cluster.IsLeader() {
+				r = append(r, h)
+			}
+		}
+		return r
+	}
+
+	t.Run("A single instance is the leader", func(t *testing.T) {
+		waitFor(t, 3*time.Second, "Expected a leader", func() bool { return len(leaders()) == 1 })
+
+		time.Sleep(time.Second)
+		if len(leaders()) != 1 {
+			t.Errorf("Expected a single leader, got %d", len(leaders()))
+		}
+	})
+
+	t.Run("Uploads to both instances are all accounted", func(t *testing.T) {
+		makeShare(t, a, "clustered", "admin", storage.Options{Exposure: "upload"})
+
+		const uploads, size = 10, 1024
+
+		var wg sync.WaitGroup
+		for i := range uploads {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				pr, ct := multipartWriter(size)
+				req := httptest.NewRequest("POST", path.Join("/api/v1/shares/clustered/items", fmt.Sprintf("file%d.txt", i)), pr)
+				req.Header.Set("Content-Type", ct)
+				req.Header.Set("FileSize", fmt.Sprintf("%d", size))
+
+				w := httptest.NewRecorder()
+				instances[i%2].API.ServeHTTP(w, req)
+
+				if w.Code != http.StatusOK {
+					t.Errorf("Expected status %d, got %d: %s", http.StatusOK, w.Code, w.Body.String())
+				}
+			}()
+		}
+		wg.Wait()
+
+		for _, h := range instances {
+			share, err := h.Config.Storage.GetShare(context.Background(), "clustered")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if share.Count != uploads || share.Size != uploads*size {
+				t.Errorf("Expected %d items of %d bytes, got %d items and %d bytes", uploads, uploads*size, share.Count, share.Size)
+			}
+		}
+	})
+
+	t.Run("Downloads from both instances don't exceed limits", func(t *testing.T) {
+		const limit, downloads = 3, 10
+		makeShare(t, a, "limited", "admin", storage.Options{Exposure: "download", MaxDownloads: limit})
+		makeItem(t, a, "limited", "item.txt", 1024)
+
+		codes := make(chan int, downloads)
+		var wg sync.WaitGroup
+		for i := range downloads {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				req := httptest.NewRequest("GET", "/api/v1/shares/limited/items/item.txt", nil)
+				w := httptest.NewRecorder()
+				instances[i%2].API.ServeHTTP(w, req)
+				codes <- w.Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		succeeded := 0
+		for code := range codes {
+			switch code {
+			case http.StatusOK:
+				succeeded++
+			case http.StatusGone:
+			default:
+				t.Errorf("Unexpected status %d", code)
+			}
+		}
+		if succeeded != limit {
+			t.Errorf("Expected %d downloads to succeed, got %d", limit, succeeded)
+		}
+
+		share, err := b.Config.Storage.GetShare(context.Background(), "limited")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if share.Downloads["item.txt"] != limit || share.GuestDownloads["item.txt"] != limit {
+			t.Errorf("Expected %d downloads, got %v and %v by guests", limit, share.Downloads, share.GuestDownloads)
+		}
+	})
+
+	t.Run("Search index includes changes of other instances", func(t *testing.T) {
+		makeShare(t, a, "indexed", "admin", storage.Options{Description: "quarterly"})
+
+		all := func(string) bool { return true }
+		waitFor(t, 3*time.Second, "Expected share to be found on b", func() bool {
+			return len(b.Search.Search("quarterly", all)) == 1
+		})
+	})
+
+	t.Run("Leadership is handed over when the leader stops", func(t *testing.T) {
+		leader := leaders()[0]
+		leader.Stop()
+
+		other := a
+		if leader == a {
+			other = b
+		}
+
+		waitFor(t, time.Second, "Expected the other instance to be the leader", other.Cluster.IsLeader)
+	})
+}
+
+func TestBackgroundTasks(t *testing.T) {
+	dir := t.TempDir()
+	p := path.Join(dir, "config.yml")
+	err := os.WriteFile(p, []byte(fmt.Sprintf(tasksConfig, path.Join(dir, "data"))), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := getHupload(t, &config.Config{Path: p})
+	ctx := context.Background()
+
+	makeShare(t, h, "valid", "admin", storage.Options{})
+	expired := makeShare(t, h, "expired", "admin", storage.Options{Validity: 1})
+	expired.DateCreated = time.Now().AddDate(0, 0, -2)
+	expired.Options.ExpiresAt = expired.DateCreated.AddDate(0, 0, 1)
+	err = storage.SaveShareAtPath(expired, path.Join(dir, "data", "expired"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A recent rename record is kept, an old one is removed
+	makeShare(t, h, "renamed", "admin", storage.Options{})
+	_, err = h.Config.Storage.RenameShare(ctx, "renamed", "recent", time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := `{"from":"old","name":"valid","renamed":"2020-01-01T00:00:00Z"}`
+	err = os.WriteFile(path.Join(dir, "data", ".hupload", "renames", "old.json"), []byte(old), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.StartBackground(ctx)
+	t.Cleanup(h.Stop)
+
+	waitFor(t, 3*time.Second, "Expected expired share to be purged", func() bool {
+		_, err := h.Config.Storage.GetShare(ctx, "expired")
+		return errors.Is(err, storage.ErrShareNotFound)
+	})
+	waitFor(t, 3*time.Second, "Expected old rename record to be purged", func() bool {
+		_, err := h.Config.Storage.GetRenamedShare(ctx, "old")
+		return errors.Is(err, storage.ErrShareNotFound)
+	})
+
+	_, err = h.Config.Storage.GetShare(ctx, "valid")
+	if err != nil {
+		t.Errorf("Expected valid share to be kept, got %v", err)
+	}
+	_, err = h.Config.Storage.GetRenamedShare(ctx, "renamed")
+	if err != nil {
+		t.Errorf("Expected recent rename record to be kept, got %v", err)
+	}
+	if len(h.Search.Search("expired", func(string) bool { return true })) != 0 {
+		t.Errorf("Expected purged share to be removed from the search index")
+	}
+}